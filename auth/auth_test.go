@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pavelerokhin/user-microservice-go/model"
+	"github.com/pavelerokhin/user-microservice-go/repository"
+)
+
+var (
+	dbName     = "auth-testing"
+	testLogger = log.New(os.Stdout, "testing-auth", log.LstdFlags|log.Llongfile)
+	testUser   = model.User{
+		FirstName: "user1",
+		LastName:  "y",
+		Nickname:  "z",
+		Password:  "1",
+		Email:     "a@b.com",
+		Country:   "Y",
+	}
+)
+
+func setupTestCase(t *testing.T) (*Tokens, *model.User) {
+	repo, err := repository.NewSqliteRepo(dbName, testLogger)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, os.Remove(fmt.Sprintf("%s.db", dbName)))
+	})
+
+	user := testUser
+	_, err = repo.Add(context.Background(), &user)
+	require.NoError(t, err)
+
+	keys := NewKeySet()
+	_, err = keys.Rotate()
+	require.NoError(t, err)
+
+	return New(keys, repo, Config{}, testLogger), &user
+}
+
+func TestSignVerifyOK(t *testing.T) {
+	keys := NewKeySet()
+	_, err := keys.Rotate()
+	require.NoError(t, err)
+
+	now := time.Now()
+	token, err := keys.sign(&Claims{Subject: "1", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix()})
+	require.NoError(t, err)
+
+	claims, err := keys.verify(token, now)
+	require.NoError(t, err)
+	require.Equal(t, "1", claims.Subject)
+}
+
+func TestVerifyExpiredKO(t *testing.T) {
+	keys := NewKeySet()
+	_, err := keys.Rotate()
+	require.NoError(t, err)
+
+	now := time.Now()
+	token, err := keys.sign(&Claims{Subject: "1", ExpiresAt: now.Add(time.Minute).Unix()})
+	require.NoError(t, err)
+
+	_, err = keys.verify(token, now.Add(2*time.Minute))
+	require.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestVerifyTamperedKO(t *testing.T) {
+	keys := NewKeySet()
+	_, err := keys.Rotate()
+	require.NoError(t, err)
+
+	now := time.Now()
+	token, err := keys.sign(&Claims{Subject: "1", ExpiresAt: now.Add(time.Minute).Unix()})
+	require.NoError(t, err)
+
+	forged, err := keys.sign(&Claims{Subject: "2", ExpiresAt: now.Add(time.Minute).Unix()})
+	require.NoError(t, err)
+	parts, forgedParts := strings.Split(token, "."), strings.Split(forged, ".")
+
+	_, err = keys.verify(parts[0]+"."+forgedParts[1]+"."+parts[2], now)
+	require.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestKeyRotationOK(t *testing.T) {
+	keys := NewKeySet()
+	oldKid, err := keys.Rotate()
+	require.NoError(t, err)
+
+	now := time.Now()
+	token, err := keys.sign(&Claims{Subject: "1", ExpiresAt: now.Add(time.Minute).Unix()})
+	require.NoError(t, err)
+
+	newKid, err := keys.Rotate()
+	require.NoError(t, err)
+	require.Len(t, keys.JWKS().Keys, 2)
+
+	// tokens signed before the rotation are still valid
+	_, err = keys.verify(token, now)
+	require.NoError(t, err)
+
+	require.Error(t, keys.Retire(newKid))
+	require.NoError(t, keys.Retire(oldKid))
+	require.Len(t, keys.JWKS().Keys, 1)
+	require.Equal(t, newKid, keys.JWKS().Keys[0].Kid)
+
+	// ...until their key is retired
+	_, err = keys.verify(token, now)
+	require.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestIssueVerifyOK(t *testing.T) {
+	tokens, user := setupTestCase(t)
+
+	pair, err := tokens.Issue(context.Background(), user)
+	require.NoError(t, err)
+	require.NotEmpty(t, pair.AccessToken)
+	require.NotEmpty(t, pair.RefreshToken)
+	require.Equal(t, "Bearer", pair.TokenType)
+
+	claims, err := tokens.Verify(pair.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprint(user.ID), claims.Subject)
+	require.Equal(t, DefaultIssuer, claims.Issuer)
+}
+
+func TestIssuePermissionsOK(t *testing.T) {
+	tokens, user := setupTestCase(t)
+
+	pair, err := tokens.Issue(context.Background(), user)
+	require.NoError(t, err)
+	claims, err := tokens.Verify(pair.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, []string{model.RoleUser}, claims.Roles)
+	require.Empty(t, claims.Permissions)
+
+	admin := &model.User{ID: user.ID, Roles: model.DefaultRoles[:1]}
+	pair, err = tokens.Issue(context.Background(), admin)
+	require.NoError(t, err)
+	claims, err = tokens.Verify(pair.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, []string{model.RoleAdmin}, claims.Roles)
+	require.Contains(t, claims.Permissions, model.PermissionUsersDelete)
+}
+
+func TestRefreshRotationOK(t *testing.T) {
+	tokens, user := setupTestCase(t)
+
+	pair, err := tokens.Issue(context.Background(), user)
+	require.NoError(t, err)
+
+	refreshed, err := tokens.Refresh(context.Background(), pair.RefreshToken)
+	require.NoError(t, err)
+	require.NotEqual(t, pair.RefreshToken, refreshed.RefreshToken)
+
+	// the old refresh token cannot be used twice...
+	_, err = tokens.Refresh(context.Background(), pair.RefreshToken)
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	// ...and its reuse revokes the whole family
+	_, err = tokens.Refresh(context.Background(), refreshed.RefreshToken)
+	require.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestRevokeOK(t *testing.T) {
+	tokens, user := setupTestCase(t)
+
+	pair, err := tokens.Issue(context.Background(), user)
+	require.NoError(t, err)
+
+	require.NoError(t, tokens.Revoke(context.Background(), pair.RefreshToken))
+
+	_, err = tokens.Refresh(context.Background(), pair.RefreshToken)
+	require.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestRefreshUnknownKO(t *testing.T) {
+	tokens, _ := setupTestCase(t)
+
+	_, err := tokens.Refresh(context.Background(), "unknown")
+	require.ErrorIs(t, err, ErrInvalidToken)
+}
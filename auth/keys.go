@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const keyBits = 2048
+
+// KeySet holds the RSA keys used to sign and verify the access tokens. Only the active key signs
+// new tokens; the other keys are kept to verify tokens issued before a rotation, until they are retired
+type KeySet struct {
+	mu     sync.RWMutex
+	keys   map[string]*rsa.PrivateKey
+	active string
+}
+
+// JWK is the public part of a signing key, as described in RFC 7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKS is the JSON Web Key Set exposing the public keys
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func NewKeySet() *KeySet {
+	return &KeySet{keys: map[string]*rsa.PrivateKey{}}
+}
+
+// LoadKeySet loads the PEM encoded RSA private keys (*.pem) from the directory. The key ID is the
+// file name without the extension, and the last key in lexical order becomes the active one:
+// naming the files after their creation date (e.g. 2022-04-01.pem) makes rotation a matter
+// of adding a new file, and retirement a matter of removing an old one
+func LoadKeySet(dir string) (*KeySet, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no signing keys found in %s", dir)
+	}
+	sort.Strings(files)
+
+	ks := NewKeySet()
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := parsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse signing key %s: %v", file, err)
+		}
+
+		ks.Add(strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)), key)
+	}
+
+	return ks, nil
+}
+
+// Add adds the key to the set and makes it the active signing key
+func (ks *KeySet) Add(kid string, key *rsa.PrivateKey) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.keys[kid] = key
+	ks.active = kid
+}
+
+// Rotate generates a new key and makes it the active signing key. Previous keys remain available
+// for verification
+func (ks *KeySet) Rotate() (string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return "", err
+	}
+
+	kid := fmt.Sprintf("%d", time.Now().UnixNano())
+	ks.Add(kid, key)
+
+	return kid, nil
+}
+
+// Retire removes a key from the set: tokens signed with it are no longer valid. The active key
+// cannot be retired
+func (ks *KeySet) Retire(kid string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if kid == ks.active {
+		return fmt.Errorf("cannot retire the active signing key %s", kid)
+	}
+	delete(ks.keys, kid)
+
+	return nil
+}
+
+// signingKey returns the active key and its ID
+func (ks *KeySet) signingKey() (string, *rsa.PrivateKey, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	key, ok := ks.keys[ks.active]
+	if !ok {
+		return "", nil, fmt.Errorf("no active signing key")
+	}
+
+	return ks.active, key, nil
+}
+
+func (ks *KeySet) publicKey(kid string) (*rsa.PublicKey, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, false
+	}
+
+	return &key.PublicKey, true
+}
+
+// JWKS returns the public keys of the set, sorted by key ID
+func (ks *KeySet) JWKS() JWKS {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	set := JWKS{Keys: make([]JWK, 0, len(ks.keys))}
+	for kid, key := range ks.keys {
+		set.Keys = append(set.Keys, JWK{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: algorithm,
+			Kid: kid,
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+
+	return set
+}
+
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA private key")
+	}
+
+	return rsaKey, nil
+}
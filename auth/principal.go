@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"context"
+	"strconv"
+)
+
+type principalKey struct{}
+
+// Principal is the authenticated caller of a request, with the roles and the permissions it had
+// when its access token was issued
+type Principal struct {
+	UserID      int
+	Roles       []string
+	Permissions []string
+}
+
+// NewPrincipal returns the principal the verified claims identify
+func NewPrincipal(claims *Claims) (*Principal, error) {
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	return &Principal{UserID: id, Roles: claims.Roles, Permissions: claims.Permissions}, nil
+}
+
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Can reports whether the principal has been granted the permission
+func (p *Principal) Can(permission string) bool {
+	for _, granted := range p.Permissions {
+		if granted == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CanOnUser reports whether the principal may act on the user with the given ID: users may
+// always act on themselves, other users require the permission
+func (p *Principal) CanOnUser(permission string, userID int) bool {
+	return p.UserID == userID || p.Can(permission)
+}
+
+// NewContext returns a copy of the context carrying the principal
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal carried by the context, if any
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
@@ -0,0 +1,208 @@
+// pkg implements the authentication of the users: signed JWT access tokens, rotating refresh tokens
+// stored via the repository layer and the signing keys exposed as a JWKS
+
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/pavelerokhin/user-microservice-go/model"
+	"github.com/pavelerokhin/user-microservice-go/repository"
+)
+
+const (
+	DefaultIssuer     = "user-microservice-go"
+	DefaultAccessTTL  = 15 * time.Minute
+	DefaultRefreshTTL = 30 * 24 * time.Hour
+)
+
+type Config struct {
+	Issuer     string
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
+// TokenPair is returned to the client on login and refresh
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+type Tokens struct {
+	Config Config
+	Keys   *KeySet
+	Logger *log.Logger
+	Repo   repository.UserRepository
+
+	now func() time.Time
+}
+
+func New(keys *KeySet, repository repository.UserRepository, config Config, logger *log.Logger) *Tokens {
+	if config.Issuer == "" {
+		config.Issuer = DefaultIssuer
+	}
+	if config.AccessTTL == 0 {
+		config.AccessTTL = DefaultAccessTTL
+	}
+	if config.RefreshTTL == 0 {
+		config.RefreshTTL = DefaultRefreshTTL
+	}
+
+	return &Tokens{Config: config, Keys: keys, Logger: logger, Repo: repository, now: time.Now}
+}
+
+// Issue starts a new session for the user: it returns a new access token and the first refresh
+// token of a new family
+func (t *Tokens) Issue(ctx context.Context, user *model.User) (*TokenPair, error) {
+	family, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	return t.issue(ctx, user, family)
+}
+
+// Refresh exchanges a refresh token for a new token pair. Each refresh token can be used only once:
+// presenting a token which has already been used revokes the whole family, since either the client
+// or an attacker holds a stolen copy
+func (t *Tokens) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	hash := hashToken(refreshToken)
+	stored, err := t.Repo.GetRefreshToken(ctx, hash)
+	if err != nil {
+		return nil, invalidToken(ctx)
+	}
+
+	if stored.RevokedAt != nil {
+		t.Logger.Printf("reuse of refresh token detected, revoking family %v", stored.Family)
+		_ = t.Repo.RevokeRefreshTokenFamily(ctx, stored.Family)
+		return nil, ErrInvalidToken
+	}
+
+	if !t.now().Before(stored.ExpiresAt) {
+		return nil, ErrInvalidToken
+	}
+
+	err = t.Repo.RevokeRefreshToken(ctx, hash)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil { // a concurrent request has used the token in the meanwhile
+		t.Logger.Printf("reuse of refresh token detected, revoking family %v", stored.Family)
+		_ = t.Repo.RevokeRefreshTokenFamily(ctx, stored.Family)
+		return nil, ErrInvalidToken
+	}
+
+	user, err := t.Repo.Get(ctx, stored.UserID)
+	if err != nil { // the user doesn't exist anymore
+		return nil, invalidToken(ctx)
+	}
+
+	return t.issue(ctx, user, stored.Family)
+}
+
+// Revoke ends the session the refresh token belongs to
+func (t *Tokens) Revoke(ctx context.Context, refreshToken string) error {
+	stored, err := t.Repo.GetRefreshToken(ctx, hashToken(refreshToken))
+	if err != nil {
+		return invalidToken(ctx)
+	}
+
+	return t.Repo.RevokeRefreshTokenFamily(ctx, stored.Family)
+}
+
+// Verify checks the access token and returns its claims
+func (t *Tokens) Verify(accessToken string) (*Claims, error) {
+	claims, err := t.Keys.verify(accessToken, t.now())
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Issuer != t.Config.Issuer {
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+func (t *Tokens) issue(ctx context.Context, user *model.User, family string) (*TokenPair, error) {
+	now := t.now()
+
+	jti, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, err := t.Keys.sign(&Claims{
+		Issuer:      t.Config.Issuer,
+		Subject:     strconv.Itoa(user.ID),
+		ID:          jti,
+		IssuedAt:    now.Unix(),
+		NotBefore:   now.Unix(),
+		ExpiresAt:   now.Add(t.Config.AccessTTL).Unix(),
+		Roles:       user.RoleNames(),
+		Permissions: user.Permissions(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot sign access token: %v", err)
+	}
+
+	refreshToken, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.Repo.AddRefreshToken(ctx, &model.RefreshToken{
+		Hash:      hashToken(refreshToken),
+		Family:    family,
+		UserID:    user.ID,
+		ExpiresAt: now.Add(t.Config.RefreshTTL),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot store refresh token: %w", err)
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(t.Config.AccessTTL.Seconds()),
+	}, nil
+}
+
+// invalidToken returns ErrInvalidToken, unless the context is done: then the token could not be checked,
+// and the error of the context is returned
+func invalidToken(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return ErrInvalidToken
+}
+
+// randomToken returns 256 random bits encoded as a URL-safe string
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hash under which a refresh token is stored: a stolen database
+// doesn't leak usable tokens
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/pavelerokhin/user-microservice-go/auth"
+	"github.com/pavelerokhin/user-microservice-go/service"
+)
+
+type authController struct {
+	Logger  *log.Logger
+	Service service.UserService
+	Tokens  *auth.Tokens
+}
+
+type AuthController interface {
+	JWKS(response http.ResponseWriter, request *http.Request)
+	Login(response http.ResponseWriter, request *http.Request)
+	Logout(response http.ResponseWriter, request *http.Request)
+	Refresh(response http.ResponseWriter, request *http.Request)
+}
+
+type loginRequest struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func NewAuthController(service service.UserService, tokens *auth.Tokens, logger *log.Logger) AuthController {
+	return &authController{Logger: logger, Service: service, Tokens: tokens}
+}
+
+func (c authController) JWKS(response http.ResponseWriter, _ *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+	response.Header().Set("Cache-Control", "public, max-age=300")
+
+	err := json.NewEncoder(response).Encode(c.Tokens.Keys.JWKS())
+	if err != nil {
+		c.Logger.Println(errMsgEncodeKO)
+	}
+}
+
+func (c authController) Login(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+	response.Header().Set("Cache-Control", "no-store")
+
+	var credentials loginRequest
+	err := decodeRequestBody(response, request, &credentials)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error unmarshalling the request: %w", err))
+		return
+	}
+
+	user, err := c.Service.Authenticate(request.Context(), credentials.Login, credentials.Password)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error authenticating user: %w", err))
+		return
+	}
+
+	tokens, err := c.Tokens.Issue(request.Context(), user)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error issuing tokens: %w", err))
+		return
+	}
+
+	tryToResponseTokensOK(response, c.Logger, tokens)
+}
+
+func (c authController) Logout(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+
+	var body refreshRequest
+	err := decodeRequestBody(response, request, &body)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error unmarshalling the request: %w", err))
+		return
+	}
+
+	err = c.Tokens.Revoke(request.Context(), body.RefreshToken)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error revoking refresh token: %w", err))
+		return
+	}
+
+	tryToResponseMsgOK(response, c.Logger, "logged out successfully")
+}
+
+func (c authController) Refresh(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+	response.Header().Set("Cache-Control", "no-store")
+
+	var body refreshRequest
+	err := decodeRequestBody(response, request, &body)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error unmarshalling the request: %w", err))
+		return
+	}
+
+	tokens, err := c.Tokens.Refresh(request.Context(), body.RefreshToken)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error refreshing tokens: %w", err))
+		return
+	}
+
+	tryToResponseTokensOK(response, c.Logger, tokens)
+}
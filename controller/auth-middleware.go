@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pavelerokhin/user-microservice-go/auth"
+	"github.com/pavelerokhin/user-microservice-go/errs"
+	"github.com/pavelerokhin/user-microservice-go/router"
+)
+
+var errAuthenticationRequired = errs.Unauthorized(errs.CodeAuthenticationRequired, "authentication required")
+
+type authMiddleware struct {
+	Logger *log.Logger
+	Tokens *auth.Tokens
+}
+
+// Rule wraps a handler, letting through only the authorized requests
+type Rule func(f func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request)
+
+// AuthMiddleware authenticates the callers by their bearer tokens and authorizes them by permission:
+// users may read and update only themselves, acting on other users requires the permissions granted
+// by the roles of the caller
+type AuthMiddleware interface {
+	// Authenticate verifies the bearer token of the request, if any, and puts the caller in the
+	// request context. Requests with an invalid token are refused with 401
+	Authenticate(next http.Handler) http.Handler
+	// RequireAuthenticated lets only authenticated callers through
+	RequireAuthenticated(f func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request)
+	// RequirePermission returns a rule letting through only the callers granted the permission
+	RequirePermission(permission string) Rule
+	// RequireSelfOr returns a rule letting through the user whose ID is in the request path,
+	// and the callers granted the permission
+	RequireSelfOr(permission string) Rule
+}
+
+func NewAuthMiddleware(tokens *auth.Tokens, logger *log.Logger) AuthMiddleware {
+	return &authMiddleware{Logger: logger, Tokens: tokens}
+}
+
+func (m authMiddleware) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		header := request.Header.Get("Authorization")
+		if header == "" {
+			next.ServeHTTP(response, request)
+			return
+		}
+
+		token := strings.TrimPrefix(header, "Bearer ")
+		if token == header {
+			responseUnauthorized(response, request, m.Logger, errs.Unauthorized(errs.CodeInvalidToken, "the authorization scheme must be Bearer"))
+			return
+		}
+
+		claims, err := m.Tokens.Verify(token)
+		if err != nil {
+			responseUnauthorized(response, request, m.Logger, errs.Unauthorized(errs.CodeInvalidToken, "%v", err))
+			return
+		}
+
+		principal, err := auth.NewPrincipal(claims)
+		if err != nil {
+			responseUnauthorized(response, request, m.Logger, errs.Unauthorized(errs.CodeInvalidToken, "%v", err))
+			return
+		}
+
+		next.ServeHTTP(response, request.WithContext(auth.NewContext(request.Context(), principal)))
+	})
+}
+
+func (m authMiddleware) RequireAuthenticated(f func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(response http.ResponseWriter, request *http.Request) {
+		_, ok := auth.FromContext(request.Context())
+		if !ok {
+			responseUnauthorized(response, request, m.Logger, errAuthenticationRequired)
+			return
+		}
+
+		f(response, request)
+	}
+}
+
+func (m authMiddleware) RequirePermission(permission string) Rule {
+	return func(f func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+		return func(response http.ResponseWriter, request *http.Request) {
+			principal, ok := auth.FromContext(request.Context())
+			if !ok {
+				responseUnauthorized(response, request, m.Logger, errAuthenticationRequired)
+				return
+			}
+
+			if !principal.Can(permission) {
+				responseForbidden(response, request, m.Logger, errs.Forbidden(errs.CodePermissionDenied, "permission %s required", permission))
+				return
+			}
+
+			f(response, request)
+		}
+	}
+}
+
+func (m authMiddleware) RequireSelfOr(permission string) Rule {
+	return func(f func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+		return func(response http.ResponseWriter, request *http.Request) {
+			principal, ok := auth.FromContext(request.Context())
+			if !ok {
+				responseUnauthorized(response, request, m.Logger, errAuthenticationRequired)
+				return
+			}
+
+			id, err := strconv.Atoi(router.Param(request, "id"))
+			if err != nil || !principal.CanOnUser(permission, id) {
+				responseForbidden(response, request, m.Logger, errs.Forbidden(errs.CodePermissionDenied, "users may access only themselves without permission %s", permission))
+				return
+			}
+
+			f(response, request)
+		}
+	}
+}
+
+func responseUnauthorized(response http.ResponseWriter, request *http.Request, logger *log.Logger, err error) {
+	response.Header().Set("WWW-Authenticate", `Bearer realm="user-microservice-go"`)
+	tryToResponseError(response, request, logger, err)
+}
+
+func responseForbidden(response http.ResponseWriter, request *http.Request, logger *log.Logger, err error) {
+	tryToResponseError(response, request, logger, err)
+}
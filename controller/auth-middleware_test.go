@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pavelerokhin/user-microservice-go/auth"
+	"github.com/pavelerokhin/user-microservice-go/model"
+	"github.com/pavelerokhin/user-microservice-go/router"
+)
+
+func setupAuthTestCase(t *testing.T, tc *testCase) (AuthMiddleware, string, string) {
+	keys := auth.NewKeySet()
+	_, err := keys.Rotate()
+	require.NoError(t, err)
+	tokens := auth.New(keys, tc.repository, auth.Config{}, testLogger)
+
+	admin := model.User{FirstName: "admin", LastName: "y", Nickname: "admin", Password: "1",
+		Email: "admin@b.com", Country: "Y", Roles: []model.Role{{Name: model.RoleAdmin}}}
+	_, err = tc.repository.Add(context.Background(), &admin)
+	require.NoError(t, err)
+
+	user, err := tc.repository.Get(context.Background(), testUser.ID)
+	require.NoError(t, err)
+	userTokens, err := tokens.Issue(context.Background(), user)
+	require.NoError(t, err)
+	adminTokens, err := tokens.Issue(context.Background(), &admin)
+	require.NoError(t, err)
+
+	return NewAuthMiddleware(tokens, testLogger), userTokens.AccessToken, adminTokens.AccessToken
+}
+
+// serveWithAuth dispatches the request through a router of the backend to the handler wrapped by the
+// authorization rule and by the authentication middleware
+func serveWithAuth(t *testing.T, backend string, m AuthMiddleware, rule Rule, token, id string) *httptest.ResponseRecorder {
+	r, err := router.New(backend, testLogger)
+	require.NoError(t, err)
+	r.USE(m.Authenticate)
+	r.GET("/user/{id:[0-9]+}", rule(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := httptest.NewRequest(http.MethodGet, "/user/"+id, nil)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	response := httptest.NewRecorder()
+	r.ServeHTTP(response, request)
+
+	return response
+}
+
+func TestAuthenticateNoTokenKO(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
+		m, _, _ := setupAuthTestCase(t, tc)
+
+		response := serveWithAuth(t, backend, m, m.RequireAuthenticated, "", "1")
+		require.Equal(t, http.StatusUnauthorized, response.Code)
+		require.Contains(t, response.Header().Get("WWW-Authenticate"), "Bearer")
+	})
+}
+
+func TestAuthenticateInvalidTokenKO(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
+		m, _, _ := setupAuthTestCase(t, tc)
+
+		response := serveWithAuth(t, backend, m, m.RequireAuthenticated, "not-a-token", "1")
+		require.Equal(t, http.StatusUnauthorized, response.Code)
+	})
+}
+
+func TestRequireSelfOr(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
+		m, userToken, adminToken := setupAuthTestCase(t, tc)
+		rule := m.RequireSelfOr(model.PermissionUsersRead)
+
+		response := serveWithAuth(t, backend, m, rule, userToken, "1")
+		require.Equal(t, http.StatusOK, response.Code)
+
+		response = serveWithAuth(t, backend, m, rule, userToken, "2")
+		require.Equal(t, http.StatusForbidden, response.Code)
+
+		response = serveWithAuth(t, backend, m, rule, adminToken, "1")
+		require.Equal(t, http.StatusOK, response.Code)
+	})
+}
+
+func TestRequirePermission(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
+		m, userToken, adminToken := setupAuthTestCase(t, tc)
+		rule := m.RequirePermission(model.PermissionUsersDelete)
+
+		response := serveWithAuth(t, backend, m, rule, userToken, "1")
+		require.Equal(t, http.StatusForbidden, response.Code)
+
+		response = serveWithAuth(t, backend, m, rule, adminToken, "1")
+		require.Equal(t, http.StatusOK, response.Code)
+	})
+}
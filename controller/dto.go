@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pavelerokhin/user-microservice-go/model"
+)
+
+// userRequest is the representation of a user in the request bodies. The password is write-only: it is
+// accepted in the requests, but there is no place for it in the responses. The fields managed by the
+// server are read-only: they are accepted, so that a user from a response can be sent back as it is,
+// but ignored
+type userRequest struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Nickname  string `json:"nickname"`
+	Password  string `json:"password"`
+	Email     string `json:"email"`
+	Country   string `json:"country"`
+
+	ID        json.RawMessage `json:"id"`
+	Roles     json.RawMessage `json:"roles"`
+	CreatedAt json.RawMessage `json:"created_at"`
+	UpdatedAt json.RawMessage `json:"updated_at"`
+	DeletedAt json.RawMessage `json:"deleted_at"`
+	Version   json.RawMessage `json:"version"`
+}
+
+// toModel returns the user of the request, without the read-only fields
+func (r *userRequest) toModel() *model.User {
+	return &model.User{
+		FirstName: r.FirstName,
+		LastName:  r.LastName,
+		Nickname:  r.Nickname,
+		Password:  r.Password,
+		Email:     r.Email,
+		Country:   r.Country,
+	}
+}
+
+// userResponse is the representation of a user in the response bodies: it has no credentials
+type userResponse struct {
+	ID        int          `json:"id"`
+	FirstName string       `json:"first_name"`
+	LastName  string       `json:"last_name"`
+	Nickname  string       `json:"nickname"`
+	Email     string       `json:"email"`
+	Country   string       `json:"country"`
+	Roles     []model.Role `json:"roles"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+	DeletedAt *time.Time   `json:"deleted_at,omitempty"`
+	Version   int          `json:"version"`
+}
+
+func newUserResponse(user *model.User) *userResponse {
+	if user == nil {
+		return nil
+	}
+
+	return &userResponse{
+		ID:        user.ID,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Nickname:  user.Nickname,
+		Email:     user.Email,
+		Country:   user.Country,
+		Roles:     user.Roles,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+		DeletedAt: user.DeletedAt,
+		Version:   user.Version,
+	}
+}
+
+func newUsersResponse(users []model.User) []userResponse {
+	responses := make([]userResponse, len(users))
+	for i := range users {
+		responses[i] = *newUserResponse(&users[i])
+	}
+
+	return responses
+}
@@ -4,15 +4,23 @@ package controller
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
 
+	"github.com/pavelerokhin/user-microservice-go/cursor"
+	"github.com/pavelerokhin/user-microservice-go/errs"
 	"github.com/pavelerokhin/user-microservice-go/model"
+	"github.com/pavelerokhin/user-microservice-go/patch"
+	"github.com/pavelerokhin/user-microservice-go/router"
 	"github.com/pavelerokhin/user-microservice-go/service"
 )
 
 type controller struct {
+	Cursors *cursor.Codec
 	Logger  *log.Logger
 	Service service.UserService
 }
@@ -22,35 +30,38 @@ type UserController interface {
 	DeleteUser(response http.ResponseWriter, request *http.Request)
 	GetUser(response http.ResponseWriter, request *http.Request)
 	GetAllUsers(response http.ResponseWriter, request *http.Request)
-	UpdateUser(response http.ResponseWriter, request *http.Request)
+	// GetUserSchema responds with the JSON Schema of the users, as validated on create, replace and patch
+	GetUserSchema(response http.ResponseWriter, request *http.Request)
+	GrantRole(response http.ResponseWriter, request *http.Request)
+	PatchUser(response http.ResponseWriter, request *http.Request)
+	ReplaceUser(response http.ResponseWriter, request *http.Request)
+	// RestoreUser undoes the deletion of a user
+	RestoreUser(response http.ResponseWriter, request *http.Request)
+	RevokeRole(response http.ResponseWriter, request *http.Request)
 }
 
-func New(service service.UserService, logger *log.Logger) UserController {
-	return &controller{Logger: logger, Service: service}
+func New(service service.UserService, cursors *cursor.Codec, logger *log.Logger) UserController {
+	return &controller{Cursors: cursors, Logger: logger, Service: service}
 }
 
 func (c controller) AddUser(response http.ResponseWriter, request *http.Request) {
 	response.Header().Set("Content-Type", "application/json")
 
-	var user model.User
-	err := json.NewDecoder(request.Body).Decode(&user)
+	user, err := unmarshalUserFromRequest(response, request)
 	if err != nil {
-		msg := fmt.Sprintf("error unmarshalling the request: %v", err)
-		tryToResponseJSONError(response, c.Logger, 0, msg)
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error unmarshalling the request: %w", err))
 		return
 	}
 
-	errValidation := c.Service.Validate(&user)
-	if errValidation != nil {
-		msg := fmt.Sprintf("error validating the request: %v", errValidation.Error())
-		tryToResponseJSONError(response, c.Logger, 0, msg)
+	err = c.Service.Validate(user)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error validating the request: %w", err))
 		return
 	}
 
-	userAdded, errC := c.Service.Add(&user)
-	if errC != nil {
-		msg := "error saving user"
-		tryToResponseJSONError(response, c.Logger, 0, msg)
+	userAdded, err := c.Service.Add(request.Context(), user)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error saving user: %w", err))
 		return
 	}
 
@@ -60,10 +71,21 @@ func (c controller) AddUser(response http.ResponseWriter, request *http.Request)
 func (c controller) DeleteUser(response http.ResponseWriter, request *http.Request) {
 	response.Header().Set("Content-Type", "application/json")
 
-	id, err := c.Service.Delete(request)
+	id, err := getIDFromRequestVars(request)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, err)
+		return
+	}
+
+	version, err := getVersionFromRequestHeader(request)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, err)
+		return
+	}
+
+	err = c.Service.Delete(request.Context(), id, version)
 	if err != nil {
-		msg := fmt.Sprintf("error while deleting a User with ID %v: %v", id, err)
-		tryToResponseJSONError(response, c.Logger, 0, msg)
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error while deleting a User with ID %v: %w", id, err))
 		return
 	}
 
@@ -73,10 +95,48 @@ func (c controller) DeleteUser(response http.ResponseWriter, request *http.Reque
 
 func (c controller) GetUser(response http.ResponseWriter, request *http.Request) {
 	response.Header().Set("Content-Type", "application/json")
-	user, statusCode, err := c.Service.Get(request)
+
+	id, err := getIDFromRequestVars(request)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, err)
+		return
+	}
+
+	includeDeleted, err := getIncludeDeletedFromRequestQuery(request)
 	if err != nil {
-		msg := fmt.Sprintf("error getting user from the database: %v", err)
-		tryToResponseJSONError(response, c.Logger, statusCode, msg)
+		tryToResponseError(response, request, c.Logger, errs.Invalid(errs.CodeInvalidFilter, "%v", err))
+		return
+	}
+
+	user, err := c.Service.Get(request.Context(), id, includeDeleted)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error getting user from the database: %w", err))
+		return
+	}
+
+	// the conditional requests of the clients which have cached the user
+	if etag := etagOf(user); isNotModified(request, etag) {
+		response.Header().Del("Content-Type")
+		response.Header().Set("ETag", etag)
+		response.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	tryToResponseUserOK(response, c.Logger, user)
+}
+
+func (c controller) RestoreUser(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+
+	id, err := getIDFromRequestVars(request)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, err)
+		return
+	}
+
+	user, err := c.Service.Restore(request.Context(), id)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error while restoring a User with ID %v: %w", id, err))
 		return
 	}
 
@@ -85,26 +145,241 @@ func (c controller) GetUser(response http.ResponseWriter, request *http.Request)
 
 func (c controller) GetAllUsers(response http.ResponseWriter, request *http.Request) {
 	response.Header().Set("Content-Type", "application/json")
-	users, statusCode, err := c.Service.GetAll(request)
+
+	filter, err := getFilterFromRequestQuery(request)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, errs.Invalid(errs.CodeInvalidFilter, "error while parsing filter parameters: %v", err))
+		return
+	}
+
+	// Deprecated: filtering by the fields of a user in the request body, use the query string
+	if request.Body != nil {
+		var user model.User
+		err := decodeRequestBody(response, request, &user)
+		if err != nil && !errors.Is(err, errEmptyBody) {
+			tryToResponseError(response, request, c.Logger, fmt.Errorf("error while parsing filter parameters: %w", err))
+			return
+		}
+
+		if err == nil {
+			bodyFilter, err := filterOfUser(&user)
+			if err != nil {
+				tryToResponseError(response, request, c.Logger, errs.Invalid(errs.CodeInvalidFilter, "error while parsing filter parameters: %v", err))
+				return
+			}
+
+			if filter == nil {
+				filter = bodyFilter
+			} else {
+				filter.Conditions = append(filter.Conditions, bodyFilter.Conditions...)
+			}
+		}
+	}
+
+	if isCursorPagination(request) {
+		c.getUsersFromCursor(response, request, filter)
+		return
+	}
+
+	page, err := getPageFromRequestVars(request)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, err)
+		return
+	}
+
+	users, err := c.Service.GetAll(request.Context(), filter, page)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error getting users from the database: %w", err))
+		return
+	}
+
+	total, err := c.Service.Count(request.Context(), filter)
 	if err != nil {
-		msg := fmt.Sprintf("error getting users from the database: %v", err)
-		tryToResponseJSONError(response, c.Logger, statusCode, msg)
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error counting users in the database: %w", err))
+		return
+	}
+
+	body := newUsersPage(users, total, page)
+	response.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if !page.IsZero() {
+		response.Header().Set("Link", pageLinks(request, body))
+	}
+
+	if wantsEnvelope(request) {
+		tryToResponseUsersPageOK(response, c.Logger, body)
 		return
 	}
 
 	tryToResponseUsersOK(response, c.Logger, users)
 }
 
-func (c controller) UpdateUser(response http.ResponseWriter, request *http.Request) {
-	c.Logger.Println("update user request")
+// getUsersFromCursor responds with the page of the users following the cursor in the query string,
+// if any, and with the cursors of the next and previous pages
+func (c controller) getUsersFromCursor(response http.ResponseWriter, request *http.Request, filter *model.Filter) {
+	if router.Param(request, "page-size") != "" {
+		err := errs.Invalid(errs.CodeInvalidPage, "cursor pagination cannot be combined with page pagination")
+		tryToResponseError(response, request, c.Logger, err)
+		return
+	}
+
+	limit, err := getLimitFromRequestQuery(request)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, err)
+		return
+	}
+
+	var from *model.Cursor
+	if token := request.URL.Query().Get(cursorParam); token != "" {
+		from, err = c.Cursors.Decode(token)
+		if err != nil {
+			tryToResponseError(response, request, c.Logger, errs.Invalid(errs.CodeInvalidCursor, "%v", err))
+			return
+		}
+	}
+
+	page, err := c.Service.GetAllFrom(request.Context(), filter, from, limit)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error getting users from the database: %w", err))
+		return
+	}
+
+	total, err := c.Service.Count(request.Context(), filter)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error counting users in the database: %w", err))
+		return
+	}
+
+	body := cursorPage{Items: newUsersResponse(page.Users), TotalCount: total}
+	if page.Next != nil {
+		body.NextCursor, err = c.Cursors.Encode(page.Next)
+	}
+	if page.Prev != nil && err == nil {
+		body.PrevCursor, err = c.Cursors.Encode(page.Prev)
+	}
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error encoding the cursors: %w", err))
+		return
+	}
+
+	response.Header().Set("X-Total-Count", strconv.Itoa(total))
+	response.Header().Set("Link", cursorLinks(request, body))
+	tryToResponseCursorPageOK(response, c.Logger, body)
+}
+
+func (c controller) GetUserSchema(response http.ResponseWriter, _ *http.Request) {
+	response.Header().Set("Content-Type", "application/schema+json")
+	response.Header().Set("Cache-Control", "public, max-age=300")
+
+	err := json.NewEncoder(response).Encode(c.Service.Schema())
+	if err != nil {
+		c.Logger.Println(errMsgEncodeKO)
+	}
+}
+
+func (c controller) GrantRole(response http.ResponseWriter, request *http.Request) {
 	response.Header().Set("Content-Type", "application/json")
 
-	user, statusCode, err := c.Service.Update(request)
+	id, err := getIDFromRequestVars(request)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, err)
+		return
+	}
 
+	user, err := c.Service.GrantRole(request.Context(), id, router.Param(request, "role"))
 	if err != nil {
-		response.WriteHeader(statusCode)
-		msg := fmt.Sprintf("error returning the reponse: %v", err)
-		tryToResponseMsgOK(response, c.Logger, msg)
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error granting role: %w", err))
+		return
+	}
+
+	tryToResponseUserOK(response, c.Logger, user)
+}
+
+func (c controller) RevokeRole(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", "application/json")
+
+	id, err := getIDFromRequestVars(request)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, err)
+		return
+	}
+
+	user, err := c.Service.RevokeRole(request.Context(), id, router.Param(request, "role"))
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error revoking role: %w", err))
+		return
+	}
+
+	tryToResponseUserOK(response, c.Logger, user)
+}
+
+func (c controller) PatchUser(response http.ResponseWriter, request *http.Request) {
+	c.Logger.Println("patch user request")
+	response.Header().Set("Content-Type", "application/json")
+
+	id, err := getIDFromRequestVars(request)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, err)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(response, request.Body, maxBodySize))
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, errs.New(errs.KindTooLarge, errs.CodeBodyTooLarge, "error reading the patch: %v", err))
+		return
+	}
+
+	p, err := patch.Parse(request.Header.Get("Content-Type"), body)
+	if errors.Is(err, patch.ErrUnsupportedMediaType) {
+		response.Header().Set("Accept-Patch", acceptPatch)
+		tryToResponseError(response, request, c.Logger, errs.New(errs.KindUnsupported, errs.CodeUnsupportedMediaType, "%v", err))
+		return
+	}
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, errs.Invalid(errs.CodeInvalidPatch, "%v", err))
+		return
+	}
+
+	version, err := getVersionFromRequestHeader(request)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, err)
+		return
+	}
+
+	user, err := c.Service.Patch(request.Context(), id, p, version)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error patching user: %w", err))
+		return
+	}
+
+	tryToResponseUserOK(response, c.Logger, user)
+}
+
+func (c controller) ReplaceUser(response http.ResponseWriter, request *http.Request) {
+	c.Logger.Println("replace user request")
+	response.Header().Set("Content-Type", "application/json")
+
+	id, err := getIDFromRequestVars(request)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, err)
+		return
+	}
+
+	version, err := getVersionFromRequestHeader(request)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, err)
+		return
+	}
+
+	newUser, err := unmarshalUserFromRequest(response, request)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error updating user: %w", err))
+		return
+	}
+
+	user, err := c.Service.Replace(request.Context(), id, newUser, version)
+	if err != nil {
+		tryToResponseError(response, request, c.Logger, fmt.Errorf("error updating user: %w", err))
+		return
 	}
 
 	tryToResponseUserOK(response, c.Logger, user)
@@ -2,9 +2,9 @@ package controller
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/require"
 	"io"
 	"log"
@@ -12,248 +12,1048 @@ import (
 	"net/http/httptest"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/pavelerokhin/user-microservice-go/auth"
+	"github.com/pavelerokhin/user-microservice-go/cursor"
+	"github.com/pavelerokhin/user-microservice-go/errs"
 	"github.com/pavelerokhin/user-microservice-go/model"
+	"github.com/pavelerokhin/user-microservice-go/password"
+	"github.com/pavelerokhin/user-microservice-go/patch"
 	"github.com/pavelerokhin/user-microservice-go/repository"
+	"github.com/pavelerokhin/user-microservice-go/router"
 	"github.com/pavelerokhin/user-microservice-go/service"
+	"github.com/pavelerokhin/user-microservice-go/validation"
 )
 
 var (
-	repositoryName = "user-controller-testing"
-
 	testLogger = log.New(os.Stdout, "testing-controller", log.LstdFlags|log.Llongfile)
 	testUser   = model.User{
 		ID:        1,
 		FirstName: "user1",
 		LastName:  "y",
-		Nickname:  "z",
-		Password:  "1",
+		Nickname:  "user1",
+		Password:  "Passw0rd",
 		Email:     "a@b.com",
-		Country:   "Y",
+		Country:   "IT",
 	}
 
-	testUserRepository repository.UserRepository
-	testUserService    service.UserService
-	testUserController UserController
+	testHasher, _    = password.New(password.DefaultCost)
+	testCursors, _   = cursor.NewEphemeral()
+	testValidator, _ = validation.New(validation.DefaultPasswordPolicy)
 )
 
-func setupTestCase(t *testing.T) {
-	var err error
-	testUserRepository, err = repository.NewSqliteRepo(repositoryName, testLogger)
-	testUserService = service.New(testUserRepository, testLogger)
-	testUserController = New(testUserService, testLogger)
-	require.NoError(t, err)
+// testCase is the controller of a test with its service and repository, an in-memory one of its own,
+// so that the tests run in parallel
+type testCase struct {
+	repository repository.UserRepository
+	service    service.UserService
+	controller UserController
 }
 
-func setupTestCaseWithUser(t *testing.T) {
-	var err error
-	testUserRepository, err = repository.NewSqliteRepo(repositoryName, testLogger)
-	testUserService = service.New(testUserRepository, testLogger)
-	testUserController = New(testUserService, testLogger)
-	require.NoError(t, err)
-	_, err = testUserRepository.Add(&testUser)
+func setupTestCase(t *testing.T) *testCase {
+	tc := &testCase{repository: repository.NewMemoryRepo(testLogger)}
+	tc.service = service.New(tc.repository, testHasher, testValidator, testLogger)
+	tc.controller = New(tc.service, testCursors, testLogger)
+	t.Cleanup(func() {
+		require.NoError(t, tc.repository.Close())
+	})
+
+	return tc
+}
+
+func setupTestCaseWithUser(t *testing.T) *testCase {
+	tc := setupTestCase(t)
+	user := testUser
+	_, err := tc.repository.Add(context.Background(), &user)
 	require.NoError(t, err)
+
+	return tc
 }
 
-func cleanTestCase(t *testing.T) {
-	require.NoError(t, os.Remove(fmt.Sprintf("%s.db", repositoryName)))
+// withCaller puts the authenticated caller in the request context, as the authentication middleware does
+func withCaller(request *http.Request, userID int, permissions ...string) *http.Request {
+	principal := &auth.Principal{UserID: userID, Permissions: permissions}
+	return request.WithContext(auth.NewContext(request.Context(), principal))
 }
 
-func TestMain(m *testing.M) {
-	_ = os.Remove(fmt.Sprintf("%s.db", repositoryName))
-	code := m.Run()
-	os.Exit(code)
+// forEachRouter runs the test against every router backend
+func forEachRouter(t *testing.T, test func(t *testing.T, backend string)) {
+	for _, backend := range []string{router.BackendMux, router.BackendChi} {
+		backend := backend
+		t.Run(backend, func(t *testing.T) {
+			t.Parallel()
+			test(t, backend)
+		})
+	}
 }
 
-func TestAddUser(t *testing.T) {
-	setupTestCase(t)
-	defer cleanTestCase(t)
+// serve dispatches the request to the handler, registered under the pattern on a new router of the backend
+func serve(t *testing.T, backend, pattern string, handler http.HandlerFunc, request *http.Request) *httptest.ResponseRecorder {
+	r, err := router.New(backend, testLogger)
+	require.NoError(t, err)
 
-	// Create a new HTTP POST request
-	jsonUser, err := json.Marshal(testUser)
-	if err != nil {
-		t.Fatal(err)
-	}
-	request, err := http.NewRequest(http.MethodPost, "/user", bytes.NewBuffer(jsonUser))
-	if err != nil {
-		t.Fatal(err)
+	switch request.Method {
+	case http.MethodDelete:
+		r.DELETE(pattern, handler)
+	case http.MethodGet:
+		r.GET(pattern, handler)
+	case http.MethodHead:
+		r.HEAD(pattern, handler)
+	case http.MethodPatch:
+		r.PATCH(pattern, handler)
+	case http.MethodPost:
+		r.POST(pattern, handler)
+	case http.MethodPut:
+		r.PUT(pattern, handler)
+	default:
+		t.Fatalf("method %v is not supported", request.Method)
 	}
 
-	// Assign HTTP Handle function (controller AddUser function)
-	handler := http.HandlerFunc(testUserController.AddUser)
-
 	// Record HTTP Response (httptest library)
 	response := httptest.NewRecorder()
+	r.ServeHTTP(response, request)
 
-	// Dispatch the HTTP request
-	handler.ServeHTTP(response, request)
+	return response
+}
 
-	// Add assertions on the HTTP status code and the response
-	status := response.Code
-	require.Equal(t, http.StatusOK, status)
+func TestAddUser(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCase(t)
 
-	// Decode HTTP response
-	var user model.User
-	err = json.NewDecoder(io.Reader(response.Body)).Decode(&user)
-	require.NoError(t, err)
-	require.NotNil(t, user)
-	require.Equal(t, testUser.FirstName, user.FirstName)
-	require.Equal(t, testUser.LastName, user.LastName)
-	require.Equal(t, testUser.Nickname, user.Nickname)
-	require.Equal(t, testUser.Password, user.Password)
-	require.Equal(t, testUser.Email, user.Email)
-	require.Equal(t, testUser.Country, user.Country)
+		// Create a new HTTP POST request
+		jsonUser, err := json.Marshal(testUser)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request, err := http.NewRequest(http.MethodPost, "/user", bytes.NewBuffer(jsonUser))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Dispatch the HTTP request through the router (controller AddUser function)
+		response := serve(t, backend, "/user", tc.controller.AddUser, request)
+
+		// Add assertions on the HTTP status code and the response
+		status := response.Code
+		require.Equal(t, http.StatusOK, status)
+
+		// Decode HTTP response
+		var user model.User
+		err = json.NewDecoder(io.Reader(response.Body)).Decode(&user)
+		require.NoError(t, err)
+		require.NotNil(t, user)
+		require.Equal(t, testUser.FirstName, user.FirstName)
+		require.Equal(t, testUser.LastName, user.LastName)
+		require.Equal(t, testUser.Nickname, user.Nickname)
+		require.Empty(t, user.Password)
+		require.Equal(t, testUser.Email, user.Email)
+		require.Equal(t, testUser.Country, user.Country)
+
+		// the password is stored hashed
+		stored, err := tc.repository.Get(context.Background(), user.ID)
+		require.NoError(t, err)
+		require.True(t, password.IsHash(stored.Password))
+		require.NoError(t, testHasher.Compare(stored.Password, testUser.Password))
+	})
 }
 
 func TestDeleteUser(t *testing.T) {
-	setupTestCaseWithUser(t)
-	defer cleanTestCase(t)
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
 
-	// Create a new HTTP POST request to delete user
-	request, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("/user/%d", testUser.ID), nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	//Hack to try to fake gorilla/mux vars
-	vars := map[string]string{
-		"id": strconv.Itoa(testUser.ID),
-	}
-	request = mux.SetURLVars(request, vars)
+		// Create a new HTTP POST request to delete user
+		request, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("/user/%d", testUser.ID), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request = withCaller(request, testUser.ID+1, model.PermissionUsersDelete)
 
-	// Assign HTTP Handle function (controller AddUser function)
-	handler := http.HandlerFunc(testUserController.DeleteUser)
+		// Dispatch the HTTP request through the router (controller DeleteUser function)
+		response := serve(t, backend, "/user/{id:[0-9]+}", tc.controller.DeleteUser, request)
 
-	// Record HTTP Response (httptest library)
-	response := httptest.NewRecorder()
+		// Add assertions on the HTTP status code and the response
+		status := response.Code
+		require.Equal(t, http.StatusOK, status)
 
-	// Dispatch the HTTP request
-	handler.ServeHTTP(response, request)
+		// Try to get user id 1 (should be nil)
+		user, err := tc.repository.Get(context.Background(), testUser.ID)
+		require.Error(t, err)
+		require.Nil(t, user)
+	})
+}
 
-	// Add assertions on the HTTP status code and the response
-	status := response.Code
-	require.Equal(t, http.StatusOK, status)
+func TestDeleteRestoreUser(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
+		require.NoError(t, tc.repository.Delete(context.Background(), testUser.ID, 0))
 
-	// Try to get user id 1 (should be nil)
-	user, err := testUserRepository.Get(testUser.ID)
-	require.Error(t, err)
-	require.Nil(t, user)
+		get := func(query string, permissions ...string) *httptest.ResponseRecorder {
+			request, err := http.NewRequest(http.MethodGet, fmt.Sprintf("/user/%d%v", testUser.ID, query), nil)
+			require.NoError(t, err)
+			request = withCaller(request, testUser.ID+1, permissions...)
+
+			return serve(t, backend, "/user/{id:[0-9]+}", tc.controller.GetUser, request)
+		}
+
+		// the deleted users are hidden, but to the admins asking for them
+		require.Equal(t, http.StatusNotFound, get("", model.PermissionUsersRead, model.PermissionUsersDelete).Code)
+		require.Equal(t, http.StatusForbidden, get("?include_deleted=true", model.PermissionUsersRead).Code)
+		require.Equal(t, http.StatusBadRequest, get("?include_deleted=maybe", model.PermissionUsersDelete).Code)
+
+		response := get("?include_deleted=true", model.PermissionUsersRead, model.PermissionUsersDelete)
+		require.Equal(t, http.StatusOK, response.Code)
+		var deleted map[string]interface{}
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&deleted))
+		require.NotEmpty(t, deleted["deleted_at"])
+
+		// their emails and nicknames can be taken by others
+		taken := model.User{FirstName: "x", LastName: "y", Nickname: testUser.Nickname, Password: "Passw0rd",
+			Email: "taken@b.com", Country: "IT"}
+		_, err := tc.repository.Add(context.Background(), &taken)
+		require.NoError(t, err)
+
+		restore := func() *httptest.ResponseRecorder {
+			request, err := http.NewRequest(http.MethodPost, fmt.Sprintf("/user/%d/restore", testUser.ID), nil)
+			require.NoError(t, err)
+			request = withCaller(request, testUser.ID+1, model.PermissionUsersDelete)
+
+			return serve(t, backend, "/user/{id:[0-9]+}/restore", tc.controller.RestoreUser, request)
+		}
+
+		response = restore()
+		require.Equal(t, http.StatusConflict, response.Code)
+		var problem errs.Problem
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&problem))
+		require.Equal(t, errs.CodeNicknameTaken, problem.Code)
+
+		require.NoError(t, tc.repository.Delete(context.Background(), taken.ID, 0))
+		response = restore()
+		require.Equal(t, http.StatusOK, response.Code)
+		require.Equal(t, http.StatusOK, get("", model.PermissionUsersRead).Code)
+
+		// only the deleted users can be restored
+		require.Equal(t, http.StatusNotFound, restore().Code)
+	})
+}
+
+func TestGetAllUsersIncludeDeleted(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
+		_, err := tc.repository.Add(context.Background(), &model.User{FirstName: "x", LastName: "y", Nickname: "user2",
+			Password: "Passw0rd", Email: "user2@b.com", Country: "IT"})
+		require.NoError(t, err)
+		require.NoError(t, tc.repository.Delete(context.Background(), testUser.ID, 0))
+
+		list := func(query string, permissions ...string) *httptest.ResponseRecorder {
+			request, err := http.NewRequest(http.MethodGet, "/users"+query, nil)
+			require.NoError(t, err)
+			request = withCaller(request, testUser.ID+1, permissions...)
+
+			return serve(t, backend, "/users", tc.controller.GetAllUsers, request)
+		}
+
+		response := list("", model.PermissionUsersRead)
+		require.Equal(t, http.StatusOK, response.Code)
+		require.Equal(t, "1", response.Header().Get("X-Total-Count"))
+
+		response = list("?include_deleted=true", model.PermissionUsersRead, model.PermissionUsersDelete)
+		require.Equal(t, http.StatusOK, response.Code)
+		require.Equal(t, "2", response.Header().Get("X-Total-Count"))
+
+		require.Equal(t, http.StatusForbidden, list("?include_deleted=true", model.PermissionUsersRead).Code)
+	})
 }
 
 func TestGetUser(t *testing.T) {
-	setupTestCaseWithUser(t)
-	defer cleanTestCase(t)
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
 
-	// Create a new HTTP POST request to delete user
-	request, err := http.NewRequest(http.MethodGet, fmt.Sprintf("/user/%d", testUser.ID), nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	//Hack to try to fake gorilla/mux vars
-	vars := map[string]string{
-		"id": strconv.Itoa(testUser.ID),
-	}
-	request = mux.SetURLVars(request, vars)
+		// Create a new HTTP POST request to delete user
+		request, err := http.NewRequest(http.MethodGet, fmt.Sprintf("/user/%d", testUser.ID), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	// Assign HTTP Handle function (controller AddUser function)
-	handler := http.HandlerFunc(testUserController.GetUser)
+		// Dispatch the HTTP request through the router (controller GetUser function)
+		response := serve(t, backend, "/user/{id:[0-9]+}", tc.controller.GetUser, request)
+
+		// Add assertions on the HTTP status code and the response
+		status := response.Code
+		require.Equal(t, http.StatusOK, status)
+
+		// Decode HTTP response
+		var user model.User
+		err = json.NewDecoder(io.Reader(response.Body)).Decode(&user)
+		require.NoError(t, err)
+		require.NotNil(t, user)
+		require.Equal(t, testUser.FirstName, user.FirstName)
+		require.Equal(t, testUser.LastName, user.LastName)
+		require.Equal(t, testUser.Nickname, user.Nickname)
+		require.Empty(t, user.Password)
+		require.Equal(t, testUser.Email, user.Email)
+		require.Equal(t, testUser.Country, user.Country)
+	})
+}
+
+func TestGetUserCanceled(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
+
+		canceled, cancel := context.WithCancel(context.Background())
+		cancel()
+		expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		defer cancel()
+
+		for _, test := range []struct {
+			ctx    context.Context
+			status int
+			code   string
+		}{
+			{canceled, errs.StatusClientClosedRequest, errs.CodeRequestCanceled},
+			{expired, http.StatusGatewayTimeout, errs.CodeRequestTimeout},
+		} {
+			request, err := http.NewRequestWithContext(test.ctx, http.MethodGet, fmt.Sprintf("/user/%d", testUser.ID), nil)
+			require.NoError(t, err)
+
+			response := serve(t, backend, "/user/{id:[0-9]+}", tc.controller.GetUser, request)
+			require.Equal(t, test.status, response.Code)
+
+			var problem errs.Problem
+			require.NoError(t, json.NewDecoder(response.Body).Decode(&problem))
+			require.Equal(t, test.code, problem.Code)
+		}
+	})
+}
+
+func TestGetUserNotFound(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCase(t)
+
+		request, err := http.NewRequest(http.MethodGet, "/user/42", nil)
+		require.NoError(t, err)
+
+		response := serve(t, backend, "/user/{id:[0-9]+}", tc.controller.GetUser, request)
+		require.Equal(t, http.StatusNotFound, response.Code)
+		require.Equal(t, errs.MediaTypeProblem, response.Header().Get("Content-Type"))
+
+		var problem errs.Problem
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&problem))
+		require.Equal(t, errs.ProblemTypePrefix+errs.CodeUserNotFound, problem.Type)
+		require.Equal(t, "Not Found", problem.Title)
+		require.Equal(t, http.StatusNotFound, problem.Status)
+		require.Equal(t, "/user/42", problem.Instance)
+		require.Equal(t, errs.CodeUserNotFound, problem.Code)
+	})
+}
+
+func TestAddUserInvalidParams(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCase(t)
+
+		add := func(accept string) *httptest.ResponseRecorder {
+			request, err := http.NewRequest(http.MethodPost, "/user", bytes.NewBufferString(`{"first_name": "x", "country": "IT"}`))
+			require.NoError(t, err)
+			request.Header.Set("Accept", accept)
+
+			return serve(t, backend, "/user", tc.controller.AddUser, request)
+		}
+
+		// every missing field is reported at once
+		response := add("application/problem+json, application/json;q=0.9")
+		require.Equal(t, http.StatusUnprocessableEntity, response.Code)
+		require.Equal(t, errs.MediaTypeProblem, response.Header().Get("Content-Type"))
+
+		var problem errs.Problem
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&problem))
+		require.Equal(t, errs.CodeInvalidUser, problem.Code)
+		var names []string
+		for _, param := range problem.InvalidParams {
+			names = append(names, param.Name)
+		}
+		require.Equal(t, []string{"last_name", "nickname", "password", "email"}, names)
+
+		// the legacy format, during the migration
+		response = add("application/json")
+		require.Equal(t, http.StatusUnprocessableEntity, response.Code)
+		require.Equal(t, errs.MediaTypeJSON, response.Header().Get("Content-Type"))
+
+		var legacy map[string]string
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&legacy))
+		require.Equal(t, errs.CodeInvalidUser, legacy["code"])
+		require.Contains(t, legacy["message"], "last_name is required")
+	})
+}
+
+func TestAddUserConflict(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
+
+		add := func(nickname, email string) *errs.Problem {
+			body := fmt.Sprintf(`{"first_name": "x", "last_name": "y", "nickname": %q, "password": "Passw0rd",
+				"email": %q, "country": "IT"}`, nickname, email)
+			request, err := http.NewRequest(http.MethodPost, "/user", bytes.NewBufferString(body))
+			require.NoError(t, err)
+
+			response := serve(t, backend, "/user", tc.controller.AddUser, request)
+			require.Equal(t, http.StatusConflict, response.Code)
+
+			var problem errs.Problem
+			require.NoError(t, json.NewDecoder(response.Body).Decode(&problem))
+			return &problem
+		}
+
+		// the emails and the nicknames are compared case-insensitively
+		problem := add("user-f", "A@B.COM")
+		require.Equal(t, errs.CodeEmailTaken, problem.Code)
+		require.Equal(t, []errs.InvalidParam{{Name: "email", Reason: "email is already taken"}}, problem.InvalidParams)
+
+		problem = add("USER1", "user-f@b.com")
+		require.Equal(t, errs.CodeNicknameTaken, problem.Code)
+		require.Equal(t, "nickname", problem.InvalidParams[0].Name)
+	})
+}
+
+func TestGetUserSchema(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCase(t)
+
+		request, err := http.NewRequest(http.MethodGet, "/schemas/user.json", nil)
+		require.NoError(t, err)
+
+		response := serve(t, backend, "/schemas/user.json", tc.controller.GetUserSchema, request)
+		require.Equal(t, http.StatusOK, response.Code)
+		require.Equal(t, "application/schema+json", response.Header().Get("Content-Type"))
+
+		var schema struct {
+			Properties map[string]map[string]interface{} `json:"properties"`
+			Required   []string                          `json:"required"`
+		}
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&schema))
+		require.Equal(t, []string{"first_name", "last_name", "nickname", "password", "email", "country"}, schema.Required)
+		require.Equal(t, "email", schema.Properties["email"]["format"])
+		require.Equal(t, true, schema.Properties["password"]["writeOnly"])
+		require.Equal(t, true, schema.Properties["id"]["readOnly"])
+	})
+}
+
+func TestInternalErrorNotLeaked(t *testing.T) {
+	t.Parallel()
+	err := fmt.Errorf("error saving user: %w", fmt.Errorf("UNIQUE constraint failed: users.email"))
 
-	// Record HTTP Response (httptest library)
 	response := httptest.NewRecorder()
+	tryToResponseError(response, httptest.NewRequest(http.MethodPost, "/user", nil), testLogger, err)
+	require.Equal(t, http.StatusInternalServerError, response.Code)
 
-	// Dispatch the HTTP request
-	handler.ServeHTTP(response, request)
+	var problem errs.Problem
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&problem))
+	require.Equal(t, "internal", problem.Code)
+	require.Equal(t, errs.MessageInternal, problem.Detail)
 
-	// Add assertions on the HTTP status code and the response
-	status := response.Code
-	require.Equal(t, http.StatusOK, status)
+	request := httptest.NewRequest(http.MethodPost, "/user", nil)
+	request.Header.Set("Accept", errs.MediaTypeJSON)
+	response = httptest.NewRecorder()
+	tryToResponseError(response, request, testLogger, err)
 
-	// Decode HTTP response
-	var user model.User
-	err = json.NewDecoder(io.Reader(response.Body)).Decode(&user)
-	require.NoError(t, err)
-	require.NotNil(t, user)
-	require.Equal(t, testUser.FirstName, user.FirstName)
-	require.Equal(t, testUser.LastName, user.LastName)
-	require.Equal(t, testUser.Nickname, user.Nickname)
-	require.Equal(t, testUser.Password, user.Password)
-	require.Equal(t, testUser.Email, user.Email)
-	require.Equal(t, testUser.Country, user.Country)
+	var legacy errs.ResponseError
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&legacy))
+	require.Equal(t, errs.MessageInternal, legacy.Message)
 }
 
 func TestGetAllUsers(t *testing.T) {
-	setupTestCaseWithUser(t)
-	defer cleanTestCase(t)
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
 
-	// Create a new HTTP POST request to delete user
-	request, err := http.NewRequest(http.MethodGet, "/users", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+		// Create a new HTTP POST request to delete user
+		request, err := http.NewRequest(http.MethodGet, "/users", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	// Assign HTTP Handle function (controller AddUser function)
-	handler := http.HandlerFunc(testUserController.GetAllUsers)
+		// Dispatch the HTTP request through the router (controller GetAllUsers function)
+		response := serve(t, backend, "/users", tc.controller.GetAllUsers, request)
 
-	// Record HTTP Response (httptest library)
-	response := httptest.NewRecorder()
+		// Add assertions on the HTTP status code and the response
+		status := response.Code
+		require.Equal(t, http.StatusOK, status)
 
-	// Dispatch the HTTP request
-	handler.ServeHTTP(response, request)
+		// Decode HTTP response
+		var users []model.User
+		err = json.NewDecoder(io.Reader(response.Body)).Decode(&users)
+		require.NoError(t, err)
+		require.NotNil(t, users)
+		require.Equal(t, testUser.FirstName, users[0].FirstName)
+		require.Equal(t, testUser.LastName, users[0].LastName)
+		require.Equal(t, testUser.Nickname, users[0].Nickname)
+		require.Empty(t, users[0].Password)
+		require.Equal(t, testUser.Email, users[0].Email)
+		require.Equal(t, testUser.Country, users[0].Country)
+	})
+}
 
-	// Add assertions on the HTTP status code and the response
-	status := response.Code
-	require.Equal(t, http.StatusOK, status)
+func TestGetAllUsersFiltered(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
+		_, err := tc.repository.Add(context.Background(), &model.User{FirstName: "user2", LastName: "a", Nickname: "w",
+			Password: "1", Email: "w@gmail.com", Country: "Israel"})
+		require.NoError(t, err)
+		_, err = tc.repository.Add(context.Background(), &model.User{FirstName: "user3", LastName: "b", Nickname: "v",
+			Password: "1", Email: "v@gmail.com", Country: "Israel"})
+		require.NoError(t, err)
 
-	// Decode HTTP response
-	var users []model.User
-	err = json.NewDecoder(io.Reader(response.Body)).Decode(&users)
-	require.NoError(t, err)
-	require.NotNil(t, users)
-	require.Equal(t, testUser.FirstName, users[0].FirstName)
-	require.Equal(t, testUser.LastName, users[0].LastName)
-	require.Equal(t, testUser.Nickname, users[0].Nickname)
-	require.Equal(t, testUser.Password, users[0].Password)
-	require.Equal(t, testUser.Email, users[0].Email)
-	require.Equal(t, testUser.Country, users[0].Country)
+		request, err := http.NewRequest(http.MethodGet,
+			"/users?country=Israel&created_at[gte]=2022-01-01&email[like]=%25@gmail.com&sort=-last_name", nil)
+		require.NoError(t, err)
+
+		response := serve(t, backend, "/users", tc.controller.GetAllUsers, request)
+		require.Equal(t, http.StatusOK, response.Code)
+
+		var users []model.User
+		err = json.NewDecoder(io.Reader(response.Body)).Decode(&users)
+		require.NoError(t, err)
+		require.Len(t, users, 2)
+		require.Equal(t, "user3", users[0].FirstName)
+		require.Equal(t, "user2", users[1].FirstName)
+	})
 }
 
-func TestUpdateUser(t *testing.T) {
-	setupTestCaseWithUser(t)
-	defer cleanTestCase(t)
+func TestGetAllUsersInvalidFilter(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
+
+		for _, query := range []string{"password=1", "id[like]=1", "id=x", "country[regex]=Y", "sort=roles"} {
+			request, err := http.NewRequest(http.MethodGet, "/users?"+query, nil)
+			require.NoError(t, err)
+
+			response := serve(t, backend, "/users", tc.controller.GetAllUsers, request)
+			require.Equal(t, http.StatusBadRequest, response.Code, query)
+
+			var body errs.ResponseError
+			require.NoError(t, json.NewDecoder(response.Body).Decode(&body))
+			require.Equal(t, errs.CodeInvalidFilter, body.Code, query)
+		}
+	})
+}
+
+func TestGetAllUsersEnvelope(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
+		for _, name := range []string{"user2", "user3"} {
+			_, err := tc.repository.Add(context.Background(), &model.User{FirstName: name, LastName: "y", Nickname: name,
+				Password: "1", Email: name + "@b.com", Country: "Y"})
+			require.NoError(t, err)
+		}
+
+		request, err := http.NewRequest(http.MethodGet, "/users/2/1?last_name=y&envelope=true", nil)
+		require.NoError(t, err)
+
+		response := serve(t, backend, "/users/{page-size:[0-9]+}/{page:[0-9]+}", tc.controller.GetAllUsers, request)
+		require.Equal(t, http.StatusOK, response.Code)
+		require.Equal(t, "3", response.Header().Get("X-Total-Count"))
+		require.Equal(t, `</users/2/1?last_name=y&envelope=true>; rel="first", `+
+			`</users/2/2?last_name=y&envelope=true>; rel="next", `+
+			`</users/2/2?last_name=y&envelope=true>; rel="last"`, response.Header().Get("Link"))
+
+		var page usersPage
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&page))
+		require.Len(t, page.Items, 2)
+		require.Equal(t, 3, page.TotalCount)
+		require.Equal(t, 1, page.Page)
+		require.Equal(t, 2, page.PageSize)
+		require.Equal(t, 2, page.TotalPages)
 
-	// Create a new HTTP POST request to delete user
+		// without envelope, the bare list
+		request, err = http.NewRequest(http.MethodGet, "/users/2/2", nil)
+		require.NoError(t, err)
 
-	requestBody, err := json.Marshal(map[string]string{"first_name": "updated first name"})
+		response = serve(t, backend, "/users/{page-size:[0-9]+}/{page:[0-9]+}", tc.controller.GetAllUsers, request)
+		require.Equal(t, http.StatusOK, response.Code)
+		require.Equal(t, "3", response.Header().Get("X-Total-Count"))
+		require.Equal(t, `</users/2/1>; rel="first", </users/2/1>; rel="prev", </users/2/2>; rel="last"`,
+			response.Header().Get("Link"))
+
+		var users []model.User
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&users))
+		require.Len(t, users, 1)
+	})
+}
+
+func TestGetAllUsersCursor(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
+		for _, name := range []string{"user2", "user3"} {
+			_, err := tc.repository.Add(context.Background(), &model.User{FirstName: name, LastName: "y", Nickname: name,
+				Password: "1", Email: name + "@b.com", Country: "Y"})
+			require.NoError(t, err)
+		}
+
+		get := func(query string) (int, cursorPage) {
+			request, err := http.NewRequest(http.MethodGet, "/users?"+query, nil)
+			require.NoError(t, err)
+
+			response := serve(t, backend, "/users", tc.controller.GetAllUsers, request)
+			var page cursorPage
+			if response.Code == http.StatusOK {
+				require.NoError(t, json.NewDecoder(response.Body).Decode(&page))
+			}
+			return response.Code, page
+		}
+
+		status, page := get("limit=2&sort=-first_name")
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, 3, page.TotalCount)
+		require.Len(t, page.Items, 2)
+		require.Equal(t, "user3", page.Items[0].FirstName)
+		require.NotEmpty(t, page.NextCursor)
+		require.Empty(t, page.PrevCursor)
+
+		status, page = get("limit=2&sort=-first_name&cursor=" + page.NextCursor)
+		require.Equal(t, http.StatusOK, status)
+		require.Len(t, page.Items, 1)
+		require.Equal(t, "user1", page.Items[0].FirstName)
+		require.Empty(t, page.NextCursor)
+		require.NotEmpty(t, page.PrevCursor)
+		prev := page.PrevCursor
+
+		status, page = get("limit=2&sort=-first_name&cursor=" + prev)
+		require.Equal(t, http.StatusOK, status)
+		require.Len(t, page.Items, 2)
+		require.Equal(t, "user3", page.Items[0].FirstName)
+
+		// the cursor belongs to a listing sorted differently
+		status, _ = get("limit=2&cursor=" + prev)
+		require.Equal(t, http.StatusBadRequest, status)
+
+		for _, query := range []string{"cursor=forged", "limit=0", "limit=x", fmt.Sprintf("limit=%d", maxLimit+1)} {
+			status, _ = get(query)
+			require.Equal(t, http.StatusBadRequest, status, query)
+		}
+	})
+}
+
+func TestDeleteUserForbidden(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
+
+		request, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("/user/%d", testUser.ID), nil)
+		require.NoError(t, err)
+		request = withCaller(request, testUser.ID)
+
+		response := serve(t, backend, "/user/{id:[0-9]+}", tc.controller.DeleteUser, request)
+		require.Equal(t, http.StatusForbidden, response.Code)
+
+		// the user is still there
+		_, err = tc.repository.Get(context.Background(), testUser.ID)
+		require.NoError(t, err)
+	})
+}
+
+func TestGrantRevokeRole(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
+
+		path := fmt.Sprintf("/user/%d/roles/%s", testUser.ID, model.RoleAdmin)
+
+		request, err := http.NewRequest(http.MethodPost, path, nil)
+		require.NoError(t, err)
+		request = withCaller(request, testUser.ID+1, model.PermissionRolesWrite)
+		response := serve(t, backend, "/user/{id:[0-9]+}/roles/{role}", tc.controller.GrantRole, request)
+		require.Equal(t, http.StatusOK, response.Code)
+
+		var user model.User
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&user))
+		require.ElementsMatch(t, []string{model.RoleUser, model.RoleAdmin}, user.RoleNames())
+		require.Contains(t, user.Permissions(), model.PermissionUsersDelete)
+
+		request, err = http.NewRequest(http.MethodDelete, path, nil)
+		require.NoError(t, err)
+		request = withCaller(request, testUser.ID+1, model.PermissionRolesWrite)
+		response = serve(t, backend, "/user/{id:[0-9]+}/roles/{role}", tc.controller.RevokeRole, request)
+		require.Equal(t, http.StatusOK, response.Code)
+
+		user = model.User{}
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&user))
+		require.Equal(t, []string{model.RoleUser}, user.RoleNames())
+	})
+}
+
+func TestPatchUser(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
+
+		// Create a new HTTP POST request to delete user
+
+		requestBody, err := json.Marshal(map[string]string{"first_name": "updated first name"})
+		require.NoError(t, err)
+		request, err := http.NewRequest(http.MethodPatch, fmt.Sprintf("/user/%d", testUser.ID), bytes.NewBuffer(requestBody))
+		require.NoError(t, err)
+		request = withCaller(request, testUser.ID)
+
+		// Dispatch the HTTP request through the router (controller PatchUser function)
+		response := serve(t, backend, "/user/{id:[0-9]+}", tc.controller.PatchUser, request)
+
+		// Add assertions on the HTTP status code and the response
+		status := response.Code
+		require.Equal(t, http.StatusOK, status)
+
+		// Decode HTTP response
+		var user model.User
+		err = json.NewDecoder(io.Reader(response.Body)).Decode(&user)
+		require.NoError(t, err)
+		require.NotNil(t, user)
+		require.Equal(t, "updated first name", user.FirstName)
+		require.Equal(t, testUser.LastName, user.LastName)
+		require.Equal(t, testUser.Nickname, user.Nickname)
+		require.Empty(t, user.Password)
+		require.Equal(t, testUser.Email, user.Email)
+		require.Equal(t, testUser.Country, user.Country)
+	})
+}
+
+func TestPatchUserJSONPatch(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
+
+		operations := fmt.Sprintf(`[
+			{"op": "test", "path": "/id", "value": %d},
+			{"op": "replace", "path": "/country", "value": "FR"},
+			{"op": "copy", "from": "/first_name", "path": "/nickname"}
+		]`, testUser.ID)
+		request, err := http.NewRequest(http.MethodPatch, fmt.Sprintf("/user/%d", testUser.ID), bytes.NewBufferString(operations))
+		require.NoError(t, err)
+		request.Header.Set("Content-Type", "application/json-patch+json")
+		request = withCaller(request, testUser.ID)
+
+		response := serve(t, backend, "/user/{id:[0-9]+}", tc.controller.PatchUser, request)
+		require.Equal(t, http.StatusOK, response.Code)
+
+		var user model.User
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&user))
+		require.Equal(t, "FR", user.Country)
+		require.Equal(t, testUser.FirstName, user.Nickname)
+		require.Equal(t, testUser.LastName, user.LastName)
+
+		// the password is kept
+		stored, err := tc.repository.Get(context.Background(), testUser.ID)
+		require.NoError(t, err)
+		require.NoError(t, testHasher.Compare(stored.Password, testUser.Password))
+	})
+}
+
+func TestPatchUserKO(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
+
+		for _, c := range []struct {
+			contentType, body string
+			statusCode        int
+		}{
+			{"application/json-patch+json", `[{"op": "test", "path": "/country", "value": "?"}]`, http.StatusConflict},
+			{"application/json-patch+json", `[{"op": "remove", "path": "/email"}]`, http.StatusUnprocessableEntity},
+			{"application/merge-patch+json", `{"created_at": null}`, http.StatusBadRequest},
+			{"text/plain", `first_name=x`, http.StatusUnsupportedMediaType},
+		} {
+			request, err := http.NewRequest(http.MethodPatch, fmt.Sprintf("/user/%d", testUser.ID), bytes.NewBufferString(c.body))
+			require.NoError(t, err)
+			request.Header.Set("Content-Type", c.contentType)
+			request = withCaller(request, testUser.ID)
+
+			response := serve(t, backend, "/user/{id:[0-9]+}", tc.controller.PatchUser, request)
+			require.Equal(t, c.statusCode, response.Code, c.body)
+		}
+	})
+}
+
+func TestReplaceUser(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
+
+		replacement := map[string]string{"first_name": "new", "last_name": "new", "nickname": "new",
+			"password": "N3wPassword", "email": "new@b.com", "country": "FR"}
+		requestBody, err := json.Marshal(replacement)
+		require.NoError(t, err)
+		request, err := http.NewRequest(http.MethodPut, fmt.Sprintf("/user/%d", testUser.ID), bytes.NewBuffer(requestBody))
+		require.NoError(t, err)
+		request = withCaller(request, testUser.ID)
+
+		response := serve(t, backend, "/user/{id:[0-9]+}", tc.controller.ReplaceUser, request)
+		require.Equal(t, http.StatusOK, response.Code)
+
+		var user model.User
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&user))
+		require.Equal(t, testUser.ID, user.ID)
+		require.Equal(t, "new", user.FirstName)
+		require.Equal(t, "new@b.com", user.Email)
+		require.Empty(t, user.Password)
+
+		// a partial user doesn't replace a complete one
+		requestBody, err = json.Marshal(map[string]string{"first_name": "partial"})
+		require.NoError(t, err)
+		request, err = http.NewRequest(http.MethodPut, fmt.Sprintf("/user/%d", testUser.ID), bytes.NewBuffer(requestBody))
+		require.NoError(t, err)
+		request = withCaller(request, testUser.ID)
+
+		response = serve(t, backend, "/user/{id:[0-9]+}", tc.controller.ReplaceUser, request)
+		require.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	})
+}
+
+func TestConditionalRequests(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
+
+		get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+			request, err := http.NewRequest(http.MethodGet, fmt.Sprintf("/user/%d", testUser.ID), nil)
+			require.NoError(t, err)
+			if ifNoneMatch != "" {
+				request.Header.Set("If-None-Match", ifNoneMatch)
+			}
+			return serve(t, backend, "/user/{id:[0-9]+}", tc.controller.GetUser, request)
+		}
+		patchFirstName := func(ifMatch, firstName string) *httptest.ResponseRecorder {
+			requestBody, err := json.Marshal(map[string]string{"first_name": firstName})
+			require.NoError(t, err)
+			request, err := http.NewRequest(http.MethodPatch, fmt.Sprintf("/user/%d", testUser.ID), bytes.NewBuffer(requestBody))
+			require.NoError(t, err)
+			request.Header.Set("If-Match", ifMatch)
+			return serve(t, backend, "/user/{id:[0-9]+}", tc.controller.PatchUser, withCaller(request, testUser.ID))
+		}
+
+		response := get("")
+		require.Equal(t, http.StatusOK, response.Code)
+		etag := response.Header().Get("ETag")
+		require.Equal(t, `"1"`, etag)
+
+		// the client has the current representation
+		response = get(`"0", W/` + etag)
+		require.Equal(t, http.StatusNotModified, response.Code)
+		require.Equal(t, etag, response.Header().Get("ETag"))
+		require.Empty(t, response.Body.Bytes())
+
+		response = patchFirstName(etag, "first")
+		require.Equal(t, http.StatusOK, response.Code)
+		require.Equal(t, `"2"`, response.Header().Get("ETag"))
+
+		// the user has been modified since: the stale writes fail, and write nothing
+		for _, ifMatch := range []string{etag, "W/" + etag, `"1", "2"`, `"x"`} {
+			response = patchFirstName(ifMatch, "second")
+			require.Equal(t, http.StatusPreconditionFailed, response.Code, ifMatch)
+		}
+
+		request, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("/user/%d", testUser.ID), nil)
+		require.NoError(t, err)
+		request.Header.Set("If-Match", etag)
+		request = withCaller(request, testUser.ID+1, model.PermissionUsersDelete)
+		response = serve(t, backend, "/user/{id:[0-9]+}", tc.controller.DeleteUser, request)
+		require.Equal(t, http.StatusPreconditionFailed, response.Code)
+
+		response = get(etag)
+		require.Equal(t, http.StatusOK, response.Code)
+		var user model.User
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&user))
+		require.Equal(t, "first", user.FirstName)
+		require.Equal(t, 2, user.Version)
+
+		response = patchFirstName("*", "second")
+		require.Equal(t, http.StatusOK, response.Code)
+	})
+}
+
+func TestLogin(t *testing.T) {
+	t.Parallel()
+
+	tc := setupTestCaseWithUser(t)
+
+	keys := auth.NewKeySet()
+	_, err := keys.Rotate()
+	require.NoError(t, err)
+	tokens := auth.New(keys, tc.repository, auth.Config{}, testLogger)
+	authController := NewAuthController(tc.service, tokens, testLogger)
+
+	// Create a new HTTP POST request to log in
+	requestBody, err := json.Marshal(map[string]string{"login": testUser.Email, "password": testUser.Password})
 	require.NoError(t, err)
-	request, err := http.NewRequest(http.MethodPost, fmt.Sprintf("/user/%d", testUser.ID), bytes.NewBuffer(requestBody))
+	request, err := http.NewRequest(http.MethodPost, "/auth/login", bytes.NewBuffer(requestBody))
 	require.NoError(t, err)
-	vars := map[string]string{
-		"id": strconv.Itoa(testUser.ID),
+
+	response := httptest.NewRecorder()
+	http.HandlerFunc(authController.Login).ServeHTTP(response, request)
+	require.Equal(t, http.StatusOK, response.Code)
+
+	var pair auth.TokenPair
+	err = json.NewDecoder(io.Reader(response.Body)).Decode(&pair)
+	require.NoError(t, err)
+	claims, err := tokens.Verify(pair.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, strconv.Itoa(testUser.ID), claims.Subject)
+
+	// the plain text password stored by the test setup has been upgraded to a hash
+	stored, err := tc.repository.Get(context.Background(), testUser.ID)
+	require.NoError(t, err)
+	require.True(t, password.IsHash(stored.Password))
+
+	// emails and nicknames are case-insensitive
+	for _, login := range []string{strings.ToUpper(testUser.Email), strings.ToUpper(testUser.Nickname)} {
+		requestBody, err = json.Marshal(map[string]string{"login": login, "password": testUser.Password})
+		require.NoError(t, err)
+		request, err = http.NewRequest(http.MethodPost, "/auth/login", bytes.NewBuffer(requestBody))
+		require.NoError(t, err)
+
+		response = httptest.NewRecorder()
+		http.HandlerFunc(authController.Login).ServeHTTP(response, request)
+		require.Equal(t, http.StatusOK, response.Code, login)
 	}
-	request = mux.SetURLVars(request, vars)
 
-	// Assign HTTP Handle function (controller AddUser function)
-	handler := http.HandlerFunc(testUserController.UpdateUser)
+	// wrong credentials are refused
+	requestBody, err = json.Marshal(map[string]string{"login": testUser.Email, "password": "wrong"})
+	require.NoError(t, err)
+	request, err = http.NewRequest(http.MethodPost, "/auth/login", bytes.NewBuffer(requestBody))
+	require.NoError(t, err)
 
-	// Record HTTP Response (httptest library)
-	response := httptest.NewRecorder()
+	response = httptest.NewRecorder()
+	http.HandlerFunc(authController.Login).ServeHTTP(response, request)
+	require.Equal(t, http.StatusUnauthorized, response.Code)
+}
 
-	// Dispatch the HTTP request
-	handler.ServeHTTP(response, request)
+func TestAuthInvalidBodyKO(t *testing.T) {
+	t.Parallel()
 
-	// Add assertions on the HTTP status code and the response
-	status := response.Code
-	require.Equal(t, http.StatusOK, status)
+	tc := setupTestCaseWithUser(t)
 
-	// Decode HTTP response
-	var user model.User
-	err = json.NewDecoder(io.Reader(response.Body)).Decode(&user)
+	keys := auth.NewKeySet()
+	_, err := keys.Rotate()
 	require.NoError(t, err)
-	require.NotNil(t, user)
-	require.Equal(t, "updated first name", user.FirstName)
-	require.Equal(t, testUser.LastName, user.LastName)
-	require.Equal(t, testUser.Nickname, user.Nickname)
-	require.Equal(t, testUser.Password, user.Password)
-	require.Equal(t, testUser.Email, user.Email)
-	require.Equal(t, testUser.Country, user.Country)
+	tokens := auth.New(keys, tc.repository, auth.Config{}, testLogger)
+	authController := NewAuthController(tc.service, tokens, testLogger)
+
+	tests := []struct {
+		body     string
+		status   int
+		code     string
+		endpoint http.HandlerFunc
+	}{
+		{fmt.Sprintf(`{"login": %q, "password": %q, "unknown": 1}`, testUser.Email, testUser.Password),
+			http.StatusBadRequest, errs.CodeInvalidBody, authController.Login},
+		{`{"refresh_token": "x"} {"refresh_token": "y"}`, http.StatusBadRequest, errs.CodeInvalidBody, authController.Refresh},
+		{"", http.StatusBadRequest, errs.CodeEmptyBody, authController.Logout},
+		{fmt.Sprintf(`{"login": %q}`, strings.Repeat("a", maxBodySize)), http.StatusRequestEntityTooLarge,
+			errs.CodeBodyTooLarge, authController.Login},
+	}
+	for i, test := range tests {
+		request, err := http.NewRequest(http.MethodPost, "/auth", strings.NewReader(test.body))
+		require.NoError(t, err)
+
+		response := httptest.NewRecorder()
+		test.endpoint.ServeHTTP(response, request)
+		require.Equal(t, test.status, response.Code, i)
+
+		var problem errs.Problem
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&problem))
+		require.Equal(t, test.code, problem.Code, i)
+	}
+}
+
+// TestNoCredentialLeak goes through every response path as the user, checking that neither
+// the password nor its hash is ever in the response
+func TestNoCredentialLeak(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCase(t)
+
+		const secret = "s3cr3t-Pa55word"
+		user, err := tc.service.Add(context.Background(), &model.User{FirstName: "a", LastName: "b",
+			Nickname: "c", Password: secret, Email: "c@b.com", Country: "Y"})
+		require.NoError(t, err)
+		stored, err := tc.repository.Get(context.Background(), user.ID)
+		require.NoError(t, err)
+
+		newUser := func(nickname string) string {
+			return fmt.Sprintf(`{"first_name": "d", "last_name": "e", "nickname": %q, "password": %q, 
+				"email": "%s@b.com", "country": "IT"}`, nickname, secret, nickname)
+		}
+		userPath := fmt.Sprintf("/user/%d", user.ID)
+		rolePath := fmt.Sprintf("/user/%d/roles/%s", user.ID, model.RoleAdmin)
+		tests := []struct {
+			method, pattern, path, contentType, body string
+			handler                                  http.HandlerFunc
+		}{
+			{http.MethodPost, "/user", "/user", "", newUser("user-f"), tc.controller.AddUser},
+			{http.MethodGet, "/user/{id:[0-9]+}", userPath, "", "", tc.controller.GetUser},
+			{http.MethodGet, "/users", "/users", "", "", tc.controller.GetAllUsers},
+			{http.MethodGet, "/users/{page-size:[0-9]+}/{page:[0-9]+}", "/users/10/1?envelope=true", "", "",
+				tc.controller.GetAllUsers},
+			{http.MethodGet, "/users", "/users?limit=10", "", "", tc.controller.GetAllUsers},
+			{http.MethodPut, "/user/{id:[0-9]+}", userPath, "", newUser("user-g"), tc.controller.ReplaceUser},
+			{http.MethodPatch, "/user/{id:[0-9]+}", userPath, patch.MediaTypeMergePatch,
+				fmt.Sprintf(`{"password": %q}`, secret), tc.controller.PatchUser},
+			{http.MethodPatch, "/user/{id:[0-9]+}", userPath, patch.MediaTypeJSONPatch,
+				fmt.Sprintf(`[{"op": "replace", "path": "/password", "value": %q}]`, secret), tc.controller.PatchUser},
+			{http.MethodPost, "/user/{id:[0-9]+}/roles/{role}", rolePath, "", "", tc.controller.GrantRole},
+			{http.MethodDelete, "/user/{id:[0-9]+}/roles/{role}", rolePath, "", "", tc.controller.RevokeRole},
+		}
+
+		for _, test := range tests {
+			request, err := http.NewRequest(test.method, test.path, bytes.NewBufferString(test.body))
+			require.NoError(t, err)
+			if test.contentType != "" {
+				request.Header.Set("Content-Type", test.contentType)
+			}
+			request = withCaller(request, user.ID, model.PermissionUsersRead, model.PermissionUsersWrite,
+				model.PermissionRolesWrite)
+
+			response := serve(t, backend, test.pattern, test.handler, request)
+			require.Equal(t, http.StatusOK, response.Code, "%v %v: %v", test.method, test.path, response.Body)
+
+			body := response.Body.String()
+			require.NotContains(t, body, `"password"`, "%v %v", test.method, test.path)
+			require.NotContains(t, body, secret, "%v %v", test.method, test.path)
+			require.NotContains(t, body, stored.Password, "%v %v", test.method, test.path)
+		}
+	})
+}
+
+func TestAddUserReadOnlyFieldsIgnored(t *testing.T) {
+	t.Parallel()
+	forEachRouter(t, func(t *testing.T, backend string) {
+		tc := setupTestCaseWithUser(t)
+
+		body := `{"id": 42, "first_name": "d", "last_name": "e", "nickname": "user-f", "password": "Passw0rd", 
+			"email": "f@b.com", "country": "IT", "roles": [{"name": "admin"}], 
+			"created_at": "2000-01-01T00:00:00Z", "updated_at": "2000-01-01T00:00:00Z"}`
+		request, err := http.NewRequest(http.MethodPost, "/user", bytes.NewBufferString(body))
+		require.NoError(t, err)
+
+		response := serve(t, backend, "/user", tc.controller.AddUser, request)
+		require.Equal(t, http.StatusOK, response.Code)
+
+		var user model.User
+		require.NoError(t, json.NewDecoder(response.Body).Decode(&user))
+		require.NotEqual(t, 42, user.ID)
+		require.Equal(t, []string{model.RoleUser}, user.RoleNames())
+		require.True(t, user.CreatedAt.After(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)))
+	})
 }
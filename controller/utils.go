@@ -2,36 +2,293 @@ package controller
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
 
+	"github.com/pavelerokhin/user-microservice-go/auth"
 	"github.com/pavelerokhin/user-microservice-go/errs"
 	"github.com/pavelerokhin/user-microservice-go/model"
+	"github.com/pavelerokhin/user-microservice-go/patch"
+	"github.com/pavelerokhin/user-microservice-go/router"
 )
 
 const (
+	// acceptPatch lists the media types of the patches of the users (RFC 5789)
+	acceptPatch = patch.MediaTypeMergePatch + ", " + patch.MediaTypeJSONPatch
+	// maxBodySize is the maximum size of the request bodies
+	maxBodySize = 1 << 20
+	// sortParam is the query parameter of the listings with the comma-separated fields to sort by
+	sortParam = "sort"
+	// cursorParam and limitParam are the query parameters of the listings paginated by cursors: the
+	// token of the cursor to list from and the maximum number of users of the page
+	cursorParam = "cursor"
+	limitParam  = "limit"
+	// envelopeParam is the query parameter of the listings paginated by page which asks for the users
+	// wrapped in an envelope with the pagination details, rather than for a bare list
+	envelopeParam = "envelope"
+	// includeDeletedParam is the query parameter which asks for the deleted users as well, e.g.
+	// include_deleted=true
+	includeDeletedParam = "include_deleted"
+	// defaultLimit and maxLimit bound the pages of the listings paginated by cursors
+	defaultLimit = 20
+	maxLimit     = 100
+
 	errMsgEncodeOK = "error while encoding the response from the server (the user request has been processed)"
 	errMsgEncodeKO = "error while encoding the response from the server (the user request hasn't been processed)"
 )
 
+// errEmptyBody is returned by decodeRequestBody for the requests without a body, which some requests
+// are allowed to be
+var errEmptyBody = &errs.Error{Kind: errs.KindInvalid, Code: errs.CodeEmptyBody, Message: "Request body must not be empty"}
+
+// statusCodeOf returns the status code of the response to a request failed with the error, by the
+// kind of its domain error (see errs)
+func statusCodeOf(err error) int {
+	switch errs.KindOf(err) {
+	case errs.KindInvalid:
+		return http.StatusBadRequest
+	case errs.KindUnauthorized:
+		return http.StatusUnauthorized
+	case errs.KindForbidden:
+		return http.StatusForbidden
+	case errs.KindNotFound:
+		return http.StatusNotFound
+	case errs.KindMethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	case errs.KindConflict:
+		return http.StatusConflict
+	case errs.KindPreconditionFailed:
+		return http.StatusPreconditionFailed
+	case errs.KindTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case errs.KindUnsupported:
+		return http.StatusUnsupportedMediaType
+	case errs.KindValidation:
+		return http.StatusUnprocessableEntity
+	case errs.KindCanceled:
+		return errs.StatusClientClosedRequest
+	case errs.KindTimeout:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// getIDFromRequestVars parses the ID of the user in the path of the request
+func getIDFromRequestVars(request *http.Request) (int, error) {
+	id, err := strconv.Atoi(router.Param(request, "id"))
+	if err != nil {
+		return 0, errs.Invalid(errs.CodeInvalidID, "error while parsing user's ID: %v", err)
+	}
+
+	return id, nil
+}
+
+// getPageFromRequestVars parses the page in the path of the request, if any
+func getPageFromRequestVars(request *http.Request) (model.Page, error) {
+	if router.Param(request, "page-size") == "" {
+		return model.Page{}, nil
+	}
+
+	pageSize, err := strconv.Atoi(router.Param(request, "page-size"))
+	if err != nil {
+		return model.Page{}, errs.Invalid(errs.CodeInvalidPage, "cannot get pagination limit: %v", err)
+	}
+
+	page, err := strconv.Atoi(router.Param(request, "page"))
+	if err != nil {
+		return model.Page{}, errs.Invalid(errs.CodeInvalidPage, "cannot get page: %v", err)
+	}
+
+	return model.Page{Size: pageSize, Number: page}, nil
+}
+
+// getFilterFromRequestQuery parses the filter in the query string of the request, if any. Conditions
+// are expressed as field=value or field[operator]=value, the values of the in operator being
+// comma-separated, and the sort keys as sort=field,-field (- for descending order)
+func getFilterFromRequestQuery(request *http.Request) (*model.Filter, error) {
+	query := request.URL.Query()
+	if len(query) == 0 {
+		return nil, nil
+	}
+
+	filter := &model.Filter{}
+	for key, values := range query {
+		if key == cursorParam || key == limitParam || key == envelopeParam {
+			continue
+		}
+
+		if key == includeDeletedParam {
+			includeDeleted, err := getIncludeDeletedFromRequestQuery(request)
+			if err != nil {
+				return nil, err
+			}
+			filter.IncludeDeleted = includeDeleted
+			continue
+		}
+
+		if key == sortParam {
+			for _, value := range values {
+				keys, err := model.ParseSort(value)
+				if err != nil {
+					return nil, err
+				}
+				filter.Sort = append(filter.Sort, keys...)
+			}
+			continue
+		}
+
+		field, op := key, model.OpEq
+		if i := strings.Index(key, "["); i >= 0 {
+			if !strings.HasSuffix(key, "]") {
+				return nil, fmt.Errorf("%w: malformed query parameter %q", model.ErrInvalidFilter, key)
+			}
+			field, op = key[:i], key[i+1:len(key)-1]
+		}
+
+		for _, value := range values {
+			operands := []string{value}
+			if op == model.OpIn {
+				operands = strings.Split(value, ",")
+			}
+
+			condition, err := model.NewCondition(field, op, operands...)
+			if err != nil {
+				return nil, err
+			}
+			filter.Conditions = append(filter.Conditions, condition)
+		}
+	}
+
+	return filter, nil
+}
+
+// getIncludeDeletedFromRequestQuery parses the query parameter asking for the deleted users as well
+func getIncludeDeletedFromRequestQuery(request *http.Request) (bool, error) {
+	value := request.URL.Query().Get(includeDeletedParam)
+	if value == "" {
+		return false, nil
+	}
+
+	includeDeleted, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v must be true or false", model.ErrInvalidFilter, includeDeletedParam)
+	}
+
+	return includeDeleted, nil
+}
+
+// etagOf returns the entity tag of the representation of the user: a strong one, its version
+func etagOf(user *model.User) string {
+	return `"` + strconv.Itoa(user.Version) + `"`
+}
+
+// isNotModified reports whether the If-None-Match header of the request matches the entity tag by the
+// weak comparison (RFC 7232): the representation the client has is still the current one
+func isNotModified(request *http.Request, etag string) bool {
+	header := request.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getVersionFromRequestHeader returns the version of the user the write is conditional on, from the
+// If-Match header of the request, or 0 for the unconditional writes, without the header or with *.
+// The comparison is strong, and the write can be conditional on one version only: the weak tags and
+// the lists of tags match no version
+func getVersionFromRequestHeader(request *http.Request) (int, error) {
+	header := strings.TrimSpace(request.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return 0, nil
+	}
+
+	if len(header) > 2 && strings.HasPrefix(header, `"`) && strings.HasSuffix(header, `"`) {
+		version, err := strconv.Atoi(header[1 : len(header)-1])
+		if err == nil && version > 0 {
+			return version, nil
+		}
+	}
+
+	return 0, errs.PreconditionFailed(errs.CodeVersionMismatch, "the If-Match header %v matches no version of the user", header)
+}
+
+// isCursorPagination reports whether the listing is paginated by cursors, rather than by page
+func isCursorPagination(request *http.Request) bool {
+	query := request.URL.Query()
+	_, cursor := query[cursorParam]
+	_, limit := query[limitParam]
+
+	return cursor || limit
+}
+
+// getLimitFromRequestQuery parses the limit of the listings paginated by cursors
+func getLimitFromRequestQuery(request *http.Request) (int, error) {
+	value := request.URL.Query().Get(limitParam)
+	if value == "" {
+		return defaultLimit, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > maxLimit {
+		return 0, errs.Invalid(errs.CodeInvalidPage, "the limit must be a number between 1 and %v", maxLimit)
+	}
+
+	return limit, nil
+}
+
+// filterOfUser returns the filter of the users equal to the non-zero fields of the user, as in the
+// deprecated filtering by request body
+func filterOfUser(user *model.User) (*model.Filter, error) {
+	if user.Password != "" {
+		return nil, fmt.Errorf("%w: cannot filter by field %q", model.ErrInvalidFilter, "password")
+	}
+
+	filter := &model.Filter{}
+	for _, field := range []string{"id", "first_name", "last_name", "nickname", "email", "country", "created_at", "updated_at"} {
+		value := user.Field(field)
+		if !reflect.ValueOf(value).IsZero() {
+			filter.Conditions = append(filter.Conditions,
+				model.Condition{Field: field, Op: model.OpEq, Values: []interface{}{value}})
+		}
+	}
+
+	return filter, nil
+}
+
 func writeResponseJSON(response http.ResponseWriter, msg string) error {
 	return json.NewEncoder(response).Encode(errs.ResponseError{Message: msg})
 }
 
-// tryToResponseJSONError is a utility function that tries to write a response (error) message formatted
-// as an JSON to the client. In case it couldn't write the message, it tries to return a standard errMsgEncodeKO
-// message to the client. statusCode of the response can be specified. In case statusCode is 0,
-// the response is considered to be http.StatusInternalServerError (500)
-func tryToResponseJSONError(response http.ResponseWriter, logger *log.Logger, statusCode int, msg string) {
-	logger.Println(msg)
-	if statusCode == 0 {
-		response.WriteHeader(http.StatusInternalServerError)
-	} else {
-		response.WriteHeader(statusCode)
+// tryToResponseError is a utility function that tries to write the error to the client, as a problem
+// (RFC 7807) or in the legacy format, depending on the Accept header of the request (see
+// errs.WriteError). The status code of the response is the one of the kind of the domain error (see
+// errs), 500 for any other error. The details of the internal errors are logged only. In case it
+// couldn't write the error, it tries to return a standard errMsgEncodeKO message to the client
+func tryToResponseError(response http.ResponseWriter, request *http.Request, logger *log.Logger, err error) {
+	// the drivers don't always wrap the error of the context which has stopped them
+	if ctxErr := request.Context().Err(); ctxErr != nil && errs.KindOf(err) == errs.KindInternal {
+		err = fmt.Errorf("%w: %v", errs.FromContext(ctxErr), err)
 	}
+	logger.Println(err)
 
-	err := writeResponseJSON(response, msg)
-	if err != nil {
+	errWrite := errs.WriteError(response, request, statusCodeOf(err), err)
+	if errWrite != nil {
 		logger.Println(errMsgEncodeKO)
 		_ = writeResponseJSON(response, errMsgEncodeKO)
 		return
@@ -54,8 +311,13 @@ func tryToResponseMsgOK(response http.ResponseWriter, logger *log.Logger, msg st
 
 // tryToResponseUserOK duplicates tryToResponseMsgOK; it marshals the User object in the response
 func tryToResponseUserOK(response http.ResponseWriter, logger *log.Logger, msg *model.User) {
-	logger.Println(msg)
-	err := json.NewEncoder(response).Encode(msg)
+	user := newUserResponse(msg)
+	if msg != nil {
+		response.Header().Set("ETag", etagOf(msg))
+	}
+
+	logger.Println(user)
+	err := json.NewEncoder(response).Encode(user)
 	if err != nil {
 		logger.Println(errMsgEncodeOK)
 		response.WriteHeader(http.StatusInternalServerError)
@@ -67,8 +329,10 @@ func tryToResponseUserOK(response http.ResponseWriter, logger *log.Logger, msg *
 
 // tryToResponseUserOK duplicates tryToResponseMsgOK; it marshals the slice of User objects in the response
 func tryToResponseUsersOK(response http.ResponseWriter, logger *log.Logger, msg []model.User) {
-	logger.Println(msg)
-	err := json.NewEncoder(response).Encode(msg)
+	users := newUsersResponse(msg)
+
+	logger.Println(users)
+	err := json.NewEncoder(response).Encode(users)
 	if err != nil {
 		logger.Println(errMsgEncodeOK)
 		response.WriteHeader(http.StatusInternalServerError)
@@ -77,3 +341,224 @@ func tryToResponseUsersOK(response http.ResponseWriter, logger *log.Logger, msg
 	}
 	response.WriteHeader(http.StatusOK)
 }
+
+// usersPage is the envelope of the listings paginated by page
+type usersPage struct {
+	Items      []userResponse `json:"items"`
+	TotalCount int            `json:"total_count"`
+	Page       int            `json:"page"`
+	PageSize   int            `json:"page_size"`
+	TotalPages int            `json:"total_pages"`
+}
+
+// newUsersPage returns the envelope of the page of the users, out of total users. The whole list is
+// the only page, as long as the list
+func newUsersPage(users []model.User, total int, page model.Page) usersPage {
+	items := newUsersResponse(users)
+	if page.IsZero() {
+		return usersPage{Items: items, TotalCount: total, Page: 1, PageSize: total, TotalPages: 1}
+	}
+
+	totalPages := (total + page.Size - 1) / page.Size
+	return usersPage{Items: items, TotalCount: total, Page: page.Number, PageSize: page.Size, TotalPages: totalPages}
+}
+
+// cursorPage is the response of the listings paginated by cursors
+type cursorPage struct {
+	Items      []userResponse `json:"items"`
+	TotalCount int            `json:"total_count"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+	PrevCursor string         `json:"prev_cursor,omitempty"`
+}
+
+// wantsEnvelope reports whether the users of the listing are to be wrapped in an envelope
+func wantsEnvelope(request *http.Request) bool {
+	envelope, _ := strconv.ParseBool(request.URL.Query().Get(envelopeParam))
+	return envelope
+}
+
+// pageLinks returns the Link header (RFC 8288) of the page: the first, previous, next and last pages,
+// in the path of the request with its query string
+func pageLinks(request *http.Request, page usersPage) string {
+	base := strings.TrimSuffix(request.URL.Path, "/"+router.Param(request, "page-size")+"/"+router.Param(request, "page"))
+	link := func(number int, rel string) string {
+		u := url.URL{Path: fmt.Sprintf("%s/%d/%d", base, page.PageSize, number), RawQuery: request.URL.RawQuery}
+		return fmt.Sprintf(`<%s>; rel="%s"`, u.String(), rel)
+	}
+
+	last := page.TotalPages
+	if last < 1 {
+		last = 1
+	}
+
+	links := []string{link(1, "first")}
+	if page.Page > 1 {
+		links = append(links, link(min(page.Page-1, last), "prev"))
+	}
+	if page.Page < last {
+		links = append(links, link(page.Page+1, "next"))
+	}
+	links = append(links, link(last, "last"))
+
+	return strings.Join(links, ", ")
+}
+
+// cursorLinks returns the Link header (RFC 8288) of the page of a listing paginated by cursors: the
+// first, previous and next pages
+func cursorLinks(request *http.Request, page cursorPage) string {
+	link := func(token, rel string) string {
+		query := request.URL.Query()
+		query.Del(cursorParam)
+		if token != "" {
+			query.Set(cursorParam, token)
+		}
+		u := url.URL{Path: request.URL.Path, RawQuery: query.Encode()}
+		return fmt.Sprintf(`<%s>; rel="%s"`, u.String(), rel)
+	}
+
+	links := []string{link("", "first")}
+	if page.PrevCursor != "" {
+		links = append(links, link(page.PrevCursor, "prev"))
+	}
+	if page.NextCursor != "" {
+		links = append(links, link(page.NextCursor, "next"))
+	}
+
+	return strings.Join(links, ", ")
+}
+
+// tryToResponseUsersPageOK duplicates tryToResponseMsgOK; it marshals the envelope of the page of users
+// in the response
+func tryToResponseUsersPageOK(response http.ResponseWriter, logger *log.Logger, page usersPage) {
+	logger.Println(page.Items)
+	err := json.NewEncoder(response).Encode(page)
+	if err != nil {
+		logger.Println(errMsgEncodeOK)
+		response.WriteHeader(http.StatusInternalServerError)
+		_ = writeResponseJSON(response, errMsgEncodeOK)
+		return
+	}
+	response.WriteHeader(http.StatusOK)
+}
+
+// tryToResponseCursorPageOK duplicates tryToResponseMsgOK; it marshals the page of users with the
+// tokens of its cursors in the response
+func tryToResponseCursorPageOK(response http.ResponseWriter, logger *log.Logger, page cursorPage) {
+	logger.Println(page.Items)
+	err := json.NewEncoder(response).Encode(page)
+	if err != nil {
+		logger.Println(errMsgEncodeOK)
+		response.WriteHeader(http.StatusInternalServerError)
+		_ = writeResponseJSON(response, errMsgEncodeOK)
+		return
+	}
+	response.WriteHeader(http.StatusOK)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// tryToResponseTokensOK duplicates tryToResponseMsgOK; it marshals the token pair in the response.
+// Tokens are credentials, so they are not logged
+func tryToResponseTokensOK(response http.ResponseWriter, logger *log.Logger, tokens *auth.TokenPair) {
+	logger.Println("tokens have been issued successfully")
+	err := json.NewEncoder(response).Encode(tokens)
+	if err != nil {
+		logger.Println(errMsgEncodeOK)
+		response.WriteHeader(http.StatusInternalServerError)
+		_ = writeResponseJSON(response, errMsgEncodeOK)
+		return
+	}
+	response.WriteHeader(http.StatusOK)
+}
+
+// unmarshalUserFromRequest decodes the user in the body of the request
+func unmarshalUserFromRequest(w http.ResponseWriter, r *http.Request) (*model.User, error) {
+	var user userRequest
+	err := decodeRequestBody(w, r, &user)
+	if err != nil {
+		return nil, err
+	}
+
+	return user.toModel(), nil
+}
+
+// decodeRequestBody decodes the JSON object in the body of the request into v. The body is limited to
+// maxBodySize
+func decodeRequestBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	// This will cause Decode() to return a "json: unknown field ..." error
+	// if it encounters any extra unexpected fields in the JSON. Strictly
+	// speaking, it returns an error for "keys which do not match any
+	// non-ignored, exported fields in the destination".
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(v)
+	if err != nil {
+		var syntaxError *json.SyntaxError
+		var unmarshalTypeError *json.UnmarshalTypeError
+
+		switch {
+		// Catch any syntax errs in the JSON and send an error message
+		// which interpolates the location of the problem to make it
+		// easier for the client to fix.
+		case errors.As(err, &syntaxError):
+			return errs.Invalid(errs.CodeInvalidBody, "Request body contains badly-formed JSON (at position %d)", syntaxError.Offset)
+
+		// In some circumstances Decode() may also return an
+		// io.ErrUnexpectedEOF error for syntax errs in the JSON. There
+		// is an open issue regarding this at
+		// https://github.com/golang/go/issues/25956.
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			return errs.Invalid(errs.CodeInvalidBody, "Request body contains badly-formed JSON")
+
+		// Catch any type errs, like trying to assign a string in the
+		// JSON request body to an int field in our Person struct. We can
+		// interpolate the relevant field name and position into the error
+		// message to make it easier for the client to fix.
+		case errors.As(err, &unmarshalTypeError):
+			return errs.Invalid(errs.CodeInvalidBody, "Request body contains an invalid value for the %q field (at position %d)", unmarshalTypeError.Field, unmarshalTypeError.Offset)
+
+		// Catch the error caused by extra unexpected fields in the request
+		// body. We extract the field name from the error message and
+		// interpolate it in our custom error message. There is an open
+		// issue at https://github.com/golang/go/issues/29035 regarding
+		// turning this into a sentinel error.
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
+			return errs.Invalid(errs.CodeInvalidBody, "Request body contains unknown field %s", fieldName)
+
+		// An io.EOF error is returned by Decode() if the request body is
+		// empty.
+		case errors.Is(err, io.EOF):
+			return errEmptyBody
+
+		// Catch the error caused by the request body being too large. Again
+		// there is an open issue regarding turning this into a sentinel
+		// error at https://github.com/golang/go/issues/30715.
+		case err.Error() == "http: request body too large":
+			return errs.New(errs.KindTooLarge, errs.CodeBodyTooLarge, "Request body must not be larger than 1MB")
+
+		// Otherwise, default to logging the error and sending a 500 Internal
+		// Server Error response.
+		default:
+			return errors.New("Internal server error")
+		}
+	}
+
+	// Call decode again, using a pointer to an empty anonymous struct as
+	// the destination. If the request body only contained a single JSON
+	// object this will return an io.EOF error. So if we get anything else,
+	// we know that there is additional data in the request body.
+	err = dec.Decode(&struct{}{})
+	if err != io.EOF {
+		return errs.Invalid(errs.CodeInvalidBody, "Request body must only contain a single JSON object")
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+// pkg encodes the cursors of the listings as opaque tokens, signed so that clients can neither forge
+// them nor depend on their content
+
+package cursor
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pavelerokhin/user-microservice-go/model"
+)
+
+// KeySize is the minimum size of the signing keys
+const KeySize = 32
+
+var ErrInvalid = errors.New("invalid cursor")
+
+// payload is the signed content of the tokens; values are formatted with model.FormatValue
+type payload struct {
+	Sort     string   `json:"s,omitempty"`
+	Values   []string `json:"v,omitempty"`
+	ID       int      `json:"id"`
+	Backward bool     `json:"b,omitempty"`
+}
+
+// Codec encodes the cursors as tokens signed with HMAC-SHA256, and decodes the tokens it has signed
+type Codec struct {
+	key []byte
+}
+
+func New(key []byte) (*Codec, error) {
+	if len(key) < KeySize {
+		return nil, fmt.Errorf("the cursor signing key must be at least %v bytes long", KeySize)
+	}
+
+	return &Codec{key: key}, nil
+}
+
+// NewEphemeral returns a codec with a random key: its tokens don't survive a restart and cannot be
+// decoded by other replicas
+func NewEphemeral() (*Codec, error) {
+	key := make([]byte, KeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(key)
+}
+
+// Encode returns the token of the cursor
+func (c *Codec) Encode(cursor *model.Cursor) (string, error) {
+	p := payload{Sort: model.FormatSort(cursor.Sort), ID: cursor.ID, Backward: cursor.Backward}
+	for _, v := range cursor.Values {
+		p.Values = append(p.Values, model.FormatValue(v))
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(data)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(c.sign(encoded)), nil
+}
+
+// Decode verifies the token and returns its cursor
+func (c *Codec) Decode(token string) (*model.Cursor, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalid
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, c.sign(parts[0])) {
+		return nil, ErrInvalid
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalid
+	}
+
+	var p payload
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		return nil, ErrInvalid
+	}
+
+	cursor := &model.Cursor{ID: p.ID, Backward: p.Backward}
+	if p.Sort != "" {
+		cursor.Sort, err = model.ParseSort(p.Sort)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+	}
+
+	if len(p.Values) != len(cursor.Sort) {
+		return nil, ErrInvalid
+	}
+	for i, v := range p.Values {
+		value, err := model.ParseValue(cursor.Sort[i].Field, v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		cursor.Values = append(cursor.Values, value)
+	}
+
+	return cursor, nil
+}
+
+func (c *Codec) sign(data string) []byte {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
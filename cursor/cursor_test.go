@@ -0,0 +1,68 @@
+package cursor
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pavelerokhin/user-microservice-go/model"
+)
+
+func newTestCodec(t *testing.T) *Codec {
+	c, err := NewEphemeral()
+	require.NoError(t, err)
+	return c
+}
+
+func TestEncodeDecodeOK(t *testing.T) {
+	c := newTestCodec(t)
+	createdAt := time.Date(2022, 4, 1, 10, 30, 0, 123456789, time.UTC)
+	cursor := &model.Cursor{
+		Sort:     []model.SortKey{{Field: "created_at", Desc: true}, {Field: "last_name"}},
+		Values:   []interface{}{createdAt, "Smith"},
+		ID:       42,
+		Backward: true,
+	}
+
+	token, err := c.Encode(cursor)
+	require.NoError(t, err)
+
+	decoded, err := c.Decode(token)
+	require.NoError(t, err)
+	require.Equal(t, cursor.Sort, decoded.Sort)
+	require.Equal(t, 42, decoded.ID)
+	require.True(t, decoded.Backward)
+	require.True(t, createdAt.Equal(decoded.Values[0].(time.Time)))
+	require.Equal(t, "Smith", decoded.Values[1])
+}
+
+func TestDecodeTamperedKO(t *testing.T) {
+	c := newTestCodec(t)
+	token, err := c.Encode(&model.Cursor{ID: 1})
+	require.NoError(t, err)
+
+	forged, err := c.Encode(&model.Cursor{ID: 2})
+	require.NoError(t, err)
+	// the content of a token with the signature of another one
+	tampered := strings.Split(forged, ".")[0] + "." + strings.Split(token, ".")[1]
+
+	for _, token := range []string{"", "abc", tampered, token + "x"} {
+		_, err = c.Decode(token)
+		require.ErrorIs(t, err, ErrInvalid)
+	}
+}
+
+func TestDecodeOtherKeyKO(t *testing.T) {
+	token, err := newTestCodec(t).Encode(&model.Cursor{ID: 1})
+	require.NoError(t, err)
+
+	_, err = newTestCodec(t).Decode(token)
+	require.ErrorIs(t, err, ErrInvalid)
+}
+
+func TestNewShortKeyKO(t *testing.T) {
+	_, err := New([]byte("short"))
+	require.Error(t, err)
+}
@@ -0,0 +1,33 @@
+package errs
+
+// Codes of the domain errors: they are part of the API, so they never change
+const (
+	CodeAuthenticationRequired = "authentication_required"
+	CodeBodyTooLarge           = "body_too_large"
+	CodeEmailTaken             = "email_taken"
+	CodeEmptyBody              = "empty_body"
+	CodeInvalidBody            = "invalid_body"
+	CodeInvalidCredentials     = "invalid_credentials"
+	CodeInvalidCursor          = "invalid_cursor"
+	CodeInvalidFilter          = "invalid_filter"
+	CodeInvalidID              = "invalid_id"
+	CodeInvalidPage            = "invalid_page"
+	CodeInvalidPatch           = "invalid_patch"
+	CodeInvalidToken           = "invalid_token"
+	CodeInvalidUser            = "invalid_user"
+	CodeMethodNotAllowed       = "method_not_allowed"
+	CodeNicknameTaken          = "nickname_taken"
+	CodePatchTestFailed        = "patch_test_failed"
+	CodePermissionDenied       = "permission_denied"
+	CodeReadOnlyField          = "read_only_field"
+	CodeRefreshTokenExists     = "refresh_token_exists"
+	CodeRefreshTokenNotFound   = "refresh_token_not_found"
+	CodeRefreshTokenRevoked    = "refresh_token_revoked"
+	CodeRequestCanceled        = "request_canceled"
+	CodeRequestTimeout         = "request_timeout"
+	CodeRoleNotFound           = "role_not_found"
+	CodeUnsupportedMediaType   = "unsupported_media_type"
+	CodeUserExists             = "user_exists"
+	CodeUserNotFound           = "user_not_found"
+	CodeVersionMismatch        = "version_mismatch"
+)
@@ -0,0 +1,224 @@
+// pkg defines the errors of the microservice: the domain errors returned by the repository and the
+// service layers, and their representation in the responses
+
+package errs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Kind classifies the domain errors independently of the transport; the controller maps each kind to
+// a status code
+type Kind string
+
+const (
+	KindInternal           Kind = "internal"
+	KindInvalid            Kind = "invalid_argument"
+	KindUnauthorized       Kind = "unauthorized"
+	KindForbidden          Kind = "forbidden"
+	KindNotFound           Kind = "not_found"
+	KindMethodNotAllowed   Kind = "method_not_allowed"
+	KindConflict           Kind = "conflict"
+	KindPreconditionFailed Kind = "precondition_failed"
+	KindTooLarge           Kind = "too_large"
+	KindUnsupported        Kind = "unsupported"
+	KindValidation         Kind = "validation_failed"
+	// KindCanceled and KindTimeout are the kinds of the requests stopped by their context: canceled,
+	// e.g. by the client going away, or past their deadline
+	KindCanceled Kind = "canceled"
+	KindTimeout  Kind = "timeout"
+)
+
+// Error is a domain error. Its code is stable and machine-readable, and more specific than the kind,
+// e.g. user_not_found or role_not_found. The validation errors list the invalid fields in Params
+type Error struct {
+	Kind    Kind
+	Code    string
+	Message string
+	Params  []InvalidParam
+	Err     error
+}
+
+// InvalidParam is an invalid field of a request, and the reason why it is invalid
+type InvalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// sentinels of the kinds: errors.Is(err, ErrNotFound) reports whether err is a not found error
+var (
+	ErrInternal           = &Error{Kind: KindInternal}
+	ErrInvalid            = &Error{Kind: KindInvalid}
+	ErrUnauthorized       = &Error{Kind: KindUnauthorized}
+	ErrForbidden          = &Error{Kind: KindForbidden}
+	ErrNotFound           = &Error{Kind: KindNotFound}
+	ErrConflict           = &Error{Kind: KindConflict}
+	ErrPreconditionFailed = &Error{Kind: KindPreconditionFailed}
+	ErrTooLarge           = &Error{Kind: KindTooLarge}
+	ErrUnsupported        = &Error{Kind: KindUnsupported}
+	ErrValidation         = &Error{Kind: KindValidation}
+	ErrCanceled           = &Error{Kind: KindCanceled}
+	ErrTimeout            = &Error{Kind: KindTimeout}
+)
+
+func (e *Error) Error() string {
+	switch {
+	case e.Message != "":
+		return e.Message
+	case e.Err != nil:
+		return e.Err.Error()
+	default:
+		return string(e.Kind)
+	}
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the target is an Error of the same kind and, if the target has a code, with the
+// same code
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+
+	return t.Kind == e.Kind && (t.Code == "" || t.Code == e.Code)
+}
+
+// New returns a new domain error of the kind with the code and the formatted message. The last error
+// among the arguments, if any, is wrapped by the new error, like with fmt.Errorf and %w
+func New(kind Kind, code, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Code: code, Message: fmt.Sprintf(format, args...), Err: wrapped(args)}
+}
+
+func Invalid(code, format string, args ...interface{}) error {
+	return New(KindInvalid, code, format, args...)
+}
+
+func Unauthorized(code, format string, args ...interface{}) error {
+	return New(KindUnauthorized, code, format, args...)
+}
+
+func Forbidden(code, format string, args ...interface{}) error {
+	return New(KindForbidden, code, format, args...)
+}
+
+func NotFound(code, format string, args ...interface{}) error {
+	return New(KindNotFound, code, format, args...)
+}
+
+func Conflict(code, format string, args ...interface{}) error {
+	return New(KindConflict, code, format, args...)
+}
+
+func PreconditionFailed(code, format string, args ...interface{}) error {
+	return New(KindPreconditionFailed, code, format, args...)
+}
+
+func Validation(code, format string, args ...interface{}) error {
+	return New(KindValidation, code, format, args...)
+}
+
+// InvalidParams returns a new validation error with the code listing the invalid fields, all of them
+// rather than the first one only. Its message joins the reasons
+func InvalidParams(code string, params ...InvalidParam) error {
+	reasons := make([]string, len(params))
+	for i, param := range params {
+		reasons[i] = param.Reason
+	}
+
+	return &Error{Kind: KindValidation, Code: code, Message: strings.Join(reasons, "; "), Params: params}
+}
+
+// FromContext returns the domain error of the error of a context, canceled or deadline exceeded, and
+// any other error as it is
+func FromContext(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.Canceled):
+		return &Error{Kind: KindCanceled, Code: CodeRequestCanceled, Message: "the request has been canceled", Err: err}
+	case errors.Is(err, context.DeadlineExceeded):
+		return &Error{Kind: KindTimeout, Code: CodeRequestTimeout, Message: "the request has timed out", Err: err}
+	default:
+		return err
+	}
+}
+
+// errorOf returns the outermost domain error in the chain of err or, if there is none, the one of the
+// error of a context in the chain (see FromContext)
+func errorOf(err error) (*Error, bool) {
+	var e *Error
+	if errors.As(err, &e) {
+		return e, true
+	}
+	if errors.As(FromContext(err), &e) {
+		return e, true
+	}
+
+	return nil, false
+}
+
+// KindOf returns the kind of the outermost domain error in the chain of err, KindInternal if there
+// is none
+func KindOf(err error) Kind {
+	e, ok := errorOf(err)
+	if !ok {
+		return KindInternal
+	}
+
+	return e.Kind
+}
+
+// CodeOf returns the code of the outermost domain error in the chain of err, its kind if it has no
+// code, and "internal" if there is no domain error
+func CodeOf(err error) string {
+	e, ok := errorOf(err)
+	if !ok {
+		return string(KindInternal)
+	}
+	if e.Code == "" {
+		return string(e.Kind)
+	}
+
+	return e.Code
+}
+
+// MessageInternal is the message of the internal errors in the responses: their details are logged
+// only, not to leak the ones of the storage to the clients
+const MessageInternal = "internal server error"
+
+// MessageOf returns the message of err for the responses, MessageInternal for the internal errors
+func MessageOf(err error) string {
+	if KindOf(err) == KindInternal {
+		return MessageInternal
+	}
+
+	return err.Error()
+}
+
+// ParamsOf returns the invalid fields of the outermost domain error in the chain of err, if any
+func ParamsOf(err error) []InvalidParam {
+	e, ok := errorOf(err)
+	if !ok {
+		return nil
+	}
+
+	return e.Params
+}
+
+// wrapped returns the last error among the arguments, if any
+func wrapped(args []interface{}) error {
+	for i := len(args) - 1; i >= 0; i-- {
+		if err, ok := args[i].(error); ok {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package errs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsOK(t *testing.T) {
+	err := NotFound(CodeUserNotFound, "user with ID %v not found", 1)
+	require.EqualError(t, err, "user with ID 1 not found")
+
+	require.True(t, errors.Is(err, ErrNotFound))
+	require.True(t, errors.Is(err, &Error{Kind: KindNotFound, Code: CodeUserNotFound}))
+	require.False(t, errors.Is(err, &Error{Kind: KindNotFound, Code: CodeRoleNotFound}))
+	require.False(t, errors.Is(err, ErrConflict))
+
+	wrapped := fmt.Errorf("error while retrieving user: %w", err)
+	require.True(t, errors.Is(wrapped, ErrNotFound))
+}
+
+func TestNewWrapsCause(t *testing.T) {
+	cause := errors.New("cause")
+	err := Invalid(CodeInvalidFilter, "invalid filter: %v", cause)
+
+	require.EqualError(t, err, "invalid filter: cause")
+	require.True(t, errors.Is(err, cause))
+	require.True(t, errors.Is(err, ErrInvalid))
+}
+
+func TestKindAndCodeOf(t *testing.T) {
+	err := fmt.Errorf("error while patching: %w", Conflict(CodePatchTestFailed, "test failed"))
+	require.Equal(t, KindConflict, KindOf(err))
+	require.Equal(t, CodePatchTestFailed, CodeOf(err))
+
+	// the outermost domain error wins
+	err = Validation(CodeInvalidUser, "invalid user: %v", NotFound(CodeUserNotFound, "not found"))
+	require.Equal(t, KindValidation, KindOf(err))
+	require.Equal(t, CodeInvalidUser, CodeOf(err))
+
+	require.Equal(t, KindConflict, KindOf(ErrConflict))
+	require.Equal(t, "conflict", CodeOf(ErrConflict))
+
+	require.Equal(t, KindInternal, KindOf(errors.New("any")))
+	require.Equal(t, "internal", CodeOf(errors.New("any")))
+}
+
+func TestFromContext(t *testing.T) {
+	err := fmt.Errorf("error while listing users: %w", context.Canceled)
+	require.Equal(t, KindCanceled, KindOf(err))
+	require.Equal(t, CodeRequestCanceled, CodeOf(err))
+	require.True(t, errors.Is(FromContext(err), ErrCanceled))
+
+	err = fmt.Errorf("error while listing users: %w", context.DeadlineExceeded)
+	require.Equal(t, KindTimeout, KindOf(err))
+	require.Equal(t, CodeRequestTimeout, CodeOf(err))
+	require.True(t, errors.Is(FromContext(err), context.DeadlineExceeded))
+
+	require.Nil(t, FromContext(nil))
+	other := errors.New("any")
+	require.Equal(t, other, FromContext(other))
+}
@@ -0,0 +1,124 @@
+package errs
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MediaTypeProblem is the media type of the errors in the responses (RFC 7807)
+	MediaTypeProblem = "application/problem+json"
+	// MediaTypeJSON is the media type of the legacy representation of the errors, ResponseError
+	MediaTypeJSON = "application/json"
+	// ProblemTypePrefix prefixes the codes of the domain errors in the types of the problems
+	ProblemTypePrefix = "urn:user-microservice-go:problem:"
+	// StatusClientClosedRequest is the status of the requests canceled by the client going away
+	// (nginx's convention), which no response reaches
+	StatusClientClosedRequest = 499
+)
+
+// Problem is the representation of the errors in the responses: the Problem Details of RFC 7807,
+// extended with the code of the domain error and, for the validation errors, the invalid fields
+type Problem struct {
+	Type          string         `json:"type"`
+	Title         string         `json:"title"`
+	Status        int            `json:"status"`
+	Detail        string         `json:"detail,omitempty"`
+	Instance      string         `json:"instance,omitempty"`
+	Code          string         `json:"code"`
+	InvalidParams []InvalidParam `json:"invalid-params,omitempty"`
+}
+
+// NewProblem returns the problem of the request to the instance (the path of the request) failed with
+// the error and the status. The type is derived from the code of the error; errors which are not
+// domain errors have no more semantics than their status, so their type is about:blank
+func NewProblem(status int, instance string, err error) *Problem {
+	code := CodeOf(err)
+	problemType := ProblemTypePrefix + code
+	if KindOf(err) == KindInternal {
+		problemType = "about:blank"
+	}
+
+	return &Problem{
+		Type:          problemType,
+		Title:         statusText(status),
+		Status:        status,
+		Detail:        MessageOf(err),
+		Instance:      instance,
+		Code:          code,
+		InvalidParams: ParamsOf(err),
+	}
+}
+
+// statusText returns the text of the status, including the non-standard ones
+func statusText(status int) string {
+	if status == StatusClientClosedRequest {
+		return "Client Closed Request"
+	}
+
+	return http.StatusText(status)
+}
+
+// WriteError writes the error in the response with the status: as a problem, or in the legacy
+// representation to the clients preferring it (see WantsLegacy)
+func WriteError(w http.ResponseWriter, r *http.Request, status int, err error) error {
+	if WantsLegacy(r) {
+		w.Header().Set("Content-Type", MediaTypeJSON)
+		w.WriteHeader(status)
+		return json.NewEncoder(w).Encode(ResponseError{Code: CodeOf(err), Message: MessageOf(err)})
+	}
+
+	w.Header().Set("Content-Type", MediaTypeProblem)
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(NewProblem(status, r.URL.Path, err))
+}
+
+// WantsLegacy reports whether the client of the request prefers application/json to
+// application/problem+json, as by its Accept header, e.g. Accept: application/json. The clients
+// accepting both equally, or any media type, get the problems
+func WantsLegacy(r *http.Request) bool {
+	accept := strings.Join(r.Header.Values("Accept"), ",")
+	if strings.TrimSpace(accept) == "" {
+		return false
+	}
+
+	return quality(accept, MediaTypeJSON) > quality(accept, MediaTypeProblem)
+}
+
+// quality returns the quality value the Accept header gives to the media type, the one of its most
+// specific media range matching it (RFC 7231, section 5.3.2)
+func quality(accept, mediaType string) float64 {
+	q, specificity := 0.0, -1
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+
+		s := -1
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case mediaType:
+			s = 2
+		case strings.SplitN(mediaType, "/", 2)[0] + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+
+		specificity, q = s, 1
+		for _, param := range params[1:] {
+			kv := strings.SplitN(param, "=", 2)
+			if len(kv) == 2 && strings.TrimSpace(kv[0]) == "q" {
+				value, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+				if err != nil {
+					value = 0
+				}
+				q = value
+			}
+		}
+	}
+
+	return q
+}
@@ -0,0 +1,79 @@
+package errs
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewProblemOK(t *testing.T) {
+	err := InvalidParams(CodeInvalidUser,
+		InvalidParam{Name: "nickname", Reason: "the nickname is empty"},
+		InvalidParam{Name: "email", Reason: "the email is empty"})
+
+	problem := NewProblem(http.StatusUnprocessableEntity, "/user", err)
+	require.Equal(t, &Problem{
+		Type:     ProblemTypePrefix + CodeInvalidUser,
+		Title:    "Unprocessable Entity",
+		Status:   http.StatusUnprocessableEntity,
+		Detail:   "the nickname is empty; the email is empty",
+		Instance: "/user",
+		Code:     CodeInvalidUser,
+		InvalidParams: []InvalidParam{
+			{Name: "nickname", Reason: "the nickname is empty"},
+			{Name: "email", Reason: "the email is empty"},
+		},
+	}, problem)
+
+	// errors other than the domain ones have no specific type
+	problem = NewProblem(http.StatusInternalServerError, "/user", errors.New("any"))
+	require.Equal(t, "about:blank", problem.Type)
+	require.Equal(t, "internal", problem.Code)
+}
+
+func TestWantsLegacy(t *testing.T) {
+	for accept, legacy := range map[string]bool{
+		"":                         false,
+		"*/*":                      false,
+		"application/*":            false,
+		"application/problem+json": false,
+		"application/json, application/problem+json":       false,
+		"application/json":                                 true,
+		"application/json, */*;q=0.8":                      true,
+		"application/problem+json;q=0.5, application/json": true,
+		"application/json;q=0.5, application/problem+json": false,
+		"text/html, application/json;q=0.9":                true,
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/users", nil)
+		request.Header.Set("Accept", accept)
+		require.Equal(t, legacy, WantsLegacy(request), accept)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	err := NotFound(CodeUserNotFound, "user with ID 42 not found")
+
+	request := httptest.NewRequest(http.MethodGet, "/user/42", nil)
+	response := httptest.NewRecorder()
+	require.NoError(t, WriteError(response, request, http.StatusNotFound, err))
+	require.Equal(t, http.StatusNotFound, response.Code)
+	require.Equal(t, MediaTypeProblem, response.Header().Get("Content-Type"))
+
+	var problem Problem
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&problem))
+	require.Equal(t, "user with ID 42 not found", problem.Detail)
+	require.Equal(t, "/user/42", problem.Instance)
+
+	request.Header.Set("Accept", MediaTypeJSON)
+	response = httptest.NewRecorder()
+	require.NoError(t, WriteError(response, request, http.StatusNotFound, err))
+	require.Equal(t, MediaTypeJSON, response.Header().Get("Content-Type"))
+
+	var legacy ResponseError
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&legacy))
+	require.Equal(t, ResponseError{Code: CodeUserNotFound, Message: "user with ID 42 not found"}, legacy)
+}
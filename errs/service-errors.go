@@ -1,17 +1,12 @@
 package errs
 
+// ResponseError is the legacy body of the error responses, superseded by Problem: the message for the
+// humans, and the code of the domain error for the machines
 type ResponseError struct {
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message"`
 }
 
 func (e *ResponseError) Error() string {
 	return e.Message
 }
-
-// EmptyBody is an empty instance of ResponseError type, we need it for the cases in which empty body
-// of the request is allowed
-type EmptyBody ResponseError
-
-func (e *EmptyBody) Error() string {
-	return e.Message
-}
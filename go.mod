@@ -5,9 +5,12 @@ go 1.16
 require (
 	github.com/go-chi/chi v1.5.4
 	github.com/gorilla/mux v1.8.0
-	github.com/pavelerokhin/cleanarchitecture-restapi-go v0.0.0-20220411012928-73043a11f950
-	github.com/stretchr/testify v1.7.0 // indirect
+	github.com/jackc/pgconn v1.11.0
+	github.com/stretchr/testify v1.7.0
 	go.mongodb.org/mongo-driver v1.9.0
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	golang.org/x/text v0.3.7
+	gorm.io/driver/postgres v1.3.4
 	gorm.io/driver/sqlite v1.3.1
 	gorm.io/gorm v1.23.4
 )
@@ -0,0 +1,343 @@
+// pkg implements the versioned migrations of the schemas of the SQL databases: each migration upgrades
+// the schema to its version, and can be rolled back to the previous one. The versions of the migrations
+// applied to a database are recorded in its schema_migrations table
+
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Table is the table of the migrations applied to a database
+const Table = "schema_migrations"
+
+// ErrNewerSchema is returned against a database whose schema is newer than the migrations: it has been
+// migrated by a newer version of the microservice, which the older ones must not run against
+var ErrNewerSchema = errors.New("the schema of the database is newer than the migrations")
+
+// fileName matches the names of the files of the migrations, e.g. 0001_init.up.sql
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration upgrades the schema to its version with the statements of Up, and rolls it back to the
+// previous version with the ones of Down
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status is the status of a migration: AppliedAt is nil if the migration is pending. The migrations
+// applied to the database but unknown to the migrator, of a newer schema, are Unknown
+type Status struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+	Unknown   bool
+}
+
+// applied is a row of the table of the migrations
+type applied struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+// Load loads the migrations in the directory of the file system, sorted by version. Each migration is
+// a pair of files, <version>_<name>.up.sql and <version>_<name>.down.sql, e.g. 0001_init.up.sql
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+
+		version, _ := strconv.Atoi(match[1])
+		if version <= 0 {
+			return nil, fmt.Errorf("invalid migration %v: the versions start from 1", entry.Name())
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migrations %v and %v have the same version", m.Name, match[2])
+		}
+
+		statements, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if match[3] == "up" {
+			m.Up = string(statements)
+		} else {
+			m.Down = string(statements)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %v_%v must have both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// Migrator migrates the schema of a database
+type Migrator struct {
+	DB         *gorm.DB
+	Logger     *log.Logger
+	Migrations []Migration
+}
+
+// New returns the migrator of the database with the migrations, sorted by version (see Load)
+func New(db *gorm.DB, migrations []Migration, logger *log.Logger) *Migrator {
+	return &Migrator{DB: db, Logger: logger, Migrations: migrations}
+}
+
+// Latest returns the version of the last migration, 0 if there is none
+func (m *Migrator) Latest() int {
+	if len(m.Migrations) == 0 {
+		return 0
+	}
+
+	return m.Migrations[len(m.Migrations)-1].Version
+}
+
+// Version returns the version of the schema of the database, the one of the last migration applied,
+// 0 if none has been
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	rows, err := m.applied(ctx)
+	if err != nil || len(rows) == 0 {
+		return 0, err
+	}
+
+	return rows[len(rows)-1].Version, nil
+}
+
+// Check returns ErrNewerSchema if the schema of the database is newer than the migrations
+func (m *Migrator) Check(ctx context.Context) error {
+	version, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if version > m.Latest() {
+		return fmt.Errorf("%w: the database is at version %v, the last migration is %v", ErrNewerSchema,
+			version, m.Latest())
+	}
+
+	return nil
+}
+
+// Up applies the pending migrations, each one in a transaction, and returns how many
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	err := m.Check(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := m.Version(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, migration := range m.Migrations {
+		if migration.Version <= version {
+			continue
+		}
+
+		m.Logger.Printf("applying migration %v_%v", migration.Version, migration.Name)
+		err = m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			err := tx.Exec(migration.Up).Error
+			if err != nil {
+				return err
+			}
+
+			return tx.Table(Table).Create(&applied{Version: migration.Version, Name: migration.Name,
+				AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return n, fmt.Errorf("error while applying migration %v_%v: %w", migration.Version, migration.Name, err)
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// Down rolls back the last steps migrations applied, each one in a transaction, and returns how many
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	err := m.Check(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i := len(rows) - 1; i >= 0 && n < steps; i-- {
+		migration, ok := m.find(rows[i].Version)
+		if !ok {
+			return n, fmt.Errorf("cannot roll back migration %v_%v: it is unknown", rows[i].Version, rows[i].Name)
+		}
+
+		m.Logger.Printf("rolling back migration %v_%v", migration.Version, migration.Name)
+		err = m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			err := tx.Exec(migration.Down).Error
+			if err != nil {
+				return err
+			}
+
+			return tx.Table(Table).Where("version = ?", migration.Version).Delete(&applied{}).Error
+		})
+		if err != nil {
+			return n, fmt.Errorf("error while rolling back migration %v_%v: %w", migration.Version, migration.Name, err)
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// Status returns the status of the migrations, sorted by version, including the unknown ones applied
+// to the database
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	rows, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	appliedAt := map[int]time.Time{}
+	for _, row := range rows {
+		appliedAt[row.Version] = row.AppliedAt
+	}
+
+	var statuses []Status
+	for _, migration := range m.Migrations {
+		status := Status{Version: migration.Version, Name: migration.Name}
+		if t, ok := appliedAt[migration.Version]; ok {
+			status.AppliedAt = &t
+		}
+		statuses = append(statuses, status)
+	}
+	for _, row := range rows {
+		if _, ok := m.find(row.Version); !ok {
+			row := row
+			statuses = append(statuses, Status{Version: row.Version, Name: row.Name, AppliedAt: &row.AppliedAt, Unknown: true})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+
+	return statuses, nil
+}
+
+// Force records the schema of the database at the version, 0 or the one of a migration, without applying
+// nor rolling back any migration: the migrations up to the version are recorded as applied, the others
+// as pending. It adopts the databases whose schema has been migrated by other means, or repaired by hand
+func (m *Migrator) Force(ctx context.Context, version int) error {
+	if _, ok := m.find(version); !ok && version != 0 {
+		return fmt.Errorf("cannot force version %v: there is no migration with that version", version)
+	}
+
+	err := m.createTable(ctx)
+	if err != nil {
+		return err
+	}
+
+	return m.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Table(Table).Where("version > ?", version).Delete(&applied{}).Error
+		if err != nil {
+			return err
+		}
+
+		var rows []applied
+		err = tx.Table(Table).Find(&rows).Error
+		if err != nil {
+			return err
+		}
+		recorded := map[int]bool{}
+		for _, row := range rows {
+			recorded[row.Version] = true
+		}
+
+		for _, migration := range m.Migrations {
+			if migration.Version > version || recorded[migration.Version] {
+				continue
+			}
+
+			err = tx.Table(Table).Create(&applied{Version: migration.Version, Name: migration.Name,
+				AppliedAt: time.Now()}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		m.Logger.Printf("the schema has been forced to version %v", version)
+		return nil
+	})
+}
+
+// Close closes the database
+func (m *Migrator) Close() error {
+	db, err := m.DB.DB()
+	if err != nil {
+		return err
+	}
+
+	return db.Close()
+}
+
+// applied returns the migrations applied to the database, sorted by version
+func (m *Migrator) applied(ctx context.Context) ([]applied, error) {
+	err := m.createTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []applied
+	err = m.DB.WithContext(ctx).Table(Table).Order("version").Find(&rows).Error
+
+	return rows, err
+}
+
+// createTable creates the table of the migrations, unless it exists
+func (m *Migrator) createTable(ctx context.Context) error {
+	return m.DB.WithContext(ctx).Exec("CREATE TABLE IF NOT EXISTS " + Table +
+		" (version BIGINT PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at TIMESTAMP NOT NULL)").Error
+}
+
+func (m *Migrator) find(version int) (Migration, bool) {
+	for _, migration := range m.Migrations {
+		if migration.Version == version {
+			return migration, true
+		}
+	}
+
+	return Migration{}, false
+}
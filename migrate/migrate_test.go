@@ -0,0 +1,195 @@
+package migrate
+
+import (
+	"context"
+	"log"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	glogger "gorm.io/gorm/logger"
+)
+
+var (
+	dbName     = "migrate-testing.db"
+	testLogger = log.New(os.Stdout, "testing-migrate", log.LstdFlags|log.Llongfile)
+	testFS     = fstest.MapFS{
+		"migrations/0001_users.up.sql":     {Data: []byte("CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT);")},
+		"migrations/0001_users.down.sql":   {Data: []byte("DROP TABLE users;")},
+		"migrations/0002_email.up.sql":     {Data: []byte("ALTER TABLE users ADD COLUMN email TEXT;")},
+		"migrations/0002_email.down.sql":   {Data: []byte("ALTER TABLE users DROP COLUMN email;")},
+		"migrations/0003_roles.up.sql":     {Data: []byte("CREATE TABLE roles (id INTEGER PRIMARY KEY);\nCREATE TABLE grants (id INTEGER PRIMARY KEY);")},
+		"migrations/0003_roles.down.sql":   {Data: []byte("DROP TABLE grants;\nDROP TABLE roles;")},
+		"migrations/README.md":             {Data: []byte("not a migration")},
+		"other/0001_ignored.up.sql":        {Data: []byte("CREATE TABLE ignored (id INTEGER);")},
+		"invalid/0001_missing_down.up.sql": {Data: []byte("CREATE TABLE t (id INTEGER);")},
+	}
+)
+
+func setupTestCase(t *testing.T) *Migrator {
+	db, err := gorm.Open(sqlite.Open(dbName), &gorm.Config{Logger: glogger.Default.LogMode(glogger.Silent)})
+	require.NoError(t, err)
+
+	migrations, err := Load(testFS, "migrations")
+	require.NoError(t, err)
+	m := New(db, migrations, testLogger)
+
+	t.Cleanup(func() {
+		require.NoError(t, m.Close())
+		require.NoError(t, os.Remove(dbName))
+	})
+
+	return m
+}
+
+func hasTable(t *testing.T, m *Migrator, table string) bool {
+	var n int
+	err := m.DB.Raw("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&n).Error
+	require.NoError(t, err)
+
+	return n == 1
+}
+
+func TestLoadOK(t *testing.T) {
+	migrations, err := Load(testFS, "migrations")
+	require.NoError(t, err)
+	require.Len(t, migrations, 3)
+	for i, name := range []string{"users", "email", "roles"} {
+		require.Equal(t, i+1, migrations[i].Version)
+		require.Equal(t, name, migrations[i].Name)
+		require.NotEmpty(t, migrations[i].Up)
+		require.NotEmpty(t, migrations[i].Down)
+	}
+}
+
+func TestLoadKO(t *testing.T) {
+	_, err := Load(testFS, "invalid")
+	require.Error(t, err)
+
+	_, err = Load(testFS, "unknown")
+	require.Error(t, err)
+
+	_, err = Load(fstest.MapFS{
+		"m/0001_a.up.sql":   {Data: []byte("SELECT 1;")},
+		"m/0001_a.down.sql": {Data: []byte("SELECT 1;")},
+		"m/0001_b.up.sql":   {Data: []byte("SELECT 1;")},
+	}, "m")
+	require.Error(t, err)
+}
+
+func TestUpDownOK(t *testing.T) {
+	m := setupTestCase(t)
+	ctx := context.Background()
+
+	version, err := m.Version(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, version)
+
+	n, err := m.Up(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.True(t, hasTable(t, m, "users"))
+	require.True(t, hasTable(t, m, "grants"))
+	version, err = m.Version(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 3, version)
+
+	// nothing pending
+	n, err = m.Up(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	n, err = m.Down(ctx, 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.True(t, hasTable(t, m, "users"))
+	require.False(t, hasTable(t, m, "roles"))
+	version, err = m.Version(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, version)
+
+	n, err = m.Down(ctx, 5)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.False(t, hasTable(t, m, "users"))
+}
+
+func TestUpFailingMigrationKO(t *testing.T) {
+	m := setupTestCase(t)
+	ctx := context.Background()
+	m.Migrations = append(m.Migrations, Migration{Version: 4, Name: "broken", Up: "CREATE TABLE broken (id INTEGER);\nINVALID SQL;",
+		Down: "DROP TABLE broken;"})
+
+	n, err := m.Up(ctx)
+	require.Error(t, err)
+	require.Equal(t, 3, n)
+
+	// the failing migration is rolled back with its transaction
+	require.False(t, hasTable(t, m, "broken"))
+	version, err := m.Version(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 3, version)
+}
+
+func TestNewerSchemaKO(t *testing.T) {
+	m := setupTestCase(t)
+	ctx := context.Background()
+	_, err := m.Up(ctx)
+	require.NoError(t, err)
+
+	// an older version of the microservice knows only the first migration
+	older := New(m.DB, m.Migrations[:1], testLogger)
+	require.ErrorIs(t, older.Check(ctx), ErrNewerSchema)
+	_, err = older.Up(ctx)
+	require.ErrorIs(t, err, ErrNewerSchema)
+	_, err = older.Down(ctx, 1)
+	require.ErrorIs(t, err, ErrNewerSchema)
+
+	statuses, err := older.Status(ctx)
+	require.NoError(t, err)
+	require.Len(t, statuses, 3)
+	require.False(t, statuses[0].Unknown)
+	require.True(t, statuses[1].Unknown)
+	require.True(t, statuses[2].Unknown)
+}
+
+func TestStatusOK(t *testing.T) {
+	m := setupTestCase(t)
+	ctx := context.Background()
+	require.NoError(t, m.Force(ctx, 1))
+
+	statuses, err := m.Status(ctx)
+	require.NoError(t, err)
+	require.Len(t, statuses, 3)
+	require.Equal(t, "users", statuses[0].Name)
+	require.NotNil(t, statuses[0].AppliedAt)
+	require.Nil(t, statuses[1].AppliedAt)
+	require.Nil(t, statuses[2].AppliedAt)
+}
+
+func TestForceOK(t *testing.T) {
+	m := setupTestCase(t)
+	ctx := context.Background()
+
+	// the schema has been created by other means
+	require.NoError(t, m.DB.Exec(m.Migrations[0].Up).Error)
+	require.NoError(t, m.Force(ctx, 1))
+	n, err := m.Up(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	require.NoError(t, m.Force(ctx, 2))
+	version, err := m.Version(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, version)
+
+	require.NoError(t, m.Force(ctx, 0))
+	version, err = m.Version(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, version)
+
+	require.Error(t, m.Force(ctx, 42))
+}
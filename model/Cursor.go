@@ -0,0 +1,138 @@
+package model
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cursor is a position in a listing: the values of the sort keys and the ID of the user the position
+// is at. A listing from a cursor continues after that user, or before it for a backward cursor
+type Cursor struct {
+	Sort     []SortKey
+	Values   []interface{}
+	ID       int
+	Backward bool
+}
+
+// CursorPage is a page of a listing paginated by cursors. Next and Prev are nil at the ends of the listing
+type CursorPage struct {
+	Users []User
+	Next  *Cursor
+	Prev  *Cursor
+}
+
+// NewCursor returns the cursor at the user, in the listing sorted as by the filter
+func NewCursor(filter *Filter, user *User, backward bool) *Cursor {
+	cursor := &Cursor{ID: user.ID, Backward: backward}
+	if filter != nil {
+		cursor.Sort = filter.Sort
+	}
+	for _, key := range cursor.Sort {
+		cursor.Values = append(cursor.Values, user.Field(key.Field))
+	}
+
+	return cursor
+}
+
+// Order returns the sort keys of the listing from the cursor, the ID being the last one: the order
+// of the filter, reversed for backward cursors
+func (c *Cursor) Order() []SortKey {
+	order := (&Filter{Sort: c.Sort}).Order()
+	if c.Backward {
+		for i := range order {
+			order[i].Desc = !order[i].Desc
+		}
+	}
+
+	return order
+}
+
+// Seek returns the conditions selecting the users following the cursor in its order: the users
+// match if they match all the conditions of any of the groups
+func (c *Cursor) Seek() [][]Condition {
+	order := c.Order()
+	values := append(append([]interface{}{}, c.Values...), c.ID)
+
+	var groups [][]Condition
+	for i, key := range order {
+		var group []Condition
+		for j := 0; j < i; j++ {
+			group = append(group, Condition{Field: order[j].Field, Op: OpEq, Values: []interface{}{values[j]}})
+		}
+
+		op := OpGt
+		if key.Desc {
+			op = OpLt
+		}
+		groups = append(groups, append(group, Condition{Field: key.Field, Op: op, Values: []interface{}{values[i]}}))
+	}
+
+	return groups
+}
+
+// Validate checks that the cursor belongs to a listing sorted as by the filter
+func (c *Cursor) Validate(filter *Filter) error {
+	var sort []SortKey
+	if filter != nil {
+		sort = filter.Sort
+	}
+
+	if FormatSort(c.Sort) != FormatSort(sort) {
+		return fmt.Errorf("%w: the cursor belongs to a listing sorted by %q", ErrInvalidFilter, FormatSort(c.Sort))
+	}
+
+	if len(c.Values) != len(c.Sort) {
+		return fmt.Errorf("%w: the cursor has %v values for %v sort keys", ErrInvalidFilter, len(c.Values), len(c.Sort))
+	}
+
+	for i, key := range c.Sort {
+		err := (Condition{Field: key.Field, Op: OpEq, Values: []interface{}{c.Values[i]}}).Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FormatSort is the inverse of ParseSort
+func FormatSort(keys []SortKey) string {
+	fields := make([]string, len(keys))
+	for i, key := range keys {
+		fields[i] = key.Field
+		if key.Desc {
+			fields[i] = "-" + key.Field
+		}
+	}
+
+	return strings.Join(fields, ",")
+}
+
+// FormatValue returns the value of a field as accepted by ParseValue
+func FormatValue(value interface{}) string {
+	switch v := value.(type) {
+	case int:
+		return strconv.Itoa(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// ParseValue parses the value of the field after its type
+func ParseValue(field, value string) (interface{}, error) {
+	fieldType, ok := FilterFields[field]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown field %q", ErrInvalidFilter, field)
+	}
+
+	v, err := parseValue(fieldType, value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid value %q of field %v: %v", ErrInvalidFilter, value, field, err)
+	}
+
+	return v, nil
+}
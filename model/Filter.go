@@ -0,0 +1,218 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Operators of the conditions of the filters
+const (
+	OpEq   = "eq"
+	OpNe   = "ne"
+	OpIn   = "in"
+	OpLike = "like" // SQL LIKE pattern, case-insensitive: % matches any sequence, _ any character
+	OpGt   = "gt"
+	OpGte  = "gte"
+	OpLt   = "lt"
+	OpLte  = "lte"
+)
+
+// FieldType is the type of the values of a field
+type FieldType int
+
+const (
+	FieldInt FieldType = iota
+	FieldString
+	FieldTime
+)
+
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// FilterFields are the fields of the users the listings can be filtered and sorted by, named as in
+// the JSON representation and in the databases, with their types. Other fields, like the password,
+// cannot be used
+var FilterFields = map[string]FieldType{
+	"id":         FieldInt,
+	"first_name": FieldString,
+	"last_name":  FieldString,
+	"nickname":   FieldString,
+	"email":      FieldString,
+	"country":    FieldString,
+	"created_at": FieldTime,
+	"updated_at": FieldTime,
+}
+
+// KeyFields are the keys of the emails and of the nicknames of the users (see Key): they are unique,
+// so the service can look a user up by them, but they are not in the representations, so the listings
+// cannot be filtered or sorted by them
+var KeyFields = map[string]FieldType{
+	"email_key":    FieldString,
+	"nickname_key": FieldString,
+}
+
+// operators are the operators available for each type of field
+var operators = map[FieldType][]string{
+	FieldInt:    {OpEq, OpNe, OpIn, OpGt, OpGte, OpLt, OpLte},
+	FieldString: {OpEq, OpNe, OpIn, OpLike, OpGt, OpGte, OpLt, OpLte},
+	FieldTime:   {OpEq, OpNe, OpIn, OpGt, OpGte, OpLt, OpLte},
+}
+
+// timeLayouts are the accepted layouts of the values of the time fields
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02"}
+
+// Condition restricts a listing to the users whose field compares to the values with the operator.
+// Values are typed after the field (int, string or time.Time); there is one value, except for OpIn
+type Condition struct {
+	Field  string
+	Op     string
+	Values []interface{}
+}
+
+// SortKey orders a listing by a field
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+// Filter selects the users of a listing, all the conditions must hold, and orders them by the sort
+// keys; the users with equal sort keys are ordered by ID. The deleted users are listed only if
+// IncludeDeleted
+type Filter struct {
+	Conditions     []Condition
+	Sort           []SortKey
+	IncludeDeleted bool
+}
+
+// NewCondition returns the condition on the field, parsing the values after the type of the field
+func NewCondition(field, op string, values ...string) (Condition, error) {
+	fieldType, ok := FilterFields[field]
+	if !ok {
+		return Condition{}, fmt.Errorf("%w: cannot filter by field %q", ErrInvalidFilter, field)
+	}
+
+	condition := Condition{Field: field, Op: op}
+	for _, value := range values {
+		v, err := parseValue(fieldType, value)
+		if err != nil {
+			return Condition{}, fmt.Errorf("%w: invalid value %q of field %v: %v", ErrInvalidFilter, value, field, err)
+		}
+		condition.Values = append(condition.Values, v)
+	}
+
+	return condition, condition.Validate()
+}
+
+// Validate checks that the field can be filtered with the operator and the values
+func (c Condition) Validate() error {
+	fieldType, ok := FilterFields[c.Field]
+	if !ok {
+		fieldType, ok = KeyFields[c.Field]
+	}
+	if !ok {
+		return fmt.Errorf("%w: cannot filter by field %q", ErrInvalidFilter, c.Field)
+	}
+
+	if !contains(operators[fieldType], c.Op) {
+		return fmt.Errorf("%w: operator %q is not available for field %v", ErrInvalidFilter, c.Op, c.Field)
+	}
+
+	if len(c.Values) == 0 || (c.Op != OpIn && len(c.Values) > 1) {
+		return fmt.Errorf("%w: wrong number of values for operator %q of field %v", ErrInvalidFilter, c.Op, c.Field)
+	}
+
+	for _, v := range c.Values {
+		var ok bool
+		switch fieldType {
+		case FieldInt:
+			_, ok = v.(int)
+		case FieldString:
+			_, ok = v.(string)
+		case FieldTime:
+			_, ok = v.(time.Time)
+		}
+		if !ok {
+			return fmt.Errorf("%w: value %v has the wrong type for field %v", ErrInvalidFilter, v, c.Field)
+		}
+	}
+
+	return nil
+}
+
+// ParseSort parses the comma-separated list of fields to sort by; the fields prefixed by - are
+// sorted in descending order
+func ParseSort(spec string) ([]SortKey, error) {
+	var keys []SortKey
+	for _, field := range strings.Split(spec, ",") {
+		key := SortKey{Field: strings.TrimPrefix(field, "-"), Desc: strings.HasPrefix(field, "-")}
+		if _, ok := FilterFields[key.Field]; !ok {
+			return nil, fmt.Errorf("%w: cannot sort by field %q", ErrInvalidFilter, key.Field)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// Validate checks the conditions and the sort keys of the filter
+func (f *Filter) Validate() error {
+	if f == nil {
+		return nil
+	}
+
+	for _, c := range f.Conditions {
+		err := c.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, key := range f.Sort {
+		if _, ok := FilterFields[key.Field]; !ok {
+			return fmt.Errorf("%w: cannot sort by field %q", ErrInvalidFilter, key.Field)
+		}
+	}
+
+	return nil
+}
+
+// Order returns the sort keys of the listing: the ones of the filter, then the ID
+func (f *Filter) Order() []SortKey {
+	var order []SortKey
+	if f != nil {
+		order = append(order, f.Sort...)
+	}
+
+	return append(order, SortKey{Field: "id"})
+}
+
+func parseValue(fieldType FieldType, value string) (interface{}, error) {
+	switch fieldType {
+	case FieldInt:
+		return strconv.Atoi(value)
+	case FieldTime:
+		var err error
+		for _, layout := range timeLayouts {
+			var t time.Time
+			t, err = time.Parse(layout, value)
+			if err == nil {
+				return t, nil
+			}
+		}
+		return nil, err
+	default:
+		return value, nil
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
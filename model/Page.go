@@ -0,0 +1,13 @@
+package model
+
+// Page selects a page of a list of items: pages are numbered from 1. The zero value selects the
+// whole list
+type Page struct {
+	Size   int
+	Number int
+}
+
+// IsZero reports whether the page selects the whole list
+func (p Page) IsZero() bool {
+	return p.Size == 0 && p.Number == 0
+}
@@ -0,0 +1,17 @@
+package model
+
+import (
+	"time"
+)
+
+// RefreshToken is a server-side record of an issued refresh token. Only the SHA-256 hash of the token
+// is stored. Tokens rotated from the same login share the Family, so that the whole chain can be revoked
+type RefreshToken struct {
+	ID        int        `gorm:"primaryKey" json:"id" bson:"id"`
+	Hash      string     `gorm:"uniqueIndex" json:"-" bson:"hash"`
+	Family    string     `gorm:"index" json:"family" bson:"family"`
+	UserID    int        `gorm:"index" json:"user_id" bson:"user_id"`
+	ExpiresAt time.Time  `json:"expires_at" bson:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at" bson:"revoked_at"`
+	CreatedAt time.Time  `json:"created_at" bson:"created_at"`
+}
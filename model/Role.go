@@ -0,0 +1,39 @@
+package model
+
+const (
+	PermissionUsersRead   = "users:read"
+	PermissionUsersWrite  = "users:write"
+	PermissionUsersDelete = "users:delete"
+	PermissionRolesWrite  = "roles:write"
+)
+
+// Permission is a fine-grained right on the resources of the microservice. Users may always read and
+// update themselves; permissions grant the same rights on the other users
+type Permission struct {
+	ID   int    `gorm:"primaryKey" json:"-" bson:"-"`
+	Name string `gorm:"uniqueIndex" json:"name" bson:"name"`
+}
+
+// Role is a named set of permissions; roles are assigned to users
+type Role struct {
+	ID          int          `gorm:"primaryKey" json:"-" bson:"-"`
+	Name        string       `gorm:"uniqueIndex" json:"name" bson:"name"`
+	Permissions []Permission `gorm:"many2many:role_permissions" json:"permissions" bson:"permissions"`
+}
+
+// DefaultRoles are created at the startup of the repository
+var DefaultRoles = []Role{
+	{
+		Name: RoleAdmin,
+		Permissions: []Permission{
+			{Name: PermissionUsersRead},
+			{Name: PermissionUsersWrite},
+			{Name: PermissionUsersDelete},
+			{Name: PermissionRolesWrite},
+		},
+	},
+	{
+		Name:        RoleUser,
+		Permissions: []Permission{},
+	},
+}
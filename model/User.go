@@ -2,16 +2,107 @@ package model
 
 import (
 	"time"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
 )
 
+// User is a user of the microservice. The validate tags declare the rules of the valid users (see the
+// validation package). The emails and the nicknames are unique by their keys (see Key), which the
+// repositories set and index, and which are never represented in the requests nor in the responses.
+// The deleted users have no keys: their emails and nicknames can be taken by others
 type User struct {
-	ID        int       `gorm:"primaryKey" json:"id" bson:"id"`
-	FirstName string    `json:"first_name" bson:"first_name"`
-	LastName  string    `json:"last_name" bson:"last_name"`
-	Nickname  string    `json:"nickname" bson:"nickname"`
-	Password  string    `json:"password" bson:"password"`
-	Email     string    `json:"email" bson:"email"`
-	Country   string    `json:"country" bson:"country"`
-	CreatedAt time.Time `json:"created_at" bson:"created_at"`
-	UpdatedAt time.Time `json:"updated_at" bson:"updated_at"`
+	ID        int       `gorm:"primaryKey" json:"id" bson:"id" validate:"readonly"`
+	FirstName string    `json:"first_name" bson:"first_name" validate:"required,max=100"`
+	LastName  string    `json:"last_name" bson:"last_name" validate:"required,max=100"`
+	Nickname  string    `json:"nickname" bson:"nickname" validate:"required,nickname"`
+	Password  string    `json:"password,omitempty" bson:"password" validate:"required,password,writeonly"`
+	Email     string    `json:"email" bson:"email" validate:"required,email,max=254"`
+	Country   string    `json:"country" bson:"country" validate:"required,country"`
+	Roles     []Role    `gorm:"many2many:user_roles" json:"roles" bson:"-" validate:"readonly"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at" validate:"readonly"`
+	UpdatedAt time.Time `json:"updated_at" bson:"updated_at" validate:"readonly"`
+	// DeletedAt is the time of the deletion of the user, nil if not deleted: the deleted users are kept,
+	// hidden, until purged, and can be restored meanwhile
+	DeletedAt *time.Time `gorm:"index" json:"deleted_at,omitempty" bson:"deleted_at,omitempty" validate:"readonly"`
+	// Version is incremented by every modification of the user, starting from 1: the writes conditional
+	// on the version (compare-and-swap) fail if the user has been modified in the meanwhile
+	Version int `gorm:"not null;default:1" json:"version" bson:"version" validate:"readonly"`
+
+	EmailKey    string `gorm:"uniqueIndex" json:"-" bson:"email_key"`
+	NicknameKey string `gorm:"uniqueIndex" json:"-" bson:"nickname_key"`
+}
+
+// Key returns the key of an email or a nickname: two of them are the same when their keys are, i.e.
+// when they are equal case-insensitively and once normalized to NFKC, e.g. Anna@b.com and anna@b.com,
+// or "café" with a precomposed é and with an e followed by a combining acute accent
+func Key(s string) string {
+	// case folding may denormalize the string, so it is normalized again (NFKC_Casefold)
+	return norm.NFKC.String(cases.Fold().String(norm.NFKC.String(s)))
+}
+
+// SetKeys sets the keys of the email and the nickname of the user
+func (u *User) SetKeys() {
+	u.EmailKey = Key(u.Email)
+	u.NicknameKey = Key(u.Nickname)
+}
+
+// RoleNames returns the names of the roles of the user
+func (u *User) RoleNames() []string {
+	names := make([]string, 0, len(u.Roles))
+	for _, r := range u.Roles {
+		names = append(names, r.Name)
+	}
+
+	return names
+}
+
+// Permissions returns the names of the permissions granted to the user by all their roles
+func (u *User) Permissions() []string {
+	seen := map[string]bool{}
+	permissions := []string{}
+	for _, r := range u.Roles {
+		for _, p := range r.Permissions {
+			if !seen[p.Name] {
+				seen[p.Name] = true
+				permissions = append(permissions, p.Name)
+			}
+		}
+	}
+
+	return permissions
+}
+
+// Field returns the value of the field of the user named as in FilterFields or KeyFields, nil for the
+// other fields
+func (u *User) Field(name string) interface{} {
+	switch name {
+	case "id":
+		return u.ID
+	case "first_name":
+		return u.FirstName
+	case "last_name":
+		return u.LastName
+	case "nickname":
+		return u.Nickname
+	case "email":
+		return u.Email
+	case "country":
+		return u.Country
+	case "created_at":
+		return u.CreatedAt
+	case "updated_at":
+		return u.UpdatedAt
+	case "email_key":
+		return u.EmailKey
+	case "nickname_key":
+		return u.NicknameKey
+	default:
+		return nil
+	}
 }
@@ -0,0 +1,74 @@
+// pkg implements hashing and verification of the users' passwords.
+// Passwords are hashed with bcrypt: the algorithm version, the cost and the salt are stored
+// alongside the hash in the same string, so that a stored password can always be verified
+// and upgraded when the hashing parameters change
+
+package password
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const DefaultCost = bcrypt.DefaultCost
+
+var ErrMismatch = errors.New("password does not match")
+
+type Hasher struct {
+	Cost int
+}
+
+func New(cost int) (*Hasher, error) {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return nil, bcrypt.InvalidCostError(cost)
+	}
+
+	return &Hasher{Cost: cost}, nil
+}
+
+// Hash returns the bcrypt hash of the plain text password
+func (h *Hasher) Hash(plain string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(plain), h.Cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// Compare checks the plain text password against the stored one. Passwords stored before hashing was
+// introduced are kept in plain text: they are compared in constant time and reported by NeedsRehash
+func (h *Hasher) Compare(stored, plain string) error {
+	if !IsHash(stored) {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(plain)) != 1 {
+			return ErrMismatch
+		}
+		return nil
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(plain))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrMismatch
+	}
+
+	return err
+}
+
+// NeedsRehash reports whether the stored password has not been hashed with the current parameters
+func (h *Hasher) NeedsRehash(stored string) bool {
+	if !IsHash(stored) {
+		return true
+	}
+
+	cost, err := bcrypt.Cost([]byte(stored))
+	return err != nil || cost != h.Cost
+}
+
+// IsHash reports whether the stored password is a bcrypt hash
+func IsHash(stored string) bool {
+	return len(stored) == 60 &&
+		(strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$"))
+}
@@ -0,0 +1,49 @@
+package password
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestNewInvalidCostKO(t *testing.T) {
+	h, err := New(bcrypt.MaxCost + 1)
+	require.Error(t, err)
+	require.Nil(t, h)
+}
+
+func TestHashCompareOK(t *testing.T) {
+	h, err := New(bcrypt.MinCost)
+	require.NoError(t, err)
+
+	hash, err := h.Hash("secret")
+	require.NoError(t, err)
+	require.NotEqual(t, "secret", hash)
+	require.True(t, IsHash(hash))
+
+	require.NoError(t, h.Compare(hash, "secret"))
+	require.ErrorIs(t, h.Compare(hash, "wrong"), ErrMismatch)
+	require.False(t, h.NeedsRehash(hash))
+}
+
+func TestNeedsRehashCostChangedOK(t *testing.T) {
+	old, err := New(bcrypt.MinCost)
+	require.NoError(t, err)
+	hash, err := old.Hash("secret")
+	require.NoError(t, err)
+
+	h, err := New(bcrypt.MinCost + 1)
+	require.NoError(t, err)
+	require.True(t, h.NeedsRehash(hash))
+	require.NoError(t, h.Compare(hash, "secret"))
+}
+
+func TestComparePlainTextOK(t *testing.T) {
+	h, err := New(bcrypt.MinCost)
+	require.NoError(t, err)
+
+	require.NoError(t, h.Compare("secret", "secret"))
+	require.ErrorIs(t, h.Compare("secret", "wrong"), ErrMismatch)
+	require.True(t, h.NeedsRehash("secret"))
+}
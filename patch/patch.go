@@ -0,0 +1,66 @@
+// pkg implements the patches of JSON documents: JSON Merge Patch (RFC 7396) and JSON Patch (RFC 6902)
+
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+)
+
+const (
+	MediaTypeJSONPatch  = "application/json-patch+json"
+	MediaTypeMergePatch = "application/merge-patch+json"
+)
+
+var (
+	ErrInvalid              = errors.New("invalid patch")
+	ErrTestFailed           = errors.New("test operation failed")
+	ErrUnsupportedMediaType = errors.New("unsupported patch media type")
+)
+
+// Patch modifies a JSON document
+type Patch interface {
+	// Apply returns the patched copy of the document; the document itself is not modified
+	Apply(doc []byte) ([]byte, error)
+}
+
+// Parse returns the patch of the media type. Plain JSON is parsed as a JSON Merge Patch, which has the
+// same syntax as the document it patches
+func Parse(mediaType string, data []byte) (Patch, error) {
+	if mediaType == "" {
+		mediaType = "application/json"
+	}
+	mediaType, _, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedMediaType, err)
+	}
+
+	switch mediaType {
+	case MediaTypeMergePatch, "application/json":
+		if !json.Valid(data) {
+			return nil, fmt.Errorf("%w: the merge patch is not valid JSON", ErrInvalid)
+		}
+		return MergePatch(data), nil
+	case MediaTypeJSONPatch:
+		var p JSONPatch
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&p)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		return p, nil
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedMediaType, mediaType)
+	}
+}
+
+// decode returns the generic representation of the JSON value
+func decode(data []byte) (interface{}, error) {
+	var v interface{}
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
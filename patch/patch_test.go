@@ -0,0 +1,93 @@
+package patch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergePatchOK(t *testing.T) {
+	// the example of RFC 7396, section 3
+	doc := `{"title":"Goodbye!","author":{"givenName":"John","familyName":"Doe"},"tags":["example","sample"],"content":"This will be unchanged"}`
+	patch := `{"title":"Hello!","phoneNumber":"+01-123-456-7890","author":{"familyName":null},"tags":["example"]}`
+
+	result, err := MergePatch(patch).Apply([]byte(doc))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"title":"Hello!","author":{"givenName":"John"},"tags":["example"],"content":"This will be unchanged","phoneNumber":"+01-123-456-7890"}`, string(result))
+}
+
+func TestMergePatchNotObjectOK(t *testing.T) {
+	result, err := MergePatch(`["c"]`).Apply([]byte(`{"a":"b"}`))
+	require.NoError(t, err)
+	require.JSONEq(t, `["c"]`, string(result))
+}
+
+func TestJSONPatchOK(t *testing.T) {
+	doc := `{"a":{"b":["x","z"]},"c":"d","e~f":1}`
+	p, err := Parse(MediaTypeJSONPatch, []byte(`[
+		{"op":"test","path":"/c","value":"d"},
+		{"op":"add","path":"/a/b/1","value":"y"},
+		{"op":"add","path":"/a/b/-","value":"w"},
+		{"op":"remove","path":"/e~0f"},
+		{"op":"replace","path":"/c","value":null},
+		{"op":"copy","from":"/a/b/0","path":"/first"},
+		{"op":"move","from":"/a/b","path":"/letters"}
+	]`))
+	require.NoError(t, err)
+
+	result, err := p.Apply([]byte(doc))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"a":{},"c":null,"first":"x","letters":["x","y","z","w"]}`, string(result))
+}
+
+func TestJSONPatchTestFailedKO(t *testing.T) {
+	doc := []byte(`{"a":1}`)
+	p, err := Parse(MediaTypeJSONPatch, []byte(`[{"op":"replace","path":"/a","value":3},{"op":"test","path":"/a","value":2}]`))
+	require.NoError(t, err)
+
+	_, err = p.Apply(doc)
+	require.ErrorIs(t, err, ErrTestFailed)
+	// the document is not modified
+	require.JSONEq(t, `{"a":1}`, string(doc))
+}
+
+func TestJSONPatchInvalidKO(t *testing.T) {
+	doc := []byte(`{"a":[1,2]}`)
+	for _, operations := range []string{
+		`[{"op":"remove","path":"/b"}]`,
+		`[{"op":"replace","path":"/b","value":1}]`,
+		`[{"op":"add","path":"/a/3","value":1}]`,
+		`[{"op":"add","path":"/a/01","value":1}]`,
+		`[{"op":"add","path":"a","value":1}]`,
+		`[{"op":"add","path":"/c"}]`,
+		`[{"op":"move","from":"/a","path":"/a/0"}]`,
+		`[{"op":"unknown","path":"/a"}]`,
+	} {
+		p, err := Parse(MediaTypeJSONPatch, []byte(operations))
+		require.NoError(t, err)
+
+		_, err = p.Apply(doc)
+		require.ErrorIs(t, err, ErrInvalid, operations)
+	}
+}
+
+func TestParseKO(t *testing.T) {
+	_, err := Parse(MediaTypeJSONPatch, []byte(`{"op":"add"}`))
+	require.ErrorIs(t, err, ErrInvalid)
+
+	_, err = Parse(MediaTypeMergePatch, []byte(`{`))
+	require.ErrorIs(t, err, ErrInvalid)
+
+	_, err = Parse("text/plain", []byte(`{}`))
+	require.ErrorIs(t, err, ErrUnsupportedMediaType)
+}
+
+func TestParseMediaTypeOK(t *testing.T) {
+	p, err := Parse("application/merge-patch+json; charset=utf-8", []byte(`{}`))
+	require.NoError(t, err)
+	require.IsType(t, MergePatch{}, p)
+
+	p, err = Parse("", []byte(`{}`))
+	require.NoError(t, err)
+	require.IsType(t, MergePatch{}, p)
+}
@@ -0,0 +1,96 @@
+// pkg implements the purge of the deleted users: the users are soft-deleted, so that they can be
+// restored, and permanently removed by the purge once their retention period is over
+
+package purge
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pavelerokhin/user-microservice-go/repository"
+)
+
+const (
+	DefaultRetention = 30 * 24 * time.Hour
+	DefaultInterval  = time.Hour
+)
+
+// Job purges the users deleted for longer than the retention period, every interval
+type Job struct {
+	Interval  time.Duration
+	Logger    *log.Logger
+	Repo      repository.UserRepository
+	Retention time.Duration
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+}
+
+func New(repo repository.UserRepository, retention, interval time.Duration, logger *log.Logger) (*Job, error) {
+	if retention <= 0 {
+		return nil, fmt.Errorf("the retention period of the deleted users must be positive")
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("the interval of the purges must be positive")
+	}
+
+	return &Job{Interval: interval, Logger: logger, Repo: repo, Retention: retention}, nil
+}
+
+// Purge permanently removes the users deleted for longer than the retention period at the time, and
+// returns how many
+func (j *Job) Purge(ctx context.Context, now time.Time) (int, error) {
+	n, err := j.Repo.Purge(ctx, now.Add(-j.Retention))
+	if err != nil {
+		return 0, fmt.Errorf("error while purging the deleted users: %w", err)
+	}
+
+	return n, nil
+}
+
+// Start purges in the background, right away and then every interval, until Stop
+func (j *Job) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	j.cancel = cancel
+	j.done = make(chan struct{})
+
+	go func() {
+		defer close(j.done)
+
+		ticker := time.NewTicker(j.Interval)
+		defer ticker.Stop()
+		for {
+			n, err := j.Purge(ctx, time.Now())
+			if err != nil {
+				j.Logger.Println(err)
+			} else if n != 0 {
+				j.Logger.Printf("%v deleted users have been purged", n)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops the purges, canceling the running one and waiting for it. It can be registered as a close hook
+// of the server (see server.OnClose), after the repository so that it runs before its closing
+func (j *Job) Stop() error {
+	j.once.Do(func() {
+		if j.cancel == nil {
+			return
+		}
+
+		j.cancel()
+		<-j.done
+	})
+
+	return nil
+}
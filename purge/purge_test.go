@@ -0,0 +1,92 @@
+package purge
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pavelerokhin/user-microservice-go/errs"
+	"github.com/pavelerokhin/user-microservice-go/model"
+	"github.com/pavelerokhin/user-microservice-go/repository"
+)
+
+var (
+	dbName     = "purge-testing"
+	testLogger = log.New(os.Stdout, "testing-purge", log.LstdFlags|log.Llongfile)
+)
+
+func setupTestCase(t *testing.T) repository.UserRepository {
+	repo, err := repository.NewSqliteRepo(dbName, testLogger)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		require.NoError(t, repo.Close())
+		require.NoError(t, os.Remove(fmt.Sprintf("%s.db", dbName)))
+	})
+
+	return repo
+}
+
+func TestNewKO(t *testing.T) {
+	_, err := New(nil, 0, time.Hour, testLogger)
+	require.Error(t, err)
+
+	_, err = New(nil, time.Hour, 0, testLogger)
+	require.Error(t, err)
+}
+
+func TestPurgeOK(t *testing.T) {
+	repo := setupTestCase(t)
+	for _, name := range []string{"ann", "bob", "carl"} {
+		_, err := repo.Add(context.Background(), &model.User{FirstName: name, LastName: "y", Nickname: name, Password: "1",
+			Email: name + "@b.com", Country: "IT"})
+		require.NoError(t, err)
+	}
+	require.NoError(t, repo.Delete(context.Background(), 1, 0))
+	require.NoError(t, repo.Delete(context.Background(), 2, 0))
+
+	job, err := New(repo, time.Hour, time.Hour, testLogger)
+	require.NoError(t, err)
+
+	// the retention period is not over yet
+	n, err := job.Purge(context.Background(), time.Now())
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	_, err = repo.Restore(context.Background(), 2)
+	require.NoError(t, err)
+
+	n, err = job.Purge(context.Background(), time.Now().Add(2*time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	_, err = repo.Restore(context.Background(), 1)
+	require.ErrorIs(t, err, errs.ErrNotFound)
+	count, err := repo.Count(context.Background(), &model.Filter{IncludeDeleted: true})
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+}
+
+func TestStartStopOK(t *testing.T) {
+	repo := setupTestCase(t)
+	_, err := repo.Add(context.Background(), &model.User{FirstName: "ann", LastName: "y", Nickname: "ann", Password: "1",
+		Email: "ann@b.com", Country: "IT"})
+	require.NoError(t, err)
+	require.NoError(t, repo.Delete(context.Background(), 1, 0))
+
+	job, err := New(repo, time.Nanosecond, time.Millisecond, testLogger)
+	require.NoError(t, err)
+	job.Start()
+
+	require.Eventually(t, func() bool {
+		count, err := repo.Count(context.Background(), &model.Filter{IncludeDeleted: true})
+		return err == nil && count == 0
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, job.Stop())
+	require.NoError(t, job.Stop())
+}
@@ -0,0 +1,49 @@
+package repository_test
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pavelerokhin/user-microservice-go/repository"
+	"github.com/pavelerokhin/user-microservice-go/repository/repotest"
+)
+
+var conformanceLogger = log.New(os.Stdout, "testing-conformance", log.LstdFlags|log.Llongfile)
+
+// TestConformance runs the conformance tests against every backend: the PostgreSQL and MongoDB ones are
+// skipped like their own tests when their databases are not available
+func TestConformance(t *testing.T) {
+	backends := []struct {
+		name    string
+		factory repotest.Factory
+	}{
+		{repository.BackendSqlite, func(t *testing.T) repository.UserRepository {
+			r, err := repository.NewSqliteRepo(filepath.Join(t.TempDir(), "users"), conformanceLogger)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, r.Close())
+			})
+			return r
+		}},
+		{repository.BackendPostgres, repository.SetupPostgresTestCase},
+		{repository.BackendMemory, func(t *testing.T) repository.UserRepository {
+			r := repository.NewMemoryRepo(conformanceLogger)
+			t.Cleanup(func() {
+				require.NoError(t, r.Close())
+			})
+			return r
+		}},
+		{"mongo", repository.SetupMongoTestCase},
+	}
+
+	for _, backend := range backends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			repotest.Run(t, backend.factory)
+		})
+	}
+}
@@ -0,0 +1,7 @@
+package repository
+
+// the setups of the backends, for the conformance tests of the repository_test package
+var (
+	SetupPostgresTestCase = setupPostgresTestCase
+	SetupMongoTestCase    = setupMongoTestCase
+)
@@ -0,0 +1,797 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pavelerokhin/user-microservice-go/errs"
+	"github.com/pavelerokhin/user-microservice-go/model"
+)
+
+var errMemoryClosed = errors.New("the in-memory database is closed")
+
+// memoryRepo keeps the users in memory, with the semantics of the SQL databases: IDs assigned in
+// sequence and never reused, timestamps, versions, soft deletion, unique keys, filters and pagination.
+// It is safe for concurrent use. The users are lost on Close, which makes it fit for tests and demos
+type memoryRepo struct {
+	Logger *log.Logger
+
+	mu          sync.RWMutex
+	closed      bool
+	users       map[int]*model.User            // without their roles
+	userRoles   map[int][]string               // names of the roles of the users
+	roles       []model.Role                   // with their permissions, ordered by ID
+	tokens      map[string]*model.RefreshToken // by hash
+	lastUserID  int
+	lastTokenID int
+}
+
+func NewMemoryRepo(l *log.Logger) UserRepository {
+	l.Println("preparing in-memory database")
+
+	r := &memoryRepo{
+		Logger:    l,
+		users:     map[int]*model.User{},
+		userRoles: map[int][]string{},
+		tokens:    map[string]*model.RefreshToken{},
+	}
+
+	// the default roles and permissions, with the IDs they get when seeded in the SQL databases
+	permissionIDs := map[string]int{}
+	for i, defaultRole := range model.DefaultRoles {
+		role := model.Role{ID: i + 1, Name: defaultRole.Name, Permissions: []model.Permission{}}
+		for _, permission := range defaultRole.Permissions {
+			if _, ok := permissionIDs[permission.Name]; !ok {
+				permissionIDs[permission.Name] = len(permissionIDs) + 1
+			}
+			role.Permissions = append(role.Permissions,
+				model.Permission{ID: permissionIDs[permission.Name], Name: permission.Name})
+		}
+		r.roles = append(r.roles, role)
+	}
+
+	l.Println("in-memory database is ready")
+	return r
+}
+
+func (r *memoryRepo) Add(ctx context.Context, user *model.User) (*model.User, error) {
+	r.Logger.Println("request add a new user to in-memory database")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.ready(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := r.users[user.ID]; ok {
+		err = errs.Conflict(errs.CodeUserExists, "user with ID %v already exists", user.ID)
+		r.Logger.Printf("Failed adding a new user: %v", err)
+		return nil, err
+	}
+
+	user.SetKeys()
+	err = r.checkKeys(user)
+	if err != nil {
+		r.Logger.Printf("Failed adding a new user: %v", err)
+		return nil, err
+	}
+
+	roles := user.RoleNames()
+	if len(roles) == 0 {
+		roles = []string{model.RoleUser}
+	}
+	for _, role := range roles {
+		if !r.hasRole(role) {
+			err = errs.NotFound(errs.CodeRoleNotFound, "role %v not found", role)
+			r.Logger.Printf("Failed adding a new user: %v", err)
+			return nil, err
+		}
+	}
+
+	if user.ID == 0 {
+		user.ID = r.lastUserID + 1
+	}
+	if user.ID > r.lastUserID {
+		r.lastUserID = user.ID
+	}
+	now := now()
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = now
+	}
+	if user.UpdatedAt.IsZero() {
+		user.UpdatedAt = now
+	}
+	user.Version = 1
+
+	stored := *user
+	stored.Roles = nil
+	r.users[user.ID] = &stored
+	for _, role := range roles {
+		r.grantRole(user.ID, role)
+	}
+
+	*user = r.withRoles(&stored)
+	return user, nil
+}
+
+func (r *memoryRepo) Count(ctx context.Context, filter *model.Filter) (int, error) {
+	r.Logger.Printf("elaborating the count request in in-memory database")
+
+	err := validateFilter(filter)
+	if err != nil {
+		r.Logger.Printf("there are some problems counting users: %v", err)
+		return 0, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	err = r.ready(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(r.find(filter, nil)), nil
+}
+
+// Delete soft-deletes the user, like the one of the SQLite database
+func (r *memoryRepo) Delete(ctx context.Context, id, version int) error {
+	r.Logger.Printf("request delete user with ID %v from in-memory database", id)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.ready(ctx)
+	if err != nil {
+		return err
+	}
+
+	user, err := r.live(id, version, errs.NotFound(errs.CodeUserNotFound, "error: cannot find user with ID %v", id))
+	if err != nil {
+		r.Logger.Println(err)
+		return err
+	}
+
+	now := now()
+	user.DeletedAt = &now
+	user.UpdatedAt = now
+	user.EmailKey = ""
+	user.NicknameKey = ""
+	user.Version++
+
+	r.Logger.Printf("user with ID %v has been deleted successfully", id)
+	return nil
+}
+
+func (r *memoryRepo) Get(ctx context.Context, id int) (*model.User, error) {
+	r.Logger.Printf("elaborating the listing request in in-memory database")
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	err := r.ready(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := r.live(id, 0, errs.NotFound(errs.CodeUserNotFound, "user with ID %v not found", id))
+	if err != nil {
+		return nil, err
+	}
+
+	found := r.withRoles(user)
+	return &found, nil
+}
+
+func (r *memoryRepo) GetAll(ctx context.Context, filter *model.Filter, pageSize, page int) ([]model.User, error) {
+	r.Logger.Printf("elaborating the listing request in in-memory database")
+
+	err := validateFilter(filter)
+	if err != nil {
+		r.Logger.Printf("there are some problems listing users: %v", err)
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	err = r.ready(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	users := r.find(filter, nil)
+	sortUsers(users, filter.Order())
+	if pageSize > 0 { // pagination has been requested
+		offset := (page - 1) * pageSize
+		if offset < 0 {
+			offset = 0
+		}
+		if offset > len(users) {
+			offset = len(users)
+		}
+		users = users[offset:]
+		if len(users) > pageSize {
+			users = users[:pageSize]
+		}
+	}
+
+	return r.listed(users), nil
+}
+
+func (r *memoryRepo) GetAllFrom(ctx context.Context, filter *model.Filter, cursor *model.Cursor, limit int) ([]model.User, error) {
+	r.Logger.Printf("elaborating the listing request from a cursor in in-memory database")
+
+	err := validateFilterAndCursor(filter, cursor)
+	if err != nil {
+		r.Logger.Printf("there are some problems listing users: %v", err)
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	err = r.ready(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	users := r.find(filter, cursor)
+	if cursor != nil {
+		sortUsers(users, cursor.Order())
+	} else {
+		sortUsers(users, filter.Order())
+	}
+	if limit > 0 && len(users) > limit {
+		users = users[:limit]
+	}
+
+	listed := r.listed(users)
+	if cursor != nil && cursor.Backward {
+		reverse(listed)
+	}
+
+	return listed, nil
+}
+
+func (r *memoryRepo) Replace(ctx context.Context, user *model.User) (*model.User, error) {
+	r.Logger.Printf("elaborating replace request in in-memory database")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.ready(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	user.SetKeys()
+	stored, err := r.live(user.ID, user.Version, errs.NotFound(errs.CodeUserNotFound, "user with ID %v not found", user.ID))
+	if err == nil {
+		err = r.checkKeys(user)
+	}
+	if err != nil {
+		r.Logger.Printf(err.Error())
+		return nil, err
+	}
+
+	stored.FirstName = user.FirstName
+	stored.LastName = user.LastName
+	stored.Nickname = user.Nickname
+	stored.Password = user.Password
+	stored.Email = user.Email
+	stored.Country = user.Country
+	stored.EmailKey = user.EmailKey
+	stored.NicknameKey = user.NicknameKey
+	stored.UpdatedAt = now()
+	stored.Version++
+
+	r.Logger.Printf("user has been replaced successfully in in-memory database")
+	replaced := r.withRoles(stored)
+	return &replaced, nil
+}
+
+func (r *memoryRepo) Update(ctx context.Context, user, newUser *model.User) (*model.User, error) {
+	r.Logger.Printf("elaborating update request in in-memory database")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.ready(ctx)
+	if err != nil {
+		return user, err
+	}
+
+	// like GORM's Updates, only non-zero fields of newUser are written
+	newUser.SetKeys()
+	stored, err := r.live(user.ID, user.Version,
+		errs.NotFound(errs.CodeUserNotFound, "there are some problems updating user with ID %v", user.ID))
+	if err != nil {
+		r.Logger.Printf(err.Error())
+		return user, err
+	}
+
+	updated := *stored
+	setNonZero(&updated.FirstName, newUser.FirstName)
+	setNonZero(&updated.LastName, newUser.LastName)
+	setNonZero(&updated.Nickname, newUser.Nickname)
+	setNonZero(&updated.Password, newUser.Password)
+	setNonZero(&updated.Email, newUser.Email)
+	setNonZero(&updated.Country, newUser.Country)
+	setNonZero(&updated.EmailKey, newUser.EmailKey)
+	setNonZero(&updated.NicknameKey, newUser.NicknameKey)
+	err = r.checkKeys(&updated)
+	if err != nil {
+		r.Logger.Printf(err.Error())
+		return user, err
+	}
+
+	updated.UpdatedAt = now()
+	updated.Version++
+	*stored = updated
+
+	roles := user.Roles
+	*user = updated
+	user.Roles = roles
+
+	r.Logger.Printf("user has been updated successfully in in-memory database")
+	return user, nil
+}
+
+func (r *memoryRepo) Restore(ctx context.Context, id int) (*model.User, error) {
+	r.Logger.Printf("request restore user with ID %v in in-memory database", id)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.ready(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, ok := r.users[id]
+	if !ok || stored.DeletedAt == nil {
+		err = errs.NotFound(errs.CodeUserNotFound, "cannot find deleted user with ID %v", id)
+		r.Logger.Println(err)
+		return nil, err
+	}
+
+	// the email or the nickname may have been taken in the meanwhile
+	restored := *stored
+	restored.SetKeys()
+	err = r.checkKeys(&restored)
+	if err != nil {
+		r.Logger.Printf("error while restoring user with ID %v: %v", id, err)
+		return nil, err
+	}
+
+	restored.DeletedAt = nil
+	restored.UpdatedAt = now()
+	restored.Version++
+	*stored = restored
+
+	r.Logger.Printf("user with ID %v has been restored successfully", id)
+	found := r.withRoles(stored)
+	return &found, nil
+}
+
+func (r *memoryRepo) Purge(ctx context.Context, before time.Time) (int, error) {
+	r.Logger.Printf("request purge users deleted before %v from in-memory database", before)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.ready(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for id, user := range r.users {
+		if user.DeletedAt == nil || !user.DeletedAt.Before(before) {
+			continue
+		}
+
+		delete(r.users, id)
+		delete(r.userRoles, id)
+		for hash, token := range r.tokens {
+			if token.UserID == id {
+				delete(r.tokens, hash)
+			}
+		}
+		n++
+	}
+
+	r.Logger.Printf("%v users have been purged successfully", n)
+	return n, nil
+}
+
+func (r *memoryRepo) GrantRole(ctx context.Context, userID int, role string) error {
+	r.Logger.Printf("request grant role %v to user with ID %v in in-memory database", role, userID)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, err := r.userAndRole(ctx, userID, role)
+	if err != nil {
+		return err
+	}
+
+	r.grantRole(userID, role)
+	user.Version++
+	return nil
+}
+
+func (r *memoryRepo) RevokeRole(ctx context.Context, userID int, role string) error {
+	r.Logger.Printf("request revoke role %v from user with ID %v in in-memory database", role, userID)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, err := r.userAndRole(ctx, userID, role)
+	if err != nil {
+		return err
+	}
+
+	var roles []string
+	for _, name := range r.userRoles[userID] {
+		if name != role {
+			roles = append(roles, name)
+		}
+	}
+	r.userRoles[userID] = roles
+	user.Version++
+	return nil
+}
+
+func (r *memoryRepo) AddRefreshToken(ctx context.Context, token *model.RefreshToken) error {
+	r.Logger.Printf("request add a refresh token of user with ID %v to in-memory database", token.UserID)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.ready(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := r.tokens[token.Hash]; ok {
+		err = errs.Conflict(errs.CodeRefreshTokenExists, "refresh token already exists")
+		r.Logger.Printf("Failed adding a new refresh token: %v", err)
+		return err
+	}
+
+	if token.ID == 0 {
+		token.ID = r.lastTokenID + 1
+	}
+	if token.ID > r.lastTokenID {
+		r.lastTokenID = token.ID
+	}
+	if token.CreatedAt.IsZero() {
+		token.CreatedAt = now()
+	}
+
+	stored := *token
+	r.tokens[token.Hash] = &stored
+	return nil
+}
+
+func (r *memoryRepo) GetRefreshToken(ctx context.Context, hash string) (*model.RefreshToken, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	err := r.ready(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	token, ok := r.tokens[hash]
+	if !ok {
+		return nil, errs.NotFound(errs.CodeRefreshTokenNotFound, "refresh token not found")
+	}
+
+	found := *token
+	return &found, nil
+}
+
+// RevokeRefreshToken revokes the token only if it hasn't been revoked yet, so that a refresh token
+// can be exchanged exactly once even by concurrent requests
+func (r *memoryRepo) RevokeRefreshToken(ctx context.Context, hash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.ready(ctx)
+	if err != nil {
+		return err
+	}
+
+	token, ok := r.tokens[hash]
+	if !ok || token.RevokedAt != nil {
+		return errs.Conflict(errs.CodeRefreshTokenRevoked, "refresh token not found or already revoked")
+	}
+
+	now := now()
+	token.RevokedAt = &now
+	return nil
+}
+
+func (r *memoryRepo) RevokeRefreshTokenFamily(ctx context.Context, family string) error {
+	r.Logger.Printf("request revoke refresh token family %v in in-memory database", family)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.ready(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := now()
+	for _, token := range r.tokens {
+		if token.Family == family && token.RevokedAt == nil {
+			token.RevokedAt = &now
+		}
+	}
+
+	return nil
+}
+
+func (r *memoryRepo) Close() error {
+	r.Logger.Printf("closing in-memory database")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.users, r.userRoles, r.tokens = nil, nil, nil
+
+	return nil
+}
+
+// ready returns the error of the context, if done, or of the repository, if closed
+func (r *memoryRepo) ready(ctx context.Context) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	if r.closed {
+		return errMemoryClosed
+	}
+
+	return nil
+}
+
+// live returns the stored user with the ID, unless deleted, comparing the version like notWritten
+func (r *memoryRepo) live(id, version int, notFound error) (*model.User, error) {
+	user, ok := r.users[id]
+	if !ok || user.DeletedAt != nil {
+		return nil, notFound
+	}
+	if version != 0 && user.Version != version {
+		return nil, versionMismatch(id, version)
+	}
+
+	return user, nil
+}
+
+// checkKeys returns the conflict on the unique keys of the user taken by another user, if any
+func (r *memoryRepo) checkKeys(user *model.User) error {
+	for _, key := range uniqueKeys {
+		value := keyOf(user, key.column)
+		if value == "" {
+			continue
+		}
+
+		for _, other := range r.users {
+			if other.ID != user.ID && keyOf(other, key.column) == value {
+				return taken(key.field, key.code, nil)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *memoryRepo) hasRole(role string) bool {
+	for _, known := range r.roles {
+		if known.Name == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *memoryRepo) userAndRole(ctx context.Context, userID int, role string) (*model.User, error) {
+	err := r.ready(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := r.live(userID, 0, errs.NotFound(errs.CodeUserNotFound, "user with ID %v not found", userID))
+	if err != nil {
+		return nil, err
+	}
+	if !r.hasRole(role) {
+		return nil, errs.NotFound(errs.CodeRoleNotFound, "role %v not found", role)
+	}
+
+	return user, nil
+}
+
+func (r *memoryRepo) grantRole(userID int, role string) {
+	for _, name := range r.userRoles[userID] {
+		if name == role {
+			return
+		}
+	}
+
+	r.userRoles[userID] = append(r.userRoles[userID], role)
+}
+
+// withRoles returns a copy of the stored user with their roles, ordered by ID
+func (r *memoryRepo) withRoles(user *model.User) model.User {
+	found := *user
+	found.Roles = []model.Role{}
+	for _, role := range r.roles {
+		for _, name := range r.userRoles[user.ID] {
+			if name == role.Name {
+				role.Permissions = append([]model.Permission{}, role.Permissions...)
+				found.Roles = append(found.Roles, role)
+			}
+		}
+	}
+
+	return found
+}
+
+// find returns the stored users matching the filter and, if any, following the cursor, but the deleted
+// ones unless the filter includes them. The filter and the cursor must be valid
+func (r *memoryRepo) find(filter *model.Filter, cursor *model.Cursor) []*model.User {
+	var matches []func(user *model.User) bool
+	if filter != nil {
+		for _, c := range filter.Conditions {
+			matches = append(matches, match(c))
+		}
+	}
+
+	if cursor != nil {
+		var groups [][]func(user *model.User) bool
+		for _, group := range cursor.Seek() {
+			var groupMatches []func(user *model.User) bool
+			for _, c := range group {
+				groupMatches = append(groupMatches, match(c))
+			}
+			groups = append(groups, groupMatches)
+		}
+		matches = append(matches, func(user *model.User) bool {
+			for _, group := range groups {
+				if matchesAll(user, group) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+
+	users := []*model.User{}
+	for _, user := range r.users {
+		if user.DeletedAt != nil && (filter == nil || !filter.IncludeDeleted) {
+			continue
+		}
+		if matchesAll(user, matches) {
+			users = append(users, user)
+		}
+	}
+
+	return users
+}
+
+// listed returns copies of the stored users with their roles
+func (r *memoryRepo) listed(users []*model.User) []model.User {
+	listed := make([]model.User, len(users))
+	for i, user := range users {
+		listed[i] = r.withRoles(user)
+	}
+
+	return listed
+}
+
+// match returns the predicate of the condition, which must be valid
+func match(c model.Condition) func(user *model.User) bool {
+	switch c.Op {
+	case model.OpIn:
+		return func(user *model.User) bool {
+			for _, v := range c.Values {
+				if compare(user.Field(c.Field), v) == 0 {
+					return true
+				}
+			}
+			return false
+		}
+	case model.OpLike:
+		like := likeToRegex(c.Values[0].(string))
+		re := regexp.MustCompile("(?" + like.Options + ")" + like.Pattern)
+		return func(user *model.User) bool {
+			return re.MatchString(user.Field(c.Field).(string))
+		}
+	}
+
+	return func(user *model.User) bool {
+		cmp := compare(user.Field(c.Field), c.Values[0])
+		switch c.Op {
+		case model.OpEq:
+			return cmp == 0
+		case model.OpNe:
+			return cmp != 0
+		case model.OpGt:
+			return cmp > 0
+		case model.OpGte:
+			return cmp >= 0
+		case model.OpLt:
+			return cmp < 0
+		default:
+			return cmp <= 0
+		}
+	}
+}
+
+func matchesAll(user *model.User, matches []func(user *model.User) bool) bool {
+	for _, m := range matches {
+		if !m(user) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sortUsers sorts the users by the sort keys, the last one being the ID
+func sortUsers(users []*model.User, keys []model.SortKey) {
+	sort.Slice(users, func(i, j int) bool {
+		for _, key := range keys {
+			cmp := compare(users[i].Field(key.Field), users[j].Field(key.Field))
+			if cmp != 0 {
+				return (cmp < 0) != key.Desc
+			}
+		}
+		return false
+	})
+}
+
+// compare compares two values of a field of the users, of the same type: -1 if a precedes b, 0 if they
+// are equal and +1 if a follows b. The strings are compared byte-wise, like by the SQL databases
+func compare(a, b interface{}) int {
+	switch a := a.(type) {
+	case int:
+		b := b.(int)
+		if a < b {
+			return -1
+		}
+		if a > b {
+			return 1
+		}
+		return 0
+	case time.Time:
+		b := b.(time.Time)
+		if a.Before(b) {
+			return -1
+		}
+		if a.After(b) {
+			return 1
+		}
+		return 0
+	default:
+		return strings.Compare(a.(string), b.(string))
+	}
+}
+
+func keyOf(user *model.User, column string) string {
+	if column == "email_key" {
+		return user.EmailKey
+	}
+
+	return user.NicknameKey
+}
+
+func setNonZero(field *string, value string) {
+	if value != "" {
+		*field = value
+	}
+}
+
+// now returns the current time without its monotonic clock reading, like the times read from a database
+func now() time.Time {
+	return time.Now().Round(0)
+}
@@ -0,0 +1,59 @@
+package repository
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"log"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	glogger "gorm.io/gorm/logger"
+
+	"github.com/pavelerokhin/user-microservice-go/migrate"
+)
+
+// migrations are the migrations of the schemas of the SQL databases, in a directory by backend
+//
+//go:embed migrations
+var migrations embed.FS
+
+// NewSqliteMigrator returns the migrator of the SQLite database
+func NewSqliteMigrator(dbName string, l *log.Logger) (*migrate.Migrator, error) {
+	sql, err := openSqlite(dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMigrator(sql, BackendSqlite, l)
+}
+
+func openSqlite(dbName string) (*gorm.DB, error) {
+	if dbName == "" {
+		return nil, fmt.Errorf("database name is empty")
+	}
+
+	return gorm.Open(sqlite.Open(fmt.Sprintf("%s.db", dbName)), &gorm.Config{
+		Logger: glogger.Default.LogMode(glogger.Silent),
+	})
+}
+
+func newMigrator(db *gorm.DB, backend string, l *log.Logger) (*migrate.Migrator, error) {
+	ms, err := migrate.Load(migrations, "migrations/"+backend)
+	if err != nil {
+		return nil, err
+	}
+
+	return migrate.New(db, ms, l), nil
+}
+
+// migrateUp applies the pending migrations to the database, refusing to run against a newer schema
+func migrateUp(db *gorm.DB, backend string, l *log.Logger) error {
+	m, err := newMigrator(db, backend, l)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.Up(context.Background())
+	return err
+}
@@ -0,0 +1,63 @@
+-- the keys of the emails and the nicknames are normalized and case-folded by the microservice: the
+-- functional unique indexes on their lower case keep them unique case-insensitively even for the users
+-- written by other means
+
+CREATE TABLE users (
+    id BIGSERIAL PRIMARY KEY,
+    first_name TEXT,
+    last_name TEXT,
+    nickname TEXT,
+    password TEXT,
+    email TEXT,
+    country TEXT,
+    created_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ,
+    deleted_at TIMESTAMPTZ,
+    version BIGINT NOT NULL DEFAULT 1,
+    email_key TEXT,
+    nickname_key TEXT
+);
+CREATE INDEX idx_users_deleted_at ON users (deleted_at);
+CREATE UNIQUE INDEX idx_users_email_key ON users (LOWER(email_key));
+CREATE UNIQUE INDEX idx_users_nickname_key ON users (LOWER(nickname_key));
+
+CREATE TABLE roles (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT
+);
+CREATE UNIQUE INDEX idx_roles_name ON roles (name);
+
+CREATE TABLE permissions (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT
+);
+CREATE UNIQUE INDEX idx_permissions_name ON permissions (name);
+
+CREATE TABLE user_roles (
+    user_id BIGINT,
+    role_id BIGINT,
+    PRIMARY KEY (user_id, role_id),
+    CONSTRAINT fk_user_roles_user FOREIGN KEY (user_id) REFERENCES users (id),
+    CONSTRAINT fk_user_roles_role FOREIGN KEY (role_id) REFERENCES roles (id)
+);
+
+CREATE TABLE role_permissions (
+    role_id BIGINT,
+    permission_id BIGINT,
+    PRIMARY KEY (role_id, permission_id),
+    CONSTRAINT fk_role_permissions_role FOREIGN KEY (role_id) REFERENCES roles (id),
+    CONSTRAINT fk_role_permissions_permission FOREIGN KEY (permission_id) REFERENCES permissions (id)
+);
+
+CREATE TABLE refresh_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    hash TEXT,
+    family TEXT,
+    user_id BIGINT,
+    expires_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ
+);
+CREATE UNIQUE INDEX idx_refresh_tokens_hash ON refresh_tokens (hash);
+CREATE INDEX idx_refresh_tokens_family ON refresh_tokens (family);
+CREATE INDEX idx_refresh_tokens_user_id ON refresh_tokens (user_id);
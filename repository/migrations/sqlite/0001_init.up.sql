@@ -0,0 +1,15 @@
+-- the schema of the version 1 is the one created by the auto-migration of the first versions of the
+-- microservice: the table is created unless it exists, to adopt those databases
+
+CREATE TABLE IF NOT EXISTS users (
+    id INTEGER,
+    first_name TEXT,
+    last_name TEXT,
+    nickname TEXT,
+    password TEXT,
+    email TEXT,
+    country TEXT,
+    created_at DATETIME,
+    updated_at DATETIME,
+    PRIMARY KEY (id)
+);
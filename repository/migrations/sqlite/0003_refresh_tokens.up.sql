@@ -0,0 +1,12 @@
+CREATE TABLE refresh_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    hash TEXT,
+    family TEXT,
+    user_id INTEGER,
+    expires_at DATETIME,
+    revoked_at DATETIME,
+    created_at DATETIME
+);
+CREATE UNIQUE INDEX idx_refresh_tokens_hash ON refresh_tokens (hash);
+CREATE INDEX idx_refresh_tokens_family ON refresh_tokens (family);
+CREATE INDEX idx_refresh_tokens_user_id ON refresh_tokens (user_id);
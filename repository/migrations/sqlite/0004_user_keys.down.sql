@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_users_nickname_key;
+DROP INDEX IF EXISTS idx_users_email_key;
+ALTER TABLE users DROP COLUMN nickname_key;
+ALTER TABLE users DROP COLUMN email_key;
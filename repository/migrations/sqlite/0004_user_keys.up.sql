@@ -0,0 +1,7 @@
+-- the keys of the users stored before are set by the repository at its startup, as they are computed
+-- by the microservice (see model.Key)
+
+ALTER TABLE users ADD COLUMN email_key TEXT;
+ALTER TABLE users ADD COLUMN nickname_key TEXT;
+CREATE UNIQUE INDEX idx_users_email_key ON users (email_key);
+CREATE UNIQUE INDEX idx_users_nickname_key ON users (nickname_key);
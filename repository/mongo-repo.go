@@ -1,6 +1,827 @@
 package repository
 
-/*
-This file will contain the UserRepo implementation for MongoDB. Now it is here present to
-illustrate the necessity of using interface for the repository component of the microservice
-*/
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/pavelerokhin/user-microservice-go/errs"
+	"github.com/pavelerokhin/user-microservice-go/model"
+)
+
+const (
+	mongoTimeout        = 10 * time.Second
+	usersCollection     = "users"
+	countersCollection  = "counters"
+	tokensCollection    = "refresh_tokens"
+	rolesCollection     = "roles"
+	userRolesCollection = "user_roles"
+)
+
+type mongoRepo struct {
+	Client   *mongo.Client
+	Database *mongo.Database
+	Logger   *log.Logger
+}
+
+// counter is a document of the counters collection; it keeps the last ID assigned
+// to a user, so that MongoDB users get auto-incremental integer IDs like the SQLite ones
+type counter struct {
+	ID  string `bson:"_id"`
+	Seq int    `bson:"seq"`
+}
+
+// userRole is a document of the user_roles collection, which assigns roles to users
+type userRole struct {
+	UserID int    `bson:"user_id"`
+	Role   string `bson:"role"`
+}
+
+func NewMongoRepo(uri, dbName string, l *log.Logger) (UserRepository, error) {
+	l.Println("preparing MongoDB database")
+
+	if uri == "" {
+		return nil, fmt.Errorf("database URI is empty")
+	}
+	if dbName == "" {
+		return nil, fmt.Errorf("database name is empty")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, err
+	}
+
+	err = client.Ping(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	db := client.Database(dbName)
+	// the indexes of the keys are sparse, not to index the users stored before they had any (see backfillKeys)
+	_, err = db.Collection(usersCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "email_key", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+		{Keys: bson.D{{Key: "nickname_key", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Collection(tokensCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "family", Value: 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Collection(rolesCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Collection(userRolesCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "role", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r := &mongoRepo{Client: client, Database: db, Logger: l}
+	err = r.seedRoles(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.backfillKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the users stored before they had any version are at their first one
+	_, err = db.Collection(usersCollection).UpdateMany(ctx, bson.M{"version": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"version": 1}})
+	if err != nil {
+		return nil, err
+	}
+
+	l.Println("MongoDB database is ready")
+	return r, nil
+}
+
+func (r *mongoRepo) Add(ctx context.Context, user *model.User) (*model.User, error) {
+	r.Logger.Println("request add a new user to MongoDB database")
+
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	roles := user.RoleNames()
+	if len(roles) == 0 {
+		roles = []string{model.RoleUser}
+	}
+
+	// the roles are checked before the insert, not to add the user if any is unknown
+	for _, role := range roles {
+		err := r.checkRole(ctx, role)
+		if err != nil {
+			r.Logger.Printf("Failed adding a new user: %v", err)
+			return nil, err
+		}
+	}
+
+	if user.ID == 0 {
+		id, err := r.nextID(ctx)
+		if err != nil {
+			r.Logger.Printf("Failed adding a new user: %v", err)
+			return nil, err
+		}
+		user.ID = id
+	} else if err := r.bumpID(ctx, user.ID); err != nil {
+		r.Logger.Printf("Failed adding a new user: %v", err)
+		return nil, err
+	}
+
+	now := time.Now()
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = now
+	}
+	if user.UpdatedAt.IsZero() {
+		user.UpdatedAt = now
+	}
+
+	user.SetKeys()
+	user.Version = 1
+	_, err := r.Database.Collection(usersCollection).InsertOne(ctx, user)
+	if conflict := conflictOf(err); conflict != nil {
+		err = conflict
+	} else if isDuplicate(err) {
+		err = errs.Conflict(errs.CodeUserExists, "user with ID %v already exists", user.ID)
+	}
+	if err != nil {
+		r.Logger.Printf("Failed adding a new user: %v", err)
+		return nil, err
+	}
+
+	for _, role := range roles {
+		err = r.grantRole(ctx, user.ID, role)
+		if err != nil {
+			r.Logger.Printf("Failed adding a new user: %v", err)
+			r.removeAdded(user.ID)
+			return nil, err
+		}
+	}
+
+	users := []model.User{*user}
+	err = r.loadRoles(ctx, users)
+	if err != nil {
+		return nil, err
+	}
+	user.Roles = users[0].Roles
+
+	return user, nil
+}
+
+// removeAdded removes the user whose roles could not be granted by Add, with the roles granted so far:
+// without transactions, which need a replica set, the insert is undone by hand. The context of Add may
+// be done already, so the removal has a context of its own
+func (r *mongoRepo) removeAdded(id int) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	_, err := r.Database.Collection(userRolesCollection).DeleteMany(ctx, bson.M{"user_id": id})
+	if err == nil {
+		_, err = r.Database.Collection(usersCollection).DeleteOne(ctx, bson.M{"id": id})
+	}
+	if err != nil {
+		r.Logger.Printf("cannot remove user with ID %v, whose roles could not be granted: %v", id, err)
+	}
+}
+
+func (r *mongoRepo) Count(ctx context.Context, filter *model.Filter) (int, error) {
+	r.Logger.Printf("elaborating the count request in MongoDB database")
+
+	err := validateFilter(filter)
+	if err != nil {
+		r.Logger.Printf("there are some problems counting users: %v", err)
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	count, err := r.Database.Collection(usersCollection).CountDocuments(ctx, mongoFilter(filter, nil))
+	if err != nil {
+		r.Logger.Printf("there are some problems counting users: %v", err)
+		return 0, err
+	}
+
+	return int(count), nil
+}
+
+// Delete soft-deletes the user, like the one of the SQLite database
+func (r *mongoRepo) Delete(ctx context.Context, id, version int) error {
+	r.Logger.Printf("request delete user with ID %v from MongoDB database", id)
+
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	now := time.Now()
+	query := mongoCompareAndSwap(bson.M{"id": id, "deleted_at": nil}, version)
+	res, err := r.Database.Collection(usersCollection).UpdateOne(ctx, query, bson.M{
+		"$set":   bson.M{"deleted_at": now, "updated_at": now},
+		"$unset": bson.M{"email_key": "", "nickname_key": ""},
+		"$inc":   bson.M{"version": 1},
+	})
+	if err != nil {
+		r.Logger.Printf("error while deleting user with ID %v: %v", id, err)
+		return err
+	}
+
+	if res.MatchedCount == 0 {
+		err = r.notWritten(ctx, id, version,
+			errs.NotFound(errs.CodeUserNotFound, "error: cannot find user with ID %v", id))
+		r.Logger.Println(err)
+		return err
+	}
+
+	r.Logger.Printf("user with ID %v has been deleted successfully", id)
+	return nil
+}
+
+func (r *mongoRepo) Get(ctx context.Context, id int) (*model.User, error) {
+	r.Logger.Printf("elaborating the listing request in MongoDB database")
+
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	var user model.User
+	err := r.Database.Collection(usersCollection).FindOne(ctx, bson.M{"id": id, "deleted_at": nil}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, errs.NotFound(errs.CodeUserNotFound, "user with ID %v not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	users := []model.User{user}
+	err = r.loadRoles(ctx, users)
+	if err != nil {
+		return nil, err
+	}
+
+	return &users[0], nil
+}
+
+func (r *mongoRepo) GetAll(ctx context.Context, filter *model.Filter, pageSize, page int) ([]model.User, error) {
+	r.Logger.Printf("elaborating the listing request in MongoDB database")
+
+	err := validateFilter(filter)
+	if err != nil {
+		r.Logger.Printf("there are some problems listing users: %v", err)
+		return nil, err
+	}
+
+	opts := options.Find().SetSort(mongoSort(filter.Order()))
+	if pageSize > 0 { // pagination has been requested
+		// like the SQL offset, a negative skip, before the first page, is the first page
+		skip := (page - 1) * pageSize
+		if skip < 0 {
+			skip = 0
+		}
+		opts.SetSkip(int64(skip)).SetLimit(int64(pageSize))
+	}
+
+	return r.find(ctx, mongoFilter(filter, nil), opts)
+}
+
+func (r *mongoRepo) GetAllFrom(ctx context.Context, filter *model.Filter, cursor *model.Cursor, limit int) ([]model.User, error) {
+	r.Logger.Printf("elaborating the listing request from a cursor in MongoDB database")
+
+	err := validateFilterAndCursor(filter, cursor)
+	if err != nil {
+		r.Logger.Printf("there are some problems listing users: %v", err)
+		return nil, err
+	}
+
+	order := filter.Order()
+	if cursor != nil {
+		order = cursor.Order()
+	}
+
+	opts := options.Find().SetSort(mongoSort(order))
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+
+	users, err := r.find(ctx, mongoFilter(filter, cursor), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if cursor != nil && cursor.Backward {
+		reverse(users)
+	}
+
+	return users, nil
+}
+
+// find lists the users matching the query, with their roles
+func (r *mongoRepo) find(ctx context.Context, query bson.M, opts *options.FindOptions) ([]model.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	cursor, err := r.Database.Collection(usersCollection).Find(ctx, query, opts)
+	if err != nil {
+		r.Logger.Printf("there are some problems listing users: %v", err)
+		return nil, err
+	}
+
+	// an empty listing is an empty slice, as in the other databases
+	users := []model.User{}
+	err = cursor.All(ctx, &users)
+	if err != nil {
+		r.Logger.Printf("there are some problems listing users: %v", err)
+		return nil, err
+	}
+
+	err = r.loadRoles(ctx, users)
+	if err != nil {
+		r.Logger.Printf("there are some problems listing users: %v", err)
+		return nil, err
+	}
+
+	if len(users) != 0 {
+		r.Logger.Printf("users have been listed successfully from MongoDB database")
+	} else {
+		r.Logger.Printf("there are some problems listing users")
+	}
+
+	return users, nil
+}
+
+func (r *mongoRepo) Replace(ctx context.Context, user *model.User) (*model.User, error) {
+	r.Logger.Printf("elaborating replace request in MongoDB database")
+
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	user.SetKeys()
+	set := bson.M{
+		"first_name":   user.FirstName,
+		"last_name":    user.LastName,
+		"nickname":     user.Nickname,
+		"password":     user.Password,
+		"email":        user.Email,
+		"country":      user.Country,
+		"updated_at":   time.Now(),
+		"email_key":    user.EmailKey,
+		"nickname_key": user.NicknameKey,
+	}
+	query := mongoCompareAndSwap(bson.M{"id": user.ID, "deleted_at": nil}, user.Version)
+	res, err := r.Database.Collection(usersCollection).UpdateOne(ctx, query,
+		bson.M{"$set": set, "$inc": bson.M{"version": 1}})
+	if conflict := conflictOf(err); conflict != nil {
+		err = conflict
+	}
+	if err == nil && res.MatchedCount == 0 {
+		err = r.notWritten(ctx, user.ID, user.Version,
+			errs.NotFound(errs.CodeUserNotFound, "user with ID %v not found", user.ID))
+	}
+	if err != nil {
+		r.Logger.Printf(err.Error())
+		return nil, err
+	}
+
+	r.Logger.Printf("user has been replaced successfully in MongoDB database")
+	return r.Get(ctx, user.ID)
+}
+
+func (r *mongoRepo) Update(ctx context.Context, user, newUser *model.User) (*model.User, error) {
+	r.Logger.Printf("elaborating update request in MongoDB database")
+
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	// like GORM's Updates, only non-zero fields of newUser are written
+	newUser.SetKeys()
+	set := nonZeroFields(newUser)
+	delete(set, "id")
+	delete(set, "created_at")
+	set["updated_at"] = time.Now()
+
+	query := mongoCompareAndSwap(bson.M{"id": user.ID, "deleted_at": nil}, user.Version)
+	res, err := r.Database.Collection(usersCollection).UpdateOne(ctx, query,
+		bson.M{"$set": set, "$inc": bson.M{"version": 1}})
+	if conflict := conflictOf(err); conflict != nil {
+		err = conflict
+	}
+	if err == nil && res.MatchedCount == 0 {
+		err = r.notWritten(ctx, user.ID, user.Version,
+			errs.NotFound(errs.CodeUserNotFound, "there are some problems updating user with ID %v", user.ID))
+	}
+	if err != nil {
+		r.Logger.Printf(err.Error())
+		return user, err
+	}
+
+	err = r.Database.Collection(usersCollection).FindOne(ctx, bson.M{"id": user.ID}).Decode(user)
+	if err != nil {
+		r.Logger.Printf(err.Error())
+		return user, err
+	}
+
+	r.Logger.Printf("user has been updated successfully in MongoDB database")
+	return user, nil
+}
+
+func (r *mongoRepo) Restore(ctx context.Context, id int) (*model.User, error) {
+	r.Logger.Printf("request restore user with ID %v in MongoDB database", id)
+
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	var user model.User
+	err := r.Database.Collection(usersCollection).FindOne(ctx, bson.M{"id": id, "deleted_at": bson.M{"$ne": nil}}).
+		Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		err = errs.NotFound(errs.CodeUserNotFound, "cannot find deleted user with ID %v", id)
+	}
+	if err != nil {
+		r.Logger.Printf("error while restoring user with ID %v: %v", id, err)
+		return nil, err
+	}
+
+	// the email or the nickname may have been taken in the meanwhile
+	user.SetKeys()
+	_, err = r.Database.Collection(usersCollection).UpdateOne(ctx, bson.M{"id": id}, bson.M{
+		"$set":   bson.M{"email_key": user.EmailKey, "nickname_key": user.NicknameKey, "updated_at": time.Now()},
+		"$unset": bson.M{"deleted_at": ""},
+		"$inc":   bson.M{"version": 1},
+	})
+	if conflict := conflictOf(err); conflict != nil {
+		err = conflict
+	}
+	if err != nil {
+		r.Logger.Printf("error while restoring user with ID %v: %v", id, err)
+		return nil, err
+	}
+
+	r.Logger.Printf("user with ID %v has been restored successfully", id)
+	return r.Get(ctx, id)
+}
+
+func (r *mongoRepo) Purge(ctx context.Context, before time.Time) (int, error) {
+	r.Logger.Printf("request purge users deleted before %v from MongoDB database", before)
+
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	cursor, err := r.Database.Collection(usersCollection).Find(ctx, bson.M{"deleted_at": bson.M{"$lt": before}},
+		options.Find().SetProjection(bson.M{"id": 1}))
+	if err != nil {
+		r.Logger.Printf("error while purging users: %v", err)
+		return 0, err
+	}
+
+	var users []model.User
+	err = cursor.All(ctx, &users)
+	if err != nil || len(users) == 0 {
+		return 0, err
+	}
+
+	ids := make([]int, len(users))
+	for i, user := range users {
+		ids[i] = user.ID
+	}
+
+	// the roles and the tokens first: if the purge fails, the users are still there to purge next time
+	for _, collection := range []string{userRolesCollection, tokensCollection} {
+		_, err = r.Database.Collection(collection).DeleteMany(ctx, bson.M{"user_id": bson.M{"$in": ids}})
+		if err != nil {
+			r.Logger.Printf("error while purging users: %v", err)
+			return 0, err
+		}
+	}
+
+	res, err := r.Database.Collection(usersCollection).DeleteMany(ctx, bson.M{"id": bson.M{"$in": ids}})
+	if err != nil {
+		r.Logger.Printf("error while purging users: %v", err)
+		return 0, err
+	}
+
+	r.Logger.Printf("%v users have been purged successfully", res.DeletedCount)
+	return int(res.DeletedCount), nil
+}
+
+func (r *mongoRepo) GrantRole(ctx context.Context, userID int, role string) error {
+	r.Logger.Printf("request grant role %v to user with ID %v in MongoDB database", role, userID)
+
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	err := r.grantRole(ctx, userID, role)
+	if err != nil {
+		return err
+	}
+
+	return r.bumpVersion(ctx, userID)
+}
+
+func (r *mongoRepo) RevokeRole(ctx context.Context, userID int, role string) error {
+	r.Logger.Printf("request revoke role %v from user with ID %v in MongoDB database", role, userID)
+
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	err := r.checkUserAndRole(ctx, userID, role)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.Database.Collection(userRolesCollection).DeleteOne(ctx, bson.M{"user_id": userID, "role": role})
+	if err != nil {
+		return err
+	}
+
+	return r.bumpVersion(ctx, userID)
+}
+
+func (r *mongoRepo) AddRefreshToken(ctx context.Context, token *model.RefreshToken) error {
+	r.Logger.Printf("request add a refresh token of user with ID %v to MongoDB database", token.UserID)
+
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	if token.CreatedAt.IsZero() {
+		token.CreatedAt = time.Now()
+	}
+
+	_, err := r.Database.Collection(tokensCollection).InsertOne(ctx, token)
+	if isDuplicate(err) {
+		err = errs.Conflict(errs.CodeRefreshTokenExists, "refresh token already exists")
+	}
+	if err != nil {
+		r.Logger.Printf("Failed adding a new refresh token: %v", err)
+	}
+
+	return err
+}
+
+func (r *mongoRepo) GetRefreshToken(ctx context.Context, hash string) (*model.RefreshToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	var token model.RefreshToken
+	err := r.Database.Collection(tokensCollection).FindOne(ctx, bson.M{"hash": hash}).Decode(&token)
+	if err == mongo.ErrNoDocuments {
+		return nil, errs.NotFound(errs.CodeRefreshTokenNotFound, "refresh token not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// RevokeRefreshToken revokes the token only if it hasn't been revoked yet, so that a refresh token
+// can be exchanged exactly once even by concurrent requests
+func (r *mongoRepo) RevokeRefreshToken(ctx context.Context, hash string) error {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	res, err := r.Database.Collection(tokensCollection).UpdateOne(ctx,
+		bson.M{"hash": hash, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount == 0 {
+		return errs.Conflict(errs.CodeRefreshTokenRevoked, "refresh token not found or already revoked")
+	}
+
+	return nil
+}
+
+func (r *mongoRepo) RevokeRefreshTokenFamily(ctx context.Context, family string) error {
+	r.Logger.Printf("request revoke refresh token family %v in MongoDB database", family)
+
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	_, err := r.Database.Collection(tokensCollection).UpdateMany(ctx,
+		bson.M{"family": family, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+
+	return err
+}
+
+// seedRoles creates the default roles and permissions, if they don't exist yet
+func (r *mongoRepo) seedRoles(ctx context.Context) error {
+	for _, role := range model.DefaultRoles {
+		_, err := r.Database.Collection(rolesCollection).UpdateOne(ctx,
+			bson.M{"name": role.Name},
+			bson.M{"$addToSet": bson.M{"permissions": bson.M{"$each": role.Permissions}}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backfillKeys sets the keys of the users stored before the emails and the nicknames were unique, like
+// the homonym function of the SQLite database
+func (r *mongoRepo) backfillKeys(ctx context.Context) error {
+	cursor, err := r.Database.Collection(usersCollection).Find(ctx, bson.M{"deleted_at": nil, "$or": bson.A{
+		bson.M{"email_key": bson.M{"$exists": false}},
+		bson.M{"nickname_key": bson.M{"$exists": false}},
+	}})
+	if err != nil {
+		return err
+	}
+
+	var users []model.User
+	err = cursor.All(ctx, &users)
+	if err != nil {
+		return err
+	}
+
+	for i := range users {
+		users[i].SetKeys()
+		_, err = r.Database.Collection(usersCollection).UpdateOne(ctx, bson.M{"id": users[i].ID}, bson.M{"$set": bson.M{
+			"email_key":    users[i].EmailKey,
+			"nickname_key": users[i].NicknameKey,
+		}})
+		if conflict := conflictOf(err); conflict != nil {
+			r.Logger.Printf("cannot set the keys of user with ID %v: %v", users[i].ID, conflict)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bumpVersion increments the version of the user with the ID
+func (r *mongoRepo) bumpVersion(ctx context.Context, id int) error {
+	_, err := r.Database.Collection(usersCollection).UpdateOne(ctx, bson.M{"id": id}, bson.M{"$inc": bson.M{"version": 1}})
+	return err
+}
+
+// notWritten returns the error of a write to the user, like the homonym function of the SQLite database
+func (r *mongoRepo) notWritten(ctx context.Context, id, version int, notFound error) error {
+	if version == 0 {
+		return notFound
+	}
+
+	n, err := r.Database.Collection(usersCollection).CountDocuments(ctx, bson.M{"id": id, "deleted_at": nil})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFound
+	}
+
+	return versionMismatch(id, version)
+}
+
+func (r *mongoRepo) checkUserAndRole(ctx context.Context, userID int, role string) error {
+	n, err := r.Database.Collection(usersCollection).CountDocuments(ctx, bson.M{"id": userID, "deleted_at": nil})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errs.NotFound(errs.CodeUserNotFound, "user with ID %v not found", userID)
+	}
+
+	return r.checkRole(ctx, role)
+}
+
+func (r *mongoRepo) checkRole(ctx context.Context, role string) error {
+	n, err := r.Database.Collection(rolesCollection).CountDocuments(ctx, bson.M{"name": role})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errs.NotFound(errs.CodeRoleNotFound, "role %v not found", role)
+	}
+
+	return nil
+}
+
+func (r *mongoRepo) grantRole(ctx context.Context, userID int, role string) error {
+	err := r.checkUserAndRole(ctx, userID, role)
+	if err != nil {
+		return err
+	}
+
+	assignment := userRole{UserID: userID, Role: role}
+	_, err = r.Database.Collection(userRolesCollection).UpdateOne(ctx,
+		bson.M{"user_id": userID, "role": role},
+		bson.M{"$setOnInsert": assignment},
+		options.Update().SetUpsert(true),
+	)
+
+	return err
+}
+
+// loadRoles fills the roles, with their permissions, of the users
+func (r *mongoRepo) loadRoles(ctx context.Context, users []model.User) error {
+	if len(users) == 0 {
+		return nil
+	}
+
+	ids := make([]int, len(users))
+	for i := range users {
+		ids[i] = users[i].ID
+	}
+
+	cursor, err := r.Database.Collection(userRolesCollection).Find(ctx, bson.M{"user_id": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	var assignments []userRole
+	err = cursor.All(ctx, &assignments)
+	if err != nil {
+		return err
+	}
+
+	cursor, err = r.Database.Collection(rolesCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	var roles []model.Role
+	err = cursor.All(ctx, &roles)
+	if err != nil {
+		return err
+	}
+
+	rolesByName := map[string]model.Role{}
+	for _, role := range roles {
+		rolesByName[role.Name] = role
+	}
+
+	rolesByUser := map[int][]model.Role{}
+	for _, a := range assignments {
+		rolesByUser[a.UserID] = append(rolesByUser[a.UserID], rolesByName[a.Role])
+	}
+
+	for i := range users {
+		users[i].Roles = rolesByUser[users[i].ID]
+	}
+
+	return nil
+}
+
+// nextID atomically increments the users counter and returns the new value
+func (r *mongoRepo) nextID(ctx context.Context) (int, error) {
+	var c counter
+	err := r.Database.Collection(countersCollection).FindOneAndUpdate(ctx,
+		bson.M{"_id": usersCollection},
+		bson.M{"$inc": bson.M{"seq": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&c)
+
+	return c.Seq, err
+}
+
+// bumpID moves the users counter forward when a user is added with an explicit ID,
+// so that the following auto-incremental IDs don't collide with it
+func (r *mongoRepo) bumpID(ctx context.Context, id int) error {
+	_, err := r.Database.Collection(countersCollection).UpdateOne(ctx,
+		bson.M{"_id": usersCollection},
+		bson.M{"$max": bson.M{"seq": id}},
+		options.Update().SetUpsert(true),
+	)
+
+	return err
+}
+
+func (r *mongoRepo) Close() error {
+	r.Logger.Printf("disconnecting from MongoDB")
+
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	return r.Client.Disconnect(ctx)
+}
@@ -0,0 +1,435 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/pavelerokhin/user-microservice-go/errs"
+	"github.com/pavelerokhin/user-microservice-go/model"
+)
+
+// MongoDB tests run against the server of MONGO_URI, e.g.
+// MONGO_URI=mongodb://localhost:27017 go test ./repository/...
+// Without MONGO_URI they run against a mongod spawned in a temporary directory, if it is installed, and
+// are skipped otherwise. Either way they drop their own database only
+var mongoDBName = "user-repository-testing"
+
+var testMongo struct {
+	once sync.Once
+	dir  string
+	cmd  *exec.Cmd
+	uri  string
+	err  error
+}
+
+func setupMongoTestCase(t *testing.T) UserRepository {
+	uri := mongoURI(t)
+	r, err := NewMongoRepo(uri, mongoDBName, testLogger)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		mr := r.(*mongoRepo)
+		require.NoError(t, mr.Database.Drop(context.Background()))
+		require.NoError(t, mr.Client.Disconnect(context.Background()))
+	})
+
+	return r
+}
+
+// mongoURI returns the URI of the server of the tests, skipping them if there is none
+func mongoURI(t *testing.T) string {
+	if uri := os.Getenv("MONGO_URI"); uri != "" {
+		return uri
+	}
+
+	testMongo.once.Do(func() {
+		testMongo.uri, testMongo.err = spawnMongo()
+	})
+	if testMongo.err != nil {
+		t.Skipf("MONGO_URI is not set and no mongod can be spawned, skipping MongoDB tests: %v", testMongo.err)
+	}
+
+	return testMongo.uri
+}
+
+// spawnMongo starts a mongod storing its data in a temporary directory on a free port, returning its
+// URI once it accepts connections
+func spawnMongo() (string, error) {
+	mongod, err := exec.LookPath("mongod")
+	if err != nil {
+		return "", err
+	}
+
+	testMongo.dir, err = os.MkdirTemp("", "user-repository-testing")
+	if err != nil {
+		return "", err
+	}
+	data := filepath.Join(testMongo.dir, "data")
+	err = os.Mkdir(data, 0o700)
+	if err != nil {
+		return "", err
+	}
+
+	port, err := freePort()
+	if err != nil {
+		return "", err
+	}
+	testMongo.cmd = exec.Command(mongod, "--dbpath", data, "--bind_ip", "127.0.0.1", "--port", strconv.Itoa(port),
+		"--unixSocketPrefix", testMongo.dir, "--logpath", filepath.Join(testMongo.dir, "log"))
+	err = testMongo.cmd.Start()
+	if err != nil {
+		return "", fmt.Errorf("mongod start failed: %v", err)
+	}
+
+	uri := fmt.Sprintf("mongodb://127.0.0.1:%v", port)
+	client, err := mongo.NewClient(options.Client().ApplyURI(uri))
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err = client.Connect(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer client.Disconnect(context.Background())
+
+	for {
+		err = client.Ping(ctx, nil)
+		if err == nil {
+			return uri, nil
+		}
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("mongod does not accept connections: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// stopMongo stops the mongod spawned for the tests, if any, and removes its directory
+func stopMongo() {
+	if testMongo.cmd != nil && testMongo.cmd.Process != nil {
+		_ = testMongo.cmd.Process.Signal(os.Interrupt)
+		_ = testMongo.cmd.Wait()
+	}
+	if testMongo.dir != "" {
+		_ = os.RemoveAll(testMongo.dir)
+	}
+}
+
+func newMongoTestUsers() []model.User {
+	return []model.User{
+		{FirstName: "user1", LastName: "y", Nickname: "z", Password: "1", Email: "a@b.com", Country: "Y"},
+		{FirstName: "user2", LastName: "y", Nickname: "x", Password: "1", Email: "x@b.com", Country: "X"},
+	}
+}
+
+// NewMongoRepo function testing
+func TestNewMongoRepoEmptyURIKO(t *testing.T) {
+	r, err := NewMongoRepo("", mongoDBName, testLogger)
+	require.Error(t, err)
+	require.Equal(t, "database URI is empty", err.Error())
+	require.Empty(t, r)
+}
+
+// Add function testing
+func TestMongoAddOK(t *testing.T) {
+	r := setupMongoTestCase(t)
+	users := newMongoTestUsers()
+
+	result, err := r.Add(context.Background(), &users[0])
+	require.NoError(t, err)
+	require.Equal(t, 1, result.ID)
+	require.False(t, result.CreatedAt.IsZero())
+	require.False(t, result.UpdatedAt.IsZero())
+
+	result, err = r.Add(context.Background(), &users[1])
+	require.NoError(t, err)
+	require.Equal(t, 2, result.ID)
+}
+
+func TestMongoAddExplicitIDOK(t *testing.T) {
+	r := setupMongoTestCase(t)
+	users := newMongoTestUsers()
+
+	users[0].ID = 10
+	_, err := r.Add(context.Background(), &users[0])
+	require.NoError(t, err)
+
+	result, err := r.Add(context.Background(), &users[1])
+	require.NoError(t, err)
+	require.Equal(t, 11, result.ID)
+}
+
+func TestMongoAddNotUniqueKO(t *testing.T) {
+	r := setupMongoTestCase(t)
+	users := newMongoTestUsers()
+
+	_, err := r.Add(context.Background(), &users[0])
+	require.NoError(t, err)
+
+	duplicate := users[1]
+	duplicate.ID = users[0].ID
+	result, err := r.Add(context.Background(), &duplicate)
+	require.Error(t, err)
+	require.Nil(t, result)
+}
+
+func TestMongoAddGrantFailedKO(t *testing.T) {
+	r := setupMongoTestCase(t)
+	mr := r.(*mongoRepo)
+	users := newMongoTestUsers()
+
+	// the grants of the default role are rejected
+	require.NoError(t, mr.Database.RunCommand(context.Background(), bson.D{
+		{Key: "collMod", Value: userRolesCollection},
+		{Key: "validator", Value: bson.M{"role": bson.M{"$ne": model.RoleUser}}},
+	}).Err())
+
+	result, err := r.Add(context.Background(), &users[0])
+	require.Error(t, err)
+	require.Nil(t, result)
+
+	// no user has been added
+	n, err := mr.Database.Collection(usersCollection).CountDocuments(context.Background(), bson.M{})
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
+
+func TestMongoAddNotUniqueEmailNicknameKO(t *testing.T) {
+	r := setupMongoTestCase(t)
+	users := newMongoTestUsers()
+
+	_, err := r.Add(context.Background(), &users[0])
+	require.NoError(t, err)
+
+	users[1].Email = strings.ToUpper(users[0].Email)
+	result, err := r.Add(context.Background(), &users[1])
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeEmailTaken})
+	require.Nil(t, result)
+
+	users[1].Email = "x@b.com"
+	users[1].Nickname = strings.ToUpper(users[0].Nickname)
+	result, err = r.Add(context.Background(), &users[1])
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeNicknameTaken})
+	require.Nil(t, result)
+}
+
+// Delete function testing
+func TestMongoDeleteOK(t *testing.T) {
+	r := setupMongoTestCase(t)
+	users := newMongoTestUsers()
+
+	_, _ = r.Add(context.Background(), &users[0])
+	require.NoError(t, r.Delete(context.Background(), users[0].ID, 0))
+
+	_, err := r.Get(context.Background(), users[0].ID)
+	require.Error(t, err)
+}
+
+func TestMongoDeleteRestorePurgeOK(t *testing.T) {
+	r := setupMongoTestCase(t)
+	users := newMongoTestUsers()
+
+	_, err := r.Add(context.Background(), &users[0])
+	require.NoError(t, err)
+	require.NoError(t, r.Delete(context.Background(), users[0].ID, 0))
+
+	listed, err := r.GetAll(context.Background(), nil, 0, 0)
+	require.NoError(t, err)
+	require.Empty(t, listed)
+	listed, err = r.GetAll(context.Background(), &model.Filter{IncludeDeleted: true}, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	require.NotNil(t, listed[0].DeletedAt)
+
+	// the nickname of the deleted user is free
+	users[1].Nickname = users[0].Nickname
+	_, err = r.Add(context.Background(), &users[1])
+	require.NoError(t, err)
+	_, err = r.Restore(context.Background(), users[0].ID)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeNicknameTaken})
+
+	require.NoError(t, r.Delete(context.Background(), users[1].ID, 0))
+	restored, err := r.Restore(context.Background(), users[0].ID)
+	require.NoError(t, err)
+	require.Nil(t, restored.DeletedAt)
+
+	n, err := r.Purge(context.Background(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	_, err = r.Restore(context.Background(), users[1].ID)
+	require.ErrorIs(t, err, errs.ErrNotFound)
+}
+
+func TestMongoDeleteNoIdKO(t *testing.T) {
+	r := setupMongoTestCase(t)
+
+	err := r.Delete(context.Background(), 1, 0)
+	require.Error(t, err)
+	require.Equal(t, "error: cannot find user with ID 1", err.Error())
+}
+
+// Get function testing
+func TestMongoGetOK(t *testing.T) {
+	r := setupMongoTestCase(t)
+	users := newMongoTestUsers()
+
+	user, err := r.Add(context.Background(), &users[0])
+	require.NoError(t, err)
+
+	userGet, err := r.Get(context.Background(), user.ID)
+	require.NoError(t, err)
+	require.Equal(t, user.ID, userGet.ID)
+	require.Equal(t, user.FirstName, userGet.FirstName)
+	require.Equal(t, user.Nickname, userGet.Nickname)
+	require.Equal(t, user.Email, userGet.Email)
+}
+
+func TestMongoGetNoIdKO(t *testing.T) {
+	r := setupMongoTestCase(t)
+
+	user, err := r.Get(context.Background(), 1)
+	require.Nil(t, user)
+	require.Error(t, err)
+	require.Equal(t, fmt.Sprintf("user with ID %v not found", 1), err.Error())
+}
+
+// GetAll function testing
+func TestMongoGetAllPaginationFilteringOK(t *testing.T) {
+	r := setupMongoTestCase(t)
+	users := newMongoTestUsers()
+
+	_, _ = r.Add(context.Background(), &users[0])
+	_, _ = r.Add(context.Background(), &users[1])
+
+	all, err := r.GetAll(context.Background(), nil, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+
+	page, err := r.GetAll(context.Background(), nil, 1, 2)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	require.Equal(t, users[1].ID, page[0].ID)
+
+	filtered, err := r.GetAll(context.Background(), &model.Filter{Conditions: []model.Condition{
+		{Field: "country", Op: model.OpEq, Values: []interface{}{"X"}},
+	}}, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, filtered, 1)
+	require.Equal(t, users[1].FirstName, filtered[0].FirstName)
+
+	filtered, err = r.GetAll(context.Background(), &model.Filter{
+		Conditions: []model.Condition{{Field: "email", Op: model.OpLike, Values: []interface{}{"%@B.COM"}}},
+		Sort:       []model.SortKey{{Field: "id", Desc: true}},
+	}, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, filtered, 2)
+	require.Equal(t, users[1].ID, filtered[0].ID)
+}
+
+// Count function testing
+func TestMongoCountOK(t *testing.T) {
+	r := setupMongoTestCase(t)
+	users := newMongoTestUsers()
+
+	_, _ = r.Add(context.Background(), &users[0])
+	_, _ = r.Add(context.Background(), &users[1])
+
+	count, err := r.Count(context.Background(), nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	count, err = r.Count(context.Background(), &model.Filter{Conditions: []model.Condition{
+		{Field: "country", Op: model.OpEq, Values: []interface{}{"X"}},
+	}})
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+}
+
+// GetAllFrom function testing
+func TestMongoGetAllFromOK(t *testing.T) {
+	r := setupMongoTestCase(t)
+	users := newMongoTestUsers()
+
+	_, _ = r.Add(context.Background(), &users[0])
+	_, _ = r.Add(context.Background(), &users[1])
+	filter := &model.Filter{Sort: []model.SortKey{{Field: "country"}}}
+
+	first, err := r.GetAllFrom(context.Background(), filter, nil, 1)
+	require.NoError(t, err)
+	require.Len(t, first, 1)
+	require.Equal(t, users[1].ID, first[0].ID)
+
+	next, err := r.GetAllFrom(context.Background(), filter, model.NewCursor(filter, &first[0], false), 1)
+	require.NoError(t, err)
+	require.Len(t, next, 1)
+	require.Equal(t, users[0].ID, next[0].ID)
+
+	prev, err := r.GetAllFrom(context.Background(), filter, model.NewCursor(filter, &next[0], true), 1)
+	require.NoError(t, err)
+	require.Equal(t, first[0].ID, prev[0].ID)
+}
+
+// Update function testing
+func TestMongoUpdateOK(t *testing.T) {
+	r := setupMongoTestCase(t)
+	users := newMongoTestUsers()
+
+	_, _ = r.Add(context.Background(), &users[0])
+	createdAt := users[0].CreatedAt
+
+	user, err := r.Update(context.Background(), &users[0], &model.User{FirstName: "updated"})
+	require.NoError(t, err)
+	require.Equal(t, "updated", user.FirstName)
+	require.Equal(t, "y", user.LastName)
+	require.True(t, user.UpdatedAt.After(createdAt) || user.UpdatedAt.Equal(createdAt))
+
+	userGet, err := r.Get(context.Background(), users[0].ID)
+	require.NoError(t, err)
+	require.Equal(t, "updated", userGet.FirstName)
+}
+
+func TestMongoCompareAndSwapVersionKO(t *testing.T) {
+	r := setupMongoTestCase(t)
+	users := newMongoTestUsers()
+
+	_, err := r.Add(context.Background(), &users[0])
+	require.NoError(t, err)
+	require.Equal(t, 1, users[0].Version)
+
+	stale := users[0]
+	updated, err := r.Update(context.Background(), &users[0], &model.User{FirstName: "updated"})
+	require.NoError(t, err)
+	require.Equal(t, 2, updated.Version)
+
+	_, err = r.Update(context.Background(), &stale, &model.User{FirstName: "stale"})
+	require.ErrorIs(t, err, errs.ErrPreconditionFailed)
+	_, err = r.Replace(context.Background(), &stale)
+	require.ErrorIs(t, err, errs.ErrPreconditionFailed)
+	require.ErrorIs(t, r.Delete(context.Background(), stale.ID, stale.Version), errs.ErrPreconditionFailed)
+
+	got, err := r.Get(context.Background(), stale.ID)
+	require.NoError(t, err)
+	require.Equal(t, "updated", got.FirstName)
+
+	replaced, err := r.Replace(context.Background(), got)
+	require.NoError(t, err)
+	require.Equal(t, 3, replaced.Version)
+	require.NoError(t, r.GrantRole(context.Background(), stale.ID, model.RoleAdmin))
+	require.NoError(t, r.Delete(context.Background(), stale.ID, 4))
+	require.ErrorIs(t, r.Delete(context.Background(), stale.ID, 5), errs.ErrNotFound)
+}
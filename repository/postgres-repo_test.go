@@ -0,0 +1,248 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"github.com/pavelerokhin/user-microservice-go/errs"
+	"github.com/pavelerokhin/user-microservice-go/model"
+)
+
+// PostgreSQL tests run against the server of POSTGRES_TEST_DSN, e.g.
+// POSTGRES_TEST_DSN=postgres://postgres@localhost:5432/users_testing?sslmode=disable go test ./repository/...
+// Each test creates a schema of its own in the database, and drops it afterwards: the other schemas of
+// the database are never touched. POSTGRES_DSN, the database of the microservice, is never used.
+// Without POSTGRES_TEST_DSN they run against a server spawned in a temporary directory, if the PostgreSQL
+// binaries (initdb and pg_ctl) are installed, and are skipped otherwise
+var testPostgres struct {
+	once    sync.Once
+	dir     string
+	dsn     string
+	err     error
+	schemas int64
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	stopPostgres()
+	stopMongo()
+	os.Exit(code)
+}
+
+func setupPostgresTestCase(t *testing.T) UserRepository {
+	dsn := postgresTestSchema(t)
+	r, err := NewPostgresRepo(DefaultPostgresConfig(dsn), testLogger)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		require.NoError(t, r.Close())
+	})
+
+	return r
+}
+
+// postgresTestSchema creates a new schema in the database of the tests, dropped with the tables of the
+// migrations once the test is over, and returns the DSN of the database with the schema as search path
+func postgresTestSchema(t *testing.T) string {
+	dsn := postgresDSN(t)
+	schema := fmt.Sprintf("users_testing_%v_%v", os.Getpid(), atomic.AddInt64(&testPostgres.schemas, 1))
+
+	db, err := openPostgres(DefaultPostgresConfig(dsn))
+	require.NoError(t, err)
+	require.NoError(t, db.Exec("CREATE SCHEMA "+schema).Error)
+
+	t.Cleanup(func() {
+		require.NoError(t, db.Exec("DROP SCHEMA "+schema+" CASCADE").Error)
+		pool, err := db.DB()
+		require.NoError(t, err)
+		require.NoError(t, pool.Close())
+	})
+
+	return withSearchPath(dsn, schema)
+}
+
+// withSearchPath returns the DSN, either a URL or key=value pairs, with the schema as search path
+func withSearchPath(dsn, schema string) string {
+	u, err := url.Parse(dsn)
+	if err != nil || u.Scheme == "" {
+		return dsn + " search_path=" + schema
+	}
+
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// postgresDSN returns the DSN of the database of the tests, skipping them if there is none
+func postgresDSN(t *testing.T) string {
+	if dsn := os.Getenv("POSTGRES_TEST_DSN"); dsn != "" {
+		return dsn
+	}
+
+	testPostgres.once.Do(func() {
+		testPostgres.dsn, testPostgres.err = spawnPostgres()
+	})
+	if testPostgres.err != nil {
+		t.Skipf("POSTGRES_TEST_DSN is not set and no PostgreSQL server can be spawned, skipping PostgreSQL tests: %v",
+			testPostgres.err)
+	}
+
+	return testPostgres.dsn
+}
+
+// spawnPostgres initializes a database cluster in a temporary directory and starts its server on a
+// free port, returning its DSN
+func spawnPostgres() (string, error) {
+	initdb, err := postgresBinary("initdb")
+	if err != nil {
+		return "", err
+	}
+	pgCtl, err := postgresBinary("pg_ctl")
+	if err != nil {
+		return "", err
+	}
+
+	testPostgres.dir, err = os.MkdirTemp("", "user-repository-testing")
+	if err != nil {
+		return "", err
+	}
+	data := filepath.Join(testPostgres.dir, "data")
+	out, err := exec.Command(initdb, "-D", data, "-U", "postgres", "-A", "trust", "-E", "UTF8",
+		"--locale=C").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("initdb failed: %v: %s", err, out)
+	}
+
+	port, err := freePort()
+	if err != nil {
+		return "", err
+	}
+	options := fmt.Sprintf("-h 127.0.0.1 -p %v -k %v", port, testPostgres.dir)
+	out, err = exec.Command(pgCtl, "-D", data, "-o", options, "-l", filepath.Join(testPostgres.dir, "log"),
+		"-w", "start").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("pg_ctl start failed: %v: %s", err, out)
+	}
+
+	return fmt.Sprintf("host=127.0.0.1 port=%v user=postgres dbname=postgres sslmode=disable", port), nil
+}
+
+// stopPostgres stops the server spawned for the tests, if any, and removes its directory
+func stopPostgres() {
+	if testPostgres.dir == "" {
+		return
+	}
+
+	if pgCtl, err := postgresBinary("pg_ctl"); err == nil {
+		_ = exec.Command(pgCtl, "-D", filepath.Join(testPostgres.dir, "data"), "-m", "fast", "-w", "stop").Run()
+	}
+	_ = os.RemoveAll(testPostgres.dir)
+}
+
+// postgresBinary returns the path of the PostgreSQL binary, looked up in the PATH and in the directories
+// of the Debian packages
+func postgresBinary(name string) (string, error) {
+	path, err := exec.LookPath(name)
+	if err == nil {
+		return path, nil
+	}
+
+	paths, _ := filepath.Glob(filepath.Join("/usr/lib/postgresql/*/bin", name))
+	if len(paths) == 0 {
+		return "", err
+	}
+
+	return paths[len(paths)-1], nil
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// NewPostgresRepo function testing
+func TestNewPostgresRepoEmptyDSNKO(t *testing.T) {
+	r, err := NewPostgresRepo(DefaultPostgresConfig(""), testLogger)
+	require.Error(t, err)
+	require.Equal(t, "database DSN is empty", err.Error())
+	require.Empty(t, r)
+}
+
+func TestPostgresUniqueKeysCaseInsensitiveKO(t *testing.T) {
+	r := setupPostgresTestCase(t)
+	db := r.(*repo).DB
+
+	// a key written by other means than the repository, not case-folded
+	require.NoError(t, db.Exec("INSERT INTO users (first_name, email, email_key, nickname, nickname_key) "+
+		"VALUES ('a', 'ANN@B.COM', 'ANN@B.COM', 'a', 'a')").Error)
+
+	_, err := r.Add(context.Background(), &model.User{FirstName: "b", LastName: "b", Nickname: "bob", Password: "1",
+		Email: "ann@b.com", Country: "Y"})
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeEmailTaken})
+}
+
+func TestPostgresPoolOK(t *testing.T) {
+	dsn := postgresDSN(t)
+	config := DefaultPostgresConfig(dsn)
+	config.MaxOpenConns = 3
+
+	db, err := openPostgres(config)
+	require.NoError(t, err)
+	pool, err := db.DB()
+	require.NoError(t, err)
+	defer pool.Close()
+	require.Equal(t, 3, pool.Stats().MaxOpenConnections)
+	require.NoError(t, db.Transaction(func(tx *gorm.DB) error { return tx.Exec("SELECT 1").Error }))
+}
+
+func TestNewPostgresRepoConcurrentOK(t *testing.T) {
+	dsn := postgresTestSchema(t)
+
+	// replicas starting together against an empty database
+	const replicas = 4
+	repos := make([]UserRepository, replicas)
+	failures := make([]error, replicas)
+	var wg sync.WaitGroup
+	for i := 0; i < replicas; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			repos[i], failures[i] = NewPostgresRepo(DefaultPostgresConfig(dsn), testLogger)
+		}(i)
+	}
+	wg.Wait()
+
+	t.Cleanup(func() {
+		for _, r := range repos {
+			if r != nil {
+				require.NoError(t, r.Close())
+			}
+		}
+	})
+
+	for i := range failures {
+		require.NoError(t, failures[i], "replica %v", i)
+	}
+
+	var roles int64
+	require.NoError(t, repos[0].(*repo).DB.Model(&model.Role{}).Count(&roles).Error)
+	require.Equal(t, int64(len(model.DefaultRoles)), roles)
+}
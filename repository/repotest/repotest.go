@@ -0,0 +1,1030 @@
+// pkg implements the conformance tests of the UserRepository implementations: the behavior every
+// backend shares, so that the SQLite, PostgreSQL, MongoDB, in-memory and future backends can be used
+// interchangeably. A backend conforms if Run passes against it
+
+package repotest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pavelerokhin/user-microservice-go/errs"
+	"github.com/pavelerokhin/user-microservice-go/model"
+	"github.com/pavelerokhin/user-microservice-go/repository"
+)
+
+// precision is the precision of the times stored by every backend: MongoDB stores milliseconds
+const precision = time.Millisecond
+
+// concurrency is the number of the concurrent requests of the concurrency tests
+const concurrency = 10
+
+// Factory returns a new, empty repository, with the default roles only. The repository is released by
+// the cleanups of the test
+type Factory func(t *testing.T) repository.UserRepository
+
+// Run runs the conformance tests, each one against a new repository of the factory. The tests run one
+// after the other, so that the factories may share a database between the repositories
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, r repository.UserRepository)
+	}{
+		{"AddOK", testAddOK},
+		{"AddCreationTimeOK", testAddCreationTimeOK},
+		{"AddRolesOK", testAddRolesOK},
+		{"AddUnknownRoleKO", testAddUnknownRoleKO},
+		{"AddNotUniqueKO", testAddNotUniqueKO},
+		{"GetNotFoundKO", testGetNotFoundKO},
+		{"GetAllOK", testGetAllOK},
+		{"GetAllEmptyOK", testGetAllEmptyOK},
+		{"GetAllPaginationOK", testGetAllPaginationOK},
+		{"GetAllFilteringOK", testGetAllFilteringOK},
+		{"GetAllSortOK", testGetAllSortOK},
+		{"GetAllDeletedOK", testGetAllDeletedOK},
+		{"GetAllInvalidFilterKO", testGetAllInvalidFilterKO},
+		{"GetAllFromOK", testGetAllFromOK},
+		{"GetAllFromInvalidCursorKO", testGetAllFromInvalidCursorKO},
+		{"ReplaceOK", testReplaceOK},
+		{"ReplaceKO", testReplaceKO},
+		{"UpdateOK", testUpdateOK},
+		{"UpdateZeroValuesOK", testUpdateZeroValuesOK},
+		{"UpdateKO", testUpdateKO},
+		{"DeleteOK", testDeleteOK},
+		{"DeleteKO", testDeleteKO},
+		{"RestoreOK", testRestoreOK},
+		{"RestoreKO", testRestoreKO},
+		{"PurgeOK", testPurgeOK},
+		{"TimestampsOK", testTimestampsOK},
+		{"GrantRevokeRoleOK", testGrantRevokeRoleOK},
+		{"GrantRevokeRoleKO", testGrantRevokeRoleKO},
+		{"RefreshTokensOK", testRefreshTokensOK},
+		{"RevokeRefreshTokenFamilyOK", testRevokeRefreshTokenFamilyOK},
+		{"ConcurrentAddOK", testConcurrentAddOK},
+		{"ConcurrentAddNotUniqueKO", testConcurrentAddNotUniqueKO},
+		{"ConcurrentUpdateKO", testConcurrentUpdateKO},
+		{"ConcurrentRevokeRefreshTokenKO", testConcurrentRevokeRefreshTokenKO},
+		{"CanceledKO", testCanceledKO},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, factory(t))
+		})
+	}
+}
+
+// newUsers returns users to add, sorted by first name: alice, bob and carol
+func newUsers() []model.User {
+	return []model.User{
+		{FirstName: "alice", LastName: "smith", Nickname: "al", Password: "1", Email: "alice@b.com", Country: "uk"},
+		{FirstName: "bob", LastName: "smith", Nickname: "bo", Password: "2", Email: "bob@b.com", Country: "it"},
+		{FirstName: "carol", LastName: "jones", Nickname: "ca", Password: "3", Email: "carol@b.com", Country: "it"},
+	}
+}
+
+// addUsers adds the users to the repository and returns them as added
+func addUsers(t *testing.T, r repository.UserRepository, users ...model.User) []model.User {
+	t.Helper()
+
+	added := make([]model.User, 0, len(users))
+	for i := range users {
+		user := users[i]
+		result, err := r.Add(context.Background(), &user)
+		require.NoError(t, err)
+		added = append(added, *result)
+	}
+
+	return added
+}
+
+// get returns the user with the ID, failing the test if not found
+func get(t *testing.T, r repository.UserRepository, id int) *model.User {
+	t.Helper()
+
+	user, err := r.Get(context.Background(), id)
+	require.NoError(t, err)
+	return user
+}
+
+// idsOf returns the IDs of the users, in their order
+func idsOf(users []model.User) []int {
+	ids := make([]int, 0, len(users))
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+
+	return ids
+}
+
+// permissionsOf returns the names of the permissions of the role of the user
+func permissionsOf(user *model.User, role string) []string {
+	var names []string
+	for _, r := range user.Roles {
+		if r.Name == role {
+			for _, permission := range r.Permissions {
+				names = append(names, permission.Name)
+			}
+		}
+	}
+
+	return names
+}
+
+// requireSameUser checks that the fields of the users are the same, but their roles and timestamps
+func requireSameUser(t *testing.T, expected, actual *model.User) {
+	t.Helper()
+
+	require.Equal(t, expected.ID, actual.ID)
+	require.Equal(t, expected.FirstName, actual.FirstName)
+	require.Equal(t, expected.LastName, actual.LastName)
+	require.Equal(t, expected.Nickname, actual.Nickname)
+	require.Equal(t, expected.Password, actual.Password)
+	require.Equal(t, expected.Email, actual.Email)
+	require.Equal(t, expected.Country, actual.Country)
+	require.Equal(t, expected.Version, actual.Version)
+}
+
+// requireSameTime checks that the times are the same, to the precision of the backends
+func requireSameTime(t *testing.T, expected, actual time.Time) {
+	t.Helper()
+	require.WithinDuration(t, expected, actual, precision)
+}
+
+// requireNotBefore checks that the actual time is not before the other one, to the precision of the backends
+func requireNotBefore(t *testing.T, other, actual time.Time) {
+	t.Helper()
+	require.False(t, actual.Before(other.Add(-precision)), "%v is before %v", actual, other)
+}
+
+// requireCount checks how many users the filter counts
+func requireCount(t *testing.T, r repository.UserRepository, filter *model.Filter, expected int) {
+	t.Helper()
+
+	count, err := r.Count(context.Background(), filter)
+	require.NoError(t, err)
+	require.Equal(t, expected, count)
+}
+
+// requireListing checks the IDs of the users listed by GetAll and counted by Count with the filter
+func requireListing(t *testing.T, r repository.UserRepository, filter *model.Filter, expected ...int) {
+	t.Helper()
+
+	users, err := r.GetAll(context.Background(), filter, 0, 0)
+	require.NoError(t, err)
+	require.NotNil(t, users)
+	require.Equal(t, append([]int{}, expected...), idsOf(users))
+	requireCount(t, r, filter, len(expected))
+}
+
+func testAddOK(t *testing.T, r repository.UserRepository) {
+	before := time.Now()
+	users := newUsers()
+	added := addUsers(t, r, users...)
+	after := time.Now()
+
+	for i, user := range added {
+		require.Greater(t, user.ID, 0)
+		if i > 0 {
+			require.Greater(t, user.ID, added[i-1].ID, "the IDs are increasing")
+		}
+		require.Equal(t, 1, user.Version)
+		require.Equal(t, []string{model.RoleUser}, user.RoleNames())
+		requireNotBefore(t, before, user.CreatedAt)
+		requireNotBefore(t, user.CreatedAt, after)
+		requireSameTime(t, user.CreatedAt, user.UpdatedAt)
+		require.Nil(t, user.DeletedAt)
+
+		stored := get(t, r, user.ID)
+		users[i].ID, users[i].Version = user.ID, 1
+		requireSameUser(t, &users[i], stored)
+		requireSameTime(t, user.CreatedAt, stored.CreatedAt)
+		requireSameTime(t, user.UpdatedAt, stored.UpdatedAt)
+		require.Equal(t, []string{model.RoleUser}, stored.RoleNames())
+	}
+}
+
+func testAddCreationTimeOK(t *testing.T, r repository.UserRepository) {
+	user := newUsers()[0]
+	user.CreatedAt = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	added := addUsers(t, r, user)[0]
+
+	requireSameTime(t, user.CreatedAt, added.CreatedAt)
+	requireSameTime(t, user.CreatedAt, get(t, r, added.ID).CreatedAt)
+}
+
+func testAddRolesOK(t *testing.T, r repository.UserRepository) {
+	user := newUsers()[0]
+	user.Roles = []model.Role{{Name: model.RoleAdmin}}
+	added := addUsers(t, r, user)[0]
+
+	require.Equal(t, []string{model.RoleAdmin}, added.RoleNames())
+	stored := get(t, r, added.ID)
+	require.Equal(t, []string{model.RoleAdmin}, stored.RoleNames())
+	require.ElementsMatch(t, []string{
+		model.PermissionUsersRead,
+		model.PermissionUsersWrite,
+		model.PermissionUsersDelete,
+		model.PermissionRolesWrite,
+	}, permissionsOf(stored, model.RoleAdmin))
+}
+
+func testAddUnknownRoleKO(t *testing.T, r repository.UserRepository) {
+	user := newUsers()[0]
+	user.Roles = []model.Role{{Name: model.RoleUser}, {Name: "unknown"}}
+	_, err := r.Add(context.Background(), &user)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindNotFound, Code: errs.CodeRoleNotFound})
+
+	// no user has been added, nor have their email and nickname been taken
+	requireCount(t, r, &model.Filter{IncludeDeleted: true}, 0)
+	addUsers(t, r, newUsers()[0])
+}
+
+func testAddNotUniqueKO(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()[:2]...)
+
+	// the emails and the nicknames are unique case-insensitively
+	user := newUsers()[2]
+	user.Email = "ALICE@b.com"
+	_, err := r.Add(context.Background(), &user)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeEmailTaken})
+
+	user = newUsers()[2]
+	user.Nickname = "Bo"
+	_, err = r.Add(context.Background(), &user)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeNicknameTaken})
+
+	user = newUsers()[2]
+	user.ID = added[0].ID
+	_, err = r.Add(context.Background(), &user)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeUserExists})
+
+	requireListing(t, r, nil, idsOf(added)...)
+}
+
+func testGetNotFoundKO(t *testing.T, r repository.UserRepository) {
+	user, err := r.Get(context.Background(), 42)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindNotFound, Code: errs.CodeUserNotFound})
+	require.Nil(t, user)
+
+	// the deleted users are not found either
+	added := addUsers(t, r, newUsers()[0])[0]
+	require.NoError(t, r.Delete(context.Background(), added.ID, 0))
+	_, err = r.Get(context.Background(), added.ID)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindNotFound, Code: errs.CodeUserNotFound})
+}
+
+func testGetAllOK(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()...)
+
+	// a nil filter, as an empty one, lists all the users by ID, with their roles
+	for _, filter := range []*model.Filter{nil, {}} {
+		users, err := r.GetAll(context.Background(), filter, 0, 0)
+		require.NoError(t, err)
+		require.Equal(t, idsOf(added), idsOf(users))
+		for i := range users {
+			requireSameUser(t, &added[i], &users[i])
+			require.Equal(t, []string{model.RoleUser}, users[i].RoleNames())
+		}
+		requireCount(t, r, filter, len(added))
+	}
+}
+
+func testGetAllEmptyOK(t *testing.T, r repository.UserRepository) {
+	users, err := r.GetAll(context.Background(), nil, 0, 0)
+	require.NoError(t, err)
+	require.NotNil(t, users)
+	require.Empty(t, users)
+
+	users, err = r.GetAllFrom(context.Background(), nil, nil, 10)
+	require.NoError(t, err)
+	require.NotNil(t, users)
+	require.Empty(t, users)
+
+	requireCount(t, r, nil, 0)
+}
+
+func testGetAllPaginationOK(t *testing.T, r repository.UserRepository) {
+	ids := idsOf(addUsers(t, r, newUsers()...))
+
+	tests := []struct {
+		pageSize, page int
+		expected       []int
+	}{
+		{pageSize: 2, page: 1, expected: ids[:2]},
+		{pageSize: 2, page: 2, expected: ids[2:]},
+		{pageSize: 2, page: 3, expected: []int{}},
+		{pageSize: 2, page: 100, expected: []int{}},
+		{pageSize: 2, page: 0, expected: ids[:2]},
+		{pageSize: 2, page: -1, expected: ids[:2]},
+		{pageSize: 10, page: 1, expected: ids},
+		{pageSize: 0, page: 3, expected: ids},
+	}
+
+	for _, test := range tests {
+		users, err := r.GetAll(context.Background(), nil, test.pageSize, test.page)
+		require.NoError(t, err)
+		require.NotNil(t, users)
+		require.Equal(t, test.expected, idsOf(users), "page %v of size %v", test.page, test.pageSize)
+	}
+}
+
+func testGetAllFilteringOK(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()...)
+	alice, bob, carol := added[0].ID, added[1].ID, added[2].ID
+
+	tests := []struct {
+		conditions []model.Condition
+		expected   []int
+	}{
+		{[]model.Condition{{Field: "last_name", Op: model.OpEq, Values: []interface{}{"smith"}}}, []int{alice, bob}},
+		{[]model.Condition{{Field: "last_name", Op: model.OpNe, Values: []interface{}{"smith"}}}, []int{carol}},
+		{[]model.Condition{{Field: "country", Op: model.OpIn, Values: []interface{}{"uk", "fr"}}}, []int{alice}},
+		{[]model.Condition{{Field: "id", Op: model.OpIn, Values: []interface{}{alice, carol}}}, []int{alice, carol}},
+		{[]model.Condition{{Field: "first_name", Op: model.OpLike, Values: []interface{}{"%O%"}}}, []int{bob, carol}},
+		{[]model.Condition{{Field: "nickname", Op: model.OpLike, Values: []interface{}{"c_"}}}, []int{carol}},
+		{[]model.Condition{{Field: "email", Op: model.OpLike, Values: []interface{}{"b%"}}}, []int{bob}},
+		{[]model.Condition{{Field: "id", Op: model.OpGt, Values: []interface{}{alice}}}, []int{bob, carol}},
+		{[]model.Condition{{Field: "id", Op: model.OpGte, Values: []interface{}{bob}}}, []int{bob, carol}},
+		{[]model.Condition{{Field: "id", Op: model.OpLt, Values: []interface{}{bob}}}, []int{alice}},
+		{[]model.Condition{{Field: "id", Op: model.OpLte, Values: []interface{}{bob}}}, []int{alice, bob}},
+		{[]model.Condition{{Field: "first_name", Op: model.OpGt, Values: []interface{}{"bob"}}}, []int{carol}},
+		{[]model.Condition{{Field: "first_name", Op: model.OpLt, Values: []interface{}{"bob"}}}, []int{alice}},
+		{[]model.Condition{{Field: "created_at", Op: model.OpLt, Values: []interface{}{time.Now().Add(time.Hour)}}},
+			[]int{alice, bob, carol}},
+		{[]model.Condition{{Field: "created_at", Op: model.OpGt, Values: []interface{}{time.Now().Add(time.Hour)}}},
+			[]int{}},
+		// all the conditions must hold, even on the same field
+		{[]model.Condition{
+			{Field: "first_name", Op: model.OpGte, Values: []interface{}{"b"}},
+			{Field: "first_name", Op: model.OpLt, Values: []interface{}{"c"}},
+		}, []int{bob}},
+		{[]model.Condition{
+			{Field: "last_name", Op: model.OpEq, Values: []interface{}{"smith"}},
+			{Field: "country", Op: model.OpEq, Values: []interface{}{"it"}},
+		}, []int{bob}},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			requireListing(t, r, &model.Filter{Conditions: test.conditions}, test.expected...)
+		})
+	}
+}
+
+func testGetAllSortOK(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()...)
+	alice, bob, carol := added[0].ID, added[1].ID, added[2].ID
+
+	tests := []struct {
+		sort     []model.SortKey
+		expected []int
+	}{
+		{[]model.SortKey{{Field: "first_name", Desc: true}}, []int{carol, bob, alice}},
+		// the users with equal sort keys are sorted by ID
+		{[]model.SortKey{{Field: "last_name"}}, []int{carol, alice, bob}},
+		{[]model.SortKey{{Field: "last_name", Desc: true}}, []int{alice, bob, carol}},
+		{[]model.SortKey{{Field: "country"}, {Field: "nickname", Desc: true}}, []int{carol, bob, alice}},
+		{[]model.SortKey{{Field: "id", Desc: true}}, []int{carol, bob, alice}},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			requireListing(t, r, &model.Filter{Sort: test.sort}, test.expected...)
+		})
+	}
+}
+
+func testGetAllDeletedOK(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()...)
+	require.NoError(t, r.Delete(context.Background(), added[1].ID, 0))
+
+	requireListing(t, r, nil, added[0].ID, added[2].ID)
+	requireListing(t, r, &model.Filter{IncludeDeleted: true}, idsOf(added)...)
+
+	users, err := r.GetAll(context.Background(), &model.Filter{IncludeDeleted: true}, 0, 0)
+	require.NoError(t, err)
+	require.Nil(t, users[0].DeletedAt)
+	require.NotNil(t, users[1].DeletedAt)
+	require.Nil(t, users[2].DeletedAt)
+
+	users, err = r.GetAllFrom(context.Background(), &model.Filter{IncludeDeleted: true}, nil, 0)
+	require.NoError(t, err)
+	require.Equal(t, idsOf(added), idsOf(users))
+}
+
+func testGetAllInvalidFilterKO(t *testing.T, r repository.UserRepository) {
+	addUsers(t, r, newUsers()...)
+	invalid := errs.Error{Kind: errs.KindInvalid, Code: errs.CodeInvalidFilter}
+
+	filters := []*model.Filter{
+		{Conditions: []model.Condition{{Field: "password", Op: model.OpEq, Values: []interface{}{"1"}}}},
+		{Conditions: []model.Condition{{Field: "id", Op: model.OpLike, Values: []interface{}{"1%"}}}},
+		{Conditions: []model.Condition{{Field: "id", Op: model.OpEq, Values: []interface{}{"1"}}}},
+		{Conditions: []model.Condition{{Field: "id", Op: model.OpEq}}},
+		{Sort: []model.SortKey{{Field: "password"}}},
+	}
+
+	for i, filter := range filters {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			_, err := r.GetAll(context.Background(), filter, 0, 0)
+			require.ErrorIs(t, err, &invalid)
+
+			_, err = r.GetAllFrom(context.Background(), filter, nil, 0)
+			require.ErrorIs(t, err, &invalid)
+
+			_, err = r.Count(context.Background(), filter)
+			require.ErrorIs(t, err, &invalid)
+		})
+	}
+}
+
+func testGetAllFromOK(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()...)
+	alice, bob, carol := added[0].ID, added[1].ID, added[2].ID
+	filter := &model.Filter{Sort: []model.SortKey{{Field: "first_name", Desc: true}}}
+
+	users, err := r.GetAllFrom(context.Background(), filter, nil, 2)
+	require.NoError(t, err)
+	require.Equal(t, []int{carol, bob}, idsOf(users))
+
+	next := model.NewCursor(filter, &users[1], false)
+	users, err = r.GetAllFrom(context.Background(), filter, next, 2)
+	require.NoError(t, err)
+	require.Equal(t, []int{alice}, idsOf(users))
+
+	users, err = r.GetAllFrom(context.Background(), filter, model.NewCursor(filter, &users[0], false), 2)
+	require.NoError(t, err)
+	require.NotNil(t, users)
+	require.Empty(t, users)
+
+	// the backward listings are in the order of the filter too
+	prev := model.NewCursor(filter, &added[0], true)
+	users, err = r.GetAllFrom(context.Background(), filter, prev, 2)
+	require.NoError(t, err)
+	require.Equal(t, []int{carol, bob}, idsOf(users))
+
+	users, err = r.GetAllFrom(context.Background(), filter, prev, 1)
+	require.NoError(t, err)
+	require.Equal(t, []int{bob}, idsOf(users))
+
+	// the listing from a cursor skips no user, and repeats none, when users are added or deleted
+	require.NoError(t, r.Delete(context.Background(), carol, 0))
+	dave := newUsers()[0]
+	dave.FirstName, dave.Nickname, dave.Email = "dave", "da", "dave@b.com"
+	dave = addUsers(t, r, dave)[0]
+	users, err = r.GetAllFrom(context.Background(), filter, next, 0)
+	require.NoError(t, err)
+	require.Equal(t, []int{alice}, idsOf(users))
+
+	// a nil filter lists by ID
+	users, err = r.GetAllFrom(context.Background(), nil, model.NewCursor(nil, &added[0], false), 0)
+	require.NoError(t, err)
+	require.Equal(t, []int{bob, dave.ID}, idsOf(users))
+}
+
+func testGetAllFromInvalidCursorKO(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()...)
+	filter := &model.Filter{Sort: []model.SortKey{{Field: "first_name"}}}
+
+	// the cursor of another sort
+	cursor := model.NewCursor(nil, &added[0], false)
+	_, err := r.GetAllFrom(context.Background(), filter, cursor, 0)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindInvalid, Code: errs.CodeInvalidCursor})
+
+	cursor = &model.Cursor{Sort: filter.Sort, Values: []interface{}{1}, ID: added[0].ID}
+	_, err = r.GetAllFrom(context.Background(), filter, cursor, 0)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindInvalid, Code: errs.CodeInvalidCursor})
+}
+
+func testReplaceOK(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()...)
+	user := get(t, r, added[0].ID)
+
+	// every field is replaced, the zero-valued ones as well
+	replacement := model.User{
+		ID:        user.ID,
+		FirstName: "alicia",
+		LastName:  "brown",
+		Nickname:  "ali",
+		Password:  "4",
+		Email:     "alicia@b.com",
+		Version:   user.Version,
+	}
+	replaced, err := r.Replace(context.Background(), &replacement)
+	require.NoError(t, err)
+
+	replacement.Version = user.Version + 1
+	requireSameUser(t, &replacement, replaced)
+	requireSameUser(t, &replacement, get(t, r, user.ID))
+	require.Empty(t, replaced.Country)
+	require.Equal(t, []string{model.RoleUser}, replaced.RoleNames())
+	requireSameTime(t, user.CreatedAt, replaced.CreatedAt)
+	requireNotBefore(t, user.UpdatedAt, replaced.UpdatedAt)
+
+	// unless 0, the version is compared and swapped
+	replacement = newUsers()[0]
+	replacement.ID = user.ID
+	replaced, err = r.Replace(context.Background(), &replacement)
+	require.NoError(t, err)
+	require.Equal(t, user.Version+2, replaced.Version)
+	require.Equal(t, "alice", replaced.FirstName)
+
+	// the other users are left as they are
+	requireSameUser(t, &added[1], get(t, r, added[1].ID))
+	requireSameUser(t, &added[2], get(t, r, added[2].ID))
+}
+
+func testReplaceKO(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()...)
+
+	replacement := newUsers()[0]
+	replacement.ID = 42
+	_, err := r.Replace(context.Background(), &replacement)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindNotFound, Code: errs.CodeUserNotFound})
+
+	replacement = newUsers()[0]
+	replacement.ID, replacement.Version = added[0].ID, added[0].Version+1
+	_, err = r.Replace(context.Background(), &replacement)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindPreconditionFailed, Code: errs.CodeVersionMismatch})
+
+	replacement = newUsers()[0]
+	replacement.ID, replacement.Email = added[0].ID, "BOB@b.com"
+	_, err = r.Replace(context.Background(), &replacement)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeEmailTaken})
+
+	replacement = newUsers()[0]
+	replacement.ID, replacement.Nickname = added[0].ID, "CA"
+	_, err = r.Replace(context.Background(), &replacement)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeNicknameTaken})
+
+	require.NoError(t, r.Delete(context.Background(), added[2].ID, 0))
+	replacement = newUsers()[2]
+	replacement.ID = added[2].ID
+	_, err = r.Replace(context.Background(), &replacement)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindNotFound, Code: errs.CodeUserNotFound})
+
+	// the failed writes have written nothing
+	requireSameUser(t, &added[0], get(t, r, added[0].ID))
+}
+
+func testUpdateOK(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()...)
+	user := get(t, r, added[0].ID)
+	expected := *user
+
+	// the ID and the creation time of newUser are ignored
+	newUser := model.User{
+		ID:        added[1].ID,
+		FirstName: "alicia",
+		Email:     "alicia@b.com",
+		CreatedAt: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	updated, err := r.Update(context.Background(), user, &newUser)
+	require.NoError(t, err)
+
+	expected.FirstName, expected.Email, expected.Version = "alicia", "alicia@b.com", expected.Version+1
+	requireSameUser(t, &expected, updated)
+	requireSameUser(t, &expected, user)
+	requireSameTime(t, expected.CreatedAt, updated.CreatedAt)
+	requireNotBefore(t, expected.UpdatedAt, updated.UpdatedAt)
+	require.Equal(t, []string{model.RoleUser}, updated.RoleNames())
+
+	stored := get(t, r, expected.ID)
+	requireSameUser(t, &expected, stored)
+	requireSameTime(t, expected.CreatedAt, stored.CreatedAt)
+	requireSameTime(t, updated.UpdatedAt, stored.UpdatedAt)
+
+	// the other users are left as they are
+	requireSameUser(t, &added[1], get(t, r, added[1].ID))
+	requireSameUser(t, &added[2], get(t, r, added[2].ID))
+}
+
+func testUpdateZeroValuesOK(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()[0])[0]
+	user := get(t, r, added.ID)
+
+	// the zero-valued fields are left as they are, but the version is incremented anyway
+	updated, err := r.Update(context.Background(), user, &model.User{})
+	require.NoError(t, err)
+
+	added.Version++
+	requireSameUser(t, &added, updated)
+	requireSameUser(t, &added, get(t, r, added.ID))
+
+	// unless 0, the version is compared and swapped
+	user = get(t, r, added.ID)
+	user.Version = 0
+	updated, err = r.Update(context.Background(), user, &model.User{Country: "fr"})
+	require.NoError(t, err)
+	require.Equal(t, "fr", updated.Country)
+	require.Equal(t, added.Version+1, get(t, r, added.ID).Version)
+}
+
+func testUpdateKO(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()...)
+
+	_, err := r.Update(context.Background(), &model.User{ID: 42}, &model.User{FirstName: "x"})
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindNotFound, Code: errs.CodeUserNotFound})
+
+	user := get(t, r, added[0].ID)
+	user.Version++
+	_, err = r.Update(context.Background(), user, &model.User{FirstName: "x"})
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindPreconditionFailed, Code: errs.CodeVersionMismatch})
+
+	user = get(t, r, added[0].ID)
+	_, err = r.Update(context.Background(), user, &model.User{Email: "Bob@b.com"})
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeEmailTaken})
+
+	user = get(t, r, added[0].ID)
+	_, err = r.Update(context.Background(), user, &model.User{Nickname: "bO"})
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeNicknameTaken})
+
+	require.NoError(t, r.Delete(context.Background(), added[2].ID, 0))
+	_, err = r.Update(context.Background(), &added[2], &model.User{FirstName: "x"})
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindNotFound, Code: errs.CodeUserNotFound})
+
+	// the failed writes have written nothing
+	requireSameUser(t, &added[0], get(t, r, added[0].ID))
+}
+
+func testDeleteOK(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()...)
+
+	require.NoError(t, r.Delete(context.Background(), added[0].ID, added[0].Version))
+	require.NoError(t, r.Delete(context.Background(), added[1].ID, 0))
+	requireListing(t, r, nil, added[2].ID)
+
+	// the email and the nickname of the deleted users are free
+	addUsers(t, r, newUsers()[0])
+}
+
+func testDeleteKO(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()[0])[0]
+
+	err := r.Delete(context.Background(), 42, 0)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindNotFound, Code: errs.CodeUserNotFound})
+
+	err = r.Delete(context.Background(), added.ID, added.Version+1)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindPreconditionFailed, Code: errs.CodeVersionMismatch})
+
+	require.NoError(t, r.Delete(context.Background(), added.ID, 0))
+	err = r.Delete(context.Background(), added.ID, 0)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindNotFound, Code: errs.CodeUserNotFound})
+	err = r.Delete(context.Background(), added.ID, added.Version+1)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindNotFound, Code: errs.CodeUserNotFound})
+}
+
+func testRestoreOK(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()[0])[0]
+	require.NoError(t, r.Delete(context.Background(), added.ID, 0))
+
+	restored, err := r.Restore(context.Background(), added.ID)
+	require.NoError(t, err)
+
+	// the deletion and the restoration are writes of the user
+	added.Version += 2
+	requireSameUser(t, &added, restored)
+	require.Nil(t, restored.DeletedAt)
+	require.Equal(t, []string{model.RoleUser}, restored.RoleNames())
+	requireSameTime(t, added.CreatedAt, restored.CreatedAt)
+	requireSameUser(t, &added, get(t, r, added.ID))
+}
+
+func testRestoreKO(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()[0])[0]
+
+	_, err := r.Restore(context.Background(), 42)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindNotFound, Code: errs.CodeUserNotFound})
+
+	// only the deleted users can be restored
+	_, err = r.Restore(context.Background(), added.ID)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindNotFound, Code: errs.CodeUserNotFound})
+
+	// the email of the deleted user has been taken in the meanwhile
+	require.NoError(t, r.Delete(context.Background(), added.ID, 0))
+	user := newUsers()[1]
+	user.Email = added.Email
+	taker := addUsers(t, r, user)[0]
+	_, err = r.Restore(context.Background(), added.ID)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeEmailTaken})
+
+	// and then the nickname
+	require.NoError(t, r.Delete(context.Background(), taker.ID, 0))
+	user = newUsers()[1]
+	user.Nickname = added.Nickname
+	addUsers(t, r, user)
+	_, err = r.Restore(context.Background(), added.ID)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeNicknameTaken})
+
+	// the user is still deleted
+	_, err = r.Get(context.Background(), added.ID)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindNotFound, Code: errs.CodeUserNotFound})
+}
+
+func testPurgeOK(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()...)
+	require.NoError(t, r.AddRefreshToken(context.Background(), &model.RefreshToken{
+		Hash: "hash", Family: "family", UserID: added[0].ID, ExpiresAt: time.Now().Add(time.Hour),
+	}))
+	require.NoError(t, r.Delete(context.Background(), added[0].ID, 0))
+	require.NoError(t, r.Delete(context.Background(), added[1].ID, 0))
+
+	// the users deleted after the time are kept
+	count, err := r.Purge(context.Background(), time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+	requireListing(t, r, &model.Filter{IncludeDeleted: true}, idsOf(added)...)
+
+	count, err = r.Purge(context.Background(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	requireListing(t, r, &model.Filter{IncludeDeleted: true}, added[2].ID)
+
+	// the purged users cannot be restored, and their refresh tokens are gone
+	_, err = r.Restore(context.Background(), added[0].ID)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindNotFound, Code: errs.CodeUserNotFound})
+	_, err = r.GetRefreshToken(context.Background(), "hash")
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindNotFound, Code: errs.CodeRefreshTokenNotFound})
+
+	count, err = r.Purge(context.Background(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+}
+
+func testTimestampsOK(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()[0])[0]
+
+	// every write of the fields of the user sets its update time, not its creation time
+	writes := []func(user *model.User) error{
+		func(user *model.User) error {
+			_, err := r.Update(context.Background(), user, &model.User{FirstName: "alicia"})
+			return err
+		},
+		func(user *model.User) error {
+			replacement := newUsers()[0]
+			replacement.ID = user.ID
+			_, err := r.Replace(context.Background(), &replacement)
+			return err
+		},
+		func(user *model.User) error {
+			return r.Delete(context.Background(), user.ID, 0)
+		},
+		func(user *model.User) error {
+			_, err := r.Restore(context.Background(), user.ID)
+			return err
+		},
+	}
+
+	for _, write := range writes {
+		users, err := r.GetAll(context.Background(), &model.Filter{IncludeDeleted: true}, 0, 0)
+		require.NoError(t, err)
+		// Update updates the user in place
+		user := users[0]
+		before := users[0]
+
+		time.Sleep(10 * precision)
+		require.NoError(t, write(&user))
+
+		users, err = r.GetAll(context.Background(), &model.Filter{IncludeDeleted: true}, 0, 0)
+		require.NoError(t, err)
+		after := users[0]
+		requireSameTime(t, added.CreatedAt, after.CreatedAt)
+		require.True(t, after.UpdatedAt.After(before.UpdatedAt), "%v is not after %v", after.UpdatedAt,
+			before.UpdatedAt)
+		require.Equal(t, before.Version+1, after.Version)
+	}
+}
+
+func testGrantRevokeRoleOK(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()[0])[0]
+
+	require.NoError(t, r.GrantRole(context.Background(), added.ID, model.RoleAdmin))
+	user := get(t, r, added.ID)
+	require.ElementsMatch(t, []string{model.RoleUser, model.RoleAdmin}, user.RoleNames())
+	require.Len(t, permissionsOf(user, model.RoleAdmin), 4)
+	require.Equal(t, added.Version+1, user.Version)
+
+	// granting a role twice grants it once
+	require.NoError(t, r.GrantRole(context.Background(), added.ID, model.RoleAdmin))
+	require.ElementsMatch(t, []string{model.RoleUser, model.RoleAdmin}, get(t, r, added.ID).RoleNames())
+
+	require.NoError(t, r.RevokeRole(context.Background(), added.ID, model.RoleUser))
+	require.Equal(t, []string{model.RoleAdmin}, get(t, r, added.ID).RoleNames())
+	require.NoError(t, r.RevokeRole(context.Background(), added.ID, model.RoleAdmin))
+	user = get(t, r, added.ID)
+	require.Empty(t, user.RoleNames())
+	require.Equal(t, added.Version+4, user.Version)
+
+	// revoking a role the user hasn't is no error
+	require.NoError(t, r.RevokeRole(context.Background(), added.ID, model.RoleAdmin))
+}
+
+func testGrantRevokeRoleKO(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()...)
+
+	err := r.GrantRole(context.Background(), 42, model.RoleAdmin)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindNotFound, Code: errs.CodeUserNotFound})
+	err = r.RevokeRole(context.Background(), 42, model.RoleUser)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindNotFound, Code: errs.CodeUserNotFound})
+
+	err = r.GrantRole(context.Background(), added[0].ID, "unknown")
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindNotFound, Code: errs.CodeRoleNotFound})
+	err = r.RevokeRole(context.Background(), added[0].ID, "unknown")
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindNotFound, Code: errs.CodeRoleNotFound})
+
+	require.NoError(t, r.Delete(context.Background(), added[1].ID, 0))
+	err = r.GrantRole(context.Background(), added[1].ID, model.RoleAdmin)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindNotFound, Code: errs.CodeUserNotFound})
+
+	require.Equal(t, []string{model.RoleUser}, get(t, r, added[0].ID).RoleNames())
+}
+
+func testRefreshTokensOK(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()[0])[0]
+
+	expiresAt := time.Now().Add(time.Hour)
+	token := model.RefreshToken{Hash: "hash", Family: "family", UserID: added.ID, ExpiresAt: expiresAt}
+	require.NoError(t, r.AddRefreshToken(context.Background(), &token))
+
+	stored, err := r.GetRefreshToken(context.Background(), "hash")
+	require.NoError(t, err)
+	require.Equal(t, "hash", stored.Hash)
+	require.Equal(t, "family", stored.Family)
+	require.Equal(t, added.ID, stored.UserID)
+	requireSameTime(t, expiresAt, stored.ExpiresAt)
+	require.Nil(t, stored.RevokedAt)
+
+	// the hashes are unique
+	duplicate := model.RefreshToken{Hash: "hash", Family: "other", UserID: added.ID, ExpiresAt: expiresAt}
+	err = r.AddRefreshToken(context.Background(), &duplicate)
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeRefreshTokenExists})
+
+	_, err = r.GetRefreshToken(context.Background(), "unknown")
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindNotFound, Code: errs.CodeRefreshTokenNotFound})
+
+	// a refresh token is revoked once
+	require.NoError(t, r.RevokeRefreshToken(context.Background(), "hash"))
+	stored, err = r.GetRefreshToken(context.Background(), "hash")
+	require.NoError(t, err)
+	require.NotNil(t, stored.RevokedAt)
+
+	err = r.RevokeRefreshToken(context.Background(), "hash")
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeRefreshTokenRevoked})
+	err = r.RevokeRefreshToken(context.Background(), "unknown")
+	require.ErrorIs(t, err, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeRefreshTokenRevoked})
+}
+
+func testRevokeRefreshTokenFamilyOK(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()[0])[0]
+
+	tokens := map[string]string{"hash1": "family", "hash2": "family", "hash3": "other"}
+	for hash, family := range tokens {
+		token := model.RefreshToken{Hash: hash, Family: family, UserID: added.ID, ExpiresAt: time.Now().Add(time.Hour)}
+		require.NoError(t, r.AddRefreshToken(context.Background(), &token))
+	}
+	require.NoError(t, r.RevokeRefreshToken(context.Background(), "hash1"))
+
+	require.NoError(t, r.RevokeRefreshTokenFamily(context.Background(), "family"))
+	require.NoError(t, r.RevokeRefreshTokenFamily(context.Background(), "unknown"))
+
+	for hash, family := range tokens {
+		token, err := r.GetRefreshToken(context.Background(), hash)
+		require.NoError(t, err)
+		require.Equal(t, family == "family", token.RevokedAt != nil, hash)
+	}
+}
+
+// concurrently runs the request concurrently, and returns the errors of the requests
+func concurrently(request func(i int) error) []error {
+	errors := make([]error, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errors[i] = request(i)
+		}(i)
+	}
+	wg.Wait()
+
+	return errors
+}
+
+// requireOneWinner checks that exactly one of the concurrent requests has succeeded, and that the
+// others have failed with the error
+func requireOneWinner(t *testing.T, errors []error, target error) {
+	t.Helper()
+
+	winners := 0
+	for _, err := range errors {
+		if err == nil {
+			winners++
+			continue
+		}
+		require.ErrorIs(t, err, target)
+	}
+	require.Equal(t, 1, winners)
+}
+
+func testConcurrentAddOK(t *testing.T, r repository.UserRepository) {
+	ids := make([]int, concurrency)
+	errors := concurrently(func(i int) error {
+		user := model.User{
+			FirstName: "user",
+			LastName:  "y",
+			Nickname:  fmt.Sprintf("user%v", i),
+			Password:  "1",
+			Email:     fmt.Sprintf("user%v@b.com", i),
+			Country:   "it",
+		}
+		added, err := r.Add(context.Background(), &user)
+		if err == nil {
+			ids[i] = added.ID
+		}
+		return err
+	})
+	for _, err := range errors {
+		require.NoError(t, err)
+	}
+
+	// every user has an ID of their own
+	unique := map[int]bool{}
+	for _, id := range ids {
+		unique[id] = true
+	}
+	require.Len(t, unique, concurrency)
+	requireCount(t, r, nil, concurrency)
+}
+
+func testConcurrentAddNotUniqueKO(t *testing.T, r repository.UserRepository) {
+	errors := concurrently(func(i int) error {
+		user := newUsers()[0]
+		user.Nickname = fmt.Sprintf("user%v", i)
+		_, err := r.Add(context.Background(), &user)
+		return err
+	})
+
+	requireOneWinner(t, errors, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeEmailTaken})
+	requireCount(t, r, nil, 1)
+}
+
+func testConcurrentUpdateKO(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()[0])[0]
+
+	// the writes conditional on the same version have one winner
+	errors := concurrently(func(i int) error {
+		user := added
+		_, err := r.Update(context.Background(), &user, &model.User{FirstName: fmt.Sprintf("user%v", i)})
+		return err
+	})
+
+	requireOneWinner(t, errors, &errs.Error{Kind: errs.KindPreconditionFailed, Code: errs.CodeVersionMismatch})
+	require.Equal(t, added.Version+1, get(t, r, added.ID).Version)
+}
+
+func testConcurrentRevokeRefreshTokenKO(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()[0])[0]
+	token := model.RefreshToken{Hash: "hash", Family: "family", UserID: added.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	require.NoError(t, r.AddRefreshToken(context.Background(), &token))
+
+	// a refresh token is exchanged once, even by concurrent requests
+	errors := concurrently(func(int) error {
+		return r.RevokeRefreshToken(context.Background(), "hash")
+	})
+
+	requireOneWinner(t, errors, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeRefreshTokenRevoked})
+}
+
+func testCanceledKO(t *testing.T, r repository.UserRepository) {
+	added := addUsers(t, r, newUsers()[0])[0]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	user := newUsers()[1]
+	_, err := r.Add(ctx, &user)
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, err = r.Get(ctx, added.ID)
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, err = r.GetAll(ctx, nil, 0, 0)
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, err = r.Update(ctx, &added, &model.User{FirstName: "alicia"})
+	require.ErrorIs(t, err, context.Canceled)
+
+	err = r.Delete(ctx, added.ID, 0)
+	require.ErrorIs(t, err, context.Canceled)
+
+	// the canceled requests have written nothing
+	requireListing(t, r, nil, added.ID)
+	requireSameUser(t, &added, get(t, r, added.ID))
+}
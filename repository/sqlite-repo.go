@@ -1,108 +1,173 @@
 package repository
 
 import (
-	"fmt"
+	"context"
 	"log"
+	"time"
 
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
-	glogger "gorm.io/gorm/logger"
+	"gorm.io/gorm/clause"
 
+	"github.com/pavelerokhin/user-microservice-go/errs"
 	"github.com/pavelerokhin/user-microservice-go/model"
 )
 
 func NewSqliteRepo(dbName string, l *log.Logger) (UserRepository, error) {
 	l.Println("preparing SQLite database")
 
-	if dbName == "" {
-		return nil, fmt.Errorf("database name is empty")
+	sql, err := openSqlite(dbName)
+	if err != nil {
+		return nil, err
 	}
 
-	sql, err := gorm.Open(sqlite.Open(fmt.Sprintf("%s.db", dbName)), &gorm.Config{
-		Logger: glogger.Default.LogMode(glogger.Silent),
-	})
+	err = migrateUp(sql, BackendSqlite, l)
+	if err != nil {
+		return nil, err
+	}
+
+	err = seedRoles(sql)
 	if err != nil {
 		return nil, err
 	}
 
-	err = sql.AutoMigrate(&model.User{})
+	err = backfillKeys(sql, l)
 	if err != nil {
 		return nil, err
 	}
 
 	l.Println("SQLite database is ready")
-	return &repo{DB: sql, Logger: l}, nil
+	return &repo{DB: sql, Logger: l, Name: "SQLite"}, nil
 }
 
-func (r *repo) Add(user *model.User) (*model.User, error) {
-	r.Logger.Println("request add a new user to SQLite database")
-	tx := r.DB.Create(&user)
-	if tx.Error != nil {
-		r.Logger.Printf("Failed adding a new post: %v", tx.Error)
-		return nil, tx.Error
+func (r *repo) Add(ctx context.Context, user *model.User) (*model.User, error) {
+	r.Logger.Printf("request add a new user to %v database", r.Name)
+
+	roles := user.RoleNames()
+	if len(roles) == 0 {
+		roles = []string{model.RoleUser}
+	}
+
+	user.SetKeys()
+	user.Version = 1
+	err := r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Omit(clause.Associations).Create(user).Error
+		if err != nil {
+			return err
+		}
+
+		for _, role := range roles {
+			err = grantRole(tx, user.ID, role)
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Preload("Roles.Permissions").Where("id = ?", user.ID).Find(user).Error
+	})
+	if conflict := conflictOf(err); conflict != nil {
+		err = conflict
+	} else if isDuplicate(err) {
+		err = errs.Conflict(errs.CodeUserExists, "user with ID %v already exists", user.ID)
+	}
+	if err != nil {
+		r.Logger.Printf("Failed adding a new post: %v", err)
+		return nil, err
 	}
 
 	return user, nil
 }
 
-func (r *repo) Delete(id int) error {
-	r.Logger.Printf("request delete user with ID %v from SQLite database", id)
+func (r *repo) Count(ctx context.Context, filter *model.Filter) (int, error) {
+	r.Logger.Printf("elaborating the count request in %v database", r.Name)
 
-	var user model.User
-	tx := r.DB.Where("id = ?", id).Find(&user)
-	if tx.RowsAffected != 0 {
-		tx = r.DB.Delete(&user)
+	err := validateFilter(filter)
+	if err != nil {
+		r.Logger.Printf("there are some problems counting users: %v", err)
+		return 0, err
+	}
 
-		if tx.Error != nil {
-			r.Logger.Printf("error while deleting user with ID %v: %v", id, tx.Error)
-		} else {
-			r.Logger.Printf("user with ID %v has been deleted successfully", id)
-		}
+	db := r.DB.WithContext(ctx).Model(&model.User{}).Scopes(live(filter))
+	if filter != nil {
+		db = db.Scopes(where(filter.Conditions))
+	}
+
+	var count int64
+	tx := db.Count(&count)
+	if tx.Error != nil {
+		r.Logger.Printf("there are some problems counting users: %v", tx.Error)
+		return 0, tx.Error
+	}
+
+	return int(count), nil
+}
+
+// Delete soft-deletes the user: the user is kept with their roles, without the keys of their email and
+// nickname, until purged
+func (r *repo) Delete(ctx context.Context, id, version int) error {
+	r.Logger.Printf("request delete user with ID %v from %v database", id, r.Name)
 
+	db := r.DB.WithContext(ctx)
+	tx := db.Model(&model.User{}).Where("id = ? AND deleted_at IS NULL", id).Scopes(compareAndSwap(version)).
+		Updates(map[string]interface{}{
+			"deleted_at":   time.Now(),
+			"email_key":    nil,
+			"nickname_key": nil,
+			"version":      gorm.Expr("version + 1"),
+		})
+	if tx.Error != nil {
+		r.Logger.Printf("error while deleting user with ID %v: %v", id, tx.Error)
 		return tx.Error
 	}
 
-	err := fmt.Errorf("error: cannot find user with ID %v", id)
-	r.Logger.Println(err)
+	if tx.RowsAffected == 0 {
+		err := notWritten(db, id, version,
+			errs.NotFound(errs.CodeUserNotFound, "error: cannot find user with ID %v", id))
+		r.Logger.Println(err)
+		return err
+	}
 
-	return err
+	r.Logger.Printf("user with ID %v has been deleted successfully", id)
+	return nil
 }
 
-func (r *repo) Get(id int) (*model.User, error) {
-	r.Logger.Printf("elaborating the listing request in SQLite database")
+func (r *repo) Get(ctx context.Context, id int) (*model.User, error) {
+	r.Logger.Printf("elaborating the listing request in %v database", r.Name)
 
 	var user *model.User
-	tx := r.DB.Where("id = ?", id).Find(&user)
+	tx := r.DB.WithContext(ctx).Preload("Roles.Permissions").Where("id = ? AND deleted_at IS NULL", id).Find(&user)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
 
 	if tx.RowsAffected != 0 {
 		return user, nil
 	}
 
-	return nil, fmt.Errorf("user with ID %v not found", id)
+	return nil, errs.NotFound(errs.CodeUserNotFound, "user with ID %v not found", id)
 }
 
-func (r *repo) GetAll(filters *model.User, pageSize, page int) ([]model.User, error) {
-	r.Logger.Printf("elaborating the listing request in SQLite database")
+func (r *repo) GetAll(ctx context.Context, filter *model.Filter, pageSize, page int) ([]model.User, error) {
+	r.Logger.Printf("elaborating the listing request in %v database", r.Name)
+
+	// the filter is validated here too, since its field names end up in the queries
+	err := validateFilter(filter)
+	if err != nil {
+		r.Logger.Printf("there are some problems listing users: %v", err)
+		return nil, err
+	}
 
 	var users []model.User
-	var tx *gorm.DB
+	db := r.DB.WithContext(ctx).Preload("Roles.Permissions").Scopes(filterAndSort(filter))
 
+	var tx *gorm.DB
 	if pageSize > 0 { // pagination has been requested
-		if filters != nil { // filtering has been requested
-			tx = r.DB.Scopes(paginate(page, pageSize)).Where(&filters).Find(&users)
-		} else { // no filtering
-			tx = r.DB.Scopes(paginate(page, pageSize)).Find(&users)
-		}
+		tx = db.Scopes(paginate(page, pageSize)).Find(&users)
 	} else { // no pagination
-		if filters != nil {
-			tx = r.DB.Where(&filters).Find(&users)
-		} else {
-			tx = r.DB.Find(&users)
-		}
+		tx = db.Find(&users)
 	}
 
 	if tx.RowsAffected != 0 {
-		r.Logger.Printf("users have been listed successfully from SQLite database")
+		r.Logger.Printf("users have been listed successfully from %v database", r.Name)
 	} else {
 		r.Logger.Printf("there are some problems listing users")
 	}
@@ -110,17 +175,261 @@ func (r *repo) GetAll(filters *model.User, pageSize, page int) ([]model.User, er
 	return users, tx.Error
 }
 
-func (r *repo) Update(user, newUser *model.User) (*model.User, error) {
-	r.Logger.Printf("elaborating update request in SQLite database")
-	tx := r.DB.Model(user).Updates(newUser)
+func (r *repo) GetAllFrom(ctx context.Context, filter *model.Filter, cursor *model.Cursor, limit int) ([]model.User, error) {
+	r.Logger.Printf("elaborating the listing request from a cursor in %v database", r.Name)
 
-	var err error
-	if tx.RowsAffected != 0 {
-		r.Logger.Printf("user has been updated successfully in SQLite database")
+	err := validateFilterAndCursor(filter, cursor)
+	if err != nil {
+		r.Logger.Printf("there are some problems listing users: %v", err)
+		return nil, err
+	}
+
+	db := r.DB.WithContext(ctx).Preload("Roles.Permissions").Scopes(live(filter))
+	if filter != nil {
+		db = db.Scopes(where(filter.Conditions))
+	}
+	if cursor != nil {
+		db = db.Scopes(seek(cursor))
 	} else {
-		err = fmt.Errorf("there are some problems updating user with ID %v", user.ID)
+		db = db.Scopes(orderBy(filter.Order()))
+	}
+	if limit > 0 {
+		db = db.Limit(limit)
+	}
+
+	var users []model.User
+	tx := db.Find(&users)
+	if tx.Error != nil {
+		r.Logger.Printf("there are some problems listing users: %v", tx.Error)
+		return nil, tx.Error
+	}
+
+	if cursor != nil && cursor.Backward {
+		reverse(users)
+	}
+
+	r.Logger.Printf("users have been listed successfully from %v database", r.Name)
+	return users, nil
+}
+
+func (r *repo) Replace(ctx context.Context, user *model.User) (*model.User, error) {
+	r.Logger.Printf("elaborating replace request in %v database", r.Name)
+	user.SetKeys()
+	err := r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// unlike Updates alone, selecting all the fields writes the zero values as well
+		res := tx.Model(&model.User{ID: user.ID}).Where("deleted_at IS NULL").Scopes(compareAndSwap(user.Version)).
+			Select("*").Omit("id", "created_at", "deleted_at", "version", clause.Associations).Updates(user)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return notWritten(tx, user.ID, user.Version,
+				errs.NotFound(errs.CodeUserNotFound, "user with ID %v not found", user.ID))
+		}
+
+		return bumpVersion(tx, user.ID)
+	})
+	if conflict := conflictOf(err); conflict != nil {
+		err = conflict
+	}
+	if err != nil {
+		r.Logger.Printf(err.Error())
+		return nil, err
+	}
+
+	r.Logger.Printf("user has been replaced successfully in %v database", r.Name)
+	return r.Get(ctx, user.ID)
+}
+
+func (r *repo) Update(ctx context.Context, user, newUser *model.User) (*model.User, error) {
+	r.Logger.Printf("elaborating update request in %v database", r.Name)
+	newUser.SetKeys()
+	err := r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(user).Where("deleted_at IS NULL").Scopes(compareAndSwap(user.Version)).
+			Omit("id", "created_at", "deleted_at", "version", clause.Associations).Updates(newUser)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return notWritten(tx, user.ID, user.Version,
+				errs.NotFound(errs.CodeUserNotFound, "there are some problems updating user with ID %v", user.ID))
+		}
+
+		err := bumpVersion(tx, user.ID)
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&model.User{}).Where("id = ?", user.ID).Select("version").Scan(&user.Version).Error
+	})
+	if conflict := conflictOf(err); conflict != nil {
+		err = conflict
+	}
+	if err != nil {
 		r.Logger.Printf(err.Error())
+		return user, err
+	}
+
+	r.Logger.Printf("user has been updated successfully in %v database", r.Name)
+	return user, nil
+}
+
+func (r *repo) Restore(ctx context.Context, id int) (*model.User, error) {
+	r.Logger.Printf("request restore user with ID %v in %v database", id, r.Name)
+
+	db := r.DB.WithContext(ctx)
+	var user model.User
+	tx := db.Where("id = ? AND deleted_at IS NOT NULL", id).Find(&user)
+	if tx.Error != nil {
+		r.Logger.Printf("error while restoring user with ID %v: %v", id, tx.Error)
+		return nil, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		err := errs.NotFound(errs.CodeUserNotFound, "cannot find deleted user with ID %v", id)
+		r.Logger.Println(err)
+		return nil, err
+	}
+
+	// the email or the nickname may have been taken in the meanwhile
+	user.SetKeys()
+	err := db.Model(&user).Updates(map[string]interface{}{
+		"deleted_at":   nil,
+		"email_key":    user.EmailKey,
+		"nickname_key": user.NicknameKey,
+		"version":      gorm.Expr("version + 1"),
+	}).Error
+	if conflict := conflictOf(err); conflict != nil {
+		err = conflict
+	}
+	if err != nil {
+		r.Logger.Printf("error while restoring user with ID %v: %v", id, err)
+		return nil, err
+	}
+
+	r.Logger.Printf("user with ID %v has been restored successfully", id)
+	return r.Get(ctx, id)
+}
+
+func (r *repo) Purge(ctx context.Context, before time.Time) (int, error) {
+	r.Logger.Printf("request purge users deleted before %v from %v database", before, r.Name)
+
+	var ids []int
+	err := r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&model.User{}).Where("deleted_at < ?", before).Pluck("id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		err = tx.Exec("DELETE FROM user_roles WHERE user_id IN ?", ids).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Where("user_id IN ?", ids).Delete(&model.RefreshToken{}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Delete(&model.User{}, ids).Error
+	})
+	if err != nil {
+		r.Logger.Printf("error while purging users: %v", err)
+		return 0, err
+	}
+
+	r.Logger.Printf("%v users have been purged successfully", len(ids))
+	return len(ids), nil
+}
+
+func (r *repo) GrantRole(ctx context.Context, userID int, role string) error {
+	r.Logger.Printf("request grant role %v to user with ID %v in %v database", role, userID, r.Name)
+	return r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := grantRole(tx, userID, role)
+		if err != nil {
+			return err
+		}
+
+		return bumpVersion(tx, userID)
+	})
+}
+
+func (r *repo) RevokeRole(ctx context.Context, userID int, role string) error {
+	r.Logger.Printf("request revoke role %v from user with ID %v in %v database", role, userID, r.Name)
+
+	return r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user, dbRole, err := findUserAndRole(tx, userID, role)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Model(user).Association("Roles").Delete(dbRole)
+		if err != nil {
+			return err
+		}
+
+		return bumpVersion(tx, userID)
+	})
+}
+
+func (r *repo) AddRefreshToken(ctx context.Context, token *model.RefreshToken) error {
+	r.Logger.Printf("request add a refresh token of user with ID %v to %v database", token.UserID, r.Name)
+	err := r.DB.WithContext(ctx).Create(token).Error
+	if isDuplicate(err) {
+		err = errs.Conflict(errs.CodeRefreshTokenExists, "refresh token already exists")
+	}
+	if err != nil {
+		r.Logger.Printf("Failed adding a new refresh token: %v", err)
+	}
+
+	return err
+}
+
+func (r *repo) GetRefreshToken(ctx context.Context, hash string) (*model.RefreshToken, error) {
+	var token *model.RefreshToken
+	tx := r.DB.WithContext(ctx).Where("hash = ?", hash).Find(&token)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	if tx.RowsAffected != 0 {
+		return token, nil
+	}
+
+	return nil, errs.NotFound(errs.CodeRefreshTokenNotFound, "refresh token not found")
+}
+
+// RevokeRefreshToken revokes the token only if it hasn't been revoked yet, so that a refresh token
+// can be exchanged exactly once even by concurrent requests
+func (r *repo) RevokeRefreshToken(ctx context.Context, hash string) error {
+	tx := r.DB.WithContext(ctx).Model(&model.RefreshToken{}).
+		Where("hash = ? AND revoked_at IS NULL", hash).
+		Update("revoked_at", time.Now())
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if tx.RowsAffected == 0 {
+		return errs.Conflict(errs.CodeRefreshTokenRevoked, "refresh token not found or already revoked")
+	}
+
+	return nil
+}
+
+func (r *repo) RevokeRefreshTokenFamily(ctx context.Context, family string) error {
+	r.Logger.Printf("request revoke refresh token family %v in %v database", family, r.Name)
+	tx := r.DB.WithContext(ctx).Model(&model.RefreshToken{}).
+		Where("family = ? AND revoked_at IS NULL", family).
+		Update("revoked_at", time.Now())
+
+	return tx.Error
+}
+
+func (r *repo) Close() error {
+	r.Logger.Printf("closing %v database", r.Name)
+	db, err := r.DB.DB()
+	if err != nil {
+		return err
 	}
 
-	return user, err
+	return db.Close()
 }
@@ -1,13 +1,18 @@
 package repository
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/pavelerokhin/user-microservice-go/errs"
+	"github.com/pavelerokhin/user-microservice-go/migrate"
 	"github.com/pavelerokhin/user-microservice-go/model"
 )
 
@@ -29,18 +34,47 @@ var (
 			ID:        2,
 			FirstName: "user2",
 			LastName:  "y",
-			Nickname:  "z",
+			Nickname:  "x",
 			Password:  "1",
-			Email:     "a@b.com",
+			Email:     "x@b.com",
 			Country:   "Y",
 		},
 	}
 )
 
-func setupTestCase(t *testing.T) {
+// testBackends are the backends the tests of the repository run against: the SQL ones, and the in-memory one
+// which must behave the same
+var testBackends = []string{BackendSqlite, BackendPostgres, BackendMemory}
+
+// forEachBackend runs the test against a new, empty repository of every backend, as testUserRepository
+func forEachBackend(t *testing.T, test func(t *testing.T)) {
+	for _, backend := range testBackends {
+		backend := backend
+		t.Run(backend, func(t *testing.T) {
+			setupTestCase(t, backend)
+			test(t)
+		})
+	}
+}
+
+func setupTestCase(t *testing.T, backend string) {
 	var err error
-	testUserRepository, err = NewSqliteRepo(dbName, testLogger)
-	require.NoError(t, err)
+	switch backend {
+	case BackendSqlite:
+		testUserRepository, err = NewSqliteRepo(dbName, testLogger)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, testUserRepository.Close())
+			cleanTestCase(t)
+		})
+	case BackendPostgres:
+		testUserRepository = setupPostgresTestCase(t)
+	case BackendMemory:
+		testUserRepository = NewMemoryRepo(testLogger)
+		t.Cleanup(func() {
+			require.NoError(t, testUserRepository.Close())
+		})
+	}
 }
 
 func cleanTestCase(t *testing.T) {
@@ -62,178 +96,627 @@ func TestNewSqliteRepoEmptyNameKO(t *testing.T) {
 	require.Empty(t, r)
 }
 
-// Add function testing
-func TestAddOK(t *testing.T) {
-	setupTestCase(t)
+func TestNewSqliteRepoNewerSchemaKO(t *testing.T) {
+	m, err := NewSqliteMigrator(dbName, testLogger)
+	require.NoError(t, err)
 	defer cleanTestCase(t)
-	result, err := testUserRepository.Add(&testUsers[0])
+	_, err = m.Up(context.Background())
+	require.NoError(t, err)
+
+	// the database has been migrated by a newer version of the microservice
+	err = m.DB.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+		m.Latest()+1, "newer", time.Now()).Error
 	require.NoError(t, err)
-	require.NotEmpty(t, result)
-	require.Equal(t, &testUsers[0], result)
+	require.NoError(t, m.Close())
+
+	r, err := NewSqliteRepo(dbName, testLogger)
+	require.ErrorIs(t, err, migrate.ErrNewerSchema)
+	require.Empty(t, r)
+}
+
+// Add function testing
+func TestAddOK(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		result, err := testUserRepository.Add(context.Background(), &testUsers[0])
+		require.NoError(t, err)
+		require.NotEmpty(t, result)
+		require.Equal(t, &testUsers[0], result)
+	})
+}
+
+func TestAddTimestampsOK(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		user := model.User{FirstName: "user1", LastName: "y", Nickname: "z", Password: "1", Email: "a@b.com",
+			Country: "Y"}
+		_, err := testUserRepository.Add(context.Background(), &user)
+		require.NoError(t, err)
+
+		// granting the default role does not touch the user
+		stored, err := testUserRepository.Get(context.Background(), user.ID)
+		require.NoError(t, err)
+		require.True(t, stored.UpdatedAt.Equal(stored.CreatedAt), "%v != %v", stored.UpdatedAt, stored.CreatedAt)
+	})
 }
 
 func TestAddNotUniqueKO(t *testing.T) {
-	setupTestCase(t)
-	defer cleanTestCase(t)
-	result, err := testUserRepository.Add(&testUsers[0])
-	require.NoError(t, err)
-	require.NotEmpty(t, result)
+	forEachBackend(t, func(t *testing.T) {
+		result, err := testUserRepository.Add(context.Background(), &testUsers[0])
+		require.NoError(t, err)
+		require.NotEmpty(t, result)
+
+		result, err = testUserRepository.Add(context.Background(), &testUsers[0])
+		require.Error(t, err)
+		require.Nil(t, result)
+	})
+}
 
-	result, err = testUserRepository.Add(&testUsers[0])
-	require.Error(t, err)
-	require.Nil(t, result)
+func TestAddNotUniqueEmailNicknameKO(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		_, err := testUserRepository.Add(context.Background(), &model.User{FirstName: "a", LastName: "a", Nickname: "café",
+			Password: "1", Email: "Ann@b.com", Country: "Y"})
+		require.NoError(t, err)
+
+		// the emails are the same case-insensitively
+		result, err := testUserRepository.Add(context.Background(), &model.User{FirstName: "b", LastName: "b", Nickname: "bob",
+			Password: "1", Email: "ANN@B.COM", Country: "Y"})
+		require.ErrorIs(t, err, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeEmailTaken})
+		require.Equal(t, []errs.InvalidParam{{Name: "email", Reason: "email is already taken"}}, errs.ParamsOf(err))
+		require.Nil(t, result)
+
+		// the nicknames are the same once normalized: é is precomposed in the first one, not in this one
+		result, err = testUserRepository.Add(context.Background(), &model.User{FirstName: "b", LastName: "b", Nickname: "CAFE\u0301",
+			Password: "1", Email: "bob@b.com", Country: "Y"})
+		require.ErrorIs(t, err, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeNicknameTaken})
+		require.Nil(t, result)
+
+		count, err := testUserRepository.Count(context.Background(), nil)
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+	})
 }
 
 // Delete function testing
 func TestDeleteOK(t *testing.T) {
-	setupTestCase(t)
-	defer cleanTestCase(t)
-
-	_, _ = testUserRepository.Add(&testUsers[0])
+	forEachBackend(t, func(t *testing.T) {
+		_, _ = testUserRepository.Add(context.Background(), &testUsers[0])
 
-	err := testUserRepository.Delete(testUsers[0].ID)
-	require.NoError(t, err)
+		err := testUserRepository.Delete(context.Background(), testUsers[0].ID, 0)
+		require.NoError(t, err)
+	})
 }
 
 func TestDeleteNoIdKO(t *testing.T) {
-	setupTestCase(t)
-	defer cleanTestCase(t)
+	forEachBackend(t, func(t *testing.T) {
+		err := testUserRepository.Delete(context.Background(), testUsers[0].ID, 0)
+		require.Error(t, err)
+		require.Equal(t, fmt.Sprintf("error: cannot find user with ID %v", testUsers[0].ID),
+			err.Error())
+	})
+}
 
-	err := testUserRepository.Delete(testUsers[0].ID)
-	require.Error(t, err)
-	require.Equal(t, fmt.Sprintf("error: cannot find user with ID %v", testUsers[0].ID),
-		err.Error())
+func TestDeleteRestorePurgeOK(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		user := testUsers[0]
+		user.Roles = nil
+		_, err := testUserRepository.Add(context.Background(), &user)
+		require.NoError(t, err)
+		require.NoError(t, testUserRepository.Delete(context.Background(), user.ID, 0))
+
+		// the deleted users are hidden, but from the listings including them
+		_, err = testUserRepository.Get(context.Background(), user.ID)
+		require.ErrorIs(t, err, errs.ErrNotFound)
+		users, err := testUserRepository.GetAll(context.Background(), nil, 0, 0)
+		require.NoError(t, err)
+		require.Empty(t, users)
+		users, err = testUserRepository.GetAll(context.Background(), &model.Filter{IncludeDeleted: true}, 0, 0)
+		require.NoError(t, err)
+		require.Len(t, users, 1)
+		require.NotNil(t, users[0].DeletedAt)
+		require.ErrorIs(t, testUserRepository.Delete(context.Background(), user.ID, 0), errs.ErrNotFound)
+
+		restored, err := testUserRepository.Restore(context.Background(), user.ID)
+		require.NoError(t, err)
+		require.Nil(t, restored.DeletedAt)
+		require.Equal(t, []string{model.RoleUser}, restored.RoleNames())
+		_, err = testUserRepository.Restore(context.Background(), user.ID)
+		require.ErrorIs(t, err, errs.ErrNotFound)
+
+		// the users are purged once deleted before the time
+		require.NoError(t, testUserRepository.Delete(context.Background(), user.ID, 0))
+		n, err := testUserRepository.Purge(context.Background(), time.Now().Add(-time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, 0, n)
+		n, err = testUserRepository.Purge(context.Background(), time.Now().Add(time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+		_, err = testUserRepository.Restore(context.Background(), user.ID)
+		require.ErrorIs(t, err, errs.ErrNotFound)
+	})
+}
+
+func TestRestoreNotUniqueKO(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		user := testUsers[0]
+		user.Roles = nil
+		_, err := testUserRepository.Add(context.Background(), &user)
+		require.NoError(t, err)
+		require.NoError(t, testUserRepository.Delete(context.Background(), user.ID, 0))
+
+		// the email of the deleted user is free
+		other := testUsers[1]
+		other.Roles = nil
+		other.Email = strings.ToUpper(user.Email)
+		_, err = testUserRepository.Add(context.Background(), &other)
+		require.NoError(t, err)
+
+		restored, err := testUserRepository.Restore(context.Background(), user.ID)
+		require.ErrorIs(t, err, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeEmailTaken})
+		require.Nil(t, restored)
+	})
 }
 
 // Get function testing
 func TestGetOK(t *testing.T) {
-	setupTestCase(t)
-	defer cleanTestCase(t)
-
-	user, err := testUserRepository.Add(&testUsers[0])
-	require.NoError(t, err)
-	require.Equal(t, &testUsers[0], user)
-
-	userGet, errGet := testUserRepository.Get(testUsers[0].ID)
-	require.NoError(t, errGet)
-	require.Equal(t, user.ID, userGet.ID)
-	require.Equal(t, user.FirstName, userGet.FirstName)
-	require.Equal(t, user.LastName, userGet.LastName)
-	require.Equal(t, user.Nickname, userGet.Nickname)
-	require.Equal(t, user.Password, userGet.Password)
-	require.Equal(t, user.Email, userGet.Email)
+	forEachBackend(t, func(t *testing.T) {
+		user, err := testUserRepository.Add(context.Background(), &testUsers[0])
+		require.NoError(t, err)
+		require.Equal(t, &testUsers[0], user)
+
+		userGet, errGet := testUserRepository.Get(context.Background(), testUsers[0].ID)
+		require.NoError(t, errGet)
+		require.Equal(t, user.ID, userGet.ID)
+		require.Equal(t, user.FirstName, userGet.FirstName)
+		require.Equal(t, user.LastName, userGet.LastName)
+		require.Equal(t, user.Nickname, userGet.Nickname)
+		require.Equal(t, user.Password, userGet.Password)
+		require.Equal(t, user.Email, userGet.Email)
+	})
 }
 
 func TestGetNoIdKO(t *testing.T) {
-	setupTestCase(t)
-	defer cleanTestCase(t)
-
-	user, err := testUserRepository.Get(testUsers[0].ID)
-	require.Nil(t, user)
-	require.Error(t, err)
-	require.Equal(t, fmt.Sprintf("user with ID %v not found", testUsers[0].ID), err.Error())
+	forEachBackend(t, func(t *testing.T) {
+		user, err := testUserRepository.Get(context.Background(), testUsers[0].ID)
+		require.Nil(t, user)
+		require.Error(t, err)
+		require.Equal(t, fmt.Sprintf("user with ID %v not found", testUsers[0].ID), err.Error())
+		require.ErrorIs(t, err, errs.ErrNotFound)
+	})
 }
 
 // GetAll function testing
 func TestGetAllOK(t *testing.T) {
-	setupTestCase(t)
-	defer cleanTestCase(t)
-
-	_, _ = testUserRepository.Add(&testUsers[0])
-	_, _ = testUserRepository.Add(&testUsers[1])
-	users, err := testUserRepository.GetAll(nil, 0, 0)
-	require.NoError(t, err)
-	require.Equal(t, testUsers[0].ID, users[0].ID)
-	require.Equal(t, testUsers[0].FirstName, users[0].FirstName)
-	require.Equal(t, testUsers[0].LastName, users[0].LastName)
-	require.Equal(t, testUsers[0].Nickname, users[0].Nickname)
-	require.Equal(t, testUsers[0].Password, users[0].Password)
-	require.Equal(t, testUsers[0].Email, users[0].Email)
-	require.Equal(t, testUsers[0].Country, users[0].Country)
-	require.Equal(t, testUsers[1].ID, users[1].ID)
-	require.Equal(t, testUsers[1].FirstName, users[1].FirstName)
-	require.Equal(t, testUsers[1].LastName, users[1].LastName)
-	require.Equal(t, testUsers[1].Nickname, users[1].Nickname)
-	require.Equal(t, testUsers[1].Password, users[1].Password)
-	require.Equal(t, testUsers[1].Email, users[1].Email)
-	require.Equal(t, testUsers[1].Country, users[1].Country)
+	forEachBackend(t, func(t *testing.T) {
+		_, _ = testUserRepository.Add(context.Background(), &testUsers[0])
+		_, _ = testUserRepository.Add(context.Background(), &testUsers[1])
+		users, err := testUserRepository.GetAll(context.Background(), nil, 0, 0)
+		require.NoError(t, err)
+		require.Equal(t, testUsers[0].ID, users[0].ID)
+		require.Equal(t, testUsers[0].FirstName, users[0].FirstName)
+		require.Equal(t, testUsers[0].LastName, users[0].LastName)
+		require.Equal(t, testUsers[0].Nickname, users[0].Nickname)
+		require.Equal(t, testUsers[0].Password, users[0].Password)
+		require.Equal(t, testUsers[0].Email, users[0].Email)
+		require.Equal(t, testUsers[0].Country, users[0].Country)
+		require.Equal(t, testUsers[1].ID, users[1].ID)
+		require.Equal(t, testUsers[1].FirstName, users[1].FirstName)
+		require.Equal(t, testUsers[1].LastName, users[1].LastName)
+		require.Equal(t, testUsers[1].Nickname, users[1].Nickname)
+		require.Equal(t, testUsers[1].Password, users[1].Password)
+		require.Equal(t, testUsers[1].Email, users[1].Email)
+		require.Equal(t, testUsers[1].Country, users[1].Country)
+	})
 }
 
 func TestGetAllPaginationOK(t *testing.T) {
-	setupTestCase(t)
-	defer cleanTestCase(t)
-
-	_, _ = testUserRepository.Add(&testUsers[0])
-	_, _ = testUserRepository.Add(&testUsers[1])
-	users, err := testUserRepository.GetAll(nil, 1, 1)
-	require.NoError(t, err)
-	require.Equal(t, testUsers[0].ID, users[0].ID)
-	require.Equal(t, testUsers[0].FirstName, users[0].FirstName)
-	require.Equal(t, testUsers[0].LastName, users[0].LastName)
-	require.Equal(t, testUsers[0].Nickname, users[0].Nickname)
-	require.Equal(t, testUsers[0].Password, users[0].Password)
-	require.Equal(t, testUsers[0].Email, users[0].Email)
-	require.Equal(t, testUsers[0].Country, users[0].Country)
-
-	users, err = testUserRepository.GetAll(nil, 1, 2)
-	require.Equal(t, testUsers[1].ID, users[0].ID)
-	require.Equal(t, testUsers[1].FirstName, users[0].FirstName)
-	require.Equal(t, testUsers[1].LastName, users[0].LastName)
-	require.Equal(t, testUsers[1].Nickname, users[0].Nickname)
-	require.Equal(t, testUsers[1].Password, users[0].Password)
-	require.Equal(t, testUsers[1].Email, users[0].Email)
-	require.Equal(t, testUsers[1].Country, users[0].Country)
+	forEachBackend(t, func(t *testing.T) {
+		_, _ = testUserRepository.Add(context.Background(), &testUsers[0])
+		_, _ = testUserRepository.Add(context.Background(), &testUsers[1])
+		users, err := testUserRepository.GetAll(context.Background(), nil, 1, 1)
+		require.NoError(t, err)
+		require.Equal(t, testUsers[0].ID, users[0].ID)
+		require.Equal(t, testUsers[0].FirstName, users[0].FirstName)
+		require.Equal(t, testUsers[0].LastName, users[0].LastName)
+		require.Equal(t, testUsers[0].Nickname, users[0].Nickname)
+		require.Equal(t, testUsers[0].Password, users[0].Password)
+		require.Equal(t, testUsers[0].Email, users[0].Email)
+		require.Equal(t, testUsers[0].Country, users[0].Country)
+
+		users, err = testUserRepository.GetAll(context.Background(), nil, 1, 2)
+		require.Equal(t, testUsers[1].ID, users[0].ID)
+		require.Equal(t, testUsers[1].FirstName, users[0].FirstName)
+		require.Equal(t, testUsers[1].LastName, users[0].LastName)
+		require.Equal(t, testUsers[1].Nickname, users[0].Nickname)
+		require.Equal(t, testUsers[1].Password, users[0].Password)
+		require.Equal(t, testUsers[1].Email, users[0].Email)
+		require.Equal(t, testUsers[1].Country, users[0].Country)
+	})
 }
 
 func TestGetAllFilteringOK(t *testing.T) {
-	setupTestCase(t)
-	defer cleanTestCase(t)
-
-	_, _ = testUserRepository.Add(&testUsers[0])
-	_, _ = testUserRepository.Add(&testUsers[1])
-	users, err := testUserRepository.GetAll(&testUsers[0], 0, 0)
-	require.NoError(t, err)
-	require.Equal(t, testUsers[0].ID, users[0].ID)
-	require.Equal(t, testUsers[0].FirstName, users[0].FirstName)
-	require.Equal(t, testUsers[0].LastName, users[0].LastName)
-	require.Equal(t, testUsers[0].Nickname, users[0].Nickname)
-	require.Equal(t, testUsers[0].Password, users[0].Password)
-	require.Equal(t, testUsers[0].Email, users[0].Email)
-	require.Equal(t, testUsers[0].Country, users[0].Country)
+	forEachBackend(t, func(t *testing.T) {
+		_, _ = testUserRepository.Add(context.Background(), &testUsers[0])
+		_, _ = testUserRepository.Add(context.Background(), &testUsers[1])
+		users, err := testUserRepository.GetAll(context.Background(), &model.Filter{Conditions: []model.Condition{
+			{Field: "first_name", Op: model.OpEq, Values: []interface{}{testUsers[0].FirstName}},
+			{Field: "email", Op: model.OpEq, Values: []interface{}{testUsers[0].Email}},
+		}}, 0, 0)
+		require.NoError(t, err)
+		require.Len(t, users, 1)
+		require.Equal(t, testUsers[0].ID, users[0].ID)
+		require.Equal(t, testUsers[0].FirstName, users[0].FirstName)
+		require.Equal(t, testUsers[0].LastName, users[0].LastName)
+		require.Equal(t, testUsers[0].Nickname, users[0].Nickname)
+		require.Equal(t, testUsers[0].Password, users[0].Password)
+		require.Equal(t, testUsers[0].Email, users[0].Email)
+		require.Equal(t, testUsers[0].Country, users[0].Country)
+	})
 }
 
 func TestGetAllPaginationFilteringOK(t *testing.T) {
-	setupTestCase(t)
-	defer cleanTestCase(t)
+	forEachBackend(t, func(t *testing.T) {
+		_, _ = testUserRepository.Add(context.Background(), &testUsers[0])
+		_, _ = testUserRepository.Add(context.Background(), &testUsers[1])
+		users, err := testUserRepository.GetAll(context.Background(), &model.Filter{Conditions: []model.Condition{
+			{Field: "id", Op: model.OpEq, Values: []interface{}{testUsers[1].ID}},
+		}}, 1, 1)
+		require.NoError(t, err)
+		require.Equal(t, testUsers[1].ID, users[0].ID)
+		require.Equal(t, testUsers[1].FirstName, users[0].FirstName)
+		require.Equal(t, testUsers[1].LastName, users[0].LastName)
+		require.Equal(t, testUsers[1].Nickname, users[0].Nickname)
+		require.Equal(t, testUsers[1].Password, users[0].Password)
+		require.Equal(t, testUsers[1].Email, users[0].Email)
+		require.Equal(t, testUsers[1].Country, users[0].Country)
+	})
+}
 
-	_, _ = testUserRepository.Add(&testUsers[0])
-	_, _ = testUserRepository.Add(&testUsers[1])
-	users, err := testUserRepository.GetAll(&model.User{
-		ID: testUsers[1].ID,
-	}, 1, 1)
-	require.NoError(t, err)
-	require.Equal(t, testUsers[1].ID, users[0].ID)
-	require.Equal(t, testUsers[1].FirstName, users[0].FirstName)
-	require.Equal(t, testUsers[1].LastName, users[0].LastName)
-	require.Equal(t, testUsers[1].Nickname, users[0].Nickname)
-	require.Equal(t, testUsers[1].Password, users[0].Password)
-	require.Equal(t, testUsers[1].Email, users[0].Email)
-	require.Equal(t, testUsers[1].Country, users[0].Country)
+func TestGetAllOperatorsOK(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		_, _ = testUserRepository.Add(context.Background(), &model.User{FirstName: "Ann", LastName: "b", Nickname: "ann",
+			Password: "1", Email: "ann@gmail.com", Country: "Israel"})
+		_, _ = testUserRepository.Add(context.Background(), &model.User{FirstName: "Bob", LastName: "a", Nickname: "bob",
+			Password: "1", Email: "bob@example.com", Country: "Israel"})
+		_, _ = testUserRepository.Add(context.Background(), &model.User{FirstName: "Carl", LastName: "c", Nickname: "carl",
+			Password: "1", Email: "CARL@GMAIL.COM", Country: "Italy"})
+
+		tests := []struct {
+			condition model.Condition
+			expected  []string
+		}{
+			{model.Condition{Field: "country", Op: model.OpEq, Values: []interface{}{"Israel"}}, []string{"Ann", "Bob"}},
+			{model.Condition{Field: "country", Op: model.OpNe, Values: []interface{}{"Israel"}}, []string{"Carl"}},
+			{model.Condition{Field: "nickname", Op: model.OpIn, Values: []interface{}{"ann", "carl"}}, []string{"Ann", "Carl"}},
+			{model.Condition{Field: "email", Op: model.OpLike, Values: []interface{}{"%@gmail.com"}}, []string{"Ann", "Carl"}},
+			{model.Condition{Field: "id", Op: model.OpGt, Values: []interface{}{1}}, []string{"Bob", "Carl"}},
+			{model.Condition{Field: "id", Op: model.OpLte, Values: []interface{}{2}}, []string{"Ann", "Bob"}},
+			{model.Condition{Field: "created_at", Op: model.OpLt, Values: []interface{}{time.Now().Add(-time.Hour)}}, nil},
+			// values are bound as parameters, never interpolated in the queries
+			{model.Condition{Field: "country", Op: model.OpEq, Values: []interface{}{"Israel' OR '1'='1"}}, nil},
+		}
+
+		for _, test := range tests {
+			users, err := testUserRepository.GetAll(context.Background(), &model.Filter{Conditions: []model.Condition{test.condition}}, 0, 0)
+			require.NoError(t, err)
+
+			var names []string
+			for _, user := range users {
+				names = append(names, user.FirstName)
+			}
+			require.Equal(t, test.expected, names, "%v %v %v", test.condition.Field, test.condition.Op, test.condition.Values)
+		}
+	})
+}
+
+func TestGetAllSortOK(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		_, _ = testUserRepository.Add(context.Background(), &model.User{FirstName: "Ann", LastName: "b", Nickname: "ann",
+			Password: "1", Email: "ann@b.com", Country: "Israel"})
+		_, _ = testUserRepository.Add(context.Background(), &model.User{FirstName: "Bob", LastName: "a", Nickname: "bob",
+			Password: "1", Email: "bob@b.com", Country: "Israel"})
+		_, _ = testUserRepository.Add(context.Background(), &model.User{FirstName: "Carl", LastName: "c", Nickname: "carl",
+			Password: "1", Email: "carl@b.com", Country: "Italy"})
+
+		users, err := testUserRepository.GetAll(context.Background(), &model.Filter{Sort: []model.SortKey{
+			{Field: "country", Desc: true},
+			{Field: "last_name"},
+		}}, 0, 0)
+		require.NoError(t, err)
+		require.Len(t, users, 3)
+		require.Equal(t, "Carl", users[0].FirstName)
+		require.Equal(t, "Bob", users[1].FirstName)
+		require.Equal(t, "Ann", users[2].FirstName)
+	})
+}
+
+func TestGetAllInvalidFilterKO(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		users, err := testUserRepository.GetAll(context.Background(), &model.Filter{Sort: []model.SortKey{{Field: "id; DROP TABLE users"}}}, 0, 0)
+		require.ErrorIs(t, err, model.ErrInvalidFilter)
+		require.Nil(t, users)
+	})
+}
+
+// Count function testing
+func TestCountOK(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		count, err := testUserRepository.Count(context.Background(), nil)
+		require.NoError(t, err)
+		require.Equal(t, 0, count)
+
+		_, _ = testUserRepository.Add(context.Background(), &testUsers[0])
+		_, _ = testUserRepository.Add(context.Background(), &testUsers[1])
+		count, err = testUserRepository.Count(context.Background(), nil)
+		require.NoError(t, err)
+		require.Equal(t, 2, count)
+
+		count, err = testUserRepository.Count(context.Background(), &model.Filter{
+			Conditions: []model.Condition{{Field: "first_name", Op: model.OpEq, Values: []interface{}{testUsers[1].FirstName}}},
+			Sort:       []model.SortKey{{Field: "country", Desc: true}},
+		})
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+	})
+}
+
+// GetAllFrom function testing
+func TestGetAllFromOK(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		for i, name := range []string{"a", "c", "b", "c", "a"} {
+			nickname := fmt.Sprintf("%v%d", name, i)
+			_, err := testUserRepository.Add(context.Background(), &model.User{FirstName: name, LastName: name, Nickname: nickname,
+				Password: "1", Email: nickname + "@b.com", Country: "Y"})
+			require.NoError(t, err)
+		}
+		filter := &model.Filter{
+			Conditions: []model.Condition{{Field: "country", Op: model.OpEq, Values: []interface{}{"Y"}}},
+			Sort:       []model.SortKey{{Field: "last_name", Desc: true}},
+		}
+
+		users, err := testUserRepository.GetAllFrom(context.Background(), filter, nil, 2)
+		require.NoError(t, err)
+		require.Equal(t, []int{2, 4}, ids(users))
+
+		// users added in the meanwhile before the cursor don't shift the following pages
+		_, err = testUserRepository.Add(context.Background(), &model.User{FirstName: "d", LastName: "d", Nickname: "d",
+			Password: "1", Email: "d@b.com", Country: "Y"})
+		require.NoError(t, err)
+
+		users, err = testUserRepository.GetAllFrom(context.Background(), filter, model.NewCursor(filter, &users[1], false), 2)
+		require.NoError(t, err)
+		require.Equal(t, []int{3, 1}, ids(users))
+
+		users, err = testUserRepository.GetAllFrom(context.Background(), filter, model.NewCursor(filter, &users[1], false), 2)
+		require.NoError(t, err)
+		require.Equal(t, []int{5}, ids(users))
+
+		// backward, in the same order
+		users, err = testUserRepository.GetAllFrom(context.Background(), filter, model.NewCursor(filter, &users[0], true), 2)
+		require.NoError(t, err)
+		require.Equal(t, []int{3, 1}, ids(users))
+	})
+}
+
+func TestGetAllFromInvalidCursorKO(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		cursor := &model.Cursor{Sort: []model.SortKey{{Field: "last_name"}}, Values: []interface{}{"a"}, ID: 1}
+		users, err := testUserRepository.GetAllFrom(context.Background(), nil, cursor, 2)
+		require.ErrorIs(t, err, model.ErrInvalidFilter)
+		require.Nil(t, users)
+	})
+}
+
+func ids(users []model.User) []int {
+	ids := make([]int, len(users))
+	for i, user := range users {
+		ids[i] = user.ID
+	}
+
+	return ids
 }
 
 // Update function testing
 func TestUpdateOK(t *testing.T) {
-	setupTestCase(t)
-	defer cleanTestCase(t)
+	forEachBackend(t, func(t *testing.T) {
+		// copies, since the user is updated in place
+		user, newUser := testUsers[0], testUsers[1]
+		_, _ = testUserRepository.Add(context.Background(), &user)
+		updated, err := testUserRepository.Update(context.Background(), &user, &newUser)
+		require.NoError(t, err)
+		require.Equal(t, user.ID, updated.ID)
+		require.Equal(t, newUser.FirstName, updated.FirstName)
+		require.Equal(t, newUser.LastName, updated.LastName)
+		require.Equal(t, newUser.Nickname, updated.Nickname)
+		require.Equal(t, newUser.Password, updated.Password)
+		require.Equal(t, newUser.Email, updated.Email)
+		require.Equal(t, newUser.Country, updated.Country)
+	})
+}
 
-	_, _ = testUserRepository.Add(&testUsers[0])
-	user, err := testUserRepository.Update(&testUsers[0], &testUsers[1])
-	require.NoError(t, err)
-	require.Equal(t, testUsers[0].ID, user.ID)
-	require.Equal(t, testUsers[0].FirstName, user.FirstName)
-	require.Equal(t, testUsers[0].LastName, user.LastName)
-	require.Equal(t, testUsers[0].Nickname, user.Nickname)
-	require.Equal(t, testUsers[0].Password, user.Password)
-	require.Equal(t, testUsers[0].Email, user.Email)
-	require.Equal(t, testUsers[0].Country, user.Country)
+func TestReplaceOK(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		user := testUsers[0]
+		user.Roles = nil
+		_, err := testUserRepository.Add(context.Background(), &user)
+		require.NoError(t, err)
+
+		replacement := testUsers[1]
+		replacement.ID = user.ID
+		replacement.Roles = nil
+		replacement.Nickname = ""
+		replaced, err := testUserRepository.Replace(context.Background(), &replacement)
+		require.NoError(t, err)
+		require.Equal(t, user.ID, replaced.ID)
+		require.Equal(t, testUsers[1].FirstName, replaced.FirstName)
+		// unlike Update, zero values are written as well
+		require.Empty(t, replaced.Nickname)
+		require.Equal(t, user.CreatedAt.Unix(), replaced.CreatedAt.Unix())
+	})
+}
+
+func TestReplaceNotUniqueKO(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		user := model.User{ID: 1, FirstName: "user1", LastName: "y", Nickname: "z", Password: "1",
+			Email: "a@b.com", Country: "Y"}
+		_, err := testUserRepository.Add(context.Background(), &user)
+		require.NoError(t, err)
+		other := model.User{ID: 2, FirstName: "user2", LastName: "y", Nickname: "x", Password: "1",
+			Email: "x@b.com", Country: "Y"}
+		_, err = testUserRepository.Add(context.Background(), &other)
+		require.NoError(t, err)
+
+		other.Nickname = strings.ToUpper(user.Nickname)
+		replaced, err := testUserRepository.Replace(context.Background(), &other)
+		require.ErrorIs(t, err, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeNicknameTaken})
+		require.Nil(t, replaced)
+
+		updated, err := testUserRepository.Update(context.Background(), &other, &model.User{Email: strings.ToUpper(user.Email)})
+		require.ErrorIs(t, err, &errs.Error{Kind: errs.KindConflict, Code: errs.CodeEmailTaken})
+		require.NotNil(t, updated)
+	})
+}
+
+func TestCompareAndSwapVersionKO(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		user := testUsers[0]
+		user.Roles = nil
+		_, err := testUserRepository.Add(context.Background(), &user)
+		require.NoError(t, err)
+		require.Equal(t, 1, user.Version)
+
+		stale := user
+		updated, err := testUserRepository.Update(context.Background(), &user, &model.User{FirstName: "updated"})
+		require.NoError(t, err)
+		require.Equal(t, 2, updated.Version)
+
+		// the writes of the stale user fail, and write nothing
+		_, err = testUserRepository.Update(context.Background(), &stale, &model.User{FirstName: "stale"})
+		require.ErrorIs(t, err, errs.ErrPreconditionFailed)
+		_, err = testUserRepository.Replace(context.Background(), &stale)
+		require.ErrorIs(t, err, errs.ErrPreconditionFailed)
+		require.ErrorIs(t, testUserRepository.Delete(context.Background(), user.ID, stale.Version), errs.ErrPreconditionFailed)
+
+		got, err := testUserRepository.Get(context.Background(), user.ID)
+		require.NoError(t, err)
+		require.Equal(t, "updated", got.FirstName)
+		require.Equal(t, 2, got.Version)
+
+		// every write increments the version
+		replaced, err := testUserRepository.Replace(context.Background(), got)
+		require.NoError(t, err)
+		require.Equal(t, 3, replaced.Version)
+		require.NoError(t, testUserRepository.GrantRole(context.Background(), user.ID, model.RoleAdmin))
+		require.NoError(t, testUserRepository.Delete(context.Background(), user.ID, 4))
+
+		// the deleted user is not found, at any version
+		require.ErrorIs(t, testUserRepository.Delete(context.Background(), user.ID, 5), errs.ErrNotFound)
+		restored, err := testUserRepository.Restore(context.Background(), user.ID)
+		require.NoError(t, err)
+		require.Equal(t, 6, restored.Version)
+	})
+}
+
+func TestReplaceNoIdKO(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		replacement := testUsers[1]
+		replacement.ID = 42
+		_, err := testUserRepository.Replace(context.Background(), &replacement)
+		require.Error(t, err)
+	})
+}
+
+func TestCloseOK(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		require.NoError(t, testUserRepository.Close())
+
+		// the repository cannot be used anymore
+		_, err := testUserRepository.Add(context.Background(), &model.User{FirstName: "x"})
+		require.Error(t, err)
+	})
+}
+
+// roles testing
+func TestAddDefaultRoleOK(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		user := testUsers[0]
+		user.Roles = nil
+		_, err := testUserRepository.Add(context.Background(), &user)
+		require.NoError(t, err)
+
+		stored, err := testUserRepository.Get(context.Background(), user.ID)
+		require.NoError(t, err)
+		require.Equal(t, []string{model.RoleUser}, stored.RoleNames())
+		require.Empty(t, stored.Permissions())
+	})
+}
+
+func TestGrantRevokeRoleOK(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		user := testUsers[0]
+		user.Roles = nil
+		_, err := testUserRepository.Add(context.Background(), &user)
+		require.NoError(t, err)
+
+		require.NoError(t, testUserRepository.GrantRole(context.Background(), user.ID, model.RoleAdmin))
+		stored, err := testUserRepository.Get(context.Background(), user.ID)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{model.RoleUser, model.RoleAdmin}, stored.RoleNames())
+		require.Contains(t, stored.Permissions(), model.PermissionRolesWrite)
+
+		require.NoError(t, testUserRepository.RevokeRole(context.Background(), user.ID, model.RoleAdmin))
+		stored, err = testUserRepository.Get(context.Background(), user.ID)
+		require.NoError(t, err)
+		require.Equal(t, []string{model.RoleUser}, stored.RoleNames())
+	})
+}
+
+func TestGrantRoleUnknownKO(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		user := testUsers[0]
+		user.Roles = nil
+		_, err := testUserRepository.Add(context.Background(), &user)
+		require.NoError(t, err)
+
+		require.Error(t, testUserRepository.GrantRole(context.Background(), user.ID, "unknown"))
+		require.Error(t, testUserRepository.GrantRole(context.Background(), user.ID+100, model.RoleAdmin))
+	})
+}
+
+// refresh tokens testing
+func TestRefreshTokensOK(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		token := model.RefreshToken{Hash: "hash", Family: "family", UserID: 1, ExpiresAt: time.Now().Add(time.Hour)}
+		require.NoError(t, testUserRepository.AddRefreshToken(context.Background(), &token))
+
+		stored, err := testUserRepository.GetRefreshToken(context.Background(), "hash")
+		require.NoError(t, err)
+		require.Equal(t, "family", stored.Family)
+		require.Nil(t, stored.RevokedAt)
+
+		// a token can be revoked only once
+		require.NoError(t, testUserRepository.RevokeRefreshToken(context.Background(), "hash"))
+		require.Error(t, testUserRepository.RevokeRefreshToken(context.Background(), "hash"))
+
+		stored, err = testUserRepository.GetRefreshToken(context.Background(), "hash")
+		require.NoError(t, err)
+		require.NotNil(t, stored.RevokedAt)
+
+		_, err = testUserRepository.GetRefreshToken(context.Background(), "unknown")
+		require.Error(t, err)
+	})
+}
+
+func TestRevokeRefreshTokenFamilyOK(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		for _, hash := range []string{"hash1", "hash2"} {
+			token := model.RefreshToken{Hash: hash, Family: "family", UserID: 1, ExpiresAt: time.Now().Add(time.Hour)}
+			require.NoError(t, testUserRepository.AddRefreshToken(context.Background(), &token))
+		}
+
+		require.NoError(t, testUserRepository.RevokeRefreshTokenFamily(context.Background(), "family"))
+		for _, hash := range []string{"hash1", "hash2"} {
+			stored, err := testUserRepository.GetRefreshToken(context.Background(), hash)
+			require.NoError(t, err)
+			require.NotNil(t, stored.RevokedAt)
+		}
+	})
 }
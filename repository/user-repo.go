@@ -1,25 +1,84 @@
 // pkg represents the repository layer of the microservice.
-// SQLite and MongoDB databases are available
+// SQLite, PostgreSQL and MongoDB databases are available, as well as an in-memory one
 
 package repository
 
 import (
+	"context"
 	"log"
+	"time"
 
 	"gorm.io/gorm"
 
 	"github.com/pavelerokhin/user-microservice-go/model"
 )
 
+// Backends of the repository, selected by the -storage flag
+const (
+	BackendSqlite   = "sqlite"
+	BackendPostgres = "postgres"
+	BackendMemory   = "memory"
+)
+
+// UserRepository stores the users. Its methods are bound to their context: they stop, returning the error
+// of the context, as soon as it is canceled or its deadline is exceeded. The backends are interchangeable:
+// each one passes the conformance tests of the repotest package
 type UserRepository interface {
-	Add(user *model.User) (*model.User, error)
-	Delete(id int) error
-	Get(id int) (*model.User, error)
-	GetAll(filters *model.User, pageSize, page int) ([]model.User, error)
-	Update(user, newUser *model.User) (*model.User, error)
+	// Add stores the user with a new ID, unless it has one, and returns it with its roles: the user role
+	// if it has none. The creation and update times are set unless given, and the version is 1. Add fails
+	// with a conflict if the email or the nickname is taken, and as not found if a role is unknown, adding
+	// no user in both cases
+	Add(ctx context.Context, user *model.User) (*model.User, error)
+	// Count counts the users matching the conditions of the filter, as listed by GetAll
+	Count(ctx context.Context, filter *model.Filter) (int, error)
+	// Delete soft-deletes the user with the ID: the deleted users are hidden, but by the listings of the
+	// filters including them, until restored or purged. Unless 0, the version is compared and swapped like
+	// the one of Replace
+	Delete(ctx context.Context, id, version int) error
+	// Get returns the user with the ID, unless deleted
+	Get(ctx context.Context, id int) (*model.User, error)
+	// GetAll lists the users matching the conditions of the filter, ordered by its sort keys and then by ID.
+	// A nil filter lists all the users. Unless pageSize is 0, which lists all of them, the users are paged:
+	// the pages before the first one are the first one, and those after the last one are empty. The empty
+	// listings, of every method, are empty slices rather than nil
+	GetAll(ctx context.Context, filter *model.Filter, pageSize, page int) ([]model.User, error)
+	// GetAllFrom lists up to limit users matching the filter which follow the cursor, or precede it for
+	// a backward cursor, in the order of the filter. A nil cursor lists from the beginning. Unlike the
+	// pages of GetAll, the listing from a cursor skips no user and repeats none when users are added or
+	// deleted in the meanwhile
+	GetAllFrom(ctx context.Context, filter *model.Filter, cursor *model.Cursor, limit int) ([]model.User, error)
+	// Replace overwrites every field of the stored user with the ID of the user, but the creation time.
+	// Every write increments the version of the user: unless 0, the version of the user is compared and
+	// swapped, so that the write fails as precondition failed if the stored user is at another version
+	Replace(ctx context.Context, user *model.User) (*model.User, error)
+	// Update sets the non-zero fields of newUser on the user, comparing and swapping the version of the
+	// user like Replace: the zero-valued fields are left as they are, so that unlike Replace, Update cannot
+	// clear a field. The ID, the creation and deletion times and the version of newUser are ignored. The
+	// user is updated in place, with its new update time and version, and returned
+	Update(ctx context.Context, user, newUser *model.User) (*model.User, error)
+	// Restore undoes the deletion of the user with the ID. It fails with a conflict if the email or the
+	// nickname of the user has been taken in the meanwhile
+	Restore(ctx context.Context, id int) (*model.User, error)
+	// Purge permanently removes the users deleted before the time, and returns how many
+	Purge(ctx context.Context, before time.Time) (int, error)
+
+	// roles of the users, with their permissions
+	GrantRole(ctx context.Context, userID int, role string) error
+	RevokeRole(ctx context.Context, userID int, role string) error
+
+	// refresh tokens of the authenticated users
+	AddRefreshToken(ctx context.Context, token *model.RefreshToken) error
+	GetRefreshToken(ctx context.Context, hash string) (*model.RefreshToken, error)
+	RevokeRefreshToken(ctx context.Context, hash string) error
+	RevokeRefreshTokenFamily(ctx context.Context, family string) error
+
+	// Close releases the connections to the database; the repository cannot be used anymore
+	Close() error
 }
 
+// repo is the repository of the SQL databases, SQLite and PostgreSQL: Name is the one of the database
 type repo struct {
 	DB     *gorm.DB
 	Logger *log.Logger
+	Name   string
 }
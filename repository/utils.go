@@ -1,6 +1,20 @@
 package repository
 
-import "gorm.io/gorm"
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/pavelerokhin/user-microservice-go/errs"
+	"github.com/pavelerokhin/user-microservice-go/model"
+)
 
 func paginate(page, pageSize int) func(db *gorm.DB) *gorm.DB {
 	return func(db *gorm.DB) *gorm.DB {
@@ -8,3 +22,440 @@ func paginate(page, pageSize int) func(db *gorm.DB) *gorm.DB {
 		return db.Offset(offset).Limit(pageSize)
 	}
 }
+
+// sqlOperators are the SQL comparison operators of the operators of the filters
+var sqlOperators = map[string]string{
+	model.OpEq:  "=",
+	model.OpNe:  "<>",
+	model.OpGt:  ">",
+	model.OpGte: ">=",
+	model.OpLt:  "<",
+	model.OpLte: "<=",
+}
+
+// mongoOperators are the MongoDB query operators of the operators of the filters
+var mongoOperators = map[string]string{
+	model.OpEq:  "$eq",
+	model.OpNe:  "$ne",
+	model.OpIn:  "$in",
+	model.OpGt:  "$gt",
+	model.OpGte: "$gte",
+	model.OpLt:  "$lt",
+	model.OpLte: "$lte",
+}
+
+// filterAndSort restricts the query to the users matching the filter and orders them by its sort keys
+// and then by ID. The filter must be valid: its field names, whitelisted by the model, are the column
+// names, while the values are always bound as parameters
+func filterAndSort(filter *model.Filter) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		db = db.Scopes(live(filter))
+		if filter != nil {
+			db = db.Scopes(where(filter.Conditions))
+		}
+
+		return db.Scopes(orderBy(filter.Order()))
+	}
+}
+
+// seek restricts the query to the users following the cursor in its order, and sorts them in that order
+func seek(cursor *model.Cursor) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		var groups []string
+		var args []interface{}
+		for _, group := range cursor.Seek() {
+			var conditions []string
+			for _, c := range group {
+				condition, values := sqlCondition(c)
+				conditions = append(conditions, condition)
+				args = append(args, values...)
+			}
+			groups = append(groups, "("+strings.Join(conditions, " AND ")+")")
+		}
+
+		return db.Where(strings.Join(groups, " OR "), args...).Scopes(orderBy(cursor.Order()))
+	}
+}
+
+// live restricts the query to the users which are not deleted, unless the filter includes the deleted ones
+func live(filter *model.Filter) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if filter != nil && filter.IncludeDeleted {
+			return db
+		}
+
+		return db.Where("deleted_at IS NULL")
+	}
+}
+
+func where(conditions []model.Condition) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		for _, c := range conditions {
+			condition, values := sqlCondition(c)
+			db = db.Where(condition, values...)
+		}
+
+		return db
+	}
+}
+
+func orderBy(keys []model.SortKey) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		for _, key := range keys {
+			db = db.Order(clause.OrderByColumn{Column: clause.Column{Name: key.Field}, Desc: key.Desc})
+		}
+
+		return db
+	}
+}
+
+// sqlCondition returns the SQL expression of the condition, with its parameters
+func sqlCondition(c model.Condition) (string, []interface{}) {
+	switch c.Op {
+	case model.OpIn:
+		return c.Field + " IN ?", []interface{}{c.Values}
+	case model.OpLike:
+		return "LOWER(" + c.Field + ") LIKE LOWER(?)", c.Values
+	default:
+		return c.Field + " " + sqlOperators[c.Op] + " ?", c.Values
+	}
+}
+
+// mongoFilter returns the MongoDB query of the users matching the filter and, if any, following the
+// cursor, but the deleted ones unless the filter includes them. The conditions are joined with $and, so
+// that there can be more than one on the same field
+func mongoFilter(filter *model.Filter, cursor *model.Cursor) bson.M {
+	conditions := bson.A{}
+	if filter != nil {
+		for _, c := range filter.Conditions {
+			conditions = append(conditions, mongoCondition(c))
+		}
+	}
+
+	if cursor != nil {
+		groups := bson.A{}
+		for _, group := range cursor.Seek() {
+			groupConditions := bson.A{}
+			for _, c := range group {
+				groupConditions = append(groupConditions, mongoCondition(c))
+			}
+			groups = append(groups, bson.M{"$and": groupConditions})
+		}
+		conditions = append(conditions, bson.M{"$or": groups})
+	}
+
+	if filter == nil || !filter.IncludeDeleted {
+		// null matches the missing field as well
+		conditions = append(conditions, bson.M{"deleted_at": nil})
+	}
+
+	if len(conditions) == 0 {
+		return bson.M{}
+	}
+
+	return bson.M{"$and": conditions}
+}
+
+func mongoCondition(c model.Condition) bson.M {
+	switch c.Op {
+	case model.OpIn:
+		return bson.M{c.Field: bson.M{"$in": c.Values}}
+	case model.OpLike:
+		return bson.M{c.Field: bson.M{"$regex": likeToRegex(c.Values[0].(string))}}
+	default:
+		return bson.M{c.Field: bson.M{mongoOperators[c.Op]: c.Values[0]}}
+	}
+}
+
+// mongoSort returns the MongoDB sort by the sort keys
+func mongoSort(keys []model.SortKey) bson.D {
+	sort := bson.D{}
+	for _, key := range keys {
+		order := 1
+		if key.Desc {
+			order = -1
+		}
+		sort = append(sort, bson.E{Key: key.Field, Value: order})
+	}
+
+	return sort
+}
+
+// validateFilter checks the filter before its field names end up in the queries
+func validateFilter(filter *model.Filter) error {
+	err := filter.Validate()
+	if err != nil {
+		return errs.Invalid(errs.CodeInvalidFilter, "%v", err)
+	}
+
+	return nil
+}
+
+// validateFilterAndCursor checks the filter and the cursor, if any, before their field names end up
+// in the queries
+func validateFilterAndCursor(filter *model.Filter, cursor *model.Cursor) error {
+	err := validateFilter(filter)
+	if err != nil || cursor == nil {
+		return err
+	}
+
+	err = cursor.Validate(filter)
+	if err != nil {
+		return errs.Invalid(errs.CodeInvalidCursor, "%v", err)
+	}
+
+	return nil
+}
+
+// reverse reverses the order of the users, listed backward from a cursor
+func reverse(users []model.User) {
+	for i, j := 0, len(users)-1; i < j; i, j = i+1, j-1 {
+		users[i], users[j] = users[j], users[i]
+	}
+}
+
+// likeToRegex translates a case-insensitive SQL LIKE pattern into an anchored regular expression:
+// % matches any sequence, _ any character and everything else literally
+func likeToRegex(pattern string) primitive.Regex {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			b.WriteString(".*")
+		case '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+
+	return primitive.Regex{Pattern: b.String(), Options: "is"}
+}
+
+// seedRoles creates the default roles and permissions, if they don't exist yet
+func seedRoles(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, defaultRole := range model.DefaultRoles {
+			role := model.Role{Name: defaultRole.Name}
+			err := tx.Where(&role).FirstOrCreate(&role).Error
+			if err != nil {
+				return err
+			}
+
+			for _, defaultPermission := range defaultRole.Permissions {
+				permission := model.Permission{Name: defaultPermission.Name}
+				err = tx.Where(&permission).FirstOrCreate(&permission).Error
+				if err != nil {
+					return err
+				}
+
+				err = tx.Model(&role).Association("Permissions").Append(&permission)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// compareAndSwap restricts the write to the user to the version, unless 0
+func compareAndSwap(version int) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if version == 0 {
+			return db
+		}
+
+		return db.Where("version = ?", version)
+	}
+}
+
+// bumpVersion increments the version of the user with the ID
+func bumpVersion(db *gorm.DB, id int) error {
+	return db.Model(&model.User{}).Where("id = ?", id).UpdateColumn("version", gorm.Expr("version + 1")).Error
+}
+
+// notWritten returns the error of a write to the user with the ID, conditional on the version, which
+// has written no user: either the user has been modified since the version, or notFound
+func notWritten(db *gorm.DB, id, version int, notFound error) error {
+	if version == 0 {
+		return notFound
+	}
+
+	var count int64
+	err := db.Model(&model.User{}).Where("id = ? AND deleted_at IS NULL", id).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return notFound
+	}
+
+	return versionMismatch(id, version)
+}
+
+// mongoCompareAndSwap restricts the query of the write to the user to the version, unless 0
+func mongoCompareAndSwap(query bson.M, version int) bson.M {
+	if version != 0 {
+		query["version"] = version
+	}
+
+	return query
+}
+
+// versionMismatch returns the error of a write to the user with the ID conditional on a version the
+// user doesn't have anymore
+func versionMismatch(id, version int) error {
+	return errs.PreconditionFailed(errs.CodeVersionMismatch, "user with ID %v has been modified since version %v",
+		id, version)
+}
+
+// backfillKeys sets the keys of the users, but the deleted ones, stored before the emails and the
+// nicknames were unique. The users whose keys are taken by others are logged and left without them, to
+// be fixed by hand: their emails and nicknames are still unique among the other users
+func backfillKeys(db *gorm.DB, l *log.Logger) error {
+	var users []model.User
+	err := db.Where("deleted_at IS NULL AND (email_key IS NULL OR nickname_key IS NULL)").Find(&users).Error
+	if err != nil {
+		return err
+	}
+
+	for i := range users {
+		users[i].SetKeys()
+		err = db.Model(&users[i]).UpdateColumns(map[string]interface{}{
+			"email_key":    users[i].EmailKey,
+			"nickname_key": users[i].NicknameKey,
+		}).Error
+		if conflict := conflictOf(err); conflict != nil {
+			l.Printf("cannot set the keys of user with ID %v: %v", users[i].ID, conflict)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func findUserAndRole(db *gorm.DB, userID int, role string) (*model.User, *model.Role, error) {
+	var user model.User
+	tx := db.Where("id = ? AND deleted_at IS NULL", userID).Find(&user)
+	if tx.Error != nil {
+		return nil, nil, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return nil, nil, errs.NotFound(errs.CodeUserNotFound, "user with ID %v not found", userID)
+	}
+
+	var dbRole model.Role
+	tx = db.Where("name = ?", role).Find(&dbRole)
+	if tx.Error != nil {
+		return nil, nil, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return nil, nil, errs.NotFound(errs.CodeRoleNotFound, "role %v not found", role)
+	}
+
+	return &user, &dbRole, nil
+}
+
+func grantRole(db *gorm.DB, userID int, role string) error {
+	user, dbRole, err := findUserAndRole(db, userID, role)
+	if err != nil {
+		return err
+	}
+
+	// the row of the join table only: appending to the association would also save the user, touching
+	// its updated time
+	return db.Table("user_roles").Clauses(clause.OnConflict{DoNothing: true}).
+		Create(map[string]interface{}{"user_id": user.ID, "role_id": dbRole.ID}).Error
+}
+
+// nonZeroFields returns the non-zero fields of the user keyed by their bson names. This mirrors
+// the way GORM treats a struct passed to Where or Updates: zero values are ignored
+func nonZeroFields(user *model.User) bson.M {
+	fields := bson.M{}
+	if user == nil {
+		return fields
+	}
+
+	if user.ID != 0 {
+		fields["id"] = user.ID
+	}
+	if user.FirstName != "" {
+		fields["first_name"] = user.FirstName
+	}
+	if user.LastName != "" {
+		fields["last_name"] = user.LastName
+	}
+	if user.Nickname != "" {
+		fields["nickname"] = user.Nickname
+	}
+	if user.Password != "" {
+		fields["password"] = user.Password
+	}
+	if user.Email != "" {
+		fields["email"] = user.Email
+	}
+	if user.Country != "" {
+		fields["country"] = user.Country
+	}
+	if !user.CreatedAt.IsZero() {
+		fields["created_at"] = user.CreatedAt
+	}
+	if !user.UpdatedAt.IsZero() {
+		fields["updated_at"] = user.UpdatedAt
+	}
+	if user.EmailKey != "" {
+		fields["email_key"] = user.EmailKey
+	}
+	if user.NicknameKey != "" {
+		fields["nickname_key"] = user.NicknameKey
+	}
+
+	return fields
+}
+
+// uniqueKeys are the unique keys of the users: their columns (and MongoDB fields), the fields they
+// make unique and the codes of the conflicts on them
+var uniqueKeys = []struct {
+	column, field, code string
+}{
+	{"email_key", "email", errs.CodeEmailTaken},
+	{"nickname_key", "nickname", errs.CodeNicknameTaken},
+}
+
+// conflictOf returns the conflict naming the field of the user whose unique key err, a violation of a
+// unique constraint of SQLite or PostgreSQL (or a duplicate key error of MongoDB), is about. It returns
+// nil if err is about none of them
+func conflictOf(err error) error {
+	if !isDuplicate(err) {
+		return nil
+	}
+
+	for _, key := range uniqueKeys {
+		if strings.Contains(err.Error(), key.column) {
+			return taken(key.field, key.code, err)
+		}
+	}
+
+	return nil
+}
+
+// isDuplicate reports whether err is a violation of a unique constraint of SQLite or PostgreSQL, or a
+// duplicate key error of MongoDB
+func isDuplicate(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "UNIQUE constraint failed") ||
+		strings.Contains(err.Error(), "duplicate key value violates unique constraint") || mongo.IsDuplicateKeyError(err))
+}
+
+// taken returns the conflict naming the field of the user, whose unique key is taken by another user
+func taken(field, code string, err error) error {
+	reason := fmt.Sprintf("%v is already taken", field)
+	return &errs.Error{Kind: errs.KindConflict, Code: code, Message: reason,
+		Params: []errs.InvalidParam{{Name: field, Reason: reason}}, Err: err}
+}
@@ -7,29 +7,71 @@ import (
 	"github.com/go-chi/chi"
 )
 
-var (
-	chiDispatcher = chi.NewRouter()
-)
+type chiRouter struct {
+	ChiDispatcher *chi.Mux
+	Logger        *log.Logger
+}
 
-type chiRouter struct{}
+func NewChiRouter(logger *log.Logger) Router {
+	cr := &chiRouter{ChiDispatcher: chi.NewRouter(), Logger: logger}
+	cr.ChiDispatcher.MethodNotAllowed(methodNotAllowed(logger, cr.matches))
 
-func (*chiRouter) DELETE(uri string, f func(w http.ResponseWriter, r *http.Request)) {
-	chiDispatcher.Delete(uri, f)
+	return cr
 }
 
-func (*chiRouter) GET(uri string, f func(w http.ResponseWriter, r *http.Request)) {
-	chiDispatcher.Get(uri, f)
+func (cr *chiRouter) DELETE(uri string, f func(w http.ResponseWriter, r *http.Request)) {
+	cr.ChiDispatcher.Delete(uri, withChiParams(f))
 }
 
-func (*chiRouter) POST(uri string, f func(w http.ResponseWriter, r *http.Request)) {
-	chiDispatcher.Post(uri, f)
+func (cr *chiRouter) GET(uri string, f func(w http.ResponseWriter, r *http.Request)) {
+	cr.ChiDispatcher.Get(uri, withChiParams(f))
 }
 
-func (*chiRouter) SERVE(port string) {
-	log.Printf("CHI HTTP server running on posrt %v", port)
-	log.Fatalln(http.ListenAndServe(port, chiDispatcher))
+func (cr *chiRouter) HEAD(uri string, f func(w http.ResponseWriter, r *http.Request)) {
+	cr.ChiDispatcher.Head(uri, withChiParams(f))
 }
 
-func NewChiRouter() Router {
-	return &chiRouter{}
+func (cr *chiRouter) OPTIONS(uri string, f func(w http.ResponseWriter, r *http.Request)) {
+	cr.ChiDispatcher.Options(uri, withChiParams(f))
+}
+
+func (cr *chiRouter) PATCH(uri string, f func(w http.ResponseWriter, r *http.Request)) {
+	cr.ChiDispatcher.Patch(uri, withChiParams(f))
+}
+
+func (cr *chiRouter) POST(uri string, f func(w http.ResponseWriter, r *http.Request)) {
+	cr.ChiDispatcher.Post(uri, withChiParams(f))
+}
+
+func (cr *chiRouter) PUT(uri string, f func(w http.ResponseWriter, r *http.Request)) {
+	cr.ChiDispatcher.Put(uri, withChiParams(f))
+}
+
+func (cr *chiRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cr.ChiDispatcher.ServeHTTP(w, r)
+}
+
+func (cr *chiRouter) USE(middlewares ...Middleware) {
+	for _, m := range middlewares {
+		cr.ChiDispatcher.Use(m)
+	}
+}
+
+// matches reports whether a route matches the path of the request with the method
+func (cr *chiRouter) matches(r *http.Request, method string) bool {
+	return cr.ChiDispatcher.Match(chi.NewRouteContext(), method, r.URL.Path)
+}
+
+// withChiParams passes the path parameters matched by chi to the handler
+func withChiParams(f func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := map[string]string{}
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			for i, key := range rctx.URLParams.Keys {
+				params[key] = rctx.URLParams.Values[i]
+			}
+		}
+
+		f(w, WithParams(r, params))
+	}
 }
@@ -0,0 +1,47 @@
+package router
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/pavelerokhin/user-microservice-go/errs"
+)
+
+// methods are the methods a route can be registered with
+var methods = []string{
+	http.MethodDelete,
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodOptions,
+	http.MethodPatch,
+	http.MethodPost,
+	http.MethodPut,
+}
+
+// methodNotAllowed returns the handler of the requests to a registered path with a method it doesn't
+// support. matches reports whether the path of the request is registered with the method. OPTIONS
+// requests are answered with 204 No Content, the others with 405 Method Not Allowed: in both cases,
+// the Allow header lists the supported methods
+func methodNotAllowed(logger *log.Logger, matches func(r *http.Request, method string) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		allowed := []string{http.MethodOptions}
+		for _, method := range methods {
+			if method != http.MethodOptions && matches(r, method) {
+				allowed = append(allowed, method)
+			}
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		notAllowed := errs.New(errs.KindMethodNotAllowed, errs.CodeMethodNotAllowed, "method %v is not allowed on %v", r.Method, r.URL.Path)
+		err := errs.WriteError(w, r, http.StatusMethodNotAllowed, notAllowed)
+		if err != nil {
+			logger.Println(err)
+		}
+	}
+}
@@ -13,22 +13,66 @@ type muxRouter struct {
 }
 
 func NewMuxRouter(logger *log.Logger) Router {
-	return &muxRouter{Logger: logger, MuxDispatcher: mux.NewRouter()}
+	mr := &muxRouter{Logger: logger, MuxDispatcher: mux.NewRouter()}
+	mr.MuxDispatcher.MethodNotAllowedHandler = methodNotAllowed(logger, mr.matches)
+
+	return mr
 }
 
 func (mr *muxRouter) DELETE(uri string, f func(w http.ResponseWriter, r *http.Request)) {
-	mr.MuxDispatcher.HandleFunc(uri, f).Methods(http.MethodDelete)
+	mr.handle(http.MethodDelete, uri, f)
 }
 
 func (mr *muxRouter) GET(uri string, f func(w http.ResponseWriter, r *http.Request)) {
-	mr.MuxDispatcher.HandleFunc(uri, f).Methods(http.MethodGet)
+	mr.handle(http.MethodGet, uri, f)
+}
+
+func (mr *muxRouter) HEAD(uri string, f func(w http.ResponseWriter, r *http.Request)) {
+	mr.handle(http.MethodHead, uri, f)
+}
+
+func (mr *muxRouter) OPTIONS(uri string, f func(w http.ResponseWriter, r *http.Request)) {
+	mr.handle(http.MethodOptions, uri, f)
+}
+
+func (mr *muxRouter) PATCH(uri string, f func(w http.ResponseWriter, r *http.Request)) {
+	mr.handle(http.MethodPatch, uri, f)
 }
 
 func (mr *muxRouter) POST(uri string, f func(w http.ResponseWriter, r *http.Request)) {
-	mr.MuxDispatcher.HandleFunc(uri, f).Methods(http.MethodPost)
+	mr.handle(http.MethodPost, uri, f)
+}
+
+func (mr *muxRouter) PUT(uri string, f func(w http.ResponseWriter, r *http.Request)) {
+	mr.handle(http.MethodPut, uri, f)
+}
+
+func (mr *muxRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mr.MuxDispatcher.ServeHTTP(w, r)
+}
+
+func (mr *muxRouter) USE(middlewares ...Middleware) {
+	for _, m := range middlewares {
+		mr.MuxDispatcher.Use(mux.MiddlewareFunc(m))
+	}
+}
+
+func (mr *muxRouter) handle(method, uri string, f func(w http.ResponseWriter, r *http.Request)) {
+	mr.MuxDispatcher.HandleFunc(uri, withMuxParams(f)).Methods(method)
+}
+
+// matches reports whether a route matches the path of the request with the method
+func (mr *muxRouter) matches(r *http.Request, method string) bool {
+	probe := r.Clone(r.Context())
+	probe.Method = method
+
+	var match mux.RouteMatch
+	return mr.MuxDispatcher.Match(probe, &match) && match.MatchErr == nil
 }
 
-func (mr *muxRouter) SERVE(port string) {
-	mr.Logger.Printf("Mux HTTP server running on port %v", port)
-	mr.Logger.Fatalln(http.ListenAndServe(port, mr.MuxDispatcher))
+// withMuxParams passes the path parameters matched by mux to the handler
+func withMuxParams(f func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f(w, WithParams(r, mux.Vars(r)))
+	}
 }
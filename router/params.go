@@ -0,0 +1,21 @@
+package router
+
+import (
+	"context"
+	"net/http"
+)
+
+type paramsKey struct{}
+
+// Param returns the value of the path parameter of the request, whatever router has dispatched it.
+// It returns an empty string if the route has no such parameter
+func Param(request *http.Request, name string) string {
+	params, _ := request.Context().Value(paramsKey{}).(map[string]string)
+	return params[name]
+}
+
+// WithParams returns a copy of the request carrying the path parameters. The routers call it before
+// the handlers; it lets the handlers be called directly as well, e.g. in tests
+func WithParams(request *http.Request, params map[string]string) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), paramsKey{}, params))
+}
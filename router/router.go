@@ -3,11 +3,47 @@
 
 package router
 
-import "net/http"
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
 
+const (
+	BackendChi = "chi"
+	BackendMux = "mux"
+)
+
+// Middleware wraps a handler; it can act before and after the wrapped handler, or stop the request
+type Middleware func(http.Handler) http.Handler
+
+// Router registers the routes of the microservice. Patterns follow the syntax shared by the backends:
+// path parameters are written as {name} or {name:regexp}, and the handlers read them with Param.
+// Requests to a registered path with a method it doesn't support are answered with 405 Method Not
+// Allowed, and OPTIONS requests with the Allow header, unless an OPTIONS handler is registered.
+// Routers are served by the server package
 type Router interface {
+	http.Handler
 	DELETE(uri string, f func(w http.ResponseWriter, r *http.Request))
 	GET(uri string, f func(w http.ResponseWriter, r *http.Request))
+	HEAD(uri string, f func(w http.ResponseWriter, r *http.Request))
+	OPTIONS(uri string, f func(w http.ResponseWriter, r *http.Request))
+	PATCH(uri string, f func(w http.ResponseWriter, r *http.Request))
 	POST(uri string, f func(w http.ResponseWriter, r *http.Request))
-	SERVE(port string)
+	PUT(uri string, f func(w http.ResponseWriter, r *http.Request))
+	// USE adds middlewares applied to every route, in the order they are given.
+	// Middlewares must be added before the routes are registered
+	USE(middlewares ...Middleware)
+}
+
+// New returns a router of the backend, BackendMux or BackendChi
+func New(backend string, logger *log.Logger) (Router, error) {
+	switch backend {
+	case BackendMux:
+		return NewMuxRouter(logger), nil
+	case BackendChi:
+		return NewChiRouter(logger), nil
+	default:
+		return nil, fmt.Errorf("unknown router %q, available routers are %q and %q", backend, BackendMux, BackendChi)
+	}
 }
@@ -0,0 +1,135 @@
+package router
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testLogger = log.New(os.Stdout, "testing-router", log.LstdFlags|log.Llongfile)
+
+func TestParam(t *testing.T) {
+	for _, backend := range []string{BackendMux, BackendChi} {
+		backend := backend
+		t.Run(backend, func(t *testing.T) {
+			r, err := New(backend, testLogger)
+			require.NoError(t, err)
+
+			var id, page string
+			r.GET("/users/{id:[0-9]+}/{page}", func(w http.ResponseWriter, r *http.Request) {
+				id, page = Param(r, "id"), Param(r, "page")
+			})
+
+			response := httptest.NewRecorder()
+			r.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/users/42/first", nil))
+			require.Equal(t, http.StatusOK, response.Code)
+			require.Equal(t, "42", id)
+			require.Equal(t, "first", page)
+
+			// the pattern regexp is honored
+			response = httptest.NewRecorder()
+			r.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/users/abc/first", nil))
+			require.Equal(t, http.StatusNotFound, response.Code)
+		})
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	for _, backend := range []string{BackendMux, BackendChi} {
+		backend := backend
+		t.Run(backend, func(t *testing.T) {
+			r, err := New(backend, testLogger)
+			require.NoError(t, err)
+
+			ok := func(w http.ResponseWriter, _ *http.Request) {}
+			r.GET("/user/{id:[0-9]+}", ok)
+			r.PUT("/user/{id:[0-9]+}", ok)
+			r.PATCH("/user/{id:[0-9]+}", ok)
+
+			response := httptest.NewRecorder()
+			r.ServeHTTP(response, httptest.NewRequest(http.MethodDelete, "/user/1", nil))
+			require.Equal(t, http.StatusMethodNotAllowed, response.Code)
+			require.Equal(t, "OPTIONS, GET, PATCH, PUT", response.Header().Get("Allow"))
+
+			response = httptest.NewRecorder()
+			r.ServeHTTP(response, httptest.NewRequest(http.MethodOptions, "/user/1", nil))
+			require.Equal(t, http.StatusNoContent, response.Code)
+			require.Equal(t, "OPTIONS, GET, PATCH, PUT", response.Header().Get("Allow"))
+
+			// unknown paths are still not found
+			response = httptest.NewRecorder()
+			r.ServeHTTP(response, httptest.NewRequest(http.MethodOptions, "/unknown", nil))
+			require.Equal(t, http.StatusNotFound, response.Code)
+		})
+	}
+}
+
+func TestExplicitOptions(t *testing.T) {
+	for _, backend := range []string{BackendMux, BackendChi} {
+		backend := backend
+		t.Run(backend, func(t *testing.T) {
+			r, err := New(backend, testLogger)
+			require.NoError(t, err)
+
+			r.GET("/users", func(w http.ResponseWriter, _ *http.Request) {})
+			r.OPTIONS("/users", func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			})
+
+			response := httptest.NewRecorder()
+			r.ServeHTTP(response, httptest.NewRequest(http.MethodOptions, "/users", nil))
+			require.Equal(t, http.StatusTeapot, response.Code)
+		})
+	}
+}
+
+func TestParamMissing(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	require.Empty(t, Param(request, "id"))
+
+	request = WithParams(request, map[string]string{"id": "1"})
+	require.Equal(t, "1", Param(request, "id"))
+	require.Empty(t, Param(request, "page"))
+}
+
+func TestNewUnknownBackend(t *testing.T) {
+	_, err := New("unknown", testLogger)
+	require.Error(t, err)
+}
+
+func TestWithTimeouts(t *testing.T) {
+	r, err := New(BackendMux, testLogger)
+	require.NoError(t, err)
+	r = WithTimeouts(r, Timeouts{Default: time.Minute, Routes: map[string]time.Duration{"GET /slow": 0}})
+
+	var deadlines []bool
+	record := func(w http.ResponseWriter, r *http.Request) {
+		_, ok := r.Context().Deadline()
+		deadlines = append(deadlines, ok)
+	}
+	r.GET("/fast", record)
+	r.GET("/slow", record)
+
+	for _, path := range []string{"/fast", "/slow"} {
+		response := httptest.NewRecorder()
+		r.ServeHTTP(response, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusOK, response.Code)
+	}
+	require.Equal(t, []bool{true, false}, deadlines)
+}
+
+func TestParseTimeouts(t *testing.T) {
+	timeouts, err := ParseTimeouts("GET /users=1m, POST /user/{id:[0-9]+}=5s,")
+	require.NoError(t, err)
+	require.Equal(t, map[string]time.Duration{"GET /users": time.Minute, "POST /user/{id:[0-9]+}": 5 * time.Second}, timeouts)
+
+	for _, s := range []string{"GET /users", "/users=1m", "FETCH /users=1m", "GET /users=soon", "GET /users=-1s"} {
+		_, err = ParseTimeouts(s)
+		require.Error(t, err, s)
+	}
+}
@@ -0,0 +1,117 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout is the default deadline of the requests
+const DefaultTimeout = 30 * time.Second
+
+// Timeouts are the deadlines of the requests by route: Default applies to the routes without one of
+// their own in Routes, which are keyed by method and pattern as registered, e.g. "GET /users".
+// A timeout of 0 sets no deadline
+type Timeouts struct {
+	Default time.Duration
+	Routes  map[string]time.Duration
+}
+
+// ParseTimeouts parses the comma-separated timeouts of the routes, e.g. "GET /users=1m,POST /auth/login=5s"
+func ParseTimeouts(s string) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		i := strings.LastIndex(spec, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid timeout %q: it must be <method> <pattern>=<duration>", spec)
+		}
+		route := strings.Fields(spec[:i])
+		if len(route) != 2 || !isMethod(route[0]) {
+			return nil, fmt.Errorf("invalid route %q: it must be <method> <pattern>, e.g. GET /users", spec[:i])
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(spec[i+1:]))
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("invalid timeout of route %q: %q", spec[:i], spec[i+1:])
+		}
+
+		timeouts[route[0]+" "+route[1]] = timeout
+	}
+
+	return timeouts, nil
+}
+
+func isMethod(method string) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// timeoutRouter registers the routes on the router with the deadlines of their timeouts
+type timeoutRouter struct {
+	Router
+	Timeouts Timeouts
+}
+
+// WithTimeouts returns the router registering the routes on r with the deadlines of the timeouts: the
+// context of a request is canceled past the timeout of its route, stopping the queries it is running.
+// The handlers are not interrupted, they answer the requests with the errors of their contexts
+func WithTimeouts(r Router, timeouts Timeouts) Router {
+	return &timeoutRouter{Router: r, Timeouts: timeouts}
+}
+
+func (tr *timeoutRouter) DELETE(uri string, f func(w http.ResponseWriter, r *http.Request)) {
+	tr.Router.DELETE(uri, tr.withTimeout(http.MethodDelete, uri, f))
+}
+
+func (tr *timeoutRouter) GET(uri string, f func(w http.ResponseWriter, r *http.Request)) {
+	tr.Router.GET(uri, tr.withTimeout(http.MethodGet, uri, f))
+}
+
+func (tr *timeoutRouter) HEAD(uri string, f func(w http.ResponseWriter, r *http.Request)) {
+	tr.Router.HEAD(uri, tr.withTimeout(http.MethodHead, uri, f))
+}
+
+func (tr *timeoutRouter) OPTIONS(uri string, f func(w http.ResponseWriter, r *http.Request)) {
+	tr.Router.OPTIONS(uri, tr.withTimeout(http.MethodOptions, uri, f))
+}
+
+func (tr *timeoutRouter) PATCH(uri string, f func(w http.ResponseWriter, r *http.Request)) {
+	tr.Router.PATCH(uri, tr.withTimeout(http.MethodPatch, uri, f))
+}
+
+func (tr *timeoutRouter) POST(uri string, f func(w http.ResponseWriter, r *http.Request)) {
+	tr.Router.POST(uri, tr.withTimeout(http.MethodPost, uri, f))
+}
+
+func (tr *timeoutRouter) PUT(uri string, f func(w http.ResponseWriter, r *http.Request)) {
+	tr.Router.PUT(uri, tr.withTimeout(http.MethodPut, uri, f))
+}
+
+// withTimeout returns the handler of the route with the deadline of its timeout
+func (tr *timeoutRouter) withTimeout(method, uri string, f func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	timeout, ok := tr.Timeouts.Routes[method+" "+uri]
+	if !ok {
+		timeout = tr.Timeouts.Default
+	}
+	if timeout <= 0 {
+		return f
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		f(w, r.WithContext(ctx))
+	}
+}
@@ -0,0 +1,195 @@
+// pkg manages the lifecycle of the HTTP server of the microservice: timeouts, graceful shutdown and
+// the release of the resources the server depends on
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultReadTimeout     = 15 * time.Second
+	DefaultWriteTimeout    = 30 * time.Second
+	DefaultIdleTimeout     = 2 * time.Minute
+	DefaultShutdownTimeout = 30 * time.Second
+)
+
+var ErrNotStarted = errors.New("the server has not been started")
+
+type Config struct {
+	// Addr is the TCP address to listen on; port 0 picks a free port (see Server.Addr)
+	Addr string
+	// ReadTimeout is the maximum duration for reading a request, body included
+	ReadTimeout time.Duration
+	// WriteTimeout is the maximum duration from the end of the reading of a request to the end of
+	// the writing of its response
+	WriteTimeout time.Duration
+	// IdleTimeout is the maximum duration a keep-alive connection waits for the next request
+	IdleTimeout time.Duration
+	// ShutdownTimeout is the maximum duration of the drain of the in-flight requests on shutdown
+	ShutdownTimeout time.Duration
+}
+
+// CloseHook releases a resource once the server has stopped serving requests
+type CloseHook func() error
+
+type Server struct {
+	Config Config
+	Logger *log.Logger
+
+	httpServer *http.Server
+	listener   net.Listener
+	serveErr   chan error
+
+	mu         sync.Mutex
+	closeHooks []CloseHook
+	closeOnce  sync.Once
+	closeErr   error
+}
+
+func New(handler http.Handler, config Config, logger *log.Logger) *Server {
+	if config.ReadTimeout == 0 {
+		config.ReadTimeout = DefaultReadTimeout
+	}
+	if config.WriteTimeout == 0 {
+		config.WriteTimeout = DefaultWriteTimeout
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = DefaultIdleTimeout
+	}
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = DefaultShutdownTimeout
+	}
+
+	return &Server{
+		Config: config,
+		Logger: logger,
+		httpServer: &http.Server{
+			Addr:         config.Addr,
+			Handler:      handler,
+			ReadTimeout:  config.ReadTimeout,
+			WriteTimeout: config.WriteTimeout,
+			IdleTimeout:  config.IdleTimeout,
+			ErrorLog:     logger,
+		},
+		serveErr: make(chan error, 1),
+	}
+}
+
+// OnClose registers hooks run when the server shuts down, after the in-flight requests have been
+// drained. Hooks run in the reverse order of their registration, like deferred calls: resources
+// registered first, which the later ones may depend on, are released last
+func (s *Server) OnClose(hooks ...CloseHook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closeHooks = append(s.closeHooks, hooks...)
+}
+
+// Start listens on the address of the server and serves the requests in the background. It returns
+// once the server is ready to accept connections
+func (s *Server) Start() error {
+	addr := s.Config.Addr
+	if addr == "" {
+		addr = ":http" // as http.ListenAndServe does
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("cannot listen on %v: %v", addr, err)
+	}
+	s.listener = listener
+
+	go func() {
+		err := s.httpServer.Serve(listener)
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+		s.serveErr <- err
+	}()
+
+	s.Logger.Printf("HTTP server running on %v", s.Addr())
+	return nil
+}
+
+// Addr returns the address the server listens on, empty if the server has not been started
+func (s *Server) Addr() string {
+	if s.listener == nil {
+		return ""
+	}
+
+	return s.listener.Addr().String()
+}
+
+// Shutdown stops accepting connections and waits for the in-flight requests to complete, until the
+// context is done; then it runs the close hooks, even if the drain has failed
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.listener == nil {
+		return ErrNotStarted
+	}
+
+	s.Logger.Printf("shutting down HTTP server on %v", s.Addr())
+	err := s.httpServer.Shutdown(ctx)
+	if err != nil {
+		s.Logger.Printf("cannot drain in-flight requests: %v", err)
+		_ = s.httpServer.Close()
+	}
+
+	closeErr := s.close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Run starts the server and serves until the context is done, e.g. on SIGTERM (see signal.NotifyContext),
+// then shuts it down within the shutdown timeout
+func (s *Server) Run(ctx context.Context) error {
+	err := s.Start()
+	if err != nil {
+		_ = s.close()
+		return err
+	}
+
+	select {
+	case err = <-s.serveErr:
+		// the server has failed by itself: there is nothing to drain
+		_ = s.close()
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.Config.ShutdownTimeout)
+	defer cancel()
+
+	return s.Shutdown(shutdownCtx)
+}
+
+// close runs the close hooks once
+func (s *Server) close() error {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		hooks := s.closeHooks
+		s.mu.Unlock()
+
+		for i := len(hooks) - 1; i >= 0; i-- {
+			err := hooks[i]()
+			if err != nil {
+				s.Logger.Printf("error while closing: %v", err)
+				if s.closeErr == nil {
+					s.closeErr = err
+				}
+			}
+		}
+	})
+
+	return s.closeErr
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testLogger = log.New(os.Stdout, "testing-server", log.LstdFlags|log.Llongfile)
+
+func startTestServer(t *testing.T, handler http.Handler) *Server {
+	s := New(handler, Config{Addr: "127.0.0.1:0", ShutdownTimeout: time.Second}, testLogger)
+	require.NoError(t, s.Start())
+	require.NotEmpty(t, s.Addr())
+
+	return s
+}
+
+func TestStartShutdownOK(t *testing.T) {
+	s := startTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+
+	response, err := http.Get("http://" + s.Addr())
+	require.NoError(t, err)
+	body, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+	require.Equal(t, "ok", string(body))
+
+	require.NoError(t, s.Shutdown(context.Background()))
+
+	// the server doesn't accept connections anymore
+	_, err = http.Get("http://" + s.Addr())
+	require.Error(t, err)
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	s := startTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_, _ = io.WriteString(w, "done")
+	}))
+
+	done := make(chan string)
+	go func() {
+		response, err := http.Get("http://" + s.Addr())
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		body, _ := io.ReadAll(response.Body)
+		_ = response.Body.Close()
+		done <- string(body)
+	}()
+	<-started
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+
+	// the shutdown waits for the in-flight request
+	select {
+	case <-shutdown:
+		t.Fatal("the shutdown has not waited for the in-flight request")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	require.Equal(t, "done", <-done)
+	require.NoError(t, <-shutdown)
+}
+
+func TestShutdownDeadlineKO(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	s := startTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+
+	go func() {
+		_, _ = http.Get("http://" + s.Addr())
+	}()
+	<-started
+
+	var closed bool
+	s.OnClose(func() error {
+		closed = true
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	// resources are released even if the drain has failed
+	require.True(t, closed)
+}
+
+func TestCloseHooksOrder(t *testing.T) {
+	s := startTestServer(t, http.NotFoundHandler())
+
+	var order []string
+	errClose := errors.New("cannot close")
+	s.OnClose(func() error {
+		order = append(order, "repository")
+		return nil
+	}, func() error {
+		order = append(order, "cache")
+		return errClose
+	})
+
+	require.ErrorIs(t, s.Shutdown(context.Background()), errClose)
+	require.Equal(t, []string{"cache", "repository"}, order)
+
+	// hooks run only once
+	_ = s.Shutdown(context.Background())
+	require.Len(t, order, 2)
+}
+
+func TestRunOK(t *testing.T) {
+	s := New(http.NotFoundHandler(), Config{Addr: "127.0.0.1:0"}, testLogger)
+	closed := make(chan struct{})
+	s.OnClose(func() error {
+		close(closed)
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		result <- s.Run(ctx)
+	}()
+
+	cancel() // as SIGTERM does
+	require.NoError(t, <-result)
+	<-closed
+}
+
+func TestRunListenKO(t *testing.T) {
+	s := startTestServer(t, http.NotFoundHandler())
+	defer func() {
+		_ = s.Shutdown(context.Background())
+	}()
+
+	// the address is already in use
+	other := New(http.NotFoundHandler(), Config{Addr: s.Addr()}, testLogger)
+	require.Error(t, other.Run(context.Background()))
+}
+
+func TestShutdownNotStartedKO(t *testing.T) {
+	s := New(http.NotFoundHandler(), Config{}, testLogger)
+	require.ErrorIs(t, s.Shutdown(context.Background()), ErrNotStarted)
+}
@@ -3,116 +3,254 @@
 package service
 
 import (
-	"errors"
+	"context"
 	"fmt"
-	"github.com/gorilla/mux"
 	"log"
-	"net/http"
-	"strconv"
+	"strings"
 
 	"github.com/pavelerokhin/user-microservice-go/errs"
 	"github.com/pavelerokhin/user-microservice-go/model"
+	"github.com/pavelerokhin/user-microservice-go/password"
+	"github.com/pavelerokhin/user-microservice-go/patch"
 	"github.com/pavelerokhin/user-microservice-go/repository"
+	"github.com/pavelerokhin/user-microservice-go/validation"
 )
 
+// the errors of the service are domain errors (see errs), matched by kind with errors.Is
+var (
+	ErrConflict           = errs.ErrConflict
+	ErrForbidden          = &errs.Error{Kind: errs.KindForbidden, Code: errs.CodePermissionDenied, Message: "the caller is not allowed to perform the operation"}
+	ErrInvalidArgument    = errs.ErrInvalid
+	ErrInvalidCredentials = &errs.Error{Kind: errs.KindUnauthorized, Code: errs.CodeInvalidCredentials, Message: "invalid login or password"}
+	ErrNotFound           = errs.ErrNotFound
+	ErrValidation         = errs.ErrValidation
+)
+
+// dummyHash is compared against the password when no user matches the login, so that the response
+// time does not reveal whether an email or nickname exists
+const dummyHash = "$2a$10$tx9FmR/1FsUZHhbm9BQaDulImKOkyCsoDvJFOMkSnx/pFP5OPFqDy"
+
+// UserService implements the use cases on the users, independently of the transport. The caller is
+// taken from the context (see auth.NewContext): the operations on the other users require the
+// permissions of the caller
 type UserService interface {
-	Add(user *model.User) (*model.User, error)
-	Delete(request *http.Request) (int, error)
-	Get(request *http.Request) (*model.User, int, error)
-	GetAll(request *http.Request) ([]model.User, int, error)
-	Update(request *http.Request) (*model.User, int, error)
+	Add(ctx context.Context, user *model.User) (*model.User, error)
+	Authenticate(ctx context.Context, login, password string) (*model.User, error)
+	CheckPassword(ctx context.Context, user *model.User, plain string) error
+	// Count counts the users matching the filter, as listed by GetAll and GetAllFrom
+	Count(ctx context.Context, filter *model.Filter) (int, error)
+	// Delete soft-deletes the user with the ID (see Restore). Delete, Patch and Replace are conditional on
+	// the version of the user, unless 0: they fail as precondition failed if the user is at another one
+	Delete(ctx context.Context, id, version int) error
+	// Get returns the user with the ID. The deleted users are returned only if includeDeleted, to the
+	// callers who can delete the users: they can see the deleted ones in the listings as well, with the
+	// filters including them, and restore them
+	Get(ctx context.Context, id int, includeDeleted bool) (*model.User, error)
+	GetAll(ctx context.Context, filter *model.Filter, page model.Page) ([]model.User, error)
+	// GetAllFrom returns the page of up to limit users matching the filter which follow the cursor, or
+	// precede it for a backward cursor, with the cursors of the next and previous pages
+	GetAllFrom(ctx context.Context, filter *model.Filter, cursor *model.Cursor, limit int) (*model.CursorPage, error)
+	GrantRole(ctx context.Context, id int, role string) (*model.User, error)
+	// Patch applies the patch to the user with the ID, as represented in the responses. Only the fields
+	// the patch modifies change; the read-only fields can be tested, but not modified
+	Patch(ctx context.Context, id int, p patch.Patch, version int) (*model.User, error)
+	// Replace replaces the user with the ID with a complete one: every field is set, and the user must
+	// be valid as a new one
+	Replace(ctx context.Context, id int, user *model.User, version int) (*model.User, error)
+	// Restore undoes the deletion of the user with the ID, unless purged
+	Restore(ctx context.Context, id int) (*model.User, error)
+	RevokeRole(ctx context.Context, id int, role string) (*model.User, error)
+	// Schema returns the JSON Schema of the users, as validated by Validate
+	Schema() map[string]interface{}
+	// Validate validates a new user, or the replacement of a user, and returns all the invalid fields at
+	// once (see errs.ParamsOf)
 	Validate(user *model.User) error
 }
 
 type service struct {
-	Logger *log.Logger
-	Repo   repository.UserRepository
+	Hasher    *password.Hasher
+	Logger    *log.Logger
+	Repo      repository.UserRepository
+	Validator *validation.Validator
 }
 
-func New(repository repository.UserRepository, logger *log.Logger) UserService {
-	return &service{Repo: repository, Logger: logger}
+func New(repository repository.UserRepository, hasher *password.Hasher, validator *validation.Validator,
+	logger *log.Logger) UserService {
+	return &service{Repo: repository, Hasher: hasher, Logger: logger, Validator: validator}
 }
 
-func (s *service) Add(user *model.User) (*model.User, error) {
+func (s *service) Add(ctx context.Context, user *model.User) (*model.User, error) {
 	s.Logger.Println("service request add a new user")
-	return s.Repo.Add(user)
+
+	hash, err := s.Hasher.Hash(user.Password)
+	if err != nil {
+		return nil, fmt.Errorf("error while hashing user's password: %v", err)
+	}
+	user.Password = hash
+	// roles cannot be chosen by the users themselves: the repository assigns the default one
+	user.Roles = nil
+
+	return s.Repo.Add(ctx, user)
+}
+
+// Authenticate returns the user identified by the login (email or nickname) and the password.
+// ErrInvalidCredentials is returned whatever the reason of the failure is, not to disclose which
+// logins exist
+func (s *service) Authenticate(ctx context.Context, login, password string) (*model.User, error) {
+	s.Logger.Println("service request authenticate user")
+
+	if login == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	// emails and nicknames are unique case-insensitively: the login is looked up by its key
+	field := "nickname_key"
+	if strings.Contains(login, "@") {
+		field = "email_key"
+	}
+	filter := &model.Filter{Conditions: []model.Condition{{Field: field, Op: model.OpEq, Values: []interface{}{model.Key(login)}}}}
+
+	candidates, err := s.Repo.GetAll(ctx, filter, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking for user to authenticate: %w", err)
+	}
+	if len(candidates) == 0 {
+		_ = s.Hasher.Compare(dummyHash, password)
+		return nil, ErrInvalidCredentials
+	}
+
+	for i := range candidates {
+		if s.CheckPassword(ctx, &candidates[i], password) == nil {
+			return &candidates[i], nil
+		}
+	}
+
+	return nil, ErrInvalidCredentials
 }
 
-func (s *service) Delete(request *http.Request) (int, error) {
+// CheckPassword verifies the plain text password of the user. If the stored password has been hashed
+// with outdated parameters (or not hashed at all), it is transparently re-hashed and saved
+func (s *service) CheckPassword(ctx context.Context, user *model.User, plain string) error {
+	s.Logger.Println("service request check user's password")
+
+	err := s.Hasher.Compare(user.Password, plain)
+	if err != nil {
+		return err
+	}
+
+	if s.Hasher.NeedsRehash(user.Password) {
+		hash, err := s.Hasher.Hash(plain)
+		if err != nil {
+			s.Logger.Printf("cannot re-hash password of user with ID %v: %v", user.ID, err)
+			return nil
+		}
+
+		_, err = s.Repo.Update(ctx, user, &model.User{Password: hash})
+		if err != nil {
+			s.Logger.Printf("cannot save re-hashed password of user with ID %v: %v", user.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *service) Count(ctx context.Context, filter *model.Filter) (int, error) {
+	s.Logger.Println("service request count users")
+
+	err := filter.Validate()
+	if err != nil {
+		return 0, errs.Invalid(errs.CodeInvalidFilter, "%v", err)
+	}
+
+	if !callerCanList(ctx, filter) {
+		return 0, ErrForbidden
+	}
+
+	return s.Repo.Count(ctx, filter)
+}
+
+func (s *service) Delete(ctx context.Context, id, version int) error {
 	s.Logger.Println("service request delete user")
 
-	id, err := getIDFromRequestVars(request)
-	if id == 0 || err != nil {
-		return 0, fmt.Errorf("cannot parse ID of the user to delete: %w", err)
+	if id <= 0 {
+		return errs.Invalid(errs.CodeInvalidID, "the ID of the user to delete must be positive")
+	}
+
+	if !callerCan(ctx, model.PermissionUsersDelete) {
+		return ErrForbidden
 	}
 
-	return id, s.Repo.Delete(id)
+	return s.Repo.Delete(ctx, id, version)
 }
 
-func (s *service) Get(request *http.Request) (*model.User, int, error) {
+func (s *service) Get(ctx context.Context, id int, includeDeleted bool) (*model.User, error) {
 	s.Logger.Println("service request get single user")
 
-	id, err := getIDFromRequestVars(request)
+	var user *model.User
+	var err error
+	if includeDeleted {
+		user, err = s.getIncludingDeleted(ctx, id)
+	} else {
+		user, err = s.Repo.Get(ctx, id)
+	}
 	if err != nil {
-		return nil, http.StatusInternalServerError, fmt.Errorf("error while parsing user's ID: %v", err)
+		return nil, fmt.Errorf("error while retrieving user with ID %v: %w", id, err)
 	}
 
-	user, err := s.Repo.Get(id)
+	s.Logger.Println(fmt.Sprintf("user with ID %v has been retrieved successfully", id))
+	return user, nil
+}
+
+// getIncludingDeleted returns the user with the ID, even if deleted
+func (s *service) getIncludingDeleted(ctx context.Context, id int) (*model.User, error) {
+	if !callerCan(ctx, model.PermissionUsersDelete) {
+		return nil, ErrForbidden
+	}
+
+	filter := &model.Filter{
+		Conditions:     []model.Condition{{Field: "id", Op: model.OpEq, Values: []interface{}{id}}},
+		IncludeDeleted: true,
+	}
+	users, err := s.Repo.GetAll(ctx, filter, 0, 0)
 	if err != nil {
-		return nil, http.StatusInternalServerError, fmt.Errorf("error while retrieving user with ID %v: %v", id, err)
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, errs.NotFound(errs.CodeUserNotFound, "user with ID %v not found", id)
 	}
 
-	s.Logger.Println(fmt.Sprintf("user with ID %v has been retrieved successfully", id))
-	return user, http.StatusOK, err
+	return &users[0], nil
 }
 
-func (s *service) GetAll(request *http.Request) ([]model.User, int, error) {
+func (s *service) GetAll(ctx context.Context, filter *model.Filter, page model.Page) ([]model.User, error) {
 	s.Logger.Println("service request list users")
-	var filters *model.User
-	var statusCode = http.StatusOK
-	var err error
 
-	if request.Body != nil {
-		filters, err, statusCode = unmarshalUserFromRequest(request)
-		errEmptyBody := &errs.EmptyBody{}
-		if err != nil && !errors.As(err, &errEmptyBody) {
-			return nil, statusCode, fmt.Errorf("error while parsing filter parameters: %v", err)
-		}
+	err := filter.Validate()
+	if err != nil {
+		return nil, errs.Invalid(errs.CodeInvalidFilter, "%v", err)
 	}
 
-	var pageSize, page int
-	vars := mux.Vars(request)
-	if vars["page-size"] != "" {
-		pageSize, err = strconv.Atoi(vars["page-size"])
-		if err != nil {
-			msg := fmt.Errorf("cannot get pagination limit: %v", err)
-			return nil, http.StatusInternalServerError, msg
-		}
-
-		page, err = strconv.Atoi(vars["page"])
-		if err != nil {
-			msg := fmt.Errorf("cannot get page: %v", err)
-			return nil, http.StatusInternalServerError, msg
-		}
+	if !callerCanList(ctx, filter) {
+		return nil, ErrForbidden
+	}
 
-		if pageSize <= 0 {
-			msg := fmt.Errorf("page size cannot be less then 1")
-			return nil, http.StatusBadRequest, msg
+	if !page.IsZero() {
+		if page.Size <= 0 {
+			return nil, errs.Invalid(errs.CodeInvalidPage, "page size cannot be less then 1")
 		}
 
-		if page <= 0 {
-			msg := fmt.Errorf("cannot get page less then 1")
-			return nil, http.StatusBadRequest, msg
+		if page.Number <= 0 {
+			return nil, errs.Invalid(errs.CodeInvalidPage, "cannot get page less then 1")
 		}
 	}
 
 	msg := "try to list users "
-	if pageSize == 0 {
+	if page.IsZero() {
 		msg += "without pagination "
 	} else {
 		msg += "with pagination "
 	}
-	if filters == nil {
+	if filter == nil {
 		msg += "without filtering"
 	} else {
 		msg += "with filtering"
@@ -120,86 +258,215 @@ func (s *service) GetAll(request *http.Request) ([]model.User, int, error) {
 
 	s.Logger.Printf(msg)
 
-	allUsers, err := s.Repo.GetAll(filters, pageSize, page)
+	return s.Repo.GetAll(ctx, filter, page.Size, page.Number)
+}
+
+func (s *service) GetAllFrom(ctx context.Context, filter *model.Filter, cursor *model.Cursor, limit int) (*model.CursorPage, error) {
+	s.Logger.Println("service request list users from a cursor")
+
+	if limit <= 0 {
+		return nil, errs.Invalid(errs.CodeInvalidPage, "limit cannot be less then 1")
+	}
+
+	err := filter.Validate()
 	if err != nil {
-		return allUsers, http.StatusInternalServerError, err
+		return nil, errs.Invalid(errs.CodeInvalidFilter, "%v", err)
+	}
+	if cursor != nil {
+		err = cursor.Validate(filter)
+		if err != nil {
+			return nil, errs.Invalid(errs.CodeInvalidCursor, "%v", err)
+		}
 	}
-	return allUsers, http.StatusOK, err
+
+	if !callerCanList(ctx, filter) {
+		return nil, ErrForbidden
+	}
+
+	// one user more tells whether there is a further page
+	users, err := s.Repo.GetAllFrom(ctx, filter, cursor, limit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	backward := cursor != nil && cursor.Backward
+	more := len(users) > limit
+	if more && backward { // the further user is the first one
+		users = users[1:]
+	} else if more {
+		users = users[:limit]
+	}
+
+	page := &model.CursorPage{Users: users}
+	if len(users) == 0 {
+		return page, nil
+	}
+
+	// going backward there is a next page, the one the cursor comes from, and going forward from a
+	// cursor there is a previous one
+	if more || backward {
+		page.Next = model.NewCursor(filter, &users[len(users)-1], false)
+	}
+	if (more && backward) || (cursor != nil && !backward) {
+		page.Prev = model.NewCursor(filter, &users[0], true)
+	}
+
+	return page, nil
 }
 
-func (s *service) Update(request *http.Request) (*model.User, int, error) {
-	s.Logger.Println("service request update a user")
+func (s *service) Patch(ctx context.Context, id int, p patch.Patch, version int) (*model.User, error) {
+	s.Logger.Println("service request patch a user")
 
-	// parse user
-	var id, err = getIDFromRequestVars(request)
-	var user *model.User
+	if !callerCanOnUser(ctx, model.PermissionUsersWrite, id) {
+		return nil, ErrForbidden
+	}
 
-	user, err = s.Repo.Get(id)
+	if p == nil {
+		return nil, errs.Invalid(errs.CodeInvalidPatch, "the patch of the user is empty")
+	}
+
+	user, err := s.Repo.Get(ctx, id)
 	if err != nil {
-		return nil,
-			http.StatusBadRequest,
-			fmt.Errorf("error while trying to find the user to update (ID %v): %v", id, err)
+		return nil, fmt.Errorf("error while trying to find the user to patch (ID %v): %w", id, err)
+	}
+	if version != 0 && user.Version != version {
+		return nil, errs.PreconditionFailed(errs.CodeVersionMismatch, "user with ID %v has been modified since version %v",
+			id, version)
 	}
 
-	if user == nil {
-		return nil,
-			http.StatusBadRequest,
-			fmt.Errorf("error updating user: cannot find user with ID %v", id)
+	newUser, err := applyPatch(user, p)
+	if err != nil {
+		return nil, err
+	}
+
+	params := s.Validator.Validate(newUser, validation.Patch)
+	if len(params) != 0 {
+		return nil, errs.InvalidParams(errs.CodeInvalidUser, params...)
+	}
+
+	if newUser.Password == "" {
+		newUser.Password = user.Password
+	} else {
+		newUser.Password, err = s.Hasher.Hash(newUser.Password)
+		if err != nil {
+			return nil, fmt.Errorf("error while hashing user's password: %v", err)
+		}
+	}
+
+	// the version is read-only: the user is replaced only if not modified since read
+	user, err = s.Repo.Replace(ctx, newUser)
+	if err != nil {
+		return nil, fmt.Errorf("error while patching user with ID %v: %w", id, err)
+	}
+
+	s.Logger.Printf("user with ID %v has been patched successfully", id)
+	return user, nil
+}
+
+func (s *service) Replace(ctx context.Context, id int, user *model.User, version int) (*model.User, error) {
+	s.Logger.Println("service request replace a user")
+
+	if !callerCanOnUser(ctx, model.PermissionUsersWrite, id) {
+		return nil, ErrForbidden
+	}
+
+	err := s.Validate(user)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.ID != 0 && user.ID != id {
+		return nil, errs.Invalid(errs.CodeReadOnlyField, "the ID of the user cannot be changed")
 	}
 
-	newUser, err, statusCode := unmarshalUserFromRequest(request)
+	newUser := *user
+	newUser.ID = id
+	newUser.Version = version
+	newUser.Roles = nil // roles are granted and revoked by the admins only
+
+	newUser.Password, err = s.Hasher.Hash(newUser.Password)
 	if err != nil {
-		return nil, statusCode, fmt.Errorf("error updating user: %s", err)
+		return nil, fmt.Errorf("error while hashing user's password: %v", err)
 	}
 
-	user, err = s.Repo.Update(user, newUser)
+	replaced, err := s.Repo.Replace(ctx, &newUser)
 	if err != nil {
-		return nil,
-			http.StatusInternalServerError,
-			fmt.Errorf("error while updating user with ID %v: %v", id, err)
+		return nil, fmt.Errorf("error while replacing user with ID %v: %w", id, err)
 	}
 
-	s.Logger.Println(fmt.Errorf("user with ID %v has been updated successfully", id))
-	return user, http.StatusOK, nil
+	s.Logger.Printf("user with ID %v has been replaced successfully", id)
+	return replaced, nil
 }
 
-func (*service) Validate(user *model.User) error {
-	if user == nil {
-		err := errors.New("the user object is empty")
-		return err
+func (s *service) Restore(ctx context.Context, id int) (*model.User, error) {
+	s.Logger.Println("service request restore a user")
+
+	if id <= 0 {
+		return nil, errs.Invalid(errs.CodeInvalidID, "the ID of the user to restore must be positive")
 	}
-	if user.FirstName == "" {
-		err := errors.New("the user's first name is empty")
-		return err
+
+	if !callerCan(ctx, model.PermissionUsersDelete) {
+		return nil, ErrForbidden
 	}
-	if user.LastName == "" {
-		err := errors.New("the user's last name is empty")
-		return err
+
+	user, err := s.Repo.Restore(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("error while restoring user with ID %v: %w", id, err)
 	}
-	if user.Nickname == "" {
-		err := errors.New("the user's nickname is empty")
-		return err
+
+	s.Logger.Printf("user with ID %v has been restored successfully", id)
+	return user, nil
+}
+
+func (s *service) GrantRole(ctx context.Context, id int, role string) (*model.User, error) {
+	s.Logger.Println("service request grant role")
+	return s.changeRole(ctx, id, role, s.Repo.GrantRole)
+}
+
+func (s *service) RevokeRole(ctx context.Context, id int, role string) (*model.User, error) {
+	s.Logger.Println("service request revoke role")
+	return s.changeRole(ctx, id, role, s.Repo.RevokeRole)
+}
+
+func (s *service) changeRole(ctx context.Context, id int, role string,
+	change func(ctx context.Context, userID int, role string) error) (*model.User, error) {
+	if !callerCan(ctx, model.PermissionRolesWrite) {
+		return nil, ErrForbidden
 	}
-	if user.Password == "" {
-		err := errors.New("the user's password is empty")
-		return err
+
+	err := change(ctx, id, role)
+	if err != nil {
+		return nil, fmt.Errorf("error while changing role %v of user with ID %v: %w", role, id, err)
 	}
-	if user.Email == "" {
-		err := errors.New("the user's email field is empty")
-		return err
+
+	user, err := s.Repo.Get(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("error while retrieving user with ID %v: %w", id, err)
 	}
-	if user.Country == "" {
-		err := errors.New("the user's country field is empty")
-		return err
+
+	s.Logger.Printf("role %v of user with ID %v has been changed successfully", role, id)
+	return user, nil
+}
+
+func (s *service) Schema() map[string]interface{} {
+	return s.Validator.Schema(&model.User{})
+}
+
+func (s *service) Validate(user *model.User) error {
+	if user == nil {
+		return errs.Validation(errs.CodeInvalidUser, "the user object is empty")
 	}
 
+	params := s.Validator.Validate(user, validation.Create)
 	if !user.CreatedAt.IsZero() {
-		err := errors.New("the user's create time must be empty")
-		return err
+		params = append(params, errs.InvalidParam{Name: "created_at", Reason: "the user's create time must be empty"})
 	}
 	if !user.UpdatedAt.IsZero() {
-		err := errors.New("the user's update time must be empty")
-		return err
+		params = append(params, errs.InvalidParam{Name: "updated_at", Reason: "the user's update time must be empty"})
+	}
+
+	if len(params) != 0 {
+		return errs.InvalidParams(errs.CodeInvalidUser, params...)
 	}
 
 	return nil
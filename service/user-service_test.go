@@ -1,259 +1,569 @@
 package service
 
 import (
-	"bytes"
-	"encoding/json"
-	"github.com/gorilla/mux"
+	"context"
 	"log"
-	"net/http"
-	"net/http/httptest"
 	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
-	"github.com/stretchr/testify/mock"
 
+	"github.com/pavelerokhin/user-microservice-go/auth"
+	"github.com/pavelerokhin/user-microservice-go/errs"
 	"github.com/pavelerokhin/user-microservice-go/model"
+	"github.com/pavelerokhin/user-microservice-go/password"
+	"github.com/pavelerokhin/user-microservice-go/patch"
+	"github.com/pavelerokhin/user-microservice-go/repository"
+	"github.com/pavelerokhin/user-microservice-go/validation"
 )
 
 var (
-	logger         = log.New(os.Stdout, "testing-user-service", log.LstdFlags|log.Llongfile)
-	mockRepository = new(MockRepository)
-	testService    = New(mockRepository, logger)
+	logger           = log.New(os.Stdout, "testing-user-service", log.LstdFlags|log.Llongfile)
+	testHasher, _    = password.New(password.DefaultCost)
+	testValidator, _ = validation.New(validation.DefaultPasswordPolicy)
+	// testService is shared by the tests which don't reach the repository
+	testService = New(repository.NewMemoryRepo(logger), testHasher, testValidator, logger)
 
 	users = []model.User{
 		{
 			ID:        1,
 			FirstName: "user1",
 			LastName:  "y",
-			Nickname:  "z",
-			Password:  "1",
+			Nickname:  "user1",
+			Password:  "Passw0rd",
 			Email:     "a@b.com",
-			Country:   "Y",
+			Country:   "IT",
 		},
 		{
 			ID:        2,
 			FirstName: "user2",
 			LastName:  "y",
-			Nickname:  "z",
-			Password:  "1",
-			Email:     "a@b.com",
-			Country:   "Y",
+			Nickname:  "user2",
+			Password:  "Passw0rd",
+			Email:     "b@b.com",
+			Country:   "IT",
 		},
 	}
 )
 
-type MockRepository struct {
-	mock mock.Mock
-}
+// setupTestCase returns a service over an in-memory repository of its own, so that the tests run in
+// parallel, with the users added as they are, passwords in plain text included
+func setupTestCase(t *testing.T, users ...model.User) (UserService, repository.UserRepository) {
+	repo := repository.NewMemoryRepo(logger)
+	t.Cleanup(func() {
+		assert.NoError(t, repo.Close())
+	})
 
-func (mr *MockRepository) Add(_ *model.User) (*model.User, error) {
-	args := mr.mock.Called()
-	result := args.Get(0)
-	return result.(*model.User), args.Error(1)
+	for _, user := range users {
+		_, err := repo.Add(context.Background(), &user)
+		assert.NoError(t, err)
+	}
+
+	return New(repo, testHasher, testValidator, logger), repo
 }
 
-func (mr *MockRepository) Delete(_ int) error {
-	args := mr.mock.Called()
-	return args.Error(1)
+// withCaller returns a context of a request authenticated as the user with the ID and the permissions
+func withCaller(userID int, permissions ...string) context.Context {
+	principal := &auth.Principal{UserID: userID, Permissions: permissions}
+	return auth.NewContext(context.Background(), principal)
 }
 
-func (mr *MockRepository) Get(_ int) (*model.User, error) {
-	args := mr.mock.Called()
-	result := args.Get(0)
-	return result.(*model.User), args.Error(1)
+// Add function
+func TestAdd(t *testing.T) {
+	t.Parallel()
+	service, repo := setupTestCase(t)
+
+	user := users[0]
+	result, err := service.Add(context.Background(), &user)
+	assert.Nil(t, err)
+	assert.Equal(t, users[0].ID, result.ID)
+	assert.Equal(t, users[0].Email, result.Email)
+	// the password is hashed before it reaches the repository
+	stored, err := repo.Get(context.Background(), result.ID)
+	assert.Nil(t, err)
+	assert.True(t, password.IsHash(stored.Password))
+	assert.Nil(t, testHasher.Compare(stored.Password, users[0].Password))
 }
 
-func (mr *MockRepository) GetAll(_ *model.User, _, _ int) ([]model.User, error) {
-	args := mr.mock.Called()
-	result := args.Get(0)
-	return result.([]model.User), args.Error(1)
+// Authenticate function
+func TestAuthenticate(t *testing.T) {
+	t.Parallel()
+	hash, err := testHasher.Hash("secret")
+	assert.Nil(t, err)
+	user := users[0]
+	user.Password = hash
+	service, _ := setupTestCase(t, user, users[1])
+
+	result, err := service.Authenticate(context.Background(), user.Email, "secret")
+	assert.Nil(t, err)
+	assert.Equal(t, user.ID, result.ID)
+
+	result, err = service.Authenticate(context.Background(), user.Nickname, "secret")
+	assert.Nil(t, err)
+	assert.Equal(t, user.ID, result.ID)
+
+	result, err = service.Authenticate(context.Background(), user.Email, "wrong")
+	assert.Nil(t, result)
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+	result, err = service.Authenticate(context.Background(), "", "")
+	assert.Nil(t, result)
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
 }
 
-func (mr *MockRepository) Update(_, _ *model.User) (*model.User, error) {
-	args := mr.mock.Called()
-	result := args.Get(0)
-	return result.(*model.User), args.Error(1)
+// CheckPassword function
+func TestCheckPassword(t *testing.T) {
+	t.Parallel()
+	hash, err := testHasher.Hash("secret")
+	assert.Nil(t, err)
+	user := users[0]
+	user.Password = hash
+
+	assert.Nil(t, testService.CheckPassword(context.Background(), &user, "secret"))
+	assert.Equal(t, hash, user.Password)
+	assert.ErrorIs(t, testService.CheckPassword(context.Background(), &user, "wrong"), password.ErrMismatch)
 }
 
-// Add function
-func TestAdd(t *testing.T) {
-	mockRepository.mock.On("Add").Return(&users[0], nil)
-	result, err := testService.Add(&users[0])
-	// Mock assertion
-	mockRepository.mock.AssertExpectations(t)
-	// Data assertion
-	assert.Equal(t, &users[0], result)
+func TestCheckPasswordRehash(t *testing.T) {
+	t.Parallel()
+	service, repo := setupTestCase(t, users[0]) // stored in plain text, before hashing was introduced
+	user, err := repo.Get(context.Background(), users[0].ID)
+	assert.Nil(t, err)
+
+	assert.Nil(t, service.CheckPassword(context.Background(), user, users[0].Password))
+	// the password has been hashed in the repository
+	stored, err := repo.Get(context.Background(), users[0].ID)
 	assert.Nil(t, err)
+	assert.True(t, password.IsHash(stored.Password))
+}
+
+// Count function
+func TestCount(t *testing.T) {
+	t.Parallel()
+	service, _ := setupTestCase(t, users...)
+
+	count, err := service.Count(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	filter := &model.Filter{Conditions: []model.Condition{{Field: "password", Op: model.OpEq, Values: []interface{}{"1"}}}}
+	_, err = service.Count(context.Background(), filter)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
 }
 
 // Delete function
 func TestDelete(t *testing.T) {
-	mockRepository.mock.On("Delete").Return(1, nil)
-
-	request, _ := http.NewRequest(http.MethodDelete, "/user/1", nil)
-	//Hack to try to fake gorilla/mux vars
-	vars := map[string]string{
-		"id": "1",
-	}
-	request = mux.SetURLVars(request, vars)
+	t.Parallel()
+	service, repo := setupTestCase(t, users[0])
 
-	id, err := testService.Delete(request)
-	// Mock assertion
-	mockRepository.mock.AssertExpectations(t)
-	// Data assertion
-	assert.Equal(t, 1, id)
+	err := service.Delete(withCaller(2, model.PermissionUsersDelete), 1, 0)
 	assert.Nil(t, err)
+	_, err = repo.Get(context.Background(), 1)
+	assert.ErrorIs(t, err, errs.ErrNotFound)
+}
+
+func TestDeleteForbidden(t *testing.T) {
+	t.Parallel()
+	err := testService.Delete(withCaller(1), 1, 0)
+	assert.ErrorIs(t, err, ErrForbidden)
+
+	err = testService.Delete(context.Background(), 1, 0)
+	assert.ErrorIs(t, err, ErrForbidden)
+}
+
+func TestDeleteInvalidID(t *testing.T) {
+	t.Parallel()
+	err := testService.Delete(withCaller(2, model.PermissionUsersDelete), 0, 0)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
 }
 
 // Get function
 func TestGet(t *testing.T) {
-	mockRepository.mock.On("Get").Return(&users[0], nil)
-	request, _ := http.NewRequest(http.MethodGet, "/user/1", nil)
-	//Hack to try to fake gorilla/mux vars
-	vars := map[string]string{
-		"id": "1",
-	}
-	request = mux.SetURLVars(request, vars)
-
-	result, statusCode, err := testService.Get(request)
-	// Mock assertion
-	mockRepository.mock.AssertExpectations(t)
-	// Data assertion
-	assert.Equal(t, &users[0], result)
-	assert.Equal(t, http.StatusOK, statusCode)
+	t.Parallel()
+	service, _ := setupTestCase(t, users[0])
+
+	result, err := service.Get(context.Background(), 1, false)
 	assert.Nil(t, err)
+	assert.Equal(t, users[0].ID, result.ID)
+	assert.Equal(t, users[0].FirstName, result.FirstName)
+	assert.Equal(t, users[0].Email, result.Email)
+
+	_, err = service.Get(context.Background(), 2, false)
+	assert.ErrorIs(t, err, errs.ErrNotFound)
+}
+
+func TestGetIncludingDeletedForbidden(t *testing.T) {
+	t.Parallel()
+	_, err := testService.Get(withCaller(1, model.PermissionUsersRead), 1, true)
+	assert.ErrorIs(t, err, ErrForbidden)
+}
+
+func TestGetAllIncludingDeletedForbidden(t *testing.T) {
+	t.Parallel()
+	filter := &model.Filter{IncludeDeleted: true}
+	_, err := testService.GetAll(withCaller(1, model.PermissionUsersRead), filter, model.Page{})
+	assert.ErrorIs(t, err, ErrForbidden)
+
+	_, err = testService.Count(withCaller(1, model.PermissionUsersRead), filter)
+	assert.ErrorIs(t, err, ErrForbidden)
+
+	_, err = testService.GetAllFrom(withCaller(1, model.PermissionUsersRead), filter, nil, 10)
+	assert.ErrorIs(t, err, ErrForbidden)
+}
+
+// Restore function
+func TestRestore(t *testing.T) {
+	t.Parallel()
+	service, repo := setupTestCase(t, users[0])
+	assert.NoError(t, repo.Delete(context.Background(), 1, 0))
+
+	result, err := service.Restore(withCaller(2, model.PermissionUsersDelete), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, users[0].ID, result.ID)
+	assert.Nil(t, result.DeletedAt)
+}
+
+func TestRestoreConflict(t *testing.T) {
+	t.Parallel()
+	service, repo := setupTestCase(t, users[0])
+	assert.NoError(t, repo.Delete(context.Background(), 1, 0))
+	// the email of the deleted user has been taken in the meanwhile
+	taker := users[1]
+	taker.Email = users[0].Email
+	_, err := repo.Add(context.Background(), &taker)
+	assert.NoError(t, err)
+
+	_, err = service.Restore(withCaller(2, model.PermissionUsersDelete), 1)
+	assert.ErrorIs(t, err, ErrConflict)
+	assert.Equal(t, errs.CodeEmailTaken, errs.CodeOf(err))
+}
+
+func TestRestoreForbidden(t *testing.T) {
+	t.Parallel()
+	_, err := testService.Restore(withCaller(1), 1)
+	assert.ErrorIs(t, err, ErrForbidden)
+
+	_, err = testService.Restore(withCaller(2, model.PermissionUsersDelete), 0)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
 }
 
 // GetAll function
 func TestGetAll(t *testing.T) {
-	mockRepository.mock.On("GetAll").Return(users, nil)
-	request := httptest.NewRequest(http.MethodGet, "/users", nil)
-	result, statusCode, err := testService.GetAll(request)
-	// Mock assertion
-	mockRepository.mock.AssertExpectations(t)
-	// Data assertion
+	t.Parallel()
+	service, _ := setupTestCase(t, users...)
+
+	result, err := service.GetAll(context.Background(), nil, model.Page{})
+	assert.Nil(t, err)
 	assert.Equal(t, 2, len(result))
-	assert.Equal(t, users, result)
-	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, users[0].ID, result[0].ID)
+	assert.Equal(t, users[1].ID, result[1].ID)
+}
+
+func TestGetAllInvalidPage(t *testing.T) {
+	t.Parallel()
+	_, err := testService.GetAll(context.Background(), nil, model.Page{Size: 0, Number: 1})
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+
+	_, err = testService.GetAll(context.Background(), nil, model.Page{Size: 10, Number: 0})
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func TestGetAllInvalidFilter(t *testing.T) {
+	t.Parallel()
+	filter := &model.Filter{Conditions: []model.Condition{{Field: "password", Op: model.OpEq, Values: []interface{}{"1"}}}}
+	_, err := testService.GetAll(context.Background(), filter, model.Page{})
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+
+	filter = &model.Filter{Conditions: []model.Condition{{Field: "id", Op: model.OpLike, Values: []interface{}{1}}}}
+	_, err = testService.GetAll(context.Background(), filter, model.Page{})
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+
+	filter = &model.Filter{Sort: []model.SortKey{{Field: "roles"}}}
+	_, err = testService.GetAll(context.Background(), filter, model.Page{})
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+// GetAllFrom function
+func TestGetAllFrom(t *testing.T) {
+	t.Parallel()
+	service, _ := setupTestCase(t, users...)
+
+	// one user more than the limit: there is a next page
+	page, err := service.GetAllFrom(context.Background(), nil, nil, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(page.Users))
+	assert.Equal(t, users[0].ID, page.Users[0].ID)
+	assert.Equal(t, &model.Cursor{ID: users[0].ID}, page.Next)
+	assert.Nil(t, page.Prev)
+
+	// the last page
+	page, err = service.GetAllFrom(context.Background(), nil, page.Next, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(page.Users))
+	assert.Equal(t, users[1].ID, page.Users[0].ID)
+	assert.Nil(t, page.Next)
+	assert.Equal(t, &model.Cursor{ID: users[1].ID, Backward: true}, page.Prev)
+}
+
+func TestGetAllFromBackward(t *testing.T) {
+	t.Parallel()
+	service, _ := setupTestCase(t, users...)
+
+	page, err := service.GetAllFrom(context.Background(), nil, &model.Cursor{ID: 3, Backward: true}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(page.Users))
+	assert.Equal(t, users[1].ID, page.Users[0].ID)
+	assert.Equal(t, &model.Cursor{ID: users[1].ID}, page.Next)
+	assert.Equal(t, &model.Cursor{ID: users[1].ID, Backward: true}, page.Prev)
+}
+
+func TestGetAllFromInvalidCursor(t *testing.T) {
+	t.Parallel()
+	_, err := testService.GetAllFrom(context.Background(), nil, nil, 0)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+
+	// the cursor belongs to a listing sorted differently
+	cursor := &model.Cursor{Sort: []model.SortKey{{Field: "country"}}, Values: []interface{}{"Y"}, ID: 1}
+	_, err = testService.GetAllFrom(context.Background(), nil, cursor, 1)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+// GrantRole function
+func TestGrantRole(t *testing.T) {
+	t.Parallel()
+	service, _ := setupTestCase(t, users[0])
+
+	result, err := service.GrantRole(withCaller(2, model.PermissionRolesWrite), 1, model.RoleAdmin)
+	assert.Nil(t, err)
+	assert.Equal(t, users[0].ID, result.ID)
+	assert.Equal(t, []string{model.RoleAdmin, model.RoleUser}, result.RoleNames())
+}
+
+func TestGrantRoleForbidden(t *testing.T) {
+	t.Parallel()
+	_, err := testService.GrantRole(withCaller(1), 1, model.RoleAdmin)
+	assert.ErrorIs(t, err, ErrForbidden)
+}
+
+// Patch function
+func TestPatch(t *testing.T) {
+	t.Parallel()
+	service, repo := setupTestCase(t, users[0])
+
+	p := patch.MergePatch(`{"first_name": "updated first name"}`)
+	result, err := service.Patch(withCaller(1), 1, p, 0)
 	assert.Nil(t, err)
+	assert.Equal(t, users[0].ID, result.ID)
+	assert.Equal(t, "updated first name", result.FirstName)
+
+	// the fields not in the patch, the password included, keep their values
+	stored, err := repo.Get(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "updated first name", stored.FirstName)
+	assert.Equal(t, users[0].LastName, stored.LastName)
+	assert.Equal(t, users[0].Password, stored.Password)
 }
 
-// Update function
-func TestUpdate(t *testing.T) {
-	oldUser := users[0]
-	newUser := users[0]
-	newUser.FirstName = "updated first name"
+func TestPatchPassword(t *testing.T) {
+	t.Parallel()
+	service, repo := setupTestCase(t, users[0])
 
-	mockRepository.mock.On("Get").Return(&users[0], nil)
-	mockRepository.mock.On("Update").Return(&newUser, nil)
-	requestBody, err := json.Marshal(map[string]string{"first_name": "updated first name"})
-	if err != nil {
-		t.Fatal(err)
-	}
-	request, _ := http.NewRequest(http.MethodGet, "/user/1", bytes.NewBuffer(requestBody))
-	//Hack to try to fake gorilla/mux vars
-	vars := map[string]string{
-		"id": "1",
-	}
-	request = mux.SetURLVars(request, vars)
-
-	//Hack to try to fake gorilla/mux vars
-	result, statusCode, err := testService.Update(request)
-	// Mock assertion
-	mockRepository.mock.AssertExpectations(t)
-	// Data assertion
-	assert.Equal(t, oldUser.ID, result.ID)
-	assert.Equal(t, newUser.FirstName, result.FirstName)
-	assert.Equal(t, http.StatusOK, statusCode)
+	p, err := patch.Parse(patch.MediaTypeJSONPatch, []byte(`[{"op": "replace", "path": "/password", "value": "New password 1"}]`))
+	assert.Nil(t, err)
+	_, err = service.Patch(withCaller(1), 1, p, 0)
+	assert.Nil(t, err)
+	stored, err := repo.Get(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.Nil(t, testHasher.Compare(stored.Password, "New password 1"))
+
+	// the removed password keeps its value
+	p, err = patch.Parse(patch.MediaTypeJSONPatch, []byte(`[{"op": "remove", "path": "/password"}]`))
+	assert.Nil(t, err)
+	_, err = service.Patch(withCaller(1), 1, p, 0)
+	assert.Nil(t, err)
+	patched, err := repo.Get(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, stored.Password, patched.Password)
+}
+
+func TestPatchTestFailedKO(t *testing.T) {
+	t.Parallel()
+	service, _ := setupTestCase(t, users[0])
+
+	p, err := patch.Parse(patch.MediaTypeJSONPatch, []byte(`[
+		{"op": "test", "path": "/id", "value": 1},
+		{"op": "test", "path": "/first_name", "value": "someone else"},
+		{"op": "replace", "path": "/first_name", "value": "updated first name"}
+	]`))
+	assert.Nil(t, err)
+	_, err = service.Patch(withCaller(1), 1, p, 0)
+	assert.ErrorIs(t, err, ErrConflict)
+}
+
+func TestPatchReadOnlyKO(t *testing.T) {
+	t.Parallel()
+	service, _ := setupTestCase(t, users[0])
+
+	_, err := service.Patch(withCaller(1), 1, patch.MergePatch(`{"id": 2}`), 0)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+
+	_, err = service.Patch(withCaller(1), 1, patch.MergePatch(`{"roles": [{"name": "admin"}]}`), 0)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func TestPatchInvalidKO(t *testing.T) {
+	t.Parallel()
+	service, _ := setupTestCase(t, users[0])
+
+	// required fields cannot be cleared
+	_, err := service.Patch(withCaller(1), 1, patch.MergePatch(`{"nickname": null}`), 0)
+	assert.ErrorIs(t, err, ErrValidation)
+
+	_, err = service.Patch(withCaller(1), 1, patch.MergePatch(`{"unknown": "field"}`), 0)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func TestPatchVersionMismatchKO(t *testing.T) {
+	t.Parallel()
+	service, repo := setupTestCase(t, users[0])
+	user, err := repo.Get(context.Background(), 1)
+	assert.Nil(t, err)
+
+	p := patch.MergePatch(`{"first_name": "updated first name"}`)
+	_, err = service.Patch(withCaller(1), 1, p, user.Version+1)
+	assert.ErrorIs(t, err, errs.ErrPreconditionFailed)
+}
+
+func TestPatchForbidden(t *testing.T) {
+	t.Parallel()
+	_, err := testService.Patch(withCaller(2), 1, patch.MergePatch(`{"first_name": "updated first name"}`), 0)
+	assert.ErrorIs(t, err, ErrForbidden)
+}
+
+// Replace function
+func TestReplace(t *testing.T) {
+	t.Parallel()
+	service, _ := setupTestCase(t, users[0])
+
+	user := users[1]
+	user.ID = 0
+	result, err := service.Replace(withCaller(1), 1, &user, 0)
 	assert.Nil(t, err)
+	assert.Equal(t, 1, result.ID)
+	assert.Equal(t, users[1].FirstName, result.FirstName)
+}
+
+func TestReplaceIncompleteKO(t *testing.T) {
+	t.Parallel()
+	// unlike a patch, a replacement must be a complete user
+	_, err := testService.Replace(withCaller(1), 1, &model.User{FirstName: "updated first name"}, 0)
+	assert.ErrorIs(t, err, ErrValidation)
+}
+
+func TestReplaceForbidden(t *testing.T) {
+	t.Parallel()
+	user := users[1]
+	_, err := testService.Replace(withCaller(2), 1, &user, 0)
+	assert.ErrorIs(t, err, ErrForbidden)
 }
 
 // Validate method
 func TestValidateEmptyUser(t *testing.T) {
+	t.Parallel()
 	err := testService.Validate(nil)
 
 	assert.NotNil(t, err)
 	assert.Equal(t, "the user object is empty", err.Error())
 }
 
-func TestValidateEmptyUserFirstName(t *testing.T) {
-	user := model.User{
-		FirstName: "",
+// validUser returns a valid new user, to be invalidated by the tests
+func validUser() model.User {
+	return model.User{
+		FirstName: "x",
+		LastName:  "y",
+		Nickname:  "xyz",
+		Password:  "Passw0rd",
+		Email:     "a@b.com",
+		Country:   "IT",
 	}
+}
+
+func TestValidateEmptyUserFirstName(t *testing.T) {
+	t.Parallel()
+	user := validUser()
+	user.FirstName = ""
 	err := testService.Validate(&user)
 	assert.NotNil(t, err)
-	assert.Equal(t, "the user's first name is empty", err.Error())
+	assert.Equal(t, "first_name is required", err.Error())
 }
 
 func TestValidateEmptyUserLastName(t *testing.T) {
-	user := model.User{
-		FirstName: "x",
-		LastName:  "",
-	}
+	t.Parallel()
+	user := validUser()
+	user.LastName = ""
 	err := testService.Validate(&user)
 	assert.NotNil(t, err)
-	assert.Equal(t, "the user's last name is empty", err.Error())
+	assert.Equal(t, "last_name is required", err.Error())
 }
 
 func TestValidateEmptyUserNickname(t *testing.T) {
-	user := model.User{
-		FirstName: "x",
-		LastName:  "y",
-		Nickname:  "",
-	}
+	t.Parallel()
+	user := validUser()
+	user.Nickname = ""
 	err := testService.Validate(&user)
 	assert.NotNil(t, err)
-	assert.Equal(t, "the user's nickname is empty", err.Error())
+	assert.Equal(t, "nickname is required", err.Error())
 }
 
 func TestValidateEmptyUserPassword(t *testing.T) {
-	user := model.User{
-		FirstName: "x",
-		LastName:  "y",
-		Nickname:  "z",
-		Password:  "",
-	}
+	t.Parallel()
+	user := validUser()
+	user.Password = ""
 	err := testService.Validate(&user)
 	assert.NotNil(t, err)
-	assert.Equal(t, "the user's password is empty", err.Error())
+	assert.Equal(t, "password is required", err.Error())
 }
 
 func TestValidateEmptyUserEmail(t *testing.T) {
-	user := model.User{
-		FirstName: "x",
-		LastName:  "y",
-		Nickname:  "z",
-		Password:  "1",
-		Email:     "",
-	}
+	t.Parallel()
+	user := validUser()
+	user.Email = ""
 	err := testService.Validate(&user)
 	assert.NotNil(t, err)
-	assert.Equal(t, "the user's email field is empty", err.Error())
+	assert.Equal(t, "email is required", err.Error())
 }
 
 func TestValidateEmptyUserCountry(t *testing.T) {
-	user := model.User{
-		FirstName: "x",
-		LastName:  "y",
-		Nickname:  "z",
-		Password:  "1",
-		Email:     "a@b.com",
-		Country:   "",
-	}
+	t.Parallel()
+	user := validUser()
+	user.Country = ""
 	err := testService.Validate(&user)
 	assert.NotNil(t, err)
-	assert.Equal(t, "the user's country field is empty", err.Error())
+	assert.Equal(t, "country is required", err.Error())
+}
+
+func TestValidateAllInvalidFields(t *testing.T) {
+	t.Parallel()
+	user := model.User{FirstName: "x", Nickname: "x!", Password: "password", Country: "Y"}
+	err := testService.Validate(&user)
+	assert.ErrorIs(t, err, ErrValidation)
+
+	var names []string
+	for _, param := range errs.ParamsOf(err) {
+		names = append(names, param.Name)
+	}
+	assert.Equal(t, []string{"last_name", "nickname", "password", "email", "country"}, names)
 }
 
 func TestValidateUserOK(t *testing.T) {
+	t.Parallel()
 	user := model.User{
 		FirstName: "x",
 		LastName:  "y",
-		Nickname:  "z",
-		Password:  "1",
+		Nickname:  "xyz",
+		Password:  "Passw0rd",
 		Email:     "a@b.com",
-		Country:   "Y",
+		Country:   "IT",
 	}
 	err := testService.Validate(&user)
 	assert.Nil(t, err)
@@ -1,98 +1,95 @@
 package service
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"net/http"
-	"strconv"
-	"strings"
-
-	"github.com/gorilla/mux"
+	"reflect"
 
+	"github.com/pavelerokhin/user-microservice-go/auth"
 	"github.com/pavelerokhin/user-microservice-go/errs"
 	"github.com/pavelerokhin/user-microservice-go/model"
+	"github.com/pavelerokhin/user-microservice-go/patch"
+	"github.com/pavelerokhin/user-microservice-go/validation"
 )
 
-func getIDFromRequestVars(request *http.Request) (int, error) {
-	vars := mux.Vars(request)
-	return strconv.Atoi(vars["id"])
-}
+// readOnlyFields of the users can be tested by the patches, but not modified
+var readOnlyFields = validation.ReadOnlyFields(&model.User{})
 
-func unmarshalUserFromRequest(r *http.Request) (*model.User, error, int) {
-	// This will cause Decode() to return a "json: unknown field ..." error
-	// if it encounters any extra unexpected fields in the JSON. Strictly
-	// speaking, it returns an error for "keys which do not match any
-	// non-ignored, exported fields in the destination".
-	dec := json.NewDecoder(r.Body)
-	dec.DisallowUnknownFields()
+// callerCan reports whether the authenticated caller has been granted the permission
+func callerCan(ctx context.Context, permission string) bool {
+	principal, ok := auth.FromContext(ctx)
+	return ok && principal.Can(permission)
+}
 
-	var user model.User
-	err := dec.Decode(&user)
-	if err != nil {
-		var syntaxError *json.SyntaxError
-		var unmarshalTypeError *json.UnmarshalTypeError
+// callerCanOnUser reports whether the authenticated caller is the user with the ID, or has been
+// granted the permission on the other users
+func callerCanOnUser(ctx context.Context, permission string, userID int) bool {
+	principal, ok := auth.FromContext(ctx)
+	return ok && principal.CanOnUser(permission, userID)
+}
 
-		switch {
-		// Catch any syntax errs in the JSON and send an error message
-		// which interpolates the location of the problem to make it
-		// easier for the client to fix.
-		case errors.As(err, &syntaxError):
-			return nil, &errs.ResponseError{
-					Message: fmt.Sprintf("Request body contains badly-formed JSON (at position %d)", syntaxError.Offset)},
-				http.StatusBadRequest
+// callerCanList reports whether the authenticated caller can list the users matching the filter: the
+// deleted users are listed only to the callers who can delete the users
+func callerCanList(ctx context.Context, filter *model.Filter) bool {
+	return filter == nil || !filter.IncludeDeleted || callerCan(ctx, model.PermissionUsersDelete)
+}
 
-		// In some circumstances Decode() may also return an
-		// io.ErrUnexpectedEOF error for syntax errs in the JSON. There
-		// is an open issue regarding this at
-		// https://github.com/golang/go/issues/25956.
-		case errors.Is(err, io.ErrUnexpectedEOF):
-			return nil, &errs.ResponseError{
-				Message: fmt.Sprintf("Request body contains badly-formed JSON")}, http.StatusBadRequest
+// applyPatch applies the patch to the JSON representation of the user, the one of the responses: the
+// password is write-only, so it is represented as empty. It can be replaced by the patch but not tested
+func applyPatch(user *model.User, p patch.Patch) (*model.User, error) {
+	doc, err := representForPatch(user)
+	if err != nil {
+		return nil, fmt.Errorf("cannot represent user with ID %v: %v", user.ID, err)
+	}
 
-		// Catch any type errs, like trying to assign a string in the
-		// JSON request body to an int field in our Person struct. We can
-		// interpolate the relevant field name and position into the error
-		// message to make it easier for the client to fix.
-		case errors.As(err, &unmarshalTypeError):
-			return nil, &errs.ResponseError{Message: fmt.Sprintf("Request body contains an invalid value for the %q field (at position %d)", unmarshalTypeError.Field, unmarshalTypeError.Offset)}, http.StatusBadRequest
+	patched, err := p.Apply(doc)
+	if errors.Is(err, patch.ErrTestFailed) {
+		return nil, errs.Conflict(errs.CodePatchTestFailed, "%v", err)
+	}
+	if err != nil {
+		return nil, errs.Invalid(errs.CodeInvalidPatch, "cannot apply the patch: %v", err)
+	}
 
-		// Catch the error caused by extra unexpected fields in the request
-		// body. We extract the field name from the error message and
-		// interpolate it in our custom error message. There is an open
-		// issue at https://github.com/golang/go/issues/29035 regarding
-		// turning this into a sentinel error.
-		case strings.HasPrefix(err.Error(), "json: unknown field "):
-			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
-			return nil, &errs.ResponseError{Message: fmt.Sprintf("Request body contains unknown field %s", fieldName)}, http.StatusBadRequest
+	var before, after map[string]interface{}
+	_ = json.Unmarshal(doc, &before)
+	if json.Unmarshal(patched, &after) != nil {
+		return nil, errs.Invalid(errs.CodeInvalidPatch, "the patched user is not an object")
+	}
+	for _, field := range readOnlyFields {
+		if !reflect.DeepEqual(before[field], after[field]) {
+			return nil, errs.Invalid(errs.CodeReadOnlyField, "the field %v is read-only", field)
+		}
+	}
 
-		// An io.EOF error is returned by Decode() if the request body is
-		// empty.
-		case errors.Is(err, io.EOF):
-			return nil, &errs.EmptyBody{Message: "Request body must not be empty"}, http.StatusBadRequest
+	dec := json.NewDecoder(bytes.NewReader(patched))
+	dec.DisallowUnknownFields()
+	var newUser model.User
+	err = dec.Decode(&newUser)
+	if err != nil {
+		return nil, errs.Invalid(errs.CodeInvalidPatch, "invalid patched user: %v", err)
+	}
+	newUser.ID = user.ID
+	newUser.Roles = nil // roles are granted and revoked by the admins only
 
-		// Catch the error caused by the request body being too large. Again
-		// there is an open issue regarding turning this into a sentinel
-		// error at https://github.com/golang/go/issues/30715.
-		case err.Error() == "http: request body too large":
-			return nil, &errs.ResponseError{Message: fmt.Sprintf("Request body must not be larger than 1MB")}, http.StatusRequestEntityTooLarge
+	return &newUser, nil
+}
 
-		// Otherwise, default to logging the error and sending a 500 Internal
-		// Server Error response.
-		default:
-			return nil, &errs.ResponseError{Message: fmt.Sprintf("Internal server error")}, http.StatusInternalServerError
-		}
+// representForPatch returns the JSON representation of the user with an empty password member, so
+// that the patches can replace or remove it
+func representForPatch(user *model.User) ([]byte, error) {
+	doc, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
 	}
 
-	// Call decode again, using a pointer to an empty anonymous struct as
-	// the destination. If the request body only contained a single JSON
-	// object this will return an io.EOF error. So if we get anything else,
-	// we know that there is additional data in the request body.
-	err = dec.Decode(&struct{}{})
-	if err != io.EOF {
-		return nil, &errs.ResponseError{Message: fmt.Sprintf("Request body must only contain a single JSON object")}, http.StatusBadRequest
+	var fields map[string]interface{}
+	if err = json.Unmarshal(doc, &fields); err != nil {
+		return nil, err
 	}
+	fields["password"] = ""
 
-	return &user, nil, http.StatusOK
+	return json.Marshal(fields)
 }
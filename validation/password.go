@@ -0,0 +1,101 @@
+package validation
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// the character classes a password policy may require
+const (
+	ClassLower  = "lower"
+	ClassUpper  = "upper"
+	ClassDigit  = "digit"
+	ClassSymbol = "symbol"
+)
+
+// classes match the characters of the classes; patterns match them in the JSON Schema
+var (
+	classes = map[string]func(r rune) bool{
+		ClassLower:  unicode.IsLower,
+		ClassUpper:  unicode.IsUpper,
+		ClassDigit:  unicode.IsDigit,
+		ClassSymbol: isSymbol,
+	}
+	patterns = map[string]string{
+		ClassLower:  `\p{Ll}`,
+		ClassUpper:  `\p{Lu}`,
+		ClassDigit:  `\p{Nd}`,
+		ClassSymbol: `[^\p{L}\p{N}\s]`,
+	}
+)
+
+// PasswordPolicy is the strength policy of the passwords: their minimum length, in characters, and
+// the classes of characters they must contain at least one of
+type PasswordPolicy struct {
+	MinLength int
+	Classes   []string
+}
+
+var DefaultPasswordPolicy = PasswordPolicy{MinLength: 8, Classes: []string{ClassLower, ClassUpper, ClassDigit}}
+
+// ParseClasses parses the comma-separated classes of characters, e.g. lower,upper,digit
+func ParseClasses(s string) ([]string, error) {
+	var parsed []string
+	for _, class := range strings.Split(s, ",") {
+		class = strings.TrimSpace(class)
+		if class == "" {
+			continue
+		}
+		if _, ok := classes[class]; !ok {
+			return nil, fmt.Errorf("unknown character class %q: the classes are %v, %v, %v and %v",
+				class, ClassLower, ClassUpper, ClassDigit, ClassSymbol)
+		}
+		parsed = append(parsed, class)
+	}
+
+	return parsed, nil
+}
+
+// Validate checks that the policy can be complied with
+func (p PasswordPolicy) Validate() error {
+	if p.MinLength < 1 || p.MinLength > PasswordMaxBytes {
+		return fmt.Errorf("the minimum length of the passwords must be between 1 and %d", PasswordMaxBytes)
+	}
+
+	for _, class := range p.Classes {
+		if _, ok := classes[class]; !ok {
+			return fmt.Errorf("unknown character class %q", class)
+		}
+	}
+
+	return nil
+}
+
+// check returns the reason why the password doesn't comply with the policy, or "" if it does
+func (p PasswordPolicy) check(password string) string {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return fmt.Sprintf("must be at least %d characters long", p.MinLength)
+	}
+	if len(password) > PasswordMaxBytes {
+		return fmt.Sprintf("must be at most %d bytes long", PasswordMaxBytes)
+	}
+
+	var missing []string
+	for _, class := range p.Classes {
+		if strings.IndexFunc(password, classes[class]) < 0 {
+			missing = append(missing, class)
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Sprintf("must contain at least one character of each class: %v (missing %v)",
+			strings.Join(p.Classes, ", "), strings.Join(missing, ", "))
+	}
+
+	return ""
+}
+
+func isSymbol(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r) && !unicode.IsSpace(r)
+}
@@ -0,0 +1,94 @@
+package validation
+
+import (
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// SchemaDialect is the JSON Schema dialect of the schemas
+const SchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// nicknamePattern matches the nicknames, as checkNickname
+const nicknamePattern = `^[\p{L}\p{Nd}_.-]+$`
+
+// Schema returns the JSON Schema of the struct (or the pointer to a struct) as validated in Create mode.
+// The schema of the patches is the same, but for the write-only fields which are not required
+func (v *Validator) Schema(value interface{}) map[string]interface{} {
+	t := reflect.Indirect(reflect.ValueOf(value)).Type()
+
+	properties := map[string]interface{}{}
+	required := []string{}
+	for _, f := range fieldsOf(t) {
+		property := typeSchema(t.Field(f.index).Type)
+		for _, r := range f.rules {
+			v.ruleSchema(property, r)
+		}
+		properties[f.name] = property
+
+		if f.has("required") {
+			required = append(required, f.name)
+		}
+	}
+
+	return map[string]interface{}{
+		"$schema":              SchemaDialect,
+		"title":                t.Name(),
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
+
+// typeSchema returns the schema of the values of the type, of the values pointed to for the pointers
+func typeSchema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return map[string]interface{}{"type": "array"}
+	default:
+		return map[string]interface{}{"type": "object"}
+	}
+}
+
+// ruleSchema adds the keywords of the rule to the schema of the property
+func (v *Validator) ruleSchema(property map[string]interface{}, r rule) {
+	switch r.name {
+	case "max":
+		property["maxLength"], _ = strconv.Atoi(r.arg)
+	case "email":
+		property["format"] = "email"
+	case "country":
+		property["enum"] = countries
+	case "nickname":
+		property["minLength"] = NicknameMinLength
+		property["maxLength"] = NicknameMaxLength
+		property["pattern"] = nicknamePattern
+	case "password":
+		property["minLength"] = v.Policy.MinLength
+		if len(v.Policy.Classes) != 0 {
+			// the patterns are not anchored: each one matches a password containing the class
+			allOf := make([]map[string]interface{}, len(v.Policy.Classes))
+			for i, class := range v.Policy.Classes {
+				allOf[i] = map[string]interface{}{"pattern": patterns[class]}
+			}
+			property["allOf"] = allOf
+		}
+	case "readonly":
+		property["readOnly"] = true
+	case "writeonly":
+		property["writeOnly"] = true
+	}
+}
@@ -0,0 +1,228 @@
+// pkg implements the validation of the users, declared by the validate tags of their fields, and its
+// JSON Schema. The fields are named as in their json tags. The rules of a tag are comma-separated:
+//   - required: the field must not be empty
+//   - max=N: the field must be at most N characters long
+//   - email: the field must be an email address (RFC 5322 addr-spec)
+//   - country: the field must be an ISO 3166-1 alpha-2 country code
+//   - nickname: the field must be a nickname, of NicknameMinLength to NicknameMaxLength letters, digits, _, . or -
+//   - password: the field must comply with the password policy of the validator
+//   - writeonly: the field is not represented in the responses (see Patch)
+//   - readonly: the field is set by the server, never by the clients: it is not validated
+// The rules other than required don't apply to the empty fields
+
+package validation
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pavelerokhin/user-microservice-go/errs"
+)
+
+const (
+	NicknameMinLength = 3
+	NicknameMaxLength = 32
+	// PasswordMaxBytes is the maximum length of the passwords in bytes: bcrypt ignores the further ones
+	PasswordMaxBytes = 72
+)
+
+// Mode tells which rules apply to a user
+type Mode int
+
+const (
+	// Create validates a complete user, as a new one or as the replacement of a user: every rule applies
+	Create Mode = iota
+	// Patch validates a patched user: the write-only fields are missing from the representation the
+	// patches apply to, so when they are empty they keep their stored values and are not validated
+	Patch
+)
+
+// Validator validates the values by the rules in the validate tags of their fields
+type Validator struct {
+	Policy PasswordPolicy
+}
+
+// New returns a new validator, with the password policy
+func New(policy PasswordPolicy) (*Validator, error) {
+	err := policy.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Validator{Policy: policy}, nil
+}
+
+// field is a field of a struct with the rules of its validate tag
+type field struct {
+	index int
+	name  string
+	rules []rule
+}
+
+// rule is a rule of a validate tag, with its argument if any: max=255
+type rule struct {
+	name, arg string
+}
+
+func (f *field) has(name string) bool {
+	for _, r := range f.rules {
+		if r.name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checks are the rules checking the values of the fields: they return the reason why the value of the
+// field breaks the rule with the argument, or "" if it doesn't. required, writeonly and readonly are
+// handled by Validate
+var checks = map[string]func(v *Validator, value reflect.Value, arg string) string{
+	"max":      checkMax,
+	"email":    checkEmail,
+	"country":  checkCountry,
+	"nickname": checkNickname,
+	"password": checkPassword,
+}
+
+// Validate validates the fields of the struct (or the pointer to a struct) in the mode, and returns
+// all the invalid ones, in the order of the fields
+func (v *Validator) Validate(value interface{}, mode Mode) []errs.InvalidParam {
+	rv := reflect.Indirect(reflect.ValueOf(value))
+
+	var params []errs.InvalidParam
+	for _, f := range fieldsOf(rv.Type()) {
+		if f.has("readonly") {
+			continue
+		}
+
+		fv := rv.Field(f.index)
+		if fv.IsZero() {
+			if f.has("required") && !(mode == Patch && f.has("writeonly")) {
+				params = append(params, errs.InvalidParam{Name: f.name, Reason: f.name + " is required"})
+			}
+			continue
+		}
+
+		// a field breaks one rule at most: the first one of its tag
+		for _, r := range f.rules {
+			check, ok := checks[r.name]
+			if !ok {
+				continue
+			}
+			if reason := check(v, fv, r.arg); reason != "" {
+				params = append(params, errs.InvalidParam{Name: f.name, Reason: f.name + " " + reason})
+				break
+			}
+		}
+	}
+
+	return params
+}
+
+// fieldsOf returns the validated fields of the struct type. The tags are part of the code, so a tag
+// with an unknown rule is a programming error: fieldsOf panics
+func fieldsOf(t reflect.Type) []field {
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag, ok := sf.Tag.Lookup("validate")
+		if !ok {
+			continue
+		}
+
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = sf.Name
+		}
+
+		f := field{index: i, name: name}
+		for _, spec := range strings.Split(tag, ",") {
+			kv := strings.SplitN(spec, "=", 2)
+			_, known := checks[kv[0]]
+			if !known && kv[0] != "required" && kv[0] != "writeonly" && kv[0] != "readonly" {
+				panic(fmt.Sprintf("validation: unknown rule %q of field %v of %v", kv[0], sf.Name, t))
+			}
+
+			r := rule{name: kv[0]}
+			if len(kv) == 2 {
+				r.arg = kv[1]
+			}
+			f.rules = append(f.rules, r)
+		}
+		fields = append(fields, f)
+	}
+
+	return fields
+}
+
+// ReadOnlyFields returns the names of the read-only fields of the struct (or the pointer to a struct)
+func ReadOnlyFields(value interface{}) []string {
+	var names []string
+	for _, f := range fieldsOf(reflect.Indirect(reflect.ValueOf(value)).Type()) {
+		if f.has("readonly") {
+			names = append(names, f.name)
+		}
+	}
+
+	return names
+}
+
+func checkMax(_ *Validator, value reflect.Value, arg string) string {
+	max, err := strconv.Atoi(arg)
+	if err != nil {
+		panic(fmt.Sprintf("validation: invalid argument of rule max: %q", arg))
+	}
+	if utf8.RuneCountInString(value.String()) > max {
+		return fmt.Sprintf("must be at most %d characters long", max)
+	}
+
+	return ""
+}
+
+func checkEmail(_ *Validator, value reflect.Value, _ string) string {
+	// the address alone, without display name nor angle brackets
+	address, err := mail.ParseAddress(value.String())
+	if err != nil || address.Name != "" || address.Address != value.String() {
+		return "must be an email address (RFC 5322)"
+	}
+
+	return ""
+}
+
+func checkCountry(_ *Validator, value reflect.Value, _ string) string {
+	if !isCountry(value.String()) {
+		return "must be an ISO 3166-1 alpha-2 country code, e.g. IT"
+	}
+
+	return ""
+}
+
+func checkNickname(_ *Validator, value reflect.Value, _ string) string {
+	nickname := value.String()
+	length := utf8.RuneCountInString(nickname)
+	if length < NicknameMinLength || length > NicknameMaxLength {
+		return fmt.Sprintf("must be %d to %d characters long", NicknameMinLength, NicknameMaxLength)
+	}
+
+	for _, r := range nickname {
+		if !isNicknameRune(r) {
+			return "may contain only letters, digits, _, . and -"
+		}
+	}
+
+	return ""
+}
+
+func isNicknameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == '-'
+}
+
+func checkPassword(v *Validator, value reflect.Value, _ string) string {
+	return v.Policy.check(value.String())
+}
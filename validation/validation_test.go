@@ -0,0 +1,153 @@
+package validation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pavelerokhin/user-microservice-go/errs"
+	"github.com/pavelerokhin/user-microservice-go/model"
+)
+
+func newTestValidator(t *testing.T) *Validator {
+	v, err := New(DefaultPasswordPolicy)
+	require.NoError(t, err)
+	return v
+}
+
+func validUser() model.User {
+	return model.User{FirstName: "x", LastName: "y", Nickname: "user.name-1", Password: "Passw0rd",
+		Email: "a@b.com", Country: "IT"}
+}
+
+// names returns the names of the invalid fields
+func names(params []errs.InvalidParam) []string {
+	var names []string
+	for _, param := range params {
+		names = append(names, param.Name)
+	}
+
+	return names
+}
+
+func TestValidateOK(t *testing.T) {
+	v := newTestValidator(t)
+
+	user := validUser()
+	require.Empty(t, v.Validate(&user, Create))
+
+	// the read-only fields are not validated
+	user.ID = 42
+	user.CreatedAt = time.Now()
+	require.Empty(t, v.Validate(user, Create))
+
+	user.Nickname = "Ünïcødé_名前"
+	user.Email = "first.last+tag@sub.example.org"
+	require.Empty(t, v.Validate(&user, Create))
+}
+
+func TestValidateAllViolations(t *testing.T) {
+	v := newTestValidator(t)
+
+	user := model.User{FirstName: string(make([]rune, 101)), Nickname: "no spaces", Password: "short",
+		Email: "Name <a@b.com>", Country: "Italy"}
+	params := v.Validate(&user, Create)
+	require.Equal(t, []string{"first_name", "last_name", "nickname", "password", "email", "country"}, names(params))
+	require.Equal(t, "last_name is required", params[1].Reason)
+	require.Equal(t, "nickname may contain only letters, digits, _, . and -", params[2].Reason)
+	require.Equal(t, "password must be at least 8 characters long", params[3].Reason)
+}
+
+func TestValidateFormats(t *testing.T) {
+	v := newTestValidator(t)
+
+	for _, c := range []struct {
+		field string
+		set   func(u *model.User)
+	}{
+		{"email", func(u *model.User) { u.Email = "a.b.com" }},
+		{"email", func(u *model.User) { u.Email = "a@b@c" }},
+		{"email", func(u *model.User) { u.Email = " a@b.com" }},
+		{"country", func(u *model.User) { u.Country = "it" }},
+		{"country", func(u *model.User) { u.Country = "XX" }},
+		{"nickname", func(u *model.User) { u.Nickname = "ab" }},
+		{"nickname", func(u *model.User) { u.Nickname = "a23456789012345678901234567890123" }},
+		{"nickname", func(u *model.User) { u.Nickname = "user@name" }},
+		{"password", func(u *model.User) { u.Password = "password1" }},
+		{"password", func(u *model.User) { u.Password = "PASSWORD1" }},
+		{"password", func(u *model.User) { u.Password = "Password" }},
+		{"password", func(u *model.User) { u.Password = "Pa55" + string(make([]byte, 72)) }},
+	} {
+		user := validUser()
+		c.set(&user)
+		require.Equal(t, []string{c.field}, names(v.Validate(&user, Create)), "%+v", user)
+	}
+}
+
+func TestValidatePatch(t *testing.T) {
+	v := newTestValidator(t)
+
+	// the password of a patched user may be empty: the stored one is kept
+	user := validUser()
+	user.Password = ""
+	require.Empty(t, v.Validate(&user, Patch))
+	require.Equal(t, []string{"password"}, names(v.Validate(&user, Create)))
+
+	// but not weak
+	user.Password = "weak"
+	require.Equal(t, []string{"password"}, names(v.Validate(&user, Patch)))
+
+	// the other fields are required anyway
+	user = validUser()
+	user.Password, user.Nickname = "", ""
+	require.Equal(t, []string{"nickname"}, names(v.Validate(&user, Patch)))
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	v, err := New(PasswordPolicy{MinLength: 4, Classes: []string{ClassSymbol}})
+	require.NoError(t, err)
+
+	user := validUser()
+	user.Password = "abcd"
+	require.Equal(t, []string{"password"}, names(v.Validate(&user, Create)))
+	user.Password = "ab-d"
+	require.Empty(t, v.Validate(&user, Create))
+
+	_, err = New(PasswordPolicy{MinLength: 0})
+	require.Error(t, err)
+	_, err = New(PasswordPolicy{MinLength: 8, Classes: []string{"emoji"}})
+	require.Error(t, err)
+
+	classes, err := ParseClasses("lower, digit,")
+	require.NoError(t, err)
+	require.Equal(t, []string{ClassLower, ClassDigit}, classes)
+	_, err = ParseClasses("lower,emoji")
+	require.Error(t, err)
+}
+
+func TestReadOnlyFields(t *testing.T) {
+	require.Equal(t, []string{"id", "roles", "created_at", "updated_at", "deleted_at", "version"}, ReadOnlyFields(&model.User{}))
+}
+
+func TestSchema(t *testing.T) {
+	v := newTestValidator(t)
+
+	schema := v.Schema(&model.User{})
+	require.Equal(t, SchemaDialect, schema["$schema"])
+	require.Equal(t, "User", schema["title"])
+	require.Equal(t, []string{"first_name", "last_name", "nickname", "password", "email", "country"}, schema["required"])
+
+	properties := schema["properties"].(map[string]interface{})
+	require.Equal(t, map[string]interface{}{"type": "integer", "readOnly": true}, properties["id"])
+	require.Equal(t, map[string]interface{}{"type": "string", "maxLength": 100}, properties["first_name"])
+	require.Equal(t, map[string]interface{}{"type": "string", "minLength": NicknameMinLength,
+		"maxLength": NicknameMaxLength, "pattern": nicknamePattern}, properties["nickname"])
+	require.Equal(t, map[string]interface{}{"type": "string", "minLength": 8, "writeOnly": true,
+		"allOf": []map[string]interface{}{{"pattern": `\p{Ll}`}, {"pattern": `\p{Lu}`}, {"pattern": `\p{Nd}`}}},
+		properties["password"])
+	require.Equal(t, map[string]interface{}{"type": "string", "format": "email", "maxLength": 254}, properties["email"])
+	require.Equal(t, map[string]interface{}{"type": "string", "format": "date-time", "readOnly": true},
+		properties["created_at"])
+	require.Len(t, properties["country"].(map[string]interface{})["enum"], 249)
+}